@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrArchiveItemNotFound is returned when a query refers to a message
+// which is not in the archive.
+var ErrArchiveItemNotFound = errors.New("archived message not found")
+
+// archiveIndex is the view of an archive, in chronological order, which
+// is used to evaluate the queries.
+type archiveIndex interface {
+	Len() int
+	Stamp(i int) time.Time
+	// Matches reports whether the message at i is with the JID, as
+	// archiveWithMatches does.
+	Matches(i int, with string) bool
+	Position(id string) (int, bool)
+}
+
+// queryArchiveIndex returns the positions of the messages selected by the
+// query along with the result's count, first index and completeness. The
+// count and the index are about the messages matching the query's
+// filter, i.e., regardless of the ids which the query pages from.
+func queryArchiveIndex(index archiveIndex, query *ArchiveQuery) (positions []int, result *ArchiveQueryResult, err error) {
+	n := index.Len()
+	lo, hi := 0, n
+	if !query.Start.IsZero() {
+		lo = sort.Search(n, func(i int) bool {
+			return !index.Stamp(i).Before(query.Start)
+		})
+	}
+	if !query.End.IsZero() {
+		hi = sort.Search(n, func(i int) bool {
+			return index.Stamp(i).After(query.End)
+		})
+	}
+	// The page is taken from the messages between the ids
+	pageLo, pageHi := lo, hi
+	if query.AfterID != "" {
+		pos, ok := index.Position(query.AfterID)
+		if !ok {
+			return nil, nil, ErrArchiveItemNotFound
+		}
+		if pos+1 > pageLo {
+			pageLo = pos + 1
+		}
+	}
+	if query.BeforeID != "" {
+		pos, ok := index.Position(query.BeforeID)
+		if !ok {
+			return nil, nil, ErrArchiveItemNotFound
+		}
+		if pos < pageHi {
+			pageHi = pos
+		}
+	}
+
+	result = &ArchiveQueryResult{}
+	if query.With == "" {
+		if lo < hi {
+			result.Count = hi - lo
+		}
+		available := pageHi - pageLo
+		if available <= 0 {
+			result.Complete = true
+			return nil, result, nil
+		}
+		selected := available
+		if query.Max >= 0 && query.Max < available {
+			selected = query.Max
+		}
+		start := pageLo
+		if query.FromEnd {
+			start = pageHi - selected
+		}
+		positions = make([]int, 0, selected)
+		for i := start; i < start+selected; i++ {
+			positions = append(positions, i)
+		}
+		result.First = start - lo
+		result.Complete = selected == available
+		return positions, result, nil
+	}
+
+	// Only the selected positions are kept while counting the matching
+	// messages, there could be a lot of them.
+	available := 0
+	for i := lo; i < hi; i++ {
+		if !index.Matches(i, query.With) {
+			continue
+		}
+		result.Count++
+		if i < pageLo {
+			result.First++
+			continue
+		}
+		if i >= pageHi {
+			continue
+		}
+		available++
+		positions = append(positions, i)
+		if query.Max >= 0 && len(positions) > query.Max {
+			if query.FromEnd {
+				positions = positions[1:]
+				result.First++
+			} else {
+				positions = positions[:query.Max]
+			}
+		}
+	}
+	result.Complete = len(positions) == available
+	return positions, result, nil
+}
+
+func archiveWithMatches(with, filter string) bool {
+	if with == filter {
+		return true
+	}
+	// A bare JID filter matches all the resources
+	return !strings.Contains(filter, "/") && strings.HasPrefix(with, filter+"/")
+}
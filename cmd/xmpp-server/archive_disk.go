@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// diskMessageArchiveStore keeps each archive in its own directory. The
+// messages are appended to a log file. The index, one fixed-size record
+// per message in chronological order, is kept in a separate file along
+// with a hash table which maps the messages' ids to their positions. The
+// queries page through the index on disk and only the selected messages
+// are read from the log, however big the archive is.
+//
+// The sizes and the preferences of the recently used archives are
+// cached. Each archive has its own lock thus the operations on different
+// archives don't wait for each other.
+type diskMessageArchiveStore struct {
+	dir string
+	// archives holds the elements of recent, which lists the cached
+	// archives from the most recently used. The mutex guards these and
+	// the archives' users.
+	archives map[string]*list.Element
+	recent   *list.List
+	mutex    sync.Mutex
+}
+
+var _ MessageArchiveStore = &diskMessageArchiveStore{}
+
+const (
+	diskArchiveLogFileName   = "messages.log"
+	diskArchiveIndexFileName = "index.dat"
+	diskArchiveIDsFileName   = "ids.dat"
+	diskArchivePrefsFileName = "prefs.json"
+
+	diskArchiveCacheSize = 1024
+
+	// diskArchiveRecordSize is the size of the index records. A record
+	// is made of, in big-endian order:
+	//
+	//	stamp       int64, in nanoseconds since the Unix epoch
+	//	offset      int64, of the message in the log
+	//	with size   uint16, the JID precedes the stanza in the log
+	//	stanza size uint32
+	//	with hash   uint64, of the JID
+	//	bare hash   uint64, of the JID's bare JID
+	//	real size   uint16, the real JID is between the JID and the stanza
+	//	id size     uint8
+	//	id          padded with zeros up to the end of the record
+	diskArchiveRecordSize = 64
+	diskArchiveMaxIDSize  = diskArchiveRecordSize - 41
+	// diskArchivePageSize is the number of records read at once.
+	diskArchivePageSize = 64
+
+	// The ids' hash table starts with the number of records it covers,
+	// as a uint64, followed by the slots. A slot holds the position of a
+	// record plus one, as a uint32, or zero if it's free. The table is
+	// rebuilt twice as large once it's half full.
+	diskArchiveIDsHeaderSize  = 8
+	diskArchiveIDsSlotSize    = 4
+	diskArchiveMinIDsCapacity = 1024
+)
+
+type diskArchive struct {
+	name string
+	dir  string
+	// users is the number of the operations using the archive. The
+	// archives in use stay in the cache so that there's only one of each.
+	users int
+
+	// mutex guards the rest.
+	mutex  sync.Mutex
+	loaded bool
+	// length is the number of the records in the index.
+	length  int
+	logSize int64
+	// idsCapacity is the number of slots in the ids' hash table.
+	idsCapacity int
+	prefsLoaded bool
+	prefs       *ArchivePreferences
+}
+
+type diskArchiveRecord struct {
+	stamp       int64
+	offset      int64
+	withSize    int
+	stanzaSize  int
+	withHash    uint64
+	bareHash    uint64
+	realJIDSize int
+	id          string
+}
+
+func (record *diskArchiveRecord) marshal() []byte {
+	data := make([]byte, diskArchiveRecordSize)
+	binary.BigEndian.PutUint64(data[0:], uint64(record.stamp))
+	binary.BigEndian.PutUint64(data[8:], uint64(record.offset))
+	binary.BigEndian.PutUint16(data[16:], uint16(record.withSize))
+	binary.BigEndian.PutUint32(data[18:], uint32(record.stanzaSize))
+	binary.BigEndian.PutUint64(data[22:], record.withHash)
+	binary.BigEndian.PutUint64(data[30:], record.bareHash)
+	binary.BigEndian.PutUint16(data[38:], uint16(record.realJIDSize))
+	data[40] = byte(len(record.id))
+	copy(data[41:], record.id)
+	return data
+}
+
+func unmarshalDiskArchiveRecord(data []byte) *diskArchiveRecord {
+	idSize := int(data[40])
+	if idSize > diskArchiveMaxIDSize {
+		idSize = diskArchiveMaxIDSize
+	}
+	return &diskArchiveRecord{
+		stamp:       int64(binary.BigEndian.Uint64(data[0:])),
+		offset:      int64(binary.BigEndian.Uint64(data[8:])),
+		withSize:    int(binary.BigEndian.Uint16(data[16:])),
+		stanzaSize:  int(binary.BigEndian.Uint32(data[18:])),
+		withHash:    binary.BigEndian.Uint64(data[22:]),
+		bareHash:    binary.BigEndian.Uint64(data[30:]),
+		realJIDSize: int(binary.BigEndian.Uint16(data[38:])),
+		id:          string(data[41 : 41+idSize]),
+	}
+}
+
+// end is the offset of the end of the record's message in the log.
+func (record *diskArchiveRecord) end() int64 {
+	return record.offset + int64(record.withSize) + int64(record.realJIDSize) + int64(record.stanzaSize)
+}
+
+func diskArchiveHash(s string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(s))
+	return hash.Sum64()
+}
+
+// diskArchiveIndex reads the archive's index for a query, a page of
+// records at a time. The archive's mutex must be held while it's used.
+// The first error is kept in err, the records read after it are empty.
+type diskArchiveIndex struct {
+	archive   *diskArchive
+	indexFile *os.File
+	idsFile   *os.File
+	page      []byte
+	// pageStart is the position of the first record in page.
+	pageStart int
+	err       error
+}
+
+func (archive *diskArchive) openIndex() *diskArchiveIndex {
+	return &diskArchiveIndex{archive: archive}
+}
+
+func (index *diskArchiveIndex) Close() {
+	if index.indexFile != nil {
+		index.indexFile.Close()
+	}
+	if index.idsFile != nil {
+		index.idsFile.Close()
+	}
+}
+
+func (index *diskArchiveIndex) record(i int) *diskArchiveRecord {
+	if index.err != nil {
+		return &diskArchiveRecord{}
+	}
+	if i < index.pageStart || i >= index.pageStart+len(index.page)/diskArchiveRecordSize {
+		if index.indexFile == nil {
+			index.indexFile, index.err = os.Open(filepath.Join(index.archive.dir, diskArchiveIndexFileName))
+			if index.err != nil {
+				return &diskArchiveRecord{}
+			}
+		}
+		start := i - i%diskArchivePageSize
+		end := start + diskArchivePageSize
+		if end > index.archive.length {
+			end = index.archive.length
+		}
+		index.page = make([]byte, (end-start)*diskArchiveRecordSize)
+		index.pageStart = start
+		if _, err := index.indexFile.ReadAt(index.page, int64(start)*diskArchiveRecordSize); err != nil {
+			index.page, index.err = nil, err
+			return &diskArchiveRecord{}
+		}
+	}
+	offset := (i - index.pageStart) * diskArchiveRecordSize
+	return unmarshalDiskArchiveRecord(index.page[offset : offset+diskArchiveRecordSize])
+}
+
+func (index *diskArchiveIndex) Len() int { return index.archive.length }
+
+func (index *diskArchiveIndex) Stamp(i int) time.Time {
+	return time.Unix(0, index.record(i).stamp)
+}
+
+// Matches compares the hashes of the JIDs, which, in the unlikely event
+// of a collision, could match a JID that isn't the one.
+func (index *diskArchiveIndex) Matches(i int, with string) bool {
+	record := index.record(i)
+	if strings.Contains(with, "/") {
+		return record.withHash == diskArchiveHash(with)
+	}
+	return record.bareHash == diskArchiveHash(with)
+}
+
+func (index *diskArchiveIndex) Position(id string) (int, bool) {
+	capacity := index.archive.idsCapacity
+	if index.err != nil || capacity == 0 {
+		return 0, false
+	}
+	if index.idsFile == nil {
+		index.idsFile, index.err = os.Open(filepath.Join(index.archive.dir, diskArchiveIDsFileName))
+		if index.err != nil {
+			return 0, false
+		}
+	}
+	slot := int(diskArchiveHash(id) % uint64(capacity))
+	var slotData [diskArchiveIDsSlotSize]byte
+	for probes := 0; probes < capacity; probes++ {
+		_, err := index.idsFile.ReadAt(slotData[:], diskArchiveIDsHeaderSize+int64(slot)*diskArchiveIDsSlotSize)
+		if err != nil {
+			index.err = err
+			return 0, false
+		}
+		value := int(binary.BigEndian.Uint32(slotData[:]))
+		if value == 0 {
+			return 0, false
+		}
+		if pos := value - 1; pos < index.archive.length && index.record(pos).id == id {
+			return pos, true
+		}
+		slot = (slot + 1) % capacity
+	}
+	return 0, false
+}
+
+func newDiskMessageArchiveStore(dir string) (*diskMessageArchiveStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create message archive directory")
+	}
+	return &diskMessageArchiveStore{
+		dir:      dir,
+		archives: make(map[string]*list.Element),
+		recent:   list.New(),
+	}, nil
+}
+
+func (store *diskMessageArchiveStore) archiveDir(archiveName string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(archiveName)))
+}
+
+// withArchive calls f with the archive locked. The archive's sizes and
+// preferences are loaded as needed by f.
+func (store *diskMessageArchiveStore) withArchive(archiveName string, f func(archive *diskArchive) error) error {
+	store.mutex.Lock()
+	var archive *diskArchive
+	if elem := store.archives[archiveName]; elem != nil {
+		store.recent.MoveToFront(elem)
+		archive = elem.Value.(*diskArchive)
+	} else {
+		archive = &diskArchive{name: archiveName, dir: store.archiveDir(archiveName)}
+		store.archives[archiveName] = store.recent.PushFront(archive)
+	}
+	archive.users++
+	store.evictArchives()
+	store.mutex.Unlock()
+
+	defer func() {
+		store.mutex.Lock()
+		archive.users--
+		store.evictArchives()
+		store.mutex.Unlock()
+	}()
+	archive.mutex.Lock()
+	defer archive.mutex.Unlock()
+	return f(archive)
+}
+
+// evictArchives removes the least recently used archives which aren't in
+// use from the cache. It must be called with the mutex held.
+func (store *diskMessageArchiveStore) evictArchives() {
+	elem := store.recent.Back()
+	for elem != nil && len(store.archives) > diskArchiveCacheSize {
+		prev := elem.Prev()
+		if archive := elem.Value.(*diskArchive); archive.users == 0 {
+			store.recent.Remove(elem)
+			delete(store.archives, archive.name)
+		}
+		elem = prev
+	}
+}
+
+// load reads the sizes of the archive's files. The records at the end of
+// the index whose messages didn't make it into the log are left out and
+// the ids' hash table is rebuilt if it doesn't cover the index. It must
+// be called with the archive's mutex held.
+func (archive *diskArchive) load() error {
+	if archive.loaded {
+		return nil
+	}
+
+	archive.length, archive.logSize, archive.idsCapacity = 0, 0, 0
+	if logInfo, err := os.Stat(filepath.Join(archive.dir, diskArchiveLogFileName)); err == nil {
+		archive.logSize = logInfo.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if indexInfo, err := os.Stat(filepath.Join(archive.dir, diskArchiveIndexFileName)); err == nil {
+		// Possibly with a partially written record at the end
+		archive.length = int(indexInfo.Size() / diskArchiveRecordSize)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	index := archive.openIndex()
+	for archive.length > 0 && index.record(archive.length-1).end() > archive.logSize {
+		archive.length--
+	}
+	index.Close()
+	if index.err != nil {
+		return index.err
+	}
+
+	covered := 0
+	idsFile, err := os.Open(filepath.Join(archive.dir, diskArchiveIDsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if idsFile != nil {
+		var header [diskArchiveIDsHeaderSize]byte
+		idsInfo, err := idsFile.Stat()
+		if err == nil {
+			_, err = idsFile.ReadAt(header[:], 0)
+		}
+		idsFile.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == nil {
+			covered = int(binary.BigEndian.Uint64(header[:]))
+			archive.idsCapacity = int((idsInfo.Size() - diskArchiveIDsHeaderSize) / diskArchiveIDsSlotSize)
+		}
+	}
+	if covered != archive.length || archive.length*2 > archive.idsCapacity {
+		if err = archive.rebuildIDs(); err != nil {
+			return err
+		}
+	}
+	archive.loaded = true
+	return nil
+}
+
+// rebuildIDs writes the ids' hash table anew, large enough for the index
+// to fill less than half of it. It must be called with the archive's
+// mutex held.
+func (archive *diskArchive) rebuildIDs() error {
+	capacity := diskArchiveMinIDsCapacity
+	for archive.length*2 > capacity {
+		capacity *= 2
+	}
+	table := make([]byte, diskArchiveIDsHeaderSize+capacity*diskArchiveIDsSlotSize)
+	binary.BigEndian.PutUint64(table, uint64(archive.length))
+	if archive.length > 0 {
+		indexFile, err := os.Open(filepath.Join(archive.dir, diskArchiveIndexFileName))
+		if err != nil {
+			return err
+		}
+		defer indexFile.Close()
+		reader := bufio.NewReader(indexFile)
+		recordData := make([]byte, diskArchiveRecordSize)
+		for pos := 0; pos < archive.length; pos++ {
+			if _, err = io.ReadFull(reader, recordData); err != nil {
+				return err
+			}
+			record := unmarshalDiskArchiveRecord(recordData)
+			slot := int(diskArchiveHash(record.id) % uint64(capacity))
+			for binary.BigEndian.Uint32(table[diskArchiveIDsHeaderSize+slot*diskArchiveIDsSlotSize:]) != 0 {
+				slot = (slot + 1) % capacity
+			}
+			binary.BigEndian.PutUint32(table[diskArchiveIDsHeaderSize+slot*diskArchiveIDsSlotSize:], uint32(pos+1))
+		}
+	}
+
+	if err := os.MkdirAll(archive.dir, 0700); err != nil {
+		return err
+	}
+	fileName := filepath.Join(archive.dir, diskArchiveIDsFileName)
+	if err := ioutil.WriteFile(fileName+".tmp", table, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		return err
+	}
+	archive.idsCapacity = capacity
+	return nil
+}
+
+// insertID adds the id of the last record to the ids' hash table. It must
+// be called with the archive's mutex held.
+func (archive *diskArchive) insertID(id string) error {
+	if archive.length*2 > archive.idsCapacity {
+		return archive.rebuildIDs()
+	}
+	idsFile, err := os.OpenFile(filepath.Join(archive.dir, diskArchiveIDsFileName), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	slot := int(diskArchiveHash(id) % uint64(archive.idsCapacity))
+	var slotData [diskArchiveIDsSlotSize]byte
+	for {
+		_, err = idsFile.ReadAt(slotData[:], diskArchiveIDsHeaderSize+int64(slot)*diskArchiveIDsSlotSize)
+		if err != nil || binary.BigEndian.Uint32(slotData[:]) == 0 {
+			break
+		}
+		slot = (slot + 1) % archive.idsCapacity
+	}
+	if err == nil {
+		binary.BigEndian.PutUint32(slotData[:], uint32(archive.length))
+		_, err = idsFile.WriteAt(slotData[:], diskArchiveIDsHeaderSize+int64(slot)*diskArchiveIDsSlotSize)
+	}
+	if err == nil {
+		// Until then, the table is rebuilt by the next load
+		var header [diskArchiveIDsHeaderSize]byte
+		binary.BigEndian.PutUint64(header[:], uint64(archive.length))
+		_, err = idsFile.WriteAt(header[:], 0)
+	}
+	if closeErr := idsFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadPrefs must be called with the archive's mutex held.
+func (archive *diskArchive) loadPrefs() error {
+	if archive.prefsLoaded {
+		return nil
+	}
+	prefsJSON, err := ioutil.ReadFile(filepath.Join(archive.dir, diskArchivePrefsFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			archive.prefs, archive.prefsLoaded = nil, true
+			return nil
+		}
+		return err
+	}
+	var prefs ArchivePreferences
+	if err = json.Unmarshal(prefsJSON, &prefs); err != nil {
+		return err
+	}
+	archive.prefs, archive.prefsLoaded = &prefs, true
+	return nil
+}
+
+func (store *diskMessageArchiveStore) AppendArchivedMessage(archiveName string, msg *ArchivedMessage) error {
+	if len(msg.ID) > diskArchiveMaxIDSize {
+		return errors.Errorf("archived message id too long: %s", msg.ID)
+	}
+	return store.withArchive(archiveName, func(archive *diskArchive) error {
+		if err := archive.load(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(archive.dir, 0700); err != nil {
+			return err
+		}
+
+		// The message goes first so that a record always refers to a
+		// complete message.
+		logFile, err := os.OpenFile(filepath.Join(archive.dir, diskArchiveLogFileName),
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		entry := make([]byte, 0, len(msg.With)+len(msg.RealJID)+len(msg.Stanza))
+		entry = append(append(append(entry, msg.With...), msg.RealJID...), msg.Stanza...)
+		_, err = logFile.Write(entry)
+		if closeErr := logFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			// The log's size is unknown now
+			archive.loaded = false
+			return err
+		}
+
+		bare := msg.With
+		if i := strings.Index(bare, "/"); i >= 0 {
+			bare = bare[:i]
+		}
+		record := diskArchiveRecord{
+			stamp:       msg.Stamp.UnixNano(),
+			offset:      archive.logSize,
+			withSize:    len(msg.With),
+			stanzaSize:  len(msg.Stanza),
+			withHash:    diskArchiveHash(msg.With),
+			bareHash:    diskArchiveHash(bare),
+			realJIDSize: len(msg.RealJID),
+			id:          msg.ID,
+		}
+		archive.logSize = record.end()
+		// Written in place of a partially written record, if any
+		indexFile, err := os.OpenFile(filepath.Join(archive.dir, diskArchiveIndexFileName),
+			os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = indexFile.WriteAt(record.marshal(), int64(archive.length)*diskArchiveRecordSize)
+		if closeErr := indexFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		archive.length++
+
+		if err = archive.insertID(msg.ID); err != nil {
+			archive.loaded = false
+			return err
+		}
+		return nil
+	})
+}
+
+func (store *diskMessageArchiveStore) QueryArchivedMessages(
+	archiveName string, query *ArchiveQuery,
+) (result *ArchiveQueryResult, err error) {
+	err = store.withArchive(archiveName, func(archive *diskArchive) error {
+		if err := archive.load(); err != nil {
+			return err
+		}
+		index := archive.openIndex()
+		defer index.Close()
+		var positions []int
+		positions, result, err = queryArchiveIndex(index, query)
+		if index.err != nil {
+			return index.err
+		}
+		if err != nil {
+			return err
+		}
+		if len(positions) == 0 {
+			return nil
+		}
+
+		logFile, err := os.Open(filepath.Join(archive.dir, diskArchiveLogFileName))
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		result.Messages = make([]*ArchivedMessage, 0, len(positions))
+		for _, pos := range positions {
+			record := index.record(pos)
+			if index.err != nil {
+				return index.err
+			}
+			data := make([]byte, record.end()-record.offset)
+			if _, err = logFile.ReadAt(data, record.offset); err != nil {
+				return errors.Wrapf(err, "unable to read archived message %s", record.id)
+			}
+			stanzaStart := record.withSize + record.realJIDSize
+			result.Messages = append(result.Messages, &ArchivedMessage{
+				ID:      record.id,
+				With:    string(data[:record.withSize]),
+				RealJID: string(data[record.withSize:stanzaStart]),
+				Stamp:   time.Unix(0, record.stamp),
+				Stanza:  data[stanzaStart:],
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ArchivePreferences is called for every archived message thus the
+// preferences are served from the cache. As with the memory store, the
+// preferences are shared and mustn't be modified.
+func (store *diskMessageArchiveStore) ArchivePreferences(archiveName string) (prefs *ArchivePreferences, err error) {
+	err = store.withArchive(archiveName, func(archive *diskArchive) error {
+		if err := archive.loadPrefs(); err != nil {
+			return err
+		}
+		prefs = archive.prefs
+		return nil
+	})
+	return prefs, err
+}
+
+func (store *diskMessageArchiveStore) SetArchivePreferences(archiveName string, prefs *ArchivePreferences) error {
+	return store.withArchive(archiveName, func(archive *diskArchive) error {
+		if err := os.MkdirAll(archive.dir, 0700); err != nil {
+			return err
+		}
+		prefsJSON, err := json.Marshal(prefs)
+		if err != nil {
+			return err
+		}
+		fileName := filepath.Join(archive.dir, diskArchivePrefsFileName)
+		if err = ioutil.WriteFile(fileName+".tmp", prefsJSON, 0600); err != nil {
+			return err
+		}
+		if err = os.Rename(fileName+".tmp", fileName); err != nil {
+			return err
+		}
+		archive.prefs, archive.prefsLoaded = prefs, true
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryMessageArchiveStore struct {
+	archives map[string]*memoryArchive
+	prefs    map[string]*ArchivePreferences
+	mutex    sync.RWMutex
+}
+
+var _ MessageArchiveStore = &memoryMessageArchiveStore{}
+
+type memoryArchive struct {
+	messages  []*ArchivedMessage
+	positions map[string]int
+}
+
+func (archive *memoryArchive) Len() int { return len(archive.messages) }
+
+func (archive *memoryArchive) Stamp(i int) time.Time { return archive.messages[i].Stamp }
+
+func (archive *memoryArchive) Matches(i int, with string) bool {
+	return archiveWithMatches(archive.messages[i].With, with)
+}
+
+func (archive *memoryArchive) Position(id string) (int, bool) {
+	pos, ok := archive.positions[id]
+	return pos, ok
+}
+
+func newMemoryMessageArchiveStore() *memoryMessageArchiveStore {
+	return &memoryMessageArchiveStore{
+		archives: make(map[string]*memoryArchive),
+		prefs:    make(map[string]*ArchivePreferences),
+	}
+}
+
+func (store *memoryMessageArchiveStore) AppendArchivedMessage(archiveName string, msg *ArchivedMessage) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	archive := store.archives[archiveName]
+	if archive == nil {
+		archive = &memoryArchive{positions: make(map[string]int)}
+		store.archives[archiveName] = archive
+	}
+	archive.positions[msg.ID] = len(archive.messages)
+	archive.messages = append(archive.messages, msg)
+	return nil
+}
+
+func (store *memoryMessageArchiveStore) QueryArchivedMessages(
+	archiveName string, query *ArchiveQuery,
+) (*ArchiveQueryResult, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	archive := store.archives[archiveName]
+	if archive == nil {
+		archive = &memoryArchive{}
+	}
+	positions, result, err := queryArchiveIndex(archive, query)
+	if err != nil {
+		return nil, err
+	}
+	result.Messages = make([]*ArchivedMessage, 0, len(positions))
+	for _, pos := range positions {
+		result.Messages = append(result.Messages, archive.messages[pos])
+	}
+	return result, nil
+}
+
+func (store *memoryMessageArchiveStore) ArchivePreferences(archiveName string) (*ArchivePreferences, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.prefs[archiveName], nil
+}
+
+func (store *memoryMessageArchiveStore) SetArchivePreferences(archiveName string, prefs *ArchivePreferences) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prefs[archiveName] = prefs
+	return nil
+}
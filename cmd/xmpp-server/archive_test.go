@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testArchiveEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// appendTestArchivedMessages appends the messages m0 to m<n-1>, a second
+// apart. The even ones are with bob's resources and the odd ones with
+// carol, whose real JID is kept as if carol were a room.
+func appendTestArchivedMessages(t *testing.T, store MessageArchiveStore, from, n int) {
+	t.Helper()
+	for i := from; i < n; i++ {
+		with, realJID := "carol@localhost", "dave@localhost/desk"
+		if i%2 == 0 {
+			with, realJID = "bob@localhost/"+strconv.Itoa(i%4), ""
+		}
+		err := store.AppendArchivedMessage("alice@localhost", &ArchivedMessage{
+			ID:      "m" + strconv.Itoa(i),
+			With:    with,
+			RealJID: realJID,
+			Stamp:   testArchiveEpoch.Add(time.Duration(i) * time.Second),
+			Stanza:  []byte(fmt.Sprintf("<message><body>%d</body></message>", i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTestArchiveQuery runs the query and checks the ids of the result
+// along with its count, first index and completeness.
+func checkTestArchiveQuery(
+	t *testing.T, store MessageArchiveStore, query ArchiveQuery, ids []string, count, first int, complete bool,
+) {
+	t.Helper()
+	result, err := store.QueryArchivedMessages("alice@localhost", &query)
+	if err != nil {
+		t.Fatalf("query %+v: %v", query, err)
+	}
+	var resultIDs []string
+	for _, msg := range result.Messages {
+		resultIDs = append(resultIDs, msg.ID)
+	}
+	if fmt.Sprint(resultIDs) != fmt.Sprint(ids) || result.Count != count ||
+		result.First != first || result.Complete != complete {
+		t.Fatalf("query %+v: got %v count %d first %d complete %v, expected %v count %d first %d complete %v",
+			query, resultIDs, result.Count, result.First, result.Complete, ids, count, first, complete)
+	}
+}
+
+func testMessageArchiveStore(t *testing.T, store MessageArchiveStore) {
+	appendTestArchivedMessages(t, store, 0, 10)
+
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 3},
+		[]string{"m0", "m1", "m2"}, 10, 0, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 3, AfterID: "m2"},
+		[]string{"m3", "m4", "m5"}, 10, 3, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 3, AfterID: "m6"},
+		[]string{"m7", "m8", "m9"}, 10, 7, true)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 3, FromEnd: true},
+		[]string{"m7", "m8", "m9"}, 10, 7, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 3, FromEnd: true, BeforeID: "m7"},
+		[]string{"m4", "m5", "m6"}, 10, 4, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 3, AfterID: "m9"},
+		nil, 10, 0, true)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: -1, AfterID: "m2", BeforeID: "m5"},
+		[]string{"m3", "m4"}, 10, 3, true)
+
+	// The count and the index are within the time range
+	checkTestArchiveQuery(t, store, ArchiveQuery{
+		Max:   2,
+		Start: testArchiveEpoch.Add(3 * time.Second),
+		End:   testArchiveEpoch.Add(6 * time.Second),
+	}, []string{"m3", "m4"}, 4, 0, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{
+		Max:     2,
+		Start:   testArchiveEpoch.Add(3 * time.Second),
+		End:     testArchiveEpoch.Add(6 * time.Second),
+		AfterID: "m4",
+	}, []string{"m5", "m6"}, 4, 2, true)
+
+	// and among the messages with the JID
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, With: "bob@localhost", AfterID: "m4"},
+		[]string{"m6", "m8"}, 5, 3, true)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, With: "bob@localhost/0"},
+		[]string{"m0", "m4"}, 3, 0, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, With: "carol@localhost", FromEnd: true, BeforeID: "m9"},
+		[]string{"m5", "m7"}, 5, 2, false)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, With: "dave@localhost"},
+		nil, 0, 0, true)
+
+	_, err := store.QueryArchivedMessages("alice@localhost", &ArchiveQuery{Max: 2, AfterID: "unknown"})
+	if err != ErrArchiveItemNotFound {
+		t.Fatalf("expected ErrArchiveItemNotFound, got %v", err)
+	}
+}
+
+func TestMemoryMessageArchiveStore(t *testing.T) {
+	testMessageArchiveStore(t, newMemoryMessageArchiveStore())
+}
+
+func TestDiskMessageArchiveStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskMessageArchiveStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMessageArchiveStore(t, store)
+
+	// Enough for the ids' hash table to be rebuilt
+	appendTestArchivedMessages(t, store, 10, 2000)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, AfterID: "m1500"},
+		[]string{"m1501", "m1502"}, 2000, 1501, false)
+
+	// A partially written record and a stale hash table are left behind
+	// by a crash.
+	archiveDir := store.archiveDir("alice@localhost")
+	indexFile, err := os.OpenFile(filepath.Join(archiveDir, diskArchiveIndexFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.Write([]byte("partial"))
+	indexFile.Close()
+	if err = os.Remove(filepath.Join(archiveDir, diskArchiveIDsFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = newDiskMessageArchiveStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, AfterID: "m1997"},
+		[]string{"m1998", "m1999"}, 2000, 1998, true)
+	appendTestArchivedMessages(t, store, 2000, 2001)
+	checkTestArchiveQuery(t, store, ArchiveQuery{Max: 2, FromEnd: true, With: "bob@localhost"},
+		[]string{"m1998", "m2000"}, 1001, 999, false)
+	result, err := store.QueryArchivedMessages("alice@localhost", &ArchiveQuery{Max: 2, AfterID: "m1998"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := result.Messages[0]; msg.With != "carol@localhost" || msg.RealJID != "dave@localhost/desk" ||
+		string(msg.Stanza) != "<message><body>1999</body></message>" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if msg := result.Messages[1]; msg.With != "bob@localhost/0" || msg.RealJID != "" ||
+		!msg.Stamp.Equal(testArchiveEpoch.Add(2000*time.Second)) ||
+		string(msg.Stanza) != "<message><body>2000</body></message>" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// diskBlocklistStore keeps each user's blocklist in a file. The
+// blocklists are consulted for every stanza so the recently used ones
+// are cached. Only the blocklists which exist are cached thus the
+// lookups of, e.g., the users who don't exist don't grow the cache.
+type diskBlocklistStore struct {
+	dir string
+	// blocklists holds the elements of recent, which lists the cached
+	// blocklists from the most recently used.
+	blocklists map[string]*list.Element
+	recent     *list.List
+	mutex      sync.Mutex
+}
+
+var _ BlocklistStore = &diskBlocklistStore{}
+
+const diskBlocklistCacheSize = 4096
+
+type diskBlocklist struct {
+	local string
+	jids  []string
+}
+
+func newDiskBlocklistStore(dir string) (*diskBlocklistStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create blocklist directory")
+	}
+	return &diskBlocklistStore{
+		dir:        dir,
+		blocklists: make(map[string]*list.Element),
+		recent:     list.New(),
+	}, nil
+}
+
+func (store *diskBlocklistStore) fileName(local string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(local))+".json")
+}
+
+// load must be called with the mutex held.
+func (store *diskBlocklistStore) load(local string) ([]string, error) {
+	if elem := store.blocklists[local]; elem != nil {
+		store.recent.MoveToFront(elem)
+		return elem.Value.(*diskBlocklist).jids, nil
+	}
+	var blocklist []string
+	blocklistJSON, err := ioutil.ReadFile(store.fileName(local))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if err = json.Unmarshal(blocklistJSON, &blocklist); err != nil {
+		return nil, errors.Wrapf(err, "unable to read the blocklist of %s", local)
+	}
+	store.cache(local, blocklist)
+	return blocklist, nil
+}
+
+// cache must be called with the mutex held. An empty blocklist is
+// removed from the cache.
+func (store *diskBlocklistStore) cache(local string, blocklist []string) {
+	if elem := store.blocklists[local]; elem != nil {
+		if len(blocklist) == 0 {
+			store.recent.Remove(elem)
+			delete(store.blocklists, local)
+			return
+		}
+		elem.Value.(*diskBlocklist).jids = blocklist
+		store.recent.MoveToFront(elem)
+		return
+	}
+	if len(blocklist) == 0 {
+		return
+	}
+	store.blocklists[local] = store.recent.PushFront(&diskBlocklist{local: local, jids: blocklist})
+	if store.recent.Len() > diskBlocklistCacheSize {
+		oldest := store.recent.Back()
+		store.recent.Remove(oldest)
+		delete(store.blocklists, oldest.Value.(*diskBlocklist).local)
+	}
+}
+
+// save must be called with the mutex held.
+func (store *diskBlocklistStore) save(local string, blocklist []string) error {
+	fileName := store.fileName(local)
+	if len(blocklist) == 0 {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		blocklistJSON, err := json.Marshal(blocklist)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(fileName+".tmp", blocklistJSON, 0600); err != nil {
+			return err
+		}
+		if err = os.Rename(fileName+".tmp", fileName); err != nil {
+			return err
+		}
+	}
+	store.cache(local, blocklist)
+	return nil
+}
+
+func (store *diskBlocklistStore) Blocklist(local string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	blocklist, err := store.load(local)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(blocklist))
+	copy(result, blocklist)
+	return result, nil
+}
+
+func (store *diskBlocklistStore) BlockJIDs(local string, jids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	blocklist, err := store.load(local)
+	if err != nil {
+		return err
+	}
+	updated := make([]string, len(blocklist), len(blocklist)+len(jids))
+	copy(updated, blocklist)
+	return store.save(local, blocklistAdd(updated, jids))
+}
+
+func (store *diskBlocklistStore) UnblockJIDs(local string, jids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	blocklist, err := store.load(local)
+	if err != nil {
+		return err
+	}
+	return store.save(local, blocklistRemove(blocklist, jids))
+}
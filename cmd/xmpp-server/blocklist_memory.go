@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+)
+
+type memoryBlocklistStore struct {
+	blocklists map[string][]string
+	mutex      sync.RWMutex
+}
+
+var _ BlocklistStore = &memoryBlocklistStore{}
+
+func newMemoryBlocklistStore() *memoryBlocklistStore {
+	return &memoryBlocklistStore{
+		blocklists: make(map[string][]string),
+	}
+}
+
+func (store *memoryBlocklistStore) Blocklist(local string) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	blocklist := make([]string, len(store.blocklists[local]))
+	copy(blocklist, store.blocklists[local])
+	return blocklist, nil
+}
+
+func (store *memoryBlocklistStore) BlockJIDs(local string, jids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.blocklists[local] = blocklistAdd(store.blocklists[local], jids)
+	return nil
+}
+
+func (store *memoryBlocklistStore) UnblockJIDs(local string, jids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	blocklist := blocklistRemove(store.blocklists[local], jids)
+	if len(blocklist) == 0 {
+		delete(store.blocklists, local)
+	} else {
+		store.blocklists[local] = blocklist
+	}
+	return nil
+}
+
+func blocklistAdd(blocklist []string, jids []string) []string {
+	for _, jid := range jids {
+		found := false
+		for _, blocked := range blocklist {
+			if blocked == jid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			blocklist = append(blocklist, jid)
+		}
+	}
+	return blocklist
+}
+
+func blocklistRemove(blocklist []string, jids []string) []string {
+	if jids == nil {
+		return nil
+	}
+	var remaining []string
+	for _, blocked := range blocklist {
+		found := false
+		for _, jid := range jids {
+			if blocked == jid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remaining = append(remaining, blocked)
+		}
+	}
+	return remaining
+}
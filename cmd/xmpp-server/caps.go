@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// capsCache maps the entity capabilities (XEP-0115) to the features
+// they stand for. Only the verified capabilities are cached so that a
+// client can't poison the features of the others.
+type capsCache struct {
+	entries map[string]map[string]bool // key is hash:ver
+	mutex   sync.RWMutex
+}
+
+const capsCacheSize = 4096
+
+func newCapsCache() *capsCache {
+	return &capsCache{entries: make(map[string]map[string]bool)}
+}
+
+func (cache *capsCache) features(hashName, ver string) map[string]bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.entries[hashName+":"+ver]
+}
+
+func (cache *capsCache) add(hashName, ver string, features map[string]bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if len(cache.entries) >= capsCacheSize {
+		for k := range cache.entries {
+			delete(cache.entries, k)
+			break
+		}
+	}
+	cache.entries[hashName+":"+ver] = features
+}
+
+// capsHash returns the hash function with the name from the IANA Hash
+// Function Textual Names registry, or nil if it's not supported.
+func capsHash(hashName string) hash.Hash {
+	switch hashName {
+	case "sha-1":
+		return sha1.New()
+	case "sha-256":
+		return sha256.New()
+	case "sha-512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// capsVerificationString generates the verification string of the
+// disco#info result as specified in XEP-0115 5.1. It returns false if
+// the hash function is not supported or if the result is not valid
+// for the generation, e.g., if it has duplicate features.
+func capsVerificationString(hashName string, info *CapsDiscoInfo) (string, bool) {
+	h := capsHash(hashName)
+	if h == nil {
+		return "", false
+	}
+	var s strings.Builder
+
+	identities := make([]string, 0, len(info.Identities))
+	for _, identity := range info.Identities {
+		identities = append(identities,
+			identity.Category+"/"+identity.Type+"/"+identity.Lang+"/"+identity.Name)
+	}
+	sort.Strings(identities)
+	for i, identity := range identities {
+		if i > 0 && identities[i-1] == identity {
+			return "", false
+		}
+		s.WriteString(identity)
+		s.WriteString("<")
+	}
+
+	features := make([]string, 0, len(info.Features))
+	for _, feature := range info.Features {
+		features = append(features, feature.Var)
+	}
+	sort.Strings(features)
+	for i, feature := range features {
+		if i > 0 && features[i-1] == feature {
+			return "", false
+		}
+		s.WriteString(feature)
+		s.WriteString("<")
+	}
+
+	forms := make(map[string]*DataForm, len(info.Forms))
+	formTypes := make([]string, 0, len(info.Forms))
+	for i := range info.Forms {
+		formType := dataFormValue(&info.Forms[i], "FORM_TYPE")
+		if formType == "" {
+			// The forms without FORM_TYPE are ignored
+			continue
+		}
+		if forms[formType] != nil {
+			return "", false
+		}
+		forms[formType] = &info.Forms[i]
+		formTypes = append(formTypes, formType)
+	}
+	sort.Strings(formTypes)
+	for _, formType := range formTypes {
+		s.WriteString(formType)
+		s.WriteString("<")
+		fields := make([]DataFormField, 0, len(forms[formType].Fields))
+		for _, field := range forms[formType].Fields {
+			if field.Var != "FORM_TYPE" {
+				fields = append(fields, field)
+			}
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i].Var < fields[j].Var })
+		for _, field := range fields {
+			s.WriteString(field.Var)
+			s.WriteString("<")
+			values := append([]string{}, field.Values...)
+			sort.Strings(values)
+			for _, value := range values {
+				s.WriteString(value)
+				s.WriteString("<")
+			}
+		}
+	}
+
+	h.Write([]byte(s.String()))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), true
+}
@@ -5,4 +5,154 @@ type Config struct {
 	Domain string
 
 	Port string
+	// HTTPPort is the port of the HTTP transports. Empty disables them.
+	// The encryption is left to a reverse proxy.
+	HTTPPort string
+	// WebSocketEnabled serves WebSocket (RFC 7395) at /xmpp-websocket.
+	WebSocketEnabled bool
+	// BOSHEnabled serves BOSH (XEP-0206) at /http-bind.
+	BOSHEnabled bool
+
+	// DataDir is where the disk-backed storages keep their files.
+	DataDir string
+
+	// OfflineStorage is the storage for offline messages: "memory",
+	// "disk", or empty to disable offline messages.
+	OfflineStorage string
+	// OfflineMessageQuota is the maximum number of offline messages
+	// stored for each user. 0 means no limit.
+	OfflineMessageQuota int
+	// FlexibleOfflineEnabled enables the offline message retrieval
+	// with XEP-0013.
+	FlexibleOfflineEnabled bool
+
+	// MessageArchiveStorage is the storage for the message archives:
+	// "memory", "disk", or empty to disable the archives.
+	MessageArchiveStorage string
+	// MessageArchiveDefault is the archiving default for the users who
+	// haven't set their preferences: "always" or "never". Defaults to
+	// "always". "roster" isn't supported as there are no rosters yet.
+	MessageArchiveDefault string
+
+	// BlocklistStorage is the storage for the users' blocklists:
+	// "memory", "disk", or empty to disable blocking.
+	BlocklistStorage string
+
+	// VCardStorage is the storage for the users' vCards: "memory",
+	// "disk", or empty to disable vCards.
+	VCardStorage string
+	// VCardMaxPhotoSize is the maximum size, in bytes, of the photo
+	// embedded in a vCard. Defaults to 64 KiB.
+	VCardMaxPhotoSize int
+	// VCardMaxSize is the maximum size, in bytes, of a vCard, the encoded
+	// photo included. Defaults to 128 KiB.
+	VCardMaxSize int
+
+	// PubSubStorage is the storage for the publish-subscribe nodes:
+	// "memory", "disk", or empty to disable publish-subscribe.
+	PubSubStorage string
+	// PEPEnabled enables the personal eventing (XEP-0163) on the users'
+	// bare JIDs. It requires PubSubStorage.
+	PEPEnabled bool
+	// PubSubServiceEnabled enables the publish-subscribe component on
+	// the pubsub subdomain. It requires PubSubStorage.
+	PubSubServiceEnabled bool
+
+	// MUCStorage is the storage for the persistent chat rooms on the
+	// groups subdomain: "memory", "disk", or empty to disable multi-user
+	// chat.
+	MUCStorage string
+	// MUCMaxHistory is the number of recent messages each room keeps to
+	// send to the new occupants. 0 disables the history.
+	MUCMaxHistory int
+
+	// FASTTokenStorage is the storage for the tokens issued to the users'
+	// devices for the fast reauthentication (XEP-0484): "memory", "disk",
+	// or empty to disable the tokens.
+	FASTTokenStorage string
+	// FASTTokenLifetime is how long, in seconds, a token is valid.
+	// Defaults to 14 days.
+	FASTTokenLifetime int
+
+	// StreamManagementEnabled enables Stream Management (XEP-0198).
+	StreamManagementEnabled bool
+	// StreamResumptionTimeout is how long, in seconds, the session of a
+	// client which has lost its connection is kept to be resumed. 0
+	// disables the resumption.
+	StreamResumptionTimeout int
+
+	// ClientWriteQueueSize is the number of outgoing elements queued for
+	// each client. Defaults to 256.
+	ClientWriteQueueSize int
+	// ClientWriteTimeout is how long, in seconds, a write to a client
+	// may take before the connection is closed. Defaults to 30.
+	ClientWriteTimeout int
+	// ClientWriteQueueOverflow is what happens when a client's queue is
+	// full: "disconnect" or "drop". Defaults to "disconnect".
+	ClientWriteQueueOverflow string
+
+	// ClientIdleTimeout is how long, in seconds, a client may stay
+	// silent before the server pings it (XEP-0199). A client which is
+	// still negotiating the stream is disconnected instead. 0 disables
+	// the check.
+	ClientIdleTimeout int
+	// ClientPingTimeout is how long, in seconds, the server waits for
+	// the pinged client before closing the connection. Defaults to 30.
+	ClientPingTimeout int
+	// ClientKeepaliveInterval is how often, in seconds, the server sends
+	// a whitespace keepalive to a client which it has sent nothing else
+	// to. 0 disables the keepalives.
+	ClientKeepaliveInterval int
+
+	// NegotiationTimeout is how long, in seconds, a new connection has
+	// to authenticate. 0 means no limit.
+	NegotiationTimeout int
+	// MaxConnections is the maximum number of client connections. 0
+	// means no limit.
+	MaxConnections int
+	// MaxNegotiatingConnections is the maximum number of connections
+	// which haven't authenticated yet. 0 means no limit.
+	MaxNegotiatingConnections int
+	// MaxConnectionsPerIP is the maximum number of connections from a
+	// single IP address. 0 means no limit.
+	MaxConnectionsPerIP int
+
+	// RateLimits are the rate limits of each user class: "normal", "bot"
+	// or "admin". The classes without an entry are not limited.
+	RateLimits map[string]UserClassLimits
+	// UserClasses maps the users, by their local parts, to their classes.
+	// The other users are "normal".
+	UserClasses map[string]string
+
+	// ResourceConflictPolicy is what happens when a session binds a
+	// resource which is already bound (RFC 6120 7.7.2.2): "kick" the
+	// existing session or "reject" the new one. Defaults to "kick".
+	ResourceConflictPolicy string
+	// MaxResourcesPerAccount is the maximum number of sessions of each
+	// user. 0 means no limit.
+	MaxResourcesPerAccount int
+}
+
+// The user classes of the rate limits
+const (
+	UserClassNormal = "normal"
+	UserClassBot    = "bot"
+	UserClassAdmin  = "admin"
+)
+
+// UserClassLimits are the rate limits applied to a class of users. The
+// session limits apply to each session while the account limits apply
+// to all the sessions of a user combined.
+type UserClassLimits struct {
+	SessionStanzas RateLimit
+	SessionBytes   RateLimit
+	AccountStanzas RateLimit
+	AccountBytes   RateLimit
+}
+
+// RateLimit is a token bucket which allows Rate per second with room
+// for Burst. A Rate of 0 means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+)
+
+// discoProvider is a module's contribution to the service discovery
+// (XEP-0030) of an entity. Each function adds the module's part of the
+// node to the result and returns false if the node is not the module's.
+// The node is empty for the entity itself. Either function may be nil.
+//
+// The client is nil when the server describes itself, e.g., for its
+// entity capabilities.
+type discoProvider struct {
+	info  func(cl *Client, jid xmppcore.JID, node string, result *DiscoInfo) (bool, error)
+	items func(cl *Client, jid xmppcore.JID, node string, result *DiscoItems) (bool, error)
+}
+
+// discoRegistry keeps the providers of the entities which the server
+// answers for. The providers are registered when the server is set up
+// thus the registry is not guarded.
+type discoRegistry struct {
+	server     []discoProvider
+	accounts   []discoProvider
+	components map[string][]discoProvider // key is the domain
+}
+
+func newDiscoRegistry() *discoRegistry {
+	return &discoRegistry{components: make(map[string][]discoProvider)}
+}
+
+func (registry *discoRegistry) addServer(provider discoProvider) {
+	registry.server = append(registry.server, provider)
+}
+
+func (registry *discoRegistry) addAccount(provider discoProvider) {
+	registry.accounts = append(registry.accounts, provider)
+}
+
+func (registry *discoRegistry) addComponent(domain string, provider discoProvider) {
+	registry.components[domain] = append(registry.components[domain], provider)
+}
+
+// discoIdentityProvider describes the entity itself with the identity
+// and the features.
+func discoIdentityProvider(identity *xmppdisco.Identity, features ...string) discoProvider {
+	return discoProvider{
+		info: func(cl *Client, jid xmppcore.JID, node string, result *DiscoInfo) (bool, error) {
+			if node != "" {
+				return false, nil
+			}
+			if identity != nil {
+				result.Identity = append(result.Identity, *identity)
+			}
+			for _, feature := range features {
+				result.Feature = append(result.Feature, xmppdisco.Feature{Var: feature})
+			}
+			return true, nil
+		},
+	}
+}
+
+// discoFeaturesProvider adds the features to the entity itself.
+func discoFeaturesProvider(features ...string) discoProvider {
+	return discoIdentityProvider(nil, features...)
+}
+
+// discoItemProvider lists the item, e.g., a component, in the items of
+// the entity itself.
+func discoItemProvider(item DiscoItem) discoProvider {
+	return discoProvider{
+		items: func(cl *Client, jid xmppcore.JID, node string, result *DiscoItems) (bool, error) {
+			if node != "" {
+				return false, nil
+			}
+			result.Items = append(result.Items, item)
+			return true, nil
+		},
+	}
+}
+
+// discoInfo collects the info of the node from the providers. It
+// returns false if none of the providers knows the node.
+func discoInfo(
+	providers []discoProvider, cl *Client, jid xmppcore.JID, node string,
+) (result *DiscoInfo, found bool, err error) {
+	result = &DiscoInfo{Node: node}
+	found = node == ""
+	for _, provider := range providers {
+		if provider.info == nil {
+			continue
+		}
+		ok, err := provider.info(cl, jid, node, result)
+		if err != nil {
+			return nil, false, err
+		}
+		found = found || ok
+	}
+	return result, found, nil
+}
+
+// discoItems collects the items of the node from the providers. It
+// returns false if none of the providers knows the node.
+func discoItems(
+	providers []discoProvider, cl *Client, jid xmppcore.JID, node string,
+) (result *DiscoItems, found bool, err error) {
+	result = &DiscoItems{Node: node, Items: []DiscoItem{}}
+	found = node == ""
+	for _, provider := range providers {
+		if provider.items == nil {
+			continue
+		}
+		ok, err := provider.items(cl, jid, node, result)
+		if err != nil {
+			return nil, false, err
+		}
+		found = found || ok
+	}
+	return result, found, nil
+}
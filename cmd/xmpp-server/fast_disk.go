@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// diskFASTTokenStore keeps the tokens of each user in a file.
+type diskFASTTokenStore struct {
+	dir   string
+	mutex sync.RWMutex
+}
+
+var _ FASTTokenStore = &diskFASTTokenStore{}
+
+func newDiskFASTTokenStore(dir string) (*diskFASTTokenStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create FAST token directory")
+	}
+	return &diskFASTTokenStore{dir: dir}, nil
+}
+
+func (store *diskFASTTokenStore) fileName(local string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(local))+".json")
+}
+
+// load must be called with the mutex held.
+func (store *diskFASTTokenStore) load(local string) ([]*FASTToken, error) {
+	var tokens []*FASTToken
+	tokensJSON, err := ioutil.ReadFile(store.fileName(local))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(tokensJSON, &tokens); err != nil {
+		return nil, errors.Wrapf(err, "unable to read the FAST tokens of %s", local)
+	}
+	return tokens, nil
+}
+
+// save must be called with the mutex held.
+func (store *diskFASTTokenStore) save(local string, tokens []*FASTToken) error {
+	fileName := store.fileName(local)
+	if len(tokens) == 0 {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tokensJSON, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(fileName+".tmp", tokensJSON, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func (store *diskFASTTokenStore) FASTTokens(local string) ([]*FASTToken, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.load(local)
+}
+
+func (store *diskFASTTokenStore) PutFASTToken(local string, token *FASTToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	tokens, err := store.load(local)
+	if err != nil {
+		return err
+	}
+	return store.save(local, append(fastTokensRemove(tokens, []string{token.UserAgentID}), token))
+}
+
+func (store *diskFASTTokenStore) DeleteFASTTokens(local string, userAgentIDs []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	tokens, err := store.load(local)
+	if err != nil {
+		return err
+	}
+	return store.save(local, fastTokensRemove(tokens, userAgentIDs))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+)
+
+type memoryFASTTokenStore struct {
+	tokens map[string][]*FASTToken
+	mutex  sync.RWMutex
+}
+
+var _ FASTTokenStore = &memoryFASTTokenStore{}
+
+func newMemoryFASTTokenStore() *memoryFASTTokenStore {
+	return &memoryFASTTokenStore{
+		tokens: make(map[string][]*FASTToken),
+	}
+}
+
+func (store *memoryFASTTokenStore) FASTTokens(local string) ([]*FASTToken, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	tokens := make([]*FASTToken, 0, len(store.tokens[local]))
+	for _, token := range store.tokens[local] {
+		tokenCopy := *token
+		tokens = append(tokens, &tokenCopy)
+	}
+	return tokens, nil
+}
+
+func (store *memoryFASTTokenStore) PutFASTToken(local string, token *FASTToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	tokenCopy := *token
+	store.tokens[local] = append(fastTokensRemove(store.tokens[local], []string{token.UserAgentID}), &tokenCopy)
+	return nil
+}
+
+func (store *memoryFASTTokenStore) DeleteFASTTokens(local string, userAgentIDs []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	tokens := fastTokensRemove(store.tokens[local], userAgentIDs)
+	if len(tokens) == 0 {
+		delete(store.tokens, local)
+	} else {
+		store.tokens[local] = tokens
+	}
+	return nil
+}
+
+func fastTokensRemove(tokens []*FASTToken, userAgentIDs []string) []*FASTToken {
+	if userAgentIDs == nil {
+		return nil
+	}
+	var remaining []*FASTToken
+	for _, token := range tokens {
+		found := false
+		for _, userAgentID := range userAgentIDs {
+			if token.UserAgentID == userAgentID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remaining = append(remaining, token)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// checkTestFASTTokens checks the devices which hold a token.
+func checkTestFASTTokens(t *testing.T, store FASTTokenStore, local string, userAgentIDs []string) []*FASTToken {
+	t.Helper()
+	tokens, err := store.FASTTokens(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, token := range tokens {
+		ids = append(ids, token.UserAgentID)
+	}
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != fmt.Sprint(userAgentIDs) {
+		t.Fatalf("unexpected devices of %s: %v, expected %v", local, ids, userAgentIDs)
+	}
+	return tokens
+}
+
+func testFASTTokenStore(t *testing.T, store FASTTokenStore) {
+	checkTestFASTTokens(t, store, "alice", nil)
+	for _, id := range []string{"d1", "d2", "d3"} {
+		if err := store.PutFASTToken("alice", &FASTToken{UserAgentID: id, InitiatorHash: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The device's token is replaced
+	err := store.PutFASTToken("alice", &FASTToken{UserAgentID: "d2", InitiatorHash: []byte("new"), Count: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range checkTestFASTTokens(t, store, "alice", []string{"d1", "d2", "d3"}) {
+		if token.UserAgentID == "d2" && (string(token.InitiatorHash) != "new" || token.Count != 7) {
+			t.Fatalf("unexpected token: %+v", token)
+		}
+	}
+	checkTestFASTTokens(t, store, "bob", nil)
+
+	if err = store.DeleteFASTTokens("alice", []string{"d1", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFASTTokens(t, store, "alice", []string{"d2", "d3"})
+	if err = store.PutFASTToken("bob", &FASTToken{UserAgentID: "d1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.DeleteFASTTokens("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFASTTokens(t, store, "alice", nil)
+	checkTestFASTTokens(t, store, "bob", []string{"d1"})
+}
+
+func TestMemoryFASTTokenStore(t *testing.T) {
+	testFASTTokenStore(t, newMemoryFASTTokenStore())
+}
+
+func TestDiskFASTTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskFASTTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFASTTokenStore(t, store)
+
+	// The tokens are kept across restarts
+	if store, err = newDiskFASTTokenStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFASTTokens(t, store, "bob", []string{"d1"})
+}
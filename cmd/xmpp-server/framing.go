@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// The transports other than TCP take apart what the server writes as
+// it would be written on a TCP stream (RFC 6120 4).
+
+const xmlNS = "http://www.w3.org/XML/1998/namespace"
+
+// streamDataHandler receives what the server writes to the stream.
+type streamDataHandler interface {
+	// streamHeader is the start tag of the stream.
+	streamHeader(header *xml.StartElement) error
+	// streamElement is a whole top-level element.
+	streamElement(elem []byte) error
+	// streamFooter is the end tag of the stream.
+	streamFooter() error
+}
+
+// splitStreamData passes what the server writes to the handler. The data
+// holds whole elements except for the stream's header and footer. The
+// XML declaration and the whitespace between the elements are dropped.
+func splitStreamData(data []byte, handler streamDataHandler) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	var elemStart int64
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				depth++
+				continue
+			}
+			if t.Name.Space == "stream" && t.Name.Local == "stream" {
+				if err = handler.streamHeader(&t); err != nil {
+					return err
+				}
+				continue
+			}
+			depth, elemStart = 1, offset
+		case xml.EndElement:
+			if depth == 0 {
+				if t.Name.Space == "stream" && t.Name.Local == "stream" {
+					if err = handler.streamFooter(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if err = handler.streamElement(data[elemStart:decoder.InputOffset()]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamElementCollector parses the whole elements of the data, e.g.,
+// the payload of a BOSH request.
+type streamElementCollector struct {
+	elems []*streamElement
+}
+
+func (c *streamElementCollector) streamHeader(header *xml.StartElement) error {
+	return nil
+}
+
+func (c *streamElementCollector) streamElement(elemXML []byte) error {
+	elem, err := newStreamElement(nil, elemXML)
+	if err != nil {
+		return err
+	}
+	c.elems = append(c.elems, elem)
+	return nil
+}
+
+func (c *streamElementCollector) streamFooter() error {
+	return nil
+}
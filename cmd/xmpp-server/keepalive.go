@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The errors returned by idleReader when the client hasn't sent
+// anything in time, hasn't authenticated in time, or is reading too
+// fast.
+var (
+	errClientIdle         = errors.New("client idle")
+	errNegotiationTimeout = errors.New("negotiation timeout")
+	errRateLimited        = errors.New("rate limited")
+)
+
+// idleReader reads from the transport with a deadline. Once the
+// transport has been idle for idleTimeout, onIdle is called and the
+// reader waits for pingTimeout more. The read fails with errClientIdle
+// if onIdle returns false or nothing arrives by then.
+type idleReader struct {
+	transport   clientTransport
+	idleTimeout time.Duration
+	pingTimeout time.Duration
+	onIdle      func() bool
+	// negotiationDeadline, if set, is when the client must have
+	// authenticated. The read fails with errNegotiationTimeout past it.
+	negotiationDeadline time.Time
+	// onRead, if set, is called with the size of each element read,
+	// e.g., to slow down the reads. The read fails with errRateLimited
+	// if it returns false.
+	onRead func(n int) bool
+}
+
+func (r *idleReader) ReadElement() (*streamElement, error) {
+	pinged := false
+	for {
+		var deadline time.Time
+		if r.idleTimeout > 0 {
+			if pinged {
+				deadline = time.Now().Add(r.pingTimeout)
+			} else {
+				deadline = time.Now().Add(r.idleTimeout)
+			}
+		}
+		if !r.negotiationDeadline.IsZero() &&
+			(deadline.IsZero() || r.negotiationDeadline.Before(deadline)) {
+			deadline = r.negotiationDeadline
+		}
+		r.transport.SetReadDeadline(deadline)
+		elem, err := r.transport.ReadElement()
+		if err == nil {
+			if r.onRead != nil && !r.onRead(elem.size) {
+				return nil, errRateLimited
+			}
+			return elem, nil
+		}
+		if !isTimeoutError(err) {
+			return nil, err
+		}
+		if !r.negotiationDeadline.IsZero() && !time.Now().Before(r.negotiationDeadline) {
+			return nil, errNegotiationTimeout
+		}
+		if pinged || !r.onIdle() {
+			return nil, errClientIdle
+		}
+		pinged = true
+	}
+}
+
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -16,6 +16,64 @@ func main() {
 		Name:   "test",
 		Domain: "localhost",
 		Port:   "5222",
+
+		HTTPPort:         "5280",
+		WebSocketEnabled: true,
+		BOSHEnabled:      true,
+
+		OfflineStorage:         "memory",
+		OfflineMessageQuota:    100,
+		FlexibleOfflineEnabled: true,
+
+		MessageArchiveStorage: "memory",
+		MessageArchiveDefault: "always",
+
+		BlocklistStorage: "memory",
+
+		VCardStorage:      "memory",
+		VCardMaxPhotoSize: 64 * 1024,
+		VCardMaxSize:      128 * 1024,
+
+		PubSubStorage:        "memory",
+		PEPEnabled:           true,
+		PubSubServiceEnabled: true,
+		MUCStorage:           "memory",
+		MUCMaxHistory:        20,
+
+		FASTTokenStorage:  "memory",
+		FASTTokenLifetime: 14 * 24 * 60 * 60,
+
+		StreamManagementEnabled: true,
+		StreamResumptionTimeout: 300,
+
+		ClientWriteQueueSize:     256,
+		ClientWriteTimeout:       30,
+		ClientWriteQueueOverflow: "disconnect",
+
+		ClientIdleTimeout:       300,
+		ClientPingTimeout:       30,
+		ClientKeepaliveInterval: 60,
+
+		NegotiationTimeout:        60,
+		MaxConnections:            10000,
+		MaxNegotiatingConnections: 1000,
+		MaxConnectionsPerIP:       20,
+
+		RateLimits: map[string]UserClassLimits{
+			"normal": {
+				SessionStanzas: RateLimit{Rate: 20, Burst: 100},
+				SessionBytes:   RateLimit{Rate: 64 * 1024, Burst: 256 * 1024},
+				AccountStanzas: RateLimit{Rate: 50, Burst: 200},
+				AccountBytes:   RateLimit{Rate: 128 * 1024, Burst: 512 * 1024},
+			},
+			"bot": {
+				SessionStanzas: RateLimit{Rate: 100, Burst: 500},
+				SessionBytes:   RateLimit{Rate: 256 * 1024, Burst: 1024 * 1024},
+			},
+		},
+
+		ResourceConflictPolicy: "kick",
+		MaxResourcesPerAccount: 10,
 	})
 	if err != nil {
 		log.Fatal(err)
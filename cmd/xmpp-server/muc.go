@@ -0,0 +1,12 @@
+package main
+
+func copyMUCRoom(room *MUCRoom) *MUCRoom {
+	roomCopy := *room
+	if room.Affiliations != nil {
+		roomCopy.Affiliations = make(map[string]string, len(room.Affiliations))
+		for jid, affiliation := range room.Affiliations {
+			roomCopy.Affiliations[jid] = affiliation
+		}
+	}
+	return &roomCopy
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// diskMUCRoomStore keeps each room in a JSON file in the directory.
+type diskMUCRoomStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+var _ MUCRoomStore = &diskMUCRoomStore{}
+
+func newDiskMUCRoomStore(dir string) (*diskMUCRoomStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create MUC directory")
+	}
+	return &diskMUCRoomStore{dir: dir}, nil
+}
+
+func (store *diskMUCRoomStore) fileName(name string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(name))+".json")
+}
+
+func (store *diskMUCRoomStore) readFile(fileName string) (*MUCRoom, error) {
+	roomJSON, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var room MUCRoom
+	if err = json.Unmarshal(roomJSON, &room); err != nil {
+		return nil, errors.Wrapf(err, "unable to read MUC room %s", filepath.Base(fileName))
+	}
+	return &room, nil
+}
+
+func (store *diskMUCRoomStore) MUCRooms() ([]*MUCRoom, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	fileInfos, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	var rooms []*MUCRoom
+	for _, fi := range fileInfos {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		room, err := store.readFile(filepath.Join(store.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func (store *diskMUCRoomStore) MUCRoom(name string) (*MUCRoom, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	room, err := store.readFile(store.fileName(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return room, err
+}
+
+func (store *diskMUCRoomStore) SaveMUCRoom(room *MUCRoom) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	roomJSON, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	fileName := store.fileName(room.Name)
+	if err = ioutil.WriteFile(fileName+".tmp", roomJSON, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func (store *diskMUCRoomStore) DeleteMUCRoom(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	err := os.Remove(store.fileName(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
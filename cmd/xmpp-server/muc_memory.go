@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+)
+
+type memoryMUCRoomStore struct {
+	rooms map[string]*MUCRoom
+	mutex sync.RWMutex
+}
+
+var _ MUCRoomStore = &memoryMUCRoomStore{}
+
+func newMemoryMUCRoomStore() *memoryMUCRoomStore {
+	return &memoryMUCRoomStore{
+		rooms: make(map[string]*MUCRoom),
+	}
+}
+
+func (store *memoryMUCRoomStore) MUCRooms() ([]*MUCRoom, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	rooms := make([]*MUCRoom, 0, len(store.rooms))
+	for _, room := range store.rooms {
+		rooms = append(rooms, copyMUCRoom(room))
+	}
+	return rooms, nil
+}
+
+func (store *memoryMUCRoomStore) MUCRoom(name string) (*MUCRoom, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if room := store.rooms[name]; room != nil {
+		return copyMUCRoom(room), nil
+	}
+	return nil, nil
+}
+
+func (store *memoryMUCRoomStore) SaveMUCRoom(room *MUCRoom) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.rooms[room.Name] = copyMUCRoom(room)
+	return nil
+}
+
+func (store *memoryMUCRoomStore) DeleteMUCRoom(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.rooms, name)
+	return nil
+}
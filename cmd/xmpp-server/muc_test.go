@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// checkTestMUCRooms checks the names of the stored rooms.
+func checkTestMUCRooms(t *testing.T, store MUCRoomStore, names []string) {
+	t.Helper()
+	rooms, err := store.MUCRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roomNames []string
+	for _, room := range rooms {
+		roomNames = append(roomNames, room.Name)
+	}
+	sort.Strings(roomNames)
+	if fmt.Sprint(roomNames) != fmt.Sprint(names) {
+		t.Fatalf("unexpected rooms: %v, expected %v", roomNames, names)
+	}
+}
+
+func testMUCRoomStore(t *testing.T, store MUCRoomStore) {
+	checkTestMUCRooms(t, store, nil)
+	if room, err := store.MUCRoom("lobby"); err != nil || room != nil {
+		t.Fatalf("unexpected room: %+v %v", room, err)
+	}
+
+	for _, name := range []string{"lobby", "kitchen"} {
+		err := store.SaveMUCRoom(&MUCRoom{
+			Name:         name,
+			Config:       MUCRoomConfig{Title: name, Persistent: true},
+			Affiliations: map[string]string{"alice@localhost": MUCAffiliationOwner},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The room is updated
+	err := store.SaveMUCRoom(&MUCRoom{
+		Name:         "lobby",
+		Config:       MUCRoomConfig{Title: "Lobby", Persistent: true, Moderated: true},
+		Affiliations: map[string]string{"alice@localhost": MUCAffiliationOwner, "bob@localhost": MUCAffiliationMember},
+		Subject:      "Welcome",
+		SubjectNick:  "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestMUCRooms(t, store, []string{"kitchen", "lobby"})
+	room, err := store.MUCRoom("lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.Config.Title != "Lobby" || !room.Config.Moderated || room.Subject != "Welcome" ||
+		room.SubjectNick != "alice" || room.Affiliations["bob@localhost"] != MUCAffiliationMember {
+		t.Fatalf("unexpected room: %+v", room)
+	}
+
+	if err = store.DeleteMUCRoom("kitchen"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.DeleteMUCRoom("unknown"); err != nil {
+		t.Fatal(err)
+	}
+	checkTestMUCRooms(t, store, []string{"lobby"})
+}
+
+func TestMemoryMUCRoomStore(t *testing.T) {
+	testMUCRoomStore(t, newMemoryMUCRoomStore())
+}
+
+func TestDiskMUCRoomStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskMUCRoomStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMUCRoomStore(t, store)
+
+	// The rooms are kept across restarts
+	if store, err = newDiskMUCRoomStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestMUCRooms(t, store, []string{"lobby"})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// diskOfflineMessageStore keeps each message in its own file, in a
+// directory per user.
+type diskOfflineMessageStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+var _ OfflineMessageStore = &diskOfflineMessageStore{}
+
+func newDiskOfflineMessageStore(dir string) (*diskOfflineMessageStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create offline message directory")
+	}
+	return &diskOfflineMessageStore{dir: dir}, nil
+}
+
+func (store *diskOfflineMessageStore) userDir(local string) string {
+	// The localpart could contain characters which are not safe for
+	// file names.
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(local)))
+}
+
+func (store *diskOfflineMessageStore) messageFileName(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + ".json"
+}
+
+func (store *diskOfflineMessageStore) PutOfflineMessage(
+	local string, msg *OfflineMessage, quota int,
+) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userDir := store.userDir(local)
+	if quota > 0 {
+		fileInfos, err := ioutil.ReadDir(userDir)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if len(fileInfos) >= quota {
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return false, err
+	}
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	// Write to a temporary file first so that a crash won't leave
+	// a partially written message.
+	fileName := filepath.Join(userDir, store.messageFileName(msg.ID))
+	if err = ioutil.WriteFile(fileName+".tmp", msgJSON, 0600); err != nil {
+		return false, err
+	}
+	if err = os.Rename(fileName+".tmp", fileName); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *diskOfflineMessageStore) OfflineMessages(local string) ([]*OfflineMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userDir := store.userDir(local)
+	fileInfos, err := ioutil.ReadDir(userDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var msgs []*OfflineMessage
+	for _, fi := range fileInfos {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		msgJSON, err := ioutil.ReadFile(filepath.Join(userDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var msg OfflineMessage
+		if err = json.Unmarshal(msgJSON, &msg); err != nil {
+			return nil, errors.Wrapf(err, "unable to read offline message %s", fi.Name())
+		}
+		msgs = append(msgs, &msg)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Stamp.Before(msgs[j].Stamp)
+	})
+	return msgs, nil
+}
+
+func (store *diskOfflineMessageStore) DeleteOfflineMessages(local string, ids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	userDir := store.userDir(local)
+	if ids == nil {
+		return os.RemoveAll(userDir)
+	}
+	for _, id := range ids {
+		err := os.Remove(filepath.Join(userDir, store.messageFileName(id)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
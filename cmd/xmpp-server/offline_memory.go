@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+)
+
+type memoryOfflineMessageStore struct {
+	messages map[string][]*OfflineMessage
+	mutex    sync.Mutex
+}
+
+var _ OfflineMessageStore = &memoryOfflineMessageStore{}
+
+func newMemoryOfflineMessageStore() *memoryOfflineMessageStore {
+	return &memoryOfflineMessageStore{
+		messages: make(map[string][]*OfflineMessage),
+	}
+}
+
+func (store *memoryOfflineMessageStore) PutOfflineMessage(
+	local string, msg *OfflineMessage, quota int,
+) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if quota > 0 && len(store.messages[local]) >= quota {
+		return false, nil
+	}
+	store.messages[local] = append(store.messages[local], msg)
+	return true, nil
+}
+
+func (store *memoryOfflineMessageStore) OfflineMessages(local string) ([]*OfflineMessage, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	msgs := make([]*OfflineMessage, len(store.messages[local]))
+	copy(msgs, store.messages[local])
+	return msgs, nil
+}
+
+func (store *memoryOfflineMessageStore) DeleteOfflineMessages(local string, ids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if ids == nil {
+		delete(store.messages, local)
+		return nil
+	}
+	idSet := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		idSet[id] = true
+	}
+	var remaining []*OfflineMessage
+	for _, msg := range store.messages[local] {
+		if !idSet[msg.ID] {
+			remaining = append(remaining, msg)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(store.messages, local)
+	} else {
+		store.messages[local] = remaining
+	}
+	return nil
+}
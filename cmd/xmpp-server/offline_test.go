@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// checkTestOfflineMessages checks the ids of the user's offline messages.
+func checkTestOfflineMessages(t *testing.T, store OfflineMessageStore, local string, ids []string) {
+	t.Helper()
+	msgs, err := store.OfflineMessages(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgIDs []string
+	for _, msg := range msgs {
+		msgIDs = append(msgIDs, msg.ID)
+	}
+	if fmt.Sprint(msgIDs) != fmt.Sprint(ids) {
+		t.Fatalf("unexpected offline messages of %s: %v, expected %v", local, msgIDs, ids)
+	}
+}
+
+func testOfflineMessageStore(t *testing.T, store OfflineMessageStore) {
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 4; i++ {
+		id := "m" + strconv.Itoa(i)
+		stored, err := store.PutOfflineMessage("bob", &OfflineMessage{
+			ID:     id,
+			From:   "alice@localhost/phone",
+			Stamp:  epoch.Add(time.Duration(i) * time.Second),
+			Stanza: []byte("<message><body>" + id + "</body></message>"),
+		}, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The quota is reached with the fourth message
+		if stored != (i <= 3) {
+			t.Fatalf("message %s stored: %v", id, stored)
+		}
+	}
+	checkTestOfflineMessages(t, store, "bob", []string{"m1", "m2", "m3"})
+	checkTestOfflineMessages(t, store, "carol", nil)
+
+	msgs, err := store.OfflineMessages("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := msgs[0]; msg.From != "alice@localhost/phone" || !msg.Stamp.Equal(epoch.Add(time.Second)) ||
+		string(msg.Stanza) != "<message><body>m1</body></message>" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	if err = store.DeleteOfflineMessages("bob", []string{"m2", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTestOfflineMessages(t, store, "bob", []string{"m1", "m3"})
+	if err = store.DeleteOfflineMessages("bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTestOfflineMessages(t, store, "bob", nil)
+
+	// Without a quota
+	for i := 0; i < 5; i++ {
+		stored, err := store.PutOfflineMessage("carol", &OfflineMessage{
+			ID:     "c" + strconv.Itoa(i),
+			Stamp:  epoch.Add(time.Duration(i) * time.Second),
+			Stanza: []byte("<message/>"),
+		}, 0)
+		if err != nil || !stored {
+			t.Fatalf("message not stored: %v", err)
+		}
+	}
+	checkTestOfflineMessages(t, store, "carol", []string{"c0", "c1", "c2", "c3", "c4"})
+}
+
+func TestMemoryOfflineMessageStore(t *testing.T) {
+	testOfflineMessageStore(t, newMemoryOfflineMessageStore())
+}
+
+func TestDiskOfflineMessageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskOfflineMessageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOfflineMessageStore(t, store)
+
+	// The messages are kept across restarts
+	if store, err = newDiskOfflineMessageStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestOfflineMessages(t, store, "carol", []string{"c0", "c1", "c2", "c3", "c4"})
+}
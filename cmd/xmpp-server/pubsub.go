@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrPubSubNodeNotFound is returned by the PubSubStore for operations on
+// nodes which don't exist.
+var ErrPubSubNodeNotFound = errors.New("pubsub node not found")
+
+func copyPubSubNode(node *PubSubNode) *PubSubNode {
+	nodeCopy := *node
+	if node.Affiliations != nil {
+		nodeCopy.Affiliations = make(map[string]string, len(node.Affiliations))
+		for jid, affiliation := range node.Affiliations {
+			nodeCopy.Affiliations[jid] = affiliation
+		}
+	}
+	if node.Subscriptions != nil {
+		nodeCopy.Subscriptions = make(map[string]string, len(node.Subscriptions))
+		for jid, subscription := range node.Subscriptions {
+			nodeCopy.Subscriptions[jid] = subscription
+		}
+	}
+	return &nodeCopy
+}
+
+// pubSubItemsAppend adds the item to the list, which is ordered oldest
+// first, replacing the item with the same id.
+func pubSubItemsAppend(items []*PubSubItem, item *PubSubItem, maxItems int) []*PubSubItem {
+	items, _ = pubSubItemsRemove(items, item.ID)
+	items = append(items, item)
+	if maxItems > 0 && len(items) > maxItems {
+		items = append([]*PubSubItem{}, items[len(items)-maxItems:]...)
+	}
+	return items
+}
+
+func pubSubItemsRemove(items []*PubSubItem, id string) ([]*PubSubItem, bool) {
+	for i, existing := range items {
+		if existing.ID == id {
+			return append(items[:i:i], items[i+1:]...), true
+		}
+	}
+	return items, false
+}
+
+// pubSubItemsSelect returns the items, from a list ordered oldest first,
+// newest first.
+func pubSubItemsSelect(items []*PubSubItem, ids []string, max int) []*PubSubItem {
+	var selected []*PubSubItem
+	for i := len(items) - 1; i >= 0; i-- {
+		if max > 0 && len(selected) >= max {
+			break
+		}
+		if len(ids) > 0 {
+			found := false
+			for _, id := range ids {
+				if items[i].ID == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		selected = append(selected, items[i])
+	}
+	return selected
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// diskPubSubStore keeps each node, along with its items, in a file in
+// the directory of the service. The nodes of the recently used services
+// are cached.
+type diskPubSubStore struct {
+	dir      string
+	services map[string]map[string]*memoryPubSubNode
+	mutex    sync.Mutex
+}
+
+var _ PubSubStore = &diskPubSubStore{}
+
+const diskPubSubCacheSize = 1024
+
+type diskPubSubNodeFile struct {
+	Node  PubSubNode    `json:"node"`
+	Items []*PubSubItem `json:"items"`
+}
+
+func newDiskPubSubStore(dir string) (*diskPubSubStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create pubsub directory")
+	}
+	return &diskPubSubStore{
+		dir:      dir,
+		services: make(map[string]map[string]*memoryPubSubNode),
+	}, nil
+}
+
+func (store *diskPubSubStore) serviceDir(service string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(service)))
+}
+
+func (store *diskPubSubStore) nodeFileName(service, node string) string {
+	return filepath.Join(store.serviceDir(service), base64.RawURLEncoding.EncodeToString([]byte(node))+".json")
+}
+
+// load must be called with the mutex held.
+func (store *diskPubSubStore) load(service string) (map[string]*memoryPubSubNode, error) {
+	if nodes := store.services[service]; nodes != nil {
+		return nodes, nil
+	}
+	nodes := make(map[string]*memoryPubSubNode)
+	serviceDir := store.serviceDir(service)
+	fileInfos, err := ioutil.ReadDir(serviceDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fileInfos {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		nodeJSON, err := ioutil.ReadFile(filepath.Join(serviceDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var nodeFile diskPubSubNodeFile
+		if err = json.Unmarshal(nodeJSON, &nodeFile); err != nil {
+			return nil, errors.Wrapf(err, "unable to read pubsub node %s", fi.Name())
+		}
+		nodes[nodeFile.Node.Name] = &memoryPubSubNode{
+			node:  nodeFile.Node,
+			items: nodeFile.Items,
+		}
+	}
+	if len(store.services) >= diskPubSubCacheSize {
+		for k := range store.services {
+			delete(store.services, k)
+			break
+		}
+	}
+	store.services[service] = nodes
+	return nodes, nil
+}
+
+// save must be called with the mutex held.
+func (store *diskPubSubStore) save(service string, n *memoryPubSubNode) error {
+	if err := os.MkdirAll(store.serviceDir(service), 0700); err != nil {
+		return err
+	}
+	nodeJSON, err := json.Marshal(&diskPubSubNodeFile{Node: n.node, Items: n.items})
+	if err != nil {
+		return err
+	}
+	fileName := store.nodeFileName(service, n.node.Name)
+	if err = ioutil.WriteFile(fileName+".tmp", nodeJSON, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func (store *diskPubSubStore) PubSubNode(service, node string) (*PubSubNode, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return nil, err
+	}
+	if n := nodes[node]; n != nil {
+		return copyPubSubNode(&n.node), nil
+	}
+	return nil, nil
+}
+
+func (store *diskPubSubStore) PubSubNodes(service string) ([]*PubSubNode, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*PubSubNode, 0, len(nodes))
+	for _, n := range nodes {
+		result = append(result, copyPubSubNode(&n.node))
+	}
+	return result, nil
+}
+
+func (store *diskPubSubStore) SavePubSubNode(service string, node *PubSubNode) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return err
+	}
+	n := &memoryPubSubNode{node: *copyPubSubNode(node)}
+	if existing := nodes[node.Name]; existing != nil {
+		n.items = existing.items
+	}
+	if err = store.save(service, n); err != nil {
+		return err
+	}
+	nodes[node.Name] = n
+	return nil
+}
+
+func (store *diskPubSubStore) DeletePubSubNode(service, node string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(store.nodeFileName(service, node))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(nodes, node)
+	return nil
+}
+
+func (store *diskPubSubStore) PublishPubSubItem(service, node string, item *PubSubItem, maxItems int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return err
+	}
+	n := nodes[node]
+	if n == nil {
+		return ErrPubSubNodeNotFound
+	}
+	updated := &memoryPubSubNode{
+		node:  n.node,
+		items: pubSubItemsAppend(append([]*PubSubItem{}, n.items...), item, maxItems),
+	}
+	if err = store.save(service, updated); err != nil {
+		return err
+	}
+	nodes[node] = updated
+	return nil
+}
+
+func (store *diskPubSubStore) PubSubItems(service, node string, ids []string, max int) ([]*PubSubItem, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return nil, err
+	}
+	n := nodes[node]
+	if n == nil {
+		return nil, ErrPubSubNodeNotFound
+	}
+	return pubSubItemsSelect(n.items, ids, max), nil
+}
+
+func (store *diskPubSubStore) RetractPubSubItem(service, node, id string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return false, err
+	}
+	n := nodes[node]
+	if n == nil {
+		return false, ErrPubSubNodeNotFound
+	}
+	items, retracted := pubSubItemsRemove(append([]*PubSubItem{}, n.items...), id)
+	if !retracted {
+		return false, nil
+	}
+	updated := &memoryPubSubNode{node: n.node, items: items}
+	if err = store.save(service, updated); err != nil {
+		return false, err
+	}
+	nodes[node] = updated
+	return true, nil
+}
+
+func (store *diskPubSubStore) PurgePubSubItems(service, node string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes, err := store.load(service)
+	if err != nil {
+		return err
+	}
+	n := nodes[node]
+	if n == nil {
+		return ErrPubSubNodeNotFound
+	}
+	updated := &memoryPubSubNode{node: n.node}
+	if err = store.save(service, updated); err != nil {
+		return err
+	}
+	nodes[node] = updated
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+)
+
+type memoryPubSubStore struct {
+	services map[string]map[string]*memoryPubSubNode
+	mutex    sync.RWMutex
+}
+
+var _ PubSubStore = &memoryPubSubStore{}
+
+type memoryPubSubNode struct {
+	node PubSubNode
+	// Oldest first
+	items []*PubSubItem
+}
+
+func newMemoryPubSubStore() *memoryPubSubStore {
+	return &memoryPubSubStore{
+		services: make(map[string]map[string]*memoryPubSubNode),
+	}
+}
+
+func (store *memoryPubSubStore) PubSubNode(service, node string) (*PubSubNode, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if n := store.services[service][node]; n != nil {
+		return copyPubSubNode(&n.node), nil
+	}
+	return nil, nil
+}
+
+func (store *memoryPubSubStore) PubSubNodes(service string) ([]*PubSubNode, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	nodes := make([]*PubSubNode, 0, len(store.services[service]))
+	for _, n := range store.services[service] {
+		nodes = append(nodes, copyPubSubNode(&n.node))
+	}
+	return nodes, nil
+}
+
+func (store *memoryPubSubStore) SavePubSubNode(service string, node *PubSubNode) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	nodes := store.services[service]
+	if nodes == nil {
+		nodes = make(map[string]*memoryPubSubNode)
+		store.services[service] = nodes
+	}
+	if n := nodes[node.Name]; n != nil {
+		n.node = *copyPubSubNode(node)
+	} else {
+		nodes[node.Name] = &memoryPubSubNode{node: *copyPubSubNode(node)}
+	}
+	return nil
+}
+
+func (store *memoryPubSubStore) DeletePubSubNode(service, node string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.services[service], node)
+	if len(store.services[service]) == 0 {
+		delete(store.services, service)
+	}
+	return nil
+}
+
+func (store *memoryPubSubStore) PublishPubSubItem(service, node string, item *PubSubItem, maxItems int) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	n := store.services[service][node]
+	if n == nil {
+		return ErrPubSubNodeNotFound
+	}
+	n.items = pubSubItemsAppend(n.items, item, maxItems)
+	return nil
+}
+
+func (store *memoryPubSubStore) PubSubItems(service, node string, ids []string, max int) ([]*PubSubItem, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	n := store.services[service][node]
+	if n == nil {
+		return nil, ErrPubSubNodeNotFound
+	}
+	return pubSubItemsSelect(n.items, ids, max), nil
+}
+
+func (store *memoryPubSubStore) RetractPubSubItem(service, node, id string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	n := store.services[service][node]
+	if n == nil {
+		return false, ErrPubSubNodeNotFound
+	}
+	var retracted bool
+	n.items, retracted = pubSubItemsRemove(n.items, id)
+	return retracted, nil
+}
+
+func (store *memoryPubSubStore) PurgePubSubItems(service, node string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	n := store.services[service][node]
+	if n == nil {
+		return ErrPubSubNodeNotFound
+	}
+	n.items = nil
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// checkTestPubSubItems checks the ids of the node's items.
+func checkTestPubSubItems(t *testing.T, store PubSubStore, node string, ids []string, max int, expected []string) {
+	t.Helper()
+	items, err := store.PubSubItems("alice@localhost", node, ids, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var itemIDs []string
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ID)
+	}
+	if fmt.Sprint(itemIDs) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected items of %s: %v, expected %v", node, itemIDs, expected)
+	}
+}
+
+func testPubSubStore(t *testing.T, store PubSubStore) {
+	const service = "alice@localhost"
+	if node, err := store.PubSubNode(service, "mood"); err != nil || node != nil {
+		t.Fatalf("unexpected node: %+v %v", node, err)
+	}
+	if err := store.PublishPubSubItem(service, "mood", &PubSubItem{ID: "i1"}, 0); err != ErrPubSubNodeNotFound {
+		t.Fatalf("expected ErrPubSubNodeNotFound, got %v", err)
+	}
+	if _, err := store.PubSubItems(service, "mood", nil, 0); err != ErrPubSubNodeNotFound {
+		t.Fatalf("expected ErrPubSubNodeNotFound, got %v", err)
+	}
+
+	for _, name := range []string{"mood", "tune"} {
+		err := store.SavePubSubNode(service, &PubSubNode{
+			Name:         name,
+			Config:       PubSubNodeConfig{AccessModel: "presence", MaxItems: 3},
+			Affiliations: map[string]string{service: "owner"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"i1", "i2", "i3", "i4"} {
+		item := &PubSubItem{ID: id, Publisher: service, Payload: []byte("<mood>" + id + "</mood>")}
+		if err := store.PublishPubSubItem(service, "mood", item, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The oldest items go beyond the maximum and the republished item
+	// becomes the newest
+	checkTestPubSubItems(t, store, "mood", nil, 0, []string{"i4", "i3", "i2"})
+	if err := store.PublishPubSubItem(service, "mood", &PubSubItem{ID: "i2", Payload: []byte("<mood/>")}, 3); err != nil {
+		t.Fatal(err)
+	}
+	checkTestPubSubItems(t, store, "mood", nil, 0, []string{"i2", "i4", "i3"})
+	checkTestPubSubItems(t, store, "mood", nil, 2, []string{"i2", "i4"})
+	checkTestPubSubItems(t, store, "mood", []string{"i3", "i1"}, 0, []string{"i3"})
+	checkTestPubSubItems(t, store, "tune", nil, 0, nil)
+
+	// The node's metadata is updated without its items
+	err := store.SavePubSubNode(service, &PubSubNode{
+		Name:          "mood",
+		Config:        PubSubNodeConfig{AccessModel: "open", MaxItems: 3},
+		Subscriptions: map[string]string{"bob@localhost": "subscribed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := store.PubSubNode(service, "mood")
+	if err != nil || node.Config.AccessModel != "open" || node.Subscriptions["bob@localhost"] != "subscribed" {
+		t.Fatalf("unexpected node: %+v %v", node, err)
+	}
+	checkTestPubSubItems(t, store, "mood", nil, 0, []string{"i2", "i4", "i3"})
+
+	if retracted, err := store.RetractPubSubItem(service, "mood", "i4"); err != nil || !retracted {
+		t.Fatalf("item not retracted: %v", err)
+	}
+	if retracted, err := store.RetractPubSubItem(service, "mood", "i4"); err != nil || retracted {
+		t.Fatalf("item retracted twice: %v", err)
+	}
+	checkTestPubSubItems(t, store, "mood", nil, 0, []string{"i2", "i3"})
+	if err = store.PurgePubSubItems(service, "tune"); err != nil {
+		t.Fatal(err)
+	}
+	checkTestPubSubItems(t, store, "mood", nil, 0, []string{"i2", "i3"})
+
+	if err = store.DeletePubSubNode(service, "tune"); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := store.PubSubNodes(service)
+	if err != nil || len(nodes) != 1 || nodes[0].Name != "mood" {
+		t.Fatalf("unexpected nodes: %+v %v", nodes, err)
+	}
+	if nodes, err = store.PubSubNodes("bob@localhost"); err != nil || len(nodes) != 0 {
+		t.Fatalf("unexpected nodes: %+v %v", nodes, err)
+	}
+}
+
+func TestMemoryPubSubStore(t *testing.T) {
+	testPubSubStore(t, newMemoryPubSubStore())
+}
+
+func TestDiskPubSubStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskPubSubStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPubSubStore(t, store)
+
+	// The nodes and their items are kept across restarts
+	if store, err = newDiskPubSubStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestPubSubItems(t, store, "mood", nil, 0, []string{"i2", "i3"})
+	items, err := store.PubSubItems("alice@localhost", "mood", []string{"i3"}, 0)
+	if err != nil || string(items[0].Payload) != "<mood>i3</mood>" || items[0].Publisher != "alice@localhost" {
+		t.Fatalf("unexpected items: %+v %v", items, err)
+	}
+	if err = store.PurgePubSubItems("alice@localhost", "mood"); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = newDiskPubSubStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkTestPubSubItems(t, store, "mood", nil, 0, nil)
+	var names []string
+	nodes, err := store.PubSubNodes("alice@localhost")
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	sort.Strings(names)
+	if err != nil || fmt.Sprint(names) != "[mood]" {
+		t.Fatalf("unexpected nodes: %v %v", names, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimitMaxDelay is the longest a client is slowed down. A client
+// which would have to wait longer is over the limit.
+const rateLimitMaxDelay = 2 * time.Second
+
+// tokenBucket allows rate tokens per second with room for burst. A nil
+// bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst < limit.Rate {
+		burst = limit.Rate
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long to wait until they would
+// have been available. If the wait would be longer than maxDelay, no
+// token is taken and it returns false.
+func (bucket *tokenBucket) reserve(n float64, maxDelay time.Duration) (time.Duration, bool) {
+	if bucket == nil {
+		return 0, true
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+	tokens := bucket.tokens - n
+	var delay time.Duration
+	if tokens < 0 {
+		delay = time.Duration(-tokens / bucket.rate * float64(time.Second))
+	}
+	if delay > maxDelay {
+		return delay, false
+	}
+	bucket.tokens = tokens
+	return delay, true
+}
+
+// accountLimiter is shared by the sessions of an account.
+type accountLimiter struct {
+	stanzas  *tokenBucket
+	bytes    *tokenBucket
+	sessions int
+}
+
+// sessionLimiter applies the limits of the user's class to a session
+// and, through the account's limiter, to all the sessions of the user.
+type sessionLimiter struct {
+	local   string
+	stanzas *tokenBucket
+	bytes   *tokenBucket
+	account *accountLimiter
+}
+
+func (limiter *sessionLimiter) reserveStanza() (time.Duration, bool) {
+	return reserveAll(1, limiter.stanzas, limiter.account.stanzas)
+}
+
+func (limiter *sessionLimiter) reserveBytes(n int) (time.Duration, bool) {
+	return reserveAll(float64(n), limiter.bytes, limiter.account.bytes)
+}
+
+// reserveAll returns the longest of the buckets' delays.
+func reserveAll(n float64, buckets ...*tokenBucket) (time.Duration, bool) {
+	var delay time.Duration
+	for _, bucket := range buckets {
+		bucketDelay, ok := bucket.reserve(n, rateLimitMaxDelay)
+		if !ok {
+			return bucketDelay, false
+		}
+		if bucketDelay > delay {
+			delay = bucketDelay
+		}
+	}
+	return delay, true
+}
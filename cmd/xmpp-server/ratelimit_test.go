@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if bucket := newTokenBucket(RateLimit{}); bucket != nil {
+		t.Fatal("expected no bucket without a rate")
+	}
+	var unlimited *tokenBucket
+	if delay, ok := unlimited.reserve(1000, 0); delay != 0 || !ok {
+		t.Fatalf("expected no limit, got %v %v", delay, ok)
+	}
+
+	// The burst is taken right away, then the tokens are borrowed from
+	// the future up to the maximum delay
+	bucket := newTokenBucket(RateLimit{Rate: 1, Burst: 2})
+	for i, expected := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		delay, ok := bucket.reserve(1, 2*time.Second)
+		if !ok || delay < expected-100*time.Millisecond || delay > expected {
+			t.Fatalf("reservation %d: got %v %v, expected %v", i, delay, ok, expected)
+		}
+	}
+	if _, ok := bucket.reserve(1, 2*time.Second); ok {
+		t.Fatal("expected the reservation to be over the maximum delay")
+	}
+	// and the refused reservation has taken nothing
+	if delay, ok := bucket.reserve(0, 2*time.Second); !ok || delay < time.Second {
+		t.Fatalf("unexpected reservation: %v %v", delay, ok)
+	}
+}
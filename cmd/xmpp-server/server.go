@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -18,9 +19,8 @@ import (
 	"github.com/exavolt/xmpp-server/cmd/xmpp-server/jwt"
 )
 
-//NOTE: it seems that we don't need to acquire lock to net.Conn to
-// prevent multiple goroutines from messing up the network stream.
-// https://stackoverflow.com/questions/38565654/golang-net-conn-write-in-parallel
+//NOTE: each client's connection is only written by its writer goroutine
+// (see writer.go) so that the routing never blocks on the network.
 
 type Server struct {
 	DoneCh chan bool
@@ -31,11 +31,94 @@ type Server struct {
 
 	saslPlainAuthVerifier SASLPlainAuthVerifier
 
+	fastTokenStore    FASTTokenStore
+	fastTokenLifetime time.Duration
+	// fastTokenMutex serializes the updates of the tokens, e.g., of the
+	// counts of the replay protection.
+	fastTokenMutex sync.Mutex
+
+	offlineMessageStore      OfflineMessageStore
+	offlineMessageQuota      int
+	flexibleOfflineRetrieval bool
+
+	messageArchiveStore   MessageArchiveStore
+	messageArchiveDefault string
+
+	blocklistStore BlocklistStore
+
+	vCardStore        VCardStore
+	vCardMaxPhotoSize int
+	vCardMaxSize      int
+	// avatarHashes caches the users' avatar hashes, keyed by the bare
+	// JID, as they go along with every available presence.
+	avatarHashes      map[string]avatarHashEntry
+	avatarHashesMutex sync.Mutex
+
+	// capsCache is shared by all the clients.
+	capsCache *capsCache
+
+	disco *discoRegistry
+
+	pubsubStore  PubSubStore
+	pep          bool
+	pubsubDomain string
+	// pubsubNodesMutex serializes the updates of the nodes' metadata.
+	pubsubNodesMutex sync.Mutex
+
+	mucStore      MUCRoomStore
+	mucRooms      map[string]*mucRoom // key is the room's local part
+	mucRoomsMutex sync.Mutex
+	mucMaxHistory int
+
+	smEnabled           bool
+	smResumptionTimeout time.Duration
+	// smSessions are the resumable sessions, keyed by the resumption id.
+	smSessions      map[string]*Client
+	smSessionsMutex sync.Mutex
+
+	clientWriteQueueSize int
+	clientWriteTimeout   time.Duration
+	// clientWriteOverflowDrop is set if the data which doesn't fit in
+	// a client's write queue is dropped instead of disconnecting the
+	// client.
+	clientWriteOverflowDrop bool
+
+	clientIdleTimeout       time.Duration
+	clientPingTimeout       time.Duration
+	clientKeepaliveInterval time.Duration
+
+	negotiationTimeout  time.Duration
+	maxConns            int
+	maxNegotiatingConns int
+	maxConnsPerIP       int
+	// connCount is the number of the connections being served and
+	// connCountByIP breaks it down by the remote IP address.
+	connCount      int
+	connCountByIP  map[string]int
+	connCountMutex sync.Mutex
+
+	rateLimits  map[string]UserClassLimits
+	userClasses map[string]string
+	// accountLimiters are shared by the sessions of each user, keyed
+	// by the local part.
+	accountLimiters      map[string]*accountLimiter
+	accountLimitersMutex sync.Mutex
+
+	resourceConflictReject bool
+	maxResourcesPerAccount int
+
+	webSocketEnabled bool
+	boshEnabled      bool
+	// boshSessions are the BOSH sessions, keyed by the session id.
+	boshSessions      map[string]*boshSession
+	boshSessionsMutex sync.Mutex
+
 	startTime time.Time
 	stopCh    chan bool
 	stopState int
 
 	netListener          net.Listener
+	httpListener         net.Listener
 	negotiatingClients   map[string]*Client            // key is streamid
 	authenticatedClients map[string]map[string]*Client // key is local:resource
 	clientsMutex         sync.RWMutex
@@ -51,22 +134,248 @@ func New(
 	if cfg == nil {
 		return nil, nil
 	}
+
+	var offlineMessageStore OfflineMessageStore
+	switch cfg.OfflineStorage {
+	case "":
+	case "memory":
+		offlineMessageStore = newMemoryOfflineMessageStore()
+	case "disk":
+		diskStore, err := newDiskOfflineMessageStore(filepath.Join(cfg.DataDir, "offline"))
+		if err != nil {
+			return nil, err
+		}
+		offlineMessageStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown offline storage %q", cfg.OfflineStorage)
+	}
+
+	var messageArchiveStore MessageArchiveStore
+	switch cfg.MessageArchiveStorage {
+	case "":
+	case "memory":
+		messageArchiveStore = newMemoryMessageArchiveStore()
+	case "disk":
+		diskStore, err := newDiskMessageArchiveStore(filepath.Join(cfg.DataDir, "archive"))
+		if err != nil {
+			return nil, err
+		}
+		messageArchiveStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown message archive storage %q", cfg.MessageArchiveStorage)
+	}
+	messageArchiveDefault := cfg.MessageArchiveDefault
+	switch messageArchiveDefault {
+	case "":
+		messageArchiveDefault = MAMDefaultAlways
+	case MAMDefaultAlways, MAMDefaultNever:
+	case MAMDefaultRoster:
+		//TODO: once there's a roster storage
+		return nil, errors.New("the roster message archive default isn't supported yet")
+	default:
+		return nil, errors.Errorf("invalid message archive default %q", messageArchiveDefault)
+	}
+
+	var blocklistStore BlocklistStore
+	switch cfg.BlocklistStorage {
+	case "":
+	case "memory":
+		blocklistStore = newMemoryBlocklistStore()
+	case "disk":
+		diskStore, err := newDiskBlocklistStore(filepath.Join(cfg.DataDir, "blocklist"))
+		if err != nil {
+			return nil, err
+		}
+		blocklistStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown blocklist storage %q", cfg.BlocklistStorage)
+	}
+
+	var vCardStore VCardStore
+	switch cfg.VCardStorage {
+	case "":
+	case "memory":
+		vCardStore = newMemoryVCardStore()
+	case "disk":
+		diskStore, err := newDiskVCardStore(filepath.Join(cfg.DataDir, "vcard"))
+		if err != nil {
+			return nil, err
+		}
+		vCardStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown vCard storage %q", cfg.VCardStorage)
+	}
+
+	var fastTokenStore FASTTokenStore
+	switch cfg.FASTTokenStorage {
+	case "":
+	case "memory":
+		fastTokenStore = newMemoryFASTTokenStore()
+	case "disk":
+		diskStore, err := newDiskFASTTokenStore(filepath.Join(cfg.DataDir, "fast"))
+		if err != nil {
+			return nil, err
+		}
+		fastTokenStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown FAST token storage %q", cfg.FASTTokenStorage)
+	}
+	fastTokenLifetime := time.Duration(cfg.FASTTokenLifetime) * time.Second
+	if fastTokenLifetime <= 0 {
+		fastTokenLifetime = 14 * 24 * time.Hour
+	}
+
+	vCardMaxPhotoSize := cfg.VCardMaxPhotoSize
+	if vCardMaxPhotoSize <= 0 {
+		vCardMaxPhotoSize = 64 * 1024
+	}
+	vCardMaxSize := cfg.VCardMaxSize
+	if vCardMaxSize <= 0 {
+		vCardMaxSize = 128 * 1024
+	}
+
+	var pubsubStore PubSubStore
+	switch cfg.PubSubStorage {
+	case "":
+	case "memory":
+		pubsubStore = newMemoryPubSubStore()
+	case "disk":
+		diskStore, err := newDiskPubSubStore(filepath.Join(cfg.DataDir, "pubsub"))
+		if err != nil {
+			return nil, err
+		}
+		pubsubStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown pubsub storage %q", cfg.PubSubStorage)
+	}
+
+	var mucStore MUCRoomStore
+	switch cfg.MUCStorage {
+	case "":
+	case "memory":
+		mucStore = newMemoryMUCRoomStore()
+	case "disk":
+		diskStore, err := newDiskMUCRoomStore(filepath.Join(cfg.DataDir, "muc"))
+		if err != nil {
+			return nil, err
+		}
+		mucStore = diskStore
+	default:
+		return nil, errors.Errorf("unknown MUC storage %q", cfg.MUCStorage)
+	}
+
+	clientWriteQueueSize := cfg.ClientWriteQueueSize
+	if clientWriteQueueSize <= 0 {
+		clientWriteQueueSize = 256
+	}
+	clientWriteTimeout := time.Duration(cfg.ClientWriteTimeout) * time.Second
+	if clientWriteTimeout <= 0 {
+		clientWriteTimeout = 30 * time.Second
+	}
+	clientPingTimeout := time.Duration(cfg.ClientPingTimeout) * time.Second
+	if clientPingTimeout <= 0 {
+		clientPingTimeout = 30 * time.Second
+	}
+	switch cfg.ClientWriteQueueOverflow {
+	case "", writeQueueOverflowDisconnect, writeQueueOverflowDrop:
+	default:
+		return nil, errors.Errorf("invalid client write queue overflow %q", cfg.ClientWriteQueueOverflow)
+	}
+
+	for class := range cfg.RateLimits {
+		switch class {
+		case UserClassNormal, UserClassBot, UserClassAdmin:
+		default:
+			return nil, errors.Errorf("unknown user class %q in the rate limits", class)
+		}
+	}
+	for local, class := range cfg.UserClasses {
+		switch class {
+		case UserClassNormal, UserClassBot, UserClassAdmin:
+		default:
+			return nil, errors.Errorf("unknown user class %q of %q", class, local)
+		}
+	}
+
+	switch cfg.ResourceConflictPolicy {
+	case "", resourceConflictKick, resourceConflictReject:
+	default:
+		return nil, errors.Errorf("invalid resource conflict policy %q", cfg.ResourceConflictPolicy)
+	}
+
+	var pubsubDomain string
+	if cfg.PubSubServiceEnabled {
+		pubsubDomain = "pubsub." + cfg.Domain
+	}
+
 	netListener, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		return nil, err
 	}
+	var httpListener net.Listener
+	if cfg.HTTPPort != "" && (cfg.WebSocketEnabled || cfg.BOSHEnabled) {
+		httpListener, err = net.Listen("tcp", ":"+cfg.HTTPPort)
+		if err != nil {
+			netListener.Close()
+			return nil, err
+		}
+	}
 	saslPlainAuthVerifier := &jwt.SASLPlainAuthVerifier{}
 	srv := &Server{
-		DoneCh:                make(chan bool),
-		name:                  cfg.Name,
-		jid:                   xmppcore.JID{Domain: cfg.Domain}, //TODO: normalize
-		groupsDomain:          "groups." + cfg.Domain,
-		saslPlainAuthVerifier: saslPlainAuthVerifier,
-		stopCh:                make(chan bool),
-		netListener:           netListener,
-		negotiatingClients:    make(map[string]*Client),
-		authenticatedClients:  make(map[string]map[string]*Client),
+		DoneCh:                   make(chan bool),
+		name:                     cfg.Name,
+		jid:                      xmppcore.JID{Domain: cfg.Domain}, //TODO: normalize
+		groupsDomain:             "groups." + cfg.Domain,
+		saslPlainAuthVerifier:    saslPlainAuthVerifier,
+		fastTokenStore:           fastTokenStore,
+		fastTokenLifetime:        fastTokenLifetime,
+		offlineMessageStore:      offlineMessageStore,
+		offlineMessageQuota:      cfg.OfflineMessageQuota,
+		flexibleOfflineRetrieval: cfg.FlexibleOfflineEnabled,
+		messageArchiveStore:      messageArchiveStore,
+		messageArchiveDefault:    messageArchiveDefault,
+		blocklistStore:           blocklistStore,
+		vCardStore:               vCardStore,
+		vCardMaxPhotoSize:        vCardMaxPhotoSize,
+		vCardMaxSize:             vCardMaxSize,
+		avatarHashes:             make(map[string]avatarHashEntry),
+		capsCache:                newCapsCache(),
+		disco:                    newDiscoRegistry(),
+		pubsubStore:              pubsubStore,
+		pep:                      cfg.PEPEnabled,
+		pubsubDomain:             pubsubDomain,
+		mucStore:                 mucStore,
+		mucRooms:                 make(map[string]*mucRoom),
+		mucMaxHistory:            cfg.MUCMaxHistory,
+		smEnabled:                cfg.StreamManagementEnabled,
+		smResumptionTimeout:      time.Duration(cfg.StreamResumptionTimeout) * time.Second,
+		smSessions:               make(map[string]*Client),
+		clientWriteQueueSize:     clientWriteQueueSize,
+		clientWriteTimeout:       clientWriteTimeout,
+		clientWriteOverflowDrop:  cfg.ClientWriteQueueOverflow == writeQueueOverflowDrop,
+		clientIdleTimeout:        time.Duration(cfg.ClientIdleTimeout) * time.Second,
+		clientPingTimeout:        clientPingTimeout,
+		clientKeepaliveInterval:  time.Duration(cfg.ClientKeepaliveInterval) * time.Second,
+		negotiationTimeout:       time.Duration(cfg.NegotiationTimeout) * time.Second,
+		maxConns:                 cfg.MaxConnections,
+		maxNegotiatingConns:      cfg.MaxNegotiatingConnections,
+		maxConnsPerIP:            cfg.MaxConnectionsPerIP,
+		connCountByIP:            make(map[string]int),
+		rateLimits:               cfg.RateLimits,
+		userClasses:              cfg.UserClasses,
+		accountLimiters:          make(map[string]*accountLimiter),
+		resourceConflictReject:   cfg.ResourceConflictPolicy == resourceConflictReject,
+		maxResourcesPerAccount:   cfg.MaxResourcesPerAccount,
+		stopCh:                   make(chan bool),
+		netListener:              netListener,
+		httpListener:             httpListener,
+		webSocketEnabled:         cfg.WebSocketEnabled,
+		boshEnabled:              cfg.BOSHEnabled,
+		boshSessions:             make(map[string]*boshSession),
+		negotiatingClients:       make(map[string]*Client),
+		authenticatedClients:     make(map[string]map[string]*Client),
 	}
+	srv.registerDiscoProviders()
 	return srv, nil
 }
 
@@ -91,6 +400,9 @@ func (srv *Server) Serve() {
 
 	srv.startTime = time.Now()
 	go srv.listen()
+	if srv.httpListener != nil {
+		go srv.listenHTTP()
+	}
 	log.Infof("Ready to accept connections")
 
 mainloop:
@@ -106,6 +418,9 @@ mainloop:
 	log.Infof("Stopping after %s uptime...", srv.Uptime())
 	srv.stopState = 1
 	srv.netListener.Close()
+	if srv.httpListener != nil {
+		srv.httpListener.Close()
+	}
 
 	srv.clientsMutex.RLock()
 	for _, cl := range srv.negotiatingClients {
@@ -147,21 +462,33 @@ func (srv *Server) listen() {
 		if conn == nil {
 			continue
 		}
+		srv.acceptClient(newTCPTransport(conn))
+	}
+}
 
-		cl, err := srv.newClient(conn)
-		if err != nil {
-			log.Error("Unable to create client: ", err)
-			continue
-		}
+// acceptClient starts serving the client on the new connection, whatever
+// the transport.
+func (srv *Server) acceptClient(transport clientTransport) {
+	if condition := srv.admitConnection(transport); condition != "" {
+		go srv.rejectConnection(transport, condition)
+		return
+	}
 
-		log.WithFields(logrus.Fields{"stream": cl.streamID}).Info("Client connected")
-		srv.clientsWaitGroup.Add(1)
-		go srv.serveClient(cl)
+	cl, err := srv.newClient(transport)
+	if err != nil {
+		log.Error("Unable to create client: ", err)
+		srv.releaseConnection(transport)
+		transport.Close()
+		return
 	}
+
+	log.WithFields(logrus.Fields{"stream": cl.streamID}).Info("Client connected")
+	srv.clientsWaitGroup.Add(1)
+	go srv.serveClient(cl)
 }
 
-func (srv *Server) newClient(conn net.Conn) (*Client, error) {
-	if conn == nil {
+func (srv *Server) newClient(transport clientTransport) (*Client, error) {
+	if transport == nil {
 		return nil, nil
 	}
 	streamID, err := srv.generateStreamID()
@@ -169,11 +496,14 @@ func (srv *Server) newClient(conn net.Conn) (*Client, error) {
 		return nil, errors.Wrap(err, "unable to generate session id")
 	}
 	cl := &Client{
-		conn:       conn,
-		streamID:   streamID,
-		xmlDecoder: xml.NewDecoder(conn), //TODO: is there a way to limit the decoder's buffer size?
-		jid:        xmppcore.JID{Domain: srv.jid.Domain},
+		transport:      transport,
+		outbox:         make(chan []byte, srv.clientWriteQueueSize),
+		dropOnOverflow: srv.clientWriteOverflowDrop,
+		streamID:       streamID,
+		jid:            xmppcore.JID{Domain: srv.jid.Domain},
+		connDone:       make(chan struct{}),
 	}
+	go srv.writeClient(transport, cl.outbox, streamID)
 	srv.clientsMutex.Lock()
 	srv.negotiatingClients[cl.streamID] = cl
 	srv.clientsMutex.Unlock()
@@ -181,34 +511,44 @@ func (srv *Server) newClient(conn net.Conn) (*Client, error) {
 }
 
 func (srv *Server) serveClient(cl *Client) {
+	// The session might be resumed on another connection (XEP-0198) thus
+	// the teardown is about the connection this goroutine serves.
+	transport, outbox, connDone := cl.transport, cl.outbox, cl.connDone
+	reader := &idleReader{
+		transport:   transport,
+		idleTimeout: srv.clientIdleTimeout,
+		pingTimeout: srv.clientPingTimeout,
+		onIdle:      func() bool { return srv.pingClient(cl) },
+	}
+	if _, ok := transport.(readLimitedTransport); !ok {
+		reader.onRead = func(n int) bool { return srv.throttleClientRead(cl, n) }
+	}
+	if srv.negotiationTimeout > 0 {
+		reader.negotiationDeadline = time.Now().Add(srv.negotiationTimeout)
+	}
 	defer func() {
-		if cl.conn != nil {
+		if cl.transport == transport {
 			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
 				Info("Closing client connection")
-			cl.conn.Close()
-			cl.conn = nil
 		} else {
 			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
 				Info("Client disconnected")
 		}
 
-		srv.clientsMutex.Lock()
-		if cl.authenticated {
-			userClients := srv.authenticatedClients[cl.jid.Local]
-			if userClients != nil {
-				delete(userClients, cl.jid.Resource)
-			}
-		} else {
-			delete(srv.negotiatingClients, cl.streamID)
+		if !srv.detachClient(cl, transport) {
+			srv.endClientSession(cl)
 		}
-		srv.clientsMutex.Unlock()
-
+		// Nothing refers to the outbox anymore. The writer goroutine
+		// closes the connection once it has sent what's left.
+		close(outbox)
+		close(connDone)
+		srv.releaseConnection(transport)
 		srv.clientsWaitGroup.Done()
 	}()
 
 mainloop:
 	for {
-		token, err := cl.xmlDecoder.Token()
+		elem, err := reader.ReadElement()
 		if err != nil {
 			// Clean disconnection
 			if err == io.EOF {
@@ -216,6 +556,29 @@ mainloop:
 					Info("Client connection closed")
 				break mainloop
 			}
+			if err == errNegotiationTimeout {
+				log.WithFields(logrus.Fields{"stream": cl.streamID}).
+					Info("Negotiation timed out")
+				cl.closeStream("connection-timeout")
+				break mainloop
+			}
+			if err == errRateLimited {
+				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+					Info("Byte rate limit exceeded")
+				cl.closeStream("policy-violation")
+				break mainloop
+			}
+			if err == errElementTooLarge {
+				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+					Info("Element size limit exceeded")
+				cl.closeStream("policy-violation")
+				break mainloop
+			}
+			if err == errClientIdle {
+				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+					Info("Client connection timed out")
+				break mainloop
+			}
 			// Un-clean disconnection (the connection is closed while
 			// the stream is still open)
 			//NOTE: this could be a expected case for every authenticated
@@ -232,53 +595,37 @@ mainloop:
 				Errorf("Unexpected error: %#v", err)
 			break mainloop
 		}
-		if token == nil {
-			log.WithFields(logrus.Fields{"stream": cl.streamID}).
-				Errorf("Token is nil")
-			break mainloop
-		}
-
-		//TODO: check for restricted-xml
-		switch token.(type) {
-		case xml.StartElement:
-			// Processed after the switch
-		case xml.EndElement:
-			endElem := token.(xml.EndElement)
-			if endElem.Name.Space == xmppcore.JabberStreamsNS && endElem.Name.Local == "stream" {
-				if !cl.closingStream {
-					cl.closingStream = true
-					log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
-						Info("Client closed the stream. Disconnecting client....")
-					//TODO: should we send a reply or simply close the connection?
-					cl.conn.Write([]byte("</stream:stream>"))
-					continue
-				}
-				cl.conn.Close()
-				break mainloop
-			}
-			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
-				Errorf("Unexpected EndElement: %#v", endElem)
-			panic(endElem)
-		case xml.ProcInst:
-			procInst := token.(xml.ProcInst)
-			if procInst.Target != "xml" {
+		if elem.footer {
+			if !cl.closingStream {
+				cl.closingStream = true
 				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
-					Errorf("Unexpected processing instruction: %#v", procInst)
+					Info("Client closed the stream. Disconnecting client....")
+				//TODO: should we send a reply or simply close the connection?
+				cl.write([]byte("</stream:stream>"))
 				continue
 			}
-			// Check XML version, encoding?
-			continue
-		default:
-			log.Warnf("%#v", token)
-			continue
+			break mainloop
 		}
 
+		//TODO: check for restricted-xml
 		if cl.closingStream {
-			cl.xmlDecoder.Skip()
 			continue
 		}
 
-		startElem := token.(xml.StartElement)
+		cl.xmlDecoder = elem.decoder
+		startElem := elem.start
+
+		switch startElem.Name.Space + " " + startElem.Name.Local {
+		case xmppcore.ClientIQElementName, xmppim.ClientPresenceElementName, xmppim.ClientMessageElementName:
+			if cl.resourceBound() && !srv.throttleClientStanza(cl) {
+				srv.rejectClientStanza(cl, &startElem, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeWait,
+					Condition: xmppcore.StanzaErrorConditionResourceConstraint,
+				})
+				cl.countHandledStanza()
+				continue
+			}
+		}
 
 		switch startElem.Name.Space + " " + startElem.Name.Local {
 		case xmppcore.StreamStreamElementName:
@@ -286,27 +633,87 @@ mainloop:
 				continue
 			}
 			cl.closingStream = true
-			cl.conn.Write([]byte("</stream:stream>"))
+			cl.write([]byte("</stream:stream>"))
 			//TODO: graceful disconnection (wait until the client close the stream)
 			break mainloop
 		case xmppcore.SASLAuthElementName:
-			if !cl.authenticated {
+			if !cl.authenticated() {
 				srv.handleClientSASLAuth(cl, &startElem)
+				if cl.authenticated() {
+					reader.negotiationDeadline = time.Time{}
+				}
+				continue
+			}
+		case SASL2AuthenticateElementName:
+			if !cl.authenticated() {
+				if resumed := srv.handleClientSASL2Authenticate(cl, &startElem); resumed != nil {
+					cl = resumed
+				}
+				if cl.authenticated() {
+					reader.negotiationDeadline = time.Time{}
+				}
 				continue
 			}
 		case xmppcore.ClientIQElementName:
-			if cl.authenticated {
+			if cl.resourceBound() {
 				srv.handleClientIQ(cl, &startElem)
+				cl.countHandledStanza()
+				continue
+			}
+			if cl.state == clientStateRestarted {
+				srv.handleClientBindIQ(cl, &startElem)
 				continue
 			}
 		case xmppim.ClientPresenceElementName:
-			if cl.authenticated {
+			if cl.resourceBound() {
 				srv.handleClientPresence(cl, &startElem)
+				cl.countHandledStanza()
 				continue
 			}
 		case xmppim.ClientMessageElementName:
-			if cl.authenticated {
+			if cl.resourceBound() {
 				srv.handleClientMessage(cl, &startElem)
+				cl.countHandledStanza()
+				continue
+			}
+		case CSIActiveElementName, CSIInactiveElementName:
+			if cl.resourceBound() {
+				srv.handleClientCSI(cl, &startElem)
+				continue
+			}
+		case SMEnableElementName:
+			if cl.resourceBound() && srv.smEnabled {
+				srv.handleClientSMEnable(cl, &startElem)
+				continue
+			}
+		case SMResumeElementName:
+			if cl.state == clientStateRestarted && srv.smEnabled {
+				if resumed := srv.handleClientSMResume(cl, &startElem); resumed != nil {
+					cl = resumed
+				}
+				continue
+			}
+		case SMRequestElementName:
+			if cl.sm != nil {
+				srv.handleClientSMRequest(cl, &startElem)
+				continue
+			}
+		case SMAnswerElementName:
+			if cl.sm != nil {
+				if srv.handleClientSMAnswer(cl, &startElem) {
+					continue
+				}
+				break mainloop
+			}
+		}
+		// RFC 6120 7.1: no stanza is processed before the resource binding
+		if cl.authenticated() {
+			switch startElem.Name.Space + " " + startElem.Name.Local {
+			case xmppcore.ClientIQElementName, xmppim.ClientPresenceElementName, xmppim.ClientMessageElementName:
+				srv.rejectClientStanza(cl, &startElem, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeAuth,
+					Condition: xmppcore.StanzaErrorConditionNotAuthorized,
+				})
 				continue
 			}
 		}
@@ -325,7 +732,7 @@ func (srv *Server) notifyClientSystemShutdown(cl *Client) {
 		}
 	}()
 	cl.closingStream = true
-	cl.conn.Write([]byte(`<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>\n` +
+	cl.write([]byte(`<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>\n` +
 		`</stream:stream>`))
 }
 
@@ -356,7 +763,7 @@ func (srv *Server) handleClientStreamOpen(cl *Client, startElem *xml.StartElemen
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.write(resultXML)
 		return false
 	}
 	if !fromJID.IsEmpty() && fromJID.Domain != srv.jid.Domain {
@@ -366,49 +773,79 @@ func (srv *Server) handleClientStreamOpen(cl *Client, startElem *xml.StartElemen
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.write(resultXML)
 		return false
 	}
 
-	var featuresXML []byte
-	if cl.authenticated {
-		featuresXML, err = xml.Marshal(&xmppcore.AuthenticatedStreamFeatures{})
+	if cl.state == clientStateAuthenticated {
+		cl.state = clientStateRestarted
+	}
+	featuresXML := srv.clientStreamFeatures(cl)
+
+	//TODO: include 'to' if 'from' was provided
+	cl.write([]byte(fmt.Sprintf(xml.Header+
+		"<stream:stream from='%s' xmlns='%s'"+
+		" id='%s' xml:lang='en'"+
+		" xmlns:stream='%s' version='1.0'>\n"+
+		string(featuresXML)+"\n",
+		xmlEscapeString(srv.jid.FullString()), xmppcore.JabberClientNS,
+		xmlEscapeString(cl.streamID), xmppcore.JabberStreamsNS)))
+
+	return true
+}
+
+// clientStreamFeatures returns the stream features offered to the client
+// at its stage of the negotiation.
+func (srv *Server) clientStreamFeatures(cl *Client) []byte {
+	if cl.authenticated() {
+		featuresXML, err := xml.Marshal(&xmppcore.AuthenticatedStreamFeatures{})
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		//TODO: get features from the config and mods
-		var mechanisms []string
-		if srv.saslPlainAuthVerifier != nil {
-			mechanisms = append(mechanisms, "PLAIN")
+		capsXML, err := xml.Marshal(srv.serverCaps())
+		if err != nil {
+			panic(err)
 		}
-		featuresXML, err = xml.Marshal(&xmppcore.NegotiationStreamFeatures{
-			Mechanisms: &xmppcore.SASLMechanisms{
-				Mechanism: mechanisms,
-			},
-		})
+		featuresXML = xmlElementAppendChildren(featuresXML, capsXML)
+		csiXML, err := xml.Marshal(&CSIFeature{})
 		if err != nil {
 			panic(err)
 		}
+		featuresXML = xmlElementAppendChildren(featuresXML, csiXML)
+		if srv.smEnabled {
+			smXML, err := xml.Marshal(&SMFeature{})
+			if err != nil {
+				panic(err)
+			}
+			featuresXML = xmlElementAppendChildren(featuresXML, smXML)
+		}
+		return featuresXML
 	}
 
-	//TODO: include 'to' if 'from' was provided
-	_, err = fmt.Fprintf(cl.conn, xml.Header+
-		"<stream:stream from='%s' xmlns='%s'"+
-		" id='%s' xml:lang='en'"+
-		" xmlns:stream='%s' version='1.0'>\n"+
-		string(featuresXML)+"\n",
-		xmlEscapeString(srv.jid.FullString()), xmppcore.JabberClientNS,
-		xmlEscapeString(cl.streamID), xmppcore.JabberStreamsNS)
+	//TODO: get features from the config and mods
+	var mechanisms []string
+	if srv.saslPlainAuthVerifier != nil {
+		mechanisms = append(mechanisms, "PLAIN")
+	}
+	featuresXML, err := xml.Marshal(&xmppcore.NegotiationStreamFeatures{
+		Mechanisms: &xmppcore.SASLMechanisms{
+			Mechanism: mechanisms,
+		},
+	})
 	if err != nil {
 		panic(err)
 	}
-
-	return true
+	sasl2XML, err := xml.Marshal(srv.sasl2Authentication(mechanisms))
+	if err != nil {
+		panic(err)
+	}
+	return xmlElementAppendChildren(featuresXML, sasl2XML)
 }
 
-func (srv *Server) finishClientNegotiation(cl *Client) {
-	if cl.jid.Local == "" || cl.jid.Resource == "" {
+// finishClientAuthentication moves the client to the authenticated
+// state. The restarted stream gets a new id.
+func (srv *Server) finishClientAuthentication(cl *Client) {
+	if cl.jid.Local == "" {
 		panic("unexpected condition")
 	}
 	newStreamID, err := srv.generateStreamID()
@@ -419,13 +856,117 @@ func (srv *Server) finishClientNegotiation(cl *Client) {
 	delete(srv.negotiatingClients, cl.streamID)
 	oldStreamID := cl.streamID
 	cl.streamID = newStreamID
-	if srv.authenticatedClients[cl.jid.Local] == nil {
-		srv.authenticatedClients[cl.jid.Local] = make(map[string]*Client)
+	cl.state = clientStateAuthenticated
+	srv.negotiatingClients[cl.streamID] = cl
+	srv.clientsMutex.Unlock()
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("Authenticated: %s => %s", oldStreamID, cl.streamID)
+}
+
+// finishClientNegotiation registers the session under the client's full
+// JID. It returns the error condition if the session can't be bound.
+func (srv *Server) finishClientNegotiation(cl *Client) string {
+	if cl.jid.Local == "" || cl.jid.Resource == "" {
+		panic("unexpected condition")
+	}
+	// The resource provided by the authentication is prepared as well
+	cl.jid.Resource = resourceprep(cl.jid.Resource)
+	if condition := srv.bindClientSession(cl); condition != "" {
+		return condition
+	}
+	srv.clientsMutex.Lock()
+	if srv.negotiatingClients[cl.streamID] == cl {
+		delete(srv.negotiatingClients, cl.streamID)
 	}
-	srv.authenticatedClients[cl.jid.Local][cl.jid.Resource] = cl
 	srv.clientsMutex.Unlock()
+	cl.state = clientStateBound
+	cl.limiter = srv.newSessionLimiter(cl.jid.Local)
+	cl.connMutex.Lock()
+	limitTransportReads(cl.transport, cl.limiter)
+	cl.connMutex.Unlock()
 	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
-		Infof("Negotiation completed: %s => %s", oldStreamID, cl.streamID)
+		Info("Negotiation completed")
+	return ""
+}
+
+// endClientSession removes the client's session from the server. The
+// session's entries are left alone if another session has taken over
+// the full JID.
+func (srv *Server) endClientSession(cl *Client) {
+	cl.connMutex.Lock()
+	cl.transport = nil
+	cl.outbox = nil
+	var unacked [][]byte
+	var smID string
+	if cl.sm != nil {
+		cl.sm.ended = true
+		unacked, cl.sm.unacked = cl.sm.unacked, nil
+		smID = cl.sm.id
+	}
+	cl.connMutex.Unlock()
+
+	if smID != "" {
+		srv.smSessionsMutex.Lock()
+		if srv.smSessions[smID] == cl {
+			delete(srv.smSessions, smID)
+		}
+		srv.smSessionsMutex.Unlock()
+	}
+
+	replaced := false
+	srv.clientsMutex.Lock()
+	if cl.resourceBound() {
+		userClients := srv.authenticatedClients[cl.jid.Local]
+		if userClients[cl.jid.Resource] == cl {
+			delete(userClients, cl.jid.Resource)
+		} else {
+			replaced = true
+		}
+	} else if srv.negotiatingClients[cl.streamID] == cl {
+		delete(srv.negotiatingClients, cl.streamID)
+	}
+	srv.clientsMutex.Unlock()
+
+	if cl.resourceBound() && !replaced {
+		srv.leaveMUCRooms(cl)
+	}
+
+	if cl.setPresence(nil) {
+		if !replaced {
+			fromJID := cl.jid
+			srv.broadcastPresence(cl, &clientPresence{
+				Type: "unavailable",
+				From: &fromJID,
+			})
+		}
+	}
+
+	srv.storeUnackedMessages(cl, unacked)
+	if cl.limiter != nil {
+		srv.releaseSessionLimiter(cl.limiter)
+	}
+}
+
+// authenticatedClient returns the session bound to the full JID
+// local@domain/resource, or nil if there's none. The resource is looked
+// up by its prepared form.
+func (srv *Server) authenticatedClient(local, resource string) *Client {
+	resource = resourceprep(resource)
+	srv.clientsMutex.RLock()
+	defer srv.clientsMutex.RUnlock()
+	return srv.authenticatedClients[local][resource]
+}
+
+// userClients returns all the sessions of a user.
+func (srv *Server) userClients(local string) []*Client {
+	srv.clientsMutex.RLock()
+	defer srv.clientsMutex.RUnlock()
+	userClients := srv.authenticatedClients[local]
+	clients := make([]*Client, 0, len(userClients))
+	for _, cl := range userClients {
+		clients = append(clients, cl)
+	}
+	return clients
 }
 
 func (srv *Server) generateStreamID() (string, error) {
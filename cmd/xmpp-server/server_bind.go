@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// RFC 6120 7: Resource Binding
+
+const bindNS = "urn:ietf:params:xml:ns:xmpp-bind"
+
+// The policies on binding a resource which is already bound
+const (
+	resourceConflictKick   = "kick"
+	resourceConflictReject = "reject"
+)
+
+// handleClientBindIQ handles the IQs of the client which has restarted
+// the stream after the authentication. Nothing but the resource binding
+// is allowed at this point.
+func (srv *Server) handleClientBindIQ(cl *Client, startElem *xml.StartElement) {
+	var iq xmppcore.ClientIQ
+	err := cl.xmlDecoder.DecodeElement(&iq, startElem)
+	if err != nil {
+		panic(err)
+	}
+	if iq.Type != xmppcore.IQTypeGet && iq.Type != xmppcore.IQTypeSet {
+		return
+	}
+	if iq.Type != xmppcore.IQTypeSet || !xmlPayloadHasElement(iq.Payload, bindNS, "bind") {
+		srv.sendClientIQError(cl, &iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionNotAuthorized,
+		})
+		return
+	}
+	payload := srv.decodeClientIQPayload(cl, &iq, func(name string) interface{} {
+		if name == xmppcore.BindBindElementName {
+			return &xmppcore.BindIQSet{}
+		}
+		return nil
+	})
+	if payload == nil {
+		return
+	}
+	bind := payload.(*xmppcore.BindIQSet)
+
+	if bind.Resource != "" && !validResource(bind.Resource) {
+		srv.sendClientIQError(cl, &iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	resource := resourceprep(bind.Resource)
+
+	// The resource provided by the authentication, if any, is the only
+	// one the client may bind.
+	providedResource := cl.jid.Resource
+	if providedResource != "" && resource != "" && resource != resourceprep(providedResource) {
+		srv.sendClientIQError(cl, &iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	switch {
+	case providedResource != "":
+	case resource != "":
+		cl.jid.Resource = resource
+	default:
+		cl.jid.Resource = srv.generateResource(cl.jid.Local, "")
+	}
+
+	switch srv.finishClientNegotiation(cl) {
+	case "":
+	case "conflict":
+		cl.jid.Resource = providedResource
+		srv.sendClientIQError(cl, &iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionConflict,
+		})
+		return
+	default:
+		cl.jid.Resource = providedResource
+		srv.sendClientIQError(cl, &iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionResourceConstraint,
+		})
+		return
+	}
+
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Info("Bound!")
+	boundJID := cl.jid
+	srv.sendClientIQResult(cl, &iq, &xmppcore.BindIQResult{
+		JID: &boundJID,
+	})
+}
+
+// resourceprep maps the resource to the form under which it's bound so
+// that the variants of a resource which differ only in width or in case
+// are the same resource (RFC 7622 3.4, with the case mapped as well):
+// the fullwidth forms are mapped to their ASCII counterparts, the
+// non-ASCII spaces to the ASCII space and the letters to lower case.
+func resourceprep(resource string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '\uff01' && r <= '\uff5e':
+			r -= '\uff01' - '!'
+		case r > unicode.MaxASCII && unicode.Is(unicode.Zs, r):
+			r = ' '
+		}
+		return unicode.ToLower(r)
+	}, resource)
+}
+
+// validResource reports whether the resource may be bound. The resource
+// is at most 1023 bytes of UTF-8 without control characters.
+func validResource(resource string) bool {
+	if resource == "" || len(resource) > 1023 || !utf8.ValidString(resource) {
+		return false
+	}
+	for _, r := range resource {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// generateResource returns a random resource which none of the user's
+// sessions has bound. The tag, if any, prefixes the resource.
+func (srv *Server) generateResource(local, tag string) string {
+	for {
+		resource := generateID()
+		if tag != "" {
+			resource = tag + "." + resource
+		}
+		resource = resourceprep(resource)
+		if srv.authenticatedClient(local, resource) == nil {
+			return resource
+		}
+	}
+}
+
+// detached reports whether the session has lost its connection and
+// waits to be resumed (XEP-0198).
+func (cl *Client) detached() bool {
+	cl.connMutex.Lock()
+	defer cl.connMutex.Unlock()
+	return cl.transport == nil && cl.sm != nil && !cl.sm.ended
+}
+
+// bindClientSession registers the client's session under its full JID
+// according to the resource conflict policy (RFC 6120 7.7.2.2) and the
+// limit of resources per account. It returns the error condition if the
+// session can't be bound.
+//
+// A session waiting to be resumed is ended as the client has chosen to
+// bind a new session instead of resuming it.
+func (srv *Server) bindClientSession(cl *Client) string {
+	for {
+		srv.clientsMutex.Lock()
+		userClients := srv.authenticatedClients[cl.jid.Local]
+		if userClients == nil {
+			userClients = make(map[string]*Client)
+			srv.authenticatedClients[cl.jid.Local] = userClients
+		}
+		existing := userClients[cl.jid.Resource]
+		if existing != nil && existing != cl && existing.detached() {
+			srv.clientsMutex.Unlock()
+			srv.endClientSession(existing)
+			continue
+		}
+		if existing != nil && existing != cl {
+			if srv.resourceConflictReject {
+				srv.clientsMutex.Unlock()
+				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+					Info("Resource already bound, rejecting the new session")
+				return "conflict"
+			}
+			srv.clientsMutex.Unlock()
+			log.WithFields(logrus.Fields{"stream": existing.streamID, "jid": existing.jid}).
+				Info("Resource bound by another session, kicking the session")
+			// The kicked session gives up its entry then we look again
+			existing.closeStream("conflict")
+			srv.endClientSession(existing)
+			continue
+		}
+		if existing == nil && srv.maxResourcesPerAccount > 0 && len(userClients) >= srv.maxResourcesPerAccount {
+			srv.clientsMutex.Unlock()
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+				Info("Maximum number of resources reached")
+			return "resource-constraint"
+		}
+		userClients[cl.jid.Resource] = cl
+		srv.clientsMutex.Unlock()
+		return ""
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResourceprep(t *testing.T) {
+	for resource, expected := range map[string]string{
+		"phone":           "phone",
+		"Phone":           "phone",
+		"ＰＨＯＮＥ":           "phone",
+		"my　phone":        "my phone",
+		"Téléphone":       "téléphone",
+		"laptop.x-Y_z/01": "laptop.x-y_z/01",
+	} {
+		if prepared := resourceprep(resource); prepared != expected {
+			t.Errorf("resourceprep(%q) = %q, expected %q", resource, prepared, expected)
+		}
+	}
+	for _, resource := range []string{"", "a\u0085b", "a\x00", strings.Repeat("a", 1024), "\xff"} {
+		if validResource(resource) {
+			t.Errorf("%q is not a valid resource", resource)
+		}
+	}
+}
+
+func TestBindResourceVariants(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	alice := ts.connect("alice", "ＰＨＯＮＥ")
+	if alice.jid != "alice@localhost/phone" {
+		t.Fatalf("unexpected bound JID %s", alice.jid)
+	}
+	bob := ts.connect("bob", "laptop")
+
+	// The variants of the resource address the session
+	bob.send(`<message type='chat' id='m1' to='alice@localhost/Phone'><body>Hello</body></message>`)
+	if msg := parseTestMessage(t, alice.expect("<message")); msg.Body != "Hello" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// and conflict with it. The new session kicks the old one.
+	phone := ts.connect("alice", "PHONE")
+	if phone.jid != "alice@localhost/phone" {
+		t.Fatalf("unexpected bound JID %s", phone.jid)
+	}
+	if received := strings.Join(alice.expectClosed(), ""); !strings.Contains(received, "<conflict") {
+		t.Fatalf("expected a conflict stream error, got %s", received)
+	}
+
+	// A resource which can't be prepared is refused
+	c := ts.newTestClient(newMemoryTransport(64))
+	c.openStream()
+	c.authenticate("carol")
+	c.openStream()
+	response := c.request(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>` +
+		`<resource>a&#x85;b</resource></bind></iq>`)
+	if !strings.Contains(response, "<bad-request") {
+		t.Fatalf("expected a bad-request error, got %s", response)
+	}
+
+	phone.close()
+	bob.close()
+	c.close()
+}
+
+func TestBindBeforeStreamRestart(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	c := ts.newTestClient(newMemoryTransport(64))
+	c.openStream()
+	c.authenticate("alice")
+
+	// The stream hasn't been restarted after the authentication
+	response := c.request(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>` +
+		`<resource>phone</resource></bind></iq>`)
+	if !strings.Contains(response, "type='error'") && !strings.Contains(response, `type="error"`) ||
+		!strings.Contains(response, "<not-authorized") {
+		t.Fatalf("expected a not-authorized error, got %s", response)
+	}
+	if ts.authenticatedClient("alice", "phone") != nil {
+		t.Fatal("the resource was bound before the stream restart")
+	}
+
+	c.openStream()
+	c.bind("phone")
+	if c.jid != "alice@localhost/phone" {
+		t.Fatalf("unexpected bound JID %s", c.jid)
+	}
+	c.close()
+}
+
+// requestBind authenticates a new client and sends the request to bind
+// the resource. It returns the client along with the response.
+func (ts *testServer) requestBind(local, resource string) (*testClient, string) {
+	ts.t.Helper()
+	c := ts.newTestClient(newMemoryTransport(64))
+	c.openStream()
+	c.authenticate(local)
+	c.openStream()
+	return c, c.request(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>` +
+		`<resource>` + resource + `</resource></bind></iq>`)
+}
+
+func TestBindConflictReject(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ResourceConflictPolicy = resourceConflictReject
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	bob := ts.connect("bob", "laptop")
+
+	c, response := ts.requestBind("alice", "phone")
+	if !strings.Contains(response, "<conflict") {
+		t.Fatalf("expected a conflict error, got %s", response)
+	}
+	// The existing session carries on and the new one may bind another
+	// resource
+	bob.send(`<message type='chat' id='m1' to='alice@localhost/phone'><body>Hello</body></message>`)
+	if msg := parseTestMessage(t, alice.expect("<message")); msg.Body != "Hello" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	c.bind("tablet")
+	if c.jid != "alice@localhost/tablet" {
+		t.Fatalf("unexpected bound JID %s", c.jid)
+	}
+
+	alice.close()
+	bob.close()
+	c.close()
+}
+
+func TestBindConflictKick(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	bob := ts.connect("bob", "laptop")
+
+	phone := ts.connect("alice", "phone")
+	if received := strings.Join(alice.expectClosed(), ""); !strings.Contains(received, "<conflict") {
+		t.Fatalf("expected a conflict stream error, got %s", received)
+	}
+	bob.send(`<message type='chat' id='m1' to='alice@localhost/phone'><body>Hello</body></message>`)
+	if msg := parseTestMessage(t, phone.expect("<message")); msg.Body != "Hello" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	phone.close()
+	bob.close()
+}
+
+func TestBindResourceLimit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxResourcesPerAccount = 2
+	})
+	defer ts.close()
+	phone := ts.connect("alice", "phone")
+	laptop := ts.connect("alice", "laptop")
+
+	c, response := ts.requestBind("alice", "tablet")
+	if !strings.Contains(response, "<resource-constraint") {
+		t.Fatalf("expected a resource-constraint error, got %s", response)
+	}
+	// Binding a bound resource replaces the session thus isn't limited
+	replaced := ts.connect("alice", "laptop")
+	laptop.expectClosed()
+	// and a session which ends makes room
+	phone.close()
+	for deadline := time.Now().Add(5 * time.Second); ts.authenticatedClient("alice", "phone") != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("the session hasn't ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.bind("tablet")
+
+	replaced.close()
+	c.close()
+}
+
+func TestBindReplacesDetachedSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ResourceConflictPolicy = resourceConflictReject
+		cfg.StreamManagementEnabled = true
+		cfg.StreamResumptionTimeout = 60
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	alice.send(`<enable xmlns='urn:xmpp:sm:3' resume='true'/>`)
+	alice.expect("<enabled")
+	alice.transport.Close()
+	ts.waitDetached(alice.jid)
+
+	// The client has chosen to bind a new session instead of resuming
+	// the one which waits
+	phone := ts.connect("alice", "phone")
+	if phone.jid != "alice@localhost/phone" {
+		t.Fatalf("unexpected bound JID %s", phone.jid)
+	}
+
+	phone.close()
+}
+
+func TestResourceConflictPolicyConfig(t *testing.T) {
+	_, err := New(&Config{Name: "test", Domain: "localhost", Port: "0", ResourceConflictPolicy: "replace"})
+	if err == nil || !strings.Contains(err.Error(), "resource conflict policy") {
+		t.Fatalf("expected an invalid resource conflict policy, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0191: Blocking Command
+
+// blockedStanzaErrorXML is the error returned to a user who attempts to
+// communicate with a contact they have blocked.
+const blockedStanzaErrorXML = `<error type='cancel'>` +
+	`<not-acceptable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>` +
+	`<blocked xmlns='` + BlockingErrorsNS + `'/>` +
+	`</error>`
+
+// blocklistItemMatches applies the JID matching rules of XEP-0016 which
+// are used by XEP-0191.
+func blocklistItemMatches(item string, jid xmppcore.JID) bool {
+	itemJID, err := xmppcore.ParseJID(item)
+	if err != nil {
+		return false
+	}
+	if itemJID.Domain != jid.Domain {
+		return false
+	}
+	if itemJID.Local != "" {
+		if itemJID.Local != jid.Local {
+			return false
+		}
+		return itemJID.Resource == "" || itemJID.Resource == jid.Resource
+	}
+	if itemJID.Resource != "" {
+		return jid.Local == "" && itemJID.Resource == jid.Resource
+	}
+	return true
+}
+
+// isBlocked reports whether the user has blocked the JID.
+func (srv *Server) isBlocked(local string, jid xmppcore.JID) bool {
+	if srv.blocklistStore == nil || local == "" {
+		return false
+	}
+	blocklist, err := srv.blocklistStore.Blocklist(local)
+	if err != nil {
+		log.WithFields(logrus.Fields{"user": local}).
+			Error("Unable to retrieve blocklist: ", err)
+		return false
+	}
+	for _, item := range blocklist {
+		if blocklistItemMatches(item, jid) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMessageBlockedError tells the client that the message wasn't sent
+// because the recipient is in the client's blocklist.
+func (srv *Server) sendMessageBlockedError(cl *Client, msg *clientMessage) {
+	if msg.Type == messageTypeError {
+		return
+	}
+	srv.deliverMessage(cl, &clientMessage{
+		ID:      msg.ID,
+		Type:    messageTypeError,
+		From:    msg.To,
+		To:      &cl.jid,
+		Payload: append(append([]byte{}, msg.Payload...), blockedStanzaErrorXML...),
+	})
+}
+
+func (srv *Server) handleClientBlockingIQ(cl *Client, iq *xmppcore.ClientIQ, payload interface{}) {
+	if iq.To != nil && !iq.To.Equals(*cl.jid.BareCopyPtr()) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	var items []BlockingItem
+	switch payload := payload.(type) {
+	case *BlockingBlocklist:
+		cl.setBlocklistRequested()
+		blocklist, err := srv.blocklistStore.Blocklist(cl.jid.Local)
+		if err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+				Error("Unable to retrieve blocklist: ", err)
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeWait,
+				Condition: xmppcore.StanzaErrorConditionInternalServerError,
+			})
+			return
+		}
+		result := &BlockingBlocklist{Items: make([]BlockingItem, 0, len(blocklist))}
+		for _, jid := range blocklist {
+			result.Items = append(result.Items, BlockingItem{JID: jid})
+		}
+		srv.sendClientIQResult(cl, iq, result)
+		return
+	case *BlockingBlock:
+		if len(payload.Items) == 0 {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionBadRequest,
+			})
+			return
+		}
+		items = payload.Items
+	case *BlockingUnblock:
+		items = payload.Items
+	}
+
+	var jids []string
+	var newlyBlocked []xmppcore.JID
+	_, blocking := payload.(*BlockingBlock)
+	for _, item := range items {
+		jid, err := xmppcore.ParseJID(item.JID)
+		if err != nil {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+			})
+			return
+		}
+		jids = append(jids, jid.FullString())
+		if blocking && !srv.isBlocked(cl.jid.Local, jid) {
+			newlyBlocked = append(newlyBlocked, jid)
+		}
+	}
+
+	var err error
+	var push interface{}
+	if blocking {
+		err = srv.blocklistStore.BlockJIDs(cl.jid.Local, jids)
+		push = &BlockingBlock{Items: items}
+	} else {
+		// An unblock without items clears the blocklist
+		err = srv.blocklistStore.UnblockJIDs(cl.jid.Local, jids)
+		push = &BlockingUnblock{Items: items}
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Error("Unable to update blocklist: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	// XEP-0191 3.3: the blocked contacts see the user go offline before
+	// the block is acknowledged
+	srv.sendBlockedUnavailablePresence(cl.jid.Local, newlyBlocked)
+	srv.sendClientIQResult(cl, iq, nil)
+	srv.pushBlocklistChange(cl.jid.Local, push)
+}
+
+// sendBlockedUnavailablePresence sends unavailable presence from each of
+// the user's available resources to the contacts.
+func (srv *Server) sendBlockedUnavailablePresence(local string, contacts []xmppcore.JID) {
+	if len(contacts) == 0 {
+		return
+	}
+	for _, ucl := range srv.userClients(local) {
+		if !ucl.isAvailable() {
+			continue
+		}
+		fromJID := ucl.jid
+		for i := range contacts {
+			srv.routePresence(&clientPresence{
+				Type: "unavailable",
+				From: &fromJID,
+				To:   &contacts[i],
+			})
+		}
+	}
+}
+
+// pushBlocklistChange sends the change to all the user's resources which
+// have retrieved the blocklist.
+func (srv *Server) pushBlocklistChange(local string, push interface{}) {
+	pushXML, err := xml.Marshal(push)
+	if err != nil {
+		panic(err)
+	}
+	for _, ucl := range srv.userClients(local) {
+		if !ucl.isBlocklistRequested() {
+			continue
+		}
+		iqXML, err := xml.Marshal(xmppcore.ClientIQ{
+			ID:      generateID(),
+			Type:    xmppcore.IQTypeSet,
+			To:      &ucl.jid,
+			Payload: pushXML,
+		})
+		if err != nil {
+			panic(err)
+		}
+		ucl.writeStanza(iqXML)
+	}
+}
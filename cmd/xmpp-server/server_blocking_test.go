@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestBlockingServer(t *testing.T) *testServer {
+	return newTestServer(t, func(cfg *Config) {
+		cfg.BlocklistStorage = "disk"
+		cfg.MUCStorage = "memory"
+	})
+}
+
+func TestBlocking(t *testing.T) {
+	ts := newTestBlockingServer(t)
+	defer ts.close()
+
+	alice := ts.connect("alice", "phone")
+	alice.available()
+	bob := ts.connect("bob", "laptop")
+	bob.available()
+
+	response := alice.request(`<iq type='set' id='block'>` +
+		`<block xmlns='urn:xmpp:blocking'><item jid='bob@localhost'/></block></iq>`)
+	if !strings.Contains(response, `type="result"`) {
+		t.Fatalf("unexpected block response: %s", response)
+	}
+	// XEP-0191 3.3: bob sees alice go offline
+	received := bob.sync()
+	if len(received) != 1 || !strings.HasPrefix(received[0], "<presence") ||
+		!strings.Contains(received[0], `type="unavailable"`) || !strings.Contains(received[0], alice.jid) {
+		t.Fatalf("expected unavailable presence from alice, got %v", received)
+	}
+
+	// Nothing goes through either way
+	alice.send(`<message type='chat' id='m1' to='bob@localhost'><body>Hi</body></message>`)
+	if msg := alice.expect("<message"); !strings.Contains(msg, "urn:xmpp:blocking:errors") {
+		t.Fatalf("expected a blocked error, got %s", msg)
+	}
+	bob.send(`<message type='chat' id='m2' to='alice@localhost'><body>Hi</body></message>`)
+	if msg := bob.expect("<message"); !strings.Contains(msg, `type="error"`) {
+		t.Fatalf("expected an error, got %s", msg)
+	}
+	alice.send(`<presence to='bob@localhost/laptop'/>`)
+	alice.expectNothing()
+	bob.expectNothing()
+
+	response = alice.request(`<iq type='set' id='unblock'>` +
+		`<unblock xmlns='urn:xmpp:blocking'><item jid='bob@localhost'/></unblock></iq>`)
+	if !strings.Contains(response, `type="result"`) {
+		t.Fatalf("unexpected unblock response: %s", response)
+	}
+	bob.send(`<message type='chat' id='m3' to='alice@localhost'><body>Hi again</body></message>`)
+	if msg := parseTestMessage(t, alice.expect("<message")); msg.Body != "Hi again" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	alice.close()
+	bob.close()
+}
+
+func TestBlockingMUCPresence(t *testing.T) {
+	ts := newTestBlockingServer(t)
+	defer ts.close()
+
+	alice := ts.connect("alice", "phone")
+	alice.available()
+	alice.request(`<iq type='set' id='block'>` +
+		`<block xmlns='urn:xmpp:blocking'><item jid='room@groups.localhost'/></block></iq>`)
+
+	alice.send(`<presence to='room@groups.localhost/alice'><x xmlns='http://jabber.org/protocol/muc'/></presence>`)
+	alice.expectNothing()
+	ts.mucRoomsMutex.Lock()
+	room := ts.mucRooms["room"]
+	ts.mucRoomsMutex.Unlock()
+	if room != nil {
+		t.Fatal("the room was created")
+	}
+
+	alice.close()
+}
+
+func TestDiskBlocklistStoreCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskBlocklistStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lookups of the users without blocklists aren't cached
+	for i := 0; i < 100; i++ {
+		if blocklist, err := store.Blocklist("nobody" + strconv.Itoa(i)); err != nil || len(blocklist) != 0 {
+			t.Fatalf("unexpected blocklist %v, %v", blocklist, err)
+		}
+	}
+	if n := store.recent.Len(); n != 0 {
+		t.Fatalf("%d blocklists cached", n)
+	}
+
+	for i := 0; i < diskBlocklistCacheSize+10; i++ {
+		if err = store.BlockJIDs("user"+strconv.Itoa(i), []string{"spam@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(store.blocklists); n != diskBlocklistCacheSize || store.recent.Len() != n {
+		t.Fatalf("%d blocklists cached", n)
+	}
+	// The evicted blocklists are loaded again
+	blocklist, err := store.Blocklist("user0")
+	if err != nil || len(blocklist) != 1 || blocklist[0] != "spam@example.com" {
+		t.Fatalf("unexpected blocklist %v, %v", blocklist, err)
+	}
+
+	// An emptied blocklist leaves the cache
+	if err = store.UnblockJIDs("user0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if store.blocklists["user0"] != nil {
+		t.Fatal("the empty blocklist is cached")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0124: Bidirectional-streams Over Synchronous HTTP (BOSH)
+// XEP-0206: XMPP Over BOSH
+
+const boshPath = "/http-bind"
+
+const boshVersion = "1.11"
+
+// The limits of the sessions. The client may ask for less.
+const (
+	boshMaxWait    = 60 * time.Second
+	boshMaxHold    = 1
+	boshInactivity = 60 * time.Second
+	// boshPolling is the shortest time between the requests of a client
+	// which holds none.
+	boshPolling = 2 * time.Second
+)
+
+// boshMaxRequestSize limits the size of the request bodies.
+const boshMaxRequestSize = 256 * 1024
+
+func (srv *Server) handleBOSH(w http.ResponseWriter, r *http.Request) {
+	// The web clients are served from elsewhere
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bodyXML, err := ioutil.ReadAll(io.LimitReader(r.Body, boshMaxRequestSize+1))
+	if err != nil {
+		return
+	}
+	if len(bodyXML) > boshMaxRequestSize {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var body BOSHBody
+	if err = xml.Unmarshal(bodyXML, &body); err != nil || body.RID == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	var session *boshSession
+	if body.SID == "" {
+		if srv.stopState != 0 {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		session, err = srv.newBOSHSession(r, &body)
+		if err != nil {
+			log.WithFields(logrus.Fields{"remote": r.RemoteAddr}).
+				Error("Unable to create BOSH session: ", err)
+			srv.writeBOSHResponse(w, boshTerminateBody("internal-server-error"))
+			return
+		}
+	} else {
+		srv.boshSessionsMutex.Lock()
+		session = srv.boshSessions[body.SID]
+		srv.boshSessionsMutex.Unlock()
+		if session == nil {
+			srv.writeBOSHResponse(w, boshTerminateBody("item-not-found"))
+			return
+		}
+	}
+	srv.writeBOSHResponse(w, session.handleRequest(&body))
+}
+
+// newBOSHSession creates the session with the limits the client asked
+// for, within the server's, and serves it as a client.
+func (srv *Server) newBOSHSession(r *http.Request, body *BOSHBody) (*boshSession, error) {
+	wait := time.Duration(body.Wait) * time.Second
+	if wait <= 0 || wait > boshMaxWait {
+		wait = boshMaxWait
+	}
+	hold := body.Hold
+	if hold < 0 {
+		hold = 0
+	}
+	if hold > boshMaxHold {
+		hold = boshMaxHold
+	}
+	sid, err := srv.generateStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := newBOSHSession(sid, body, wait, hold, boshInactivity)
+	session.remoteAddr = boshAddr(r.RemoteAddr)
+	session.onClose = func() {
+		srv.boshSessionsMutex.Lock()
+		delete(srv.boshSessions, sid)
+		srv.boshSessionsMutex.Unlock()
+	}
+	srv.boshSessionsMutex.Lock()
+	srv.boshSessions[sid] = session
+	srv.boshSessionsMutex.Unlock()
+
+	log.WithFields(logrus.Fields{"sid": sid, "remote": r.RemoteAddr}).
+		Info("BOSH session created")
+	srv.acceptClient(session)
+	return session, nil
+}
+
+func (srv *Server) writeBOSHResponse(w http.ResponseWriter, response []byte) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(response)
+}
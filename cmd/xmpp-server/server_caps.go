@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0115: Entity Capabilities
+
+// serverCapsNode identifies the server software in the server's own
+// entity capabilities.
+const serverCapsNode = "https://github.com/exavolt/xmpp-server"
+
+// handleClientCaps learns the client's features from the entity
+// capabilities in its presence. The features are looked up in the caps
+// cache, or queried from the client if the verification string is not
+// known yet.
+func (srv *Server) handleClientCaps(cl *Client, presence *clientPresence) {
+	var caps EntityCaps
+	if !xmlPayloadDecodeElement(presence.Payload, CapsNS, "c", &caps) {
+		return
+	}
+	cl.featuresMutex.RLock()
+	capsVer := cl.capsVer
+	cl.featuresMutex.RUnlock()
+	if caps.Ver == "" || caps.Ver == capsVer {
+		return
+	}
+
+	// The legacy format (without the hash) can't be verified thus
+	// it's never cached.
+	if caps.Hash != "" {
+		if features := srv.capsCache.features(caps.Hash, caps.Ver); features != nil {
+			cl.setFeatures(caps.Ver, features)
+			srv.sendPEPLastPublishedItems(cl)
+			return
+		}
+	}
+
+	queryXML, err := xml.Marshal(&DiscoInfo{Node: caps.Node + "#" + caps.Ver})
+	if err != nil {
+		panic(err)
+	}
+	srv.sendClientIQRequest(cl, &xmppcore.ClientIQ{
+		Type:    xmppcore.IQTypeGet,
+		Payload: queryXML,
+	}, func(response *xmppcore.ClientIQ) {
+		if response.Type != xmppcore.IQTypeResult {
+			return
+		}
+		var info CapsDiscoInfo
+		if err := xml.Unmarshal(response.Payload, &info); err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": response.ID}).
+				Warn("Invalid disco#info response: ", err)
+			return
+		}
+		features := make(map[string]bool, len(info.Features))
+		for _, feature := range info.Features {
+			features[feature.Var] = true
+		}
+		// Whatever the client says about itself holds for the client,
+		// but only the verified features are shared with the others.
+		if caps.Hash != "" {
+			ver, ok := capsVerificationString(caps.Hash, &info)
+			if ok && ver == caps.Ver {
+				srv.capsCache.add(caps.Hash, caps.Ver, features)
+			} else {
+				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": response.ID}).
+					Warn("Unable to verify the entity capabilities")
+			}
+		}
+		cl.setFeatures(caps.Ver, features)
+		srv.sendPEPLastPublishedItems(cl)
+	})
+}
+
+// serverDiscoInfo describes the server itself as registered by the
+// enabled modules.
+func (srv *Server) serverDiscoInfo() *DiscoInfo {
+	info, _, err := discoInfo(srv.disco.server, nil, srv.jid, "")
+	if err != nil {
+		panic(err)
+	}
+	return info
+}
+
+// serverCaps returns the entity capabilities of the server, which are
+// advertised in the stream features (XEP-0115 6.3).
+func (srv *Server) serverCaps() *EntityCaps {
+	info := srv.serverDiscoInfo()
+	capsInfo := &CapsDiscoInfo{Features: info.Feature, Forms: info.Forms}
+	for _, identity := range info.Identity {
+		capsInfo.Identities = append(capsInfo.Identities, CapsDiscoIdentity{
+			Category: identity.Category,
+			Type:     identity.Type,
+			Name:     identity.Name,
+		})
+	}
+	ver, ok := capsVerificationString("sha-1", capsInfo)
+	if !ok {
+		panic("invalid server disco#info")
+	}
+	return &EntityCaps{Hash: "sha-1", Node: serverCapsNode, Ver: ver}
+}
+
+// serverCapsDiscoInfo answers the disco#info query on the node of the
+// server's entity capabilities with the server's own info.
+func (srv *Server) serverCapsDiscoInfo(cl *Client, jid xmppcore.JID, node string, result *DiscoInfo) (bool, error) {
+	if node == "" {
+		return false, nil
+	}
+	if caps := srv.serverCaps(); node != caps.Node+"#"+caps.Ver {
+		return false, nil
+	}
+	info := srv.serverDiscoInfo()
+	result.Identity = append(result.Identity, info.Identity...)
+	result.Feature = append(result.Feature, info.Feature...)
+	result.Forms = append(result.Forms, info.Forms...)
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0280: Message Carbons
+
+func (srv *Server) handleClientCarbonsIQ(cl *Client, iq *xmppcore.ClientIQ, enable bool) {
+	if iq.To != nil && !iq.To.Equals(*cl.jid.BareCopyPtr()) && !iq.To.Equals(srv.jid) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+	cl.setCarbonsEnabled(enable)
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("Carbons enabled: %v", enable)
+	srv.sendClientIQResult(cl, iq, nil)
+}
+
+// markPrivateMessage takes the carbons opt-outs from the message. The
+// <private/> element is removed so that it's not leaked to the recipient.
+func markPrivateMessage(msg *clientMessage) {
+	stripped := xmlPayloadRemoveElements(msg.Payload, func(startElem *xml.StartElement) bool {
+		return startElem.Name.Space == CarbonsNS && startElem.Name.Local == "private"
+	})
+	if len(stripped) != len(msg.Payload) {
+		msg.Payload = stripped
+		msg.noCopy = true
+	}
+	if xmlPayloadHasElement(msg.Payload, HintsNS, "no-copy") {
+		msg.noCopy = true
+	}
+}
+
+func isCarbonsEligibleMessage(msg *clientMessage) bool {
+	if msg.noCopy {
+		return false
+	}
+	switch msg.Type {
+	case messageTypeChat:
+		return true
+	case messageTypeNormal:
+		return messageHasBody(msg)
+	}
+	return false
+}
+
+// sendSentCarbons copies a message sent by the client to the other
+// resources of the user.
+func (srv *Server) sendSentCarbons(cl *Client, msg *clientMessage) {
+	if !isCarbonsEligibleMessage(msg) {
+		return
+	}
+	msgXML, err := xml.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	srv.sendCarbons(cl.jid, &CarbonsSent{
+		Forwarded: Forwarded{Stanza: msgXML},
+	}, msg.Type)
+}
+
+// sendReceivedCarbons copies a message delivered to the client to the
+// other resources of the user.
+func (srv *Server) sendReceivedCarbons(rcl *Client, msg *clientMessage) {
+	if !isCarbonsEligibleMessage(msg) {
+		return
+	}
+	msgXML, err := xml.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	srv.sendCarbons(rcl.jid, &CarbonsReceived{
+		Forwarded: Forwarded{Stanza: msgXML},
+	}, msg.Type)
+}
+
+func (srv *Server) sendCarbons(excludedJID xmppcore.JID, carbon interface{}, msgType string) {
+	carbonXML, err := xml.Marshal(carbon)
+	if err != nil {
+		panic(err)
+	}
+	for _, ccl := range srv.userClients(excludedJID.Local) {
+		if !ccl.isCarbonsEnabled() || ccl.jid.Resource == excludedJID.Resource {
+			continue
+		}
+		srv.deliverMessage(ccl, &clientMessage{
+			Type:    msgType,
+			From:    excludedJID.BareCopyPtr(),
+			To:      &ccl.jid,
+			Payload: carbonXML,
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0352: Client State Indication
+
+// csiMaxHeldPresences limits the presences held back from an inactive
+// client. They are all sent once the limit is reached.
+const csiMaxHeldPresences = 500
+
+// heldPresence is the latest presence of a sender held back from an
+// inactive client.
+type heldPresence struct {
+	from        string
+	presenceXML []byte
+}
+
+func (srv *Server) handleClientCSI(cl *Client, startElem *xml.StartElement) {
+	if err := cl.xmlDecoder.Skip(); err != nil {
+		panic(err)
+	}
+	active := startElem.Name.Local == "active"
+
+	cl.csiMutex.Lock()
+	defer cl.csiMutex.Unlock()
+	if cl.inactive == !active {
+		return
+	}
+	cl.inactive = !active
+	held := len(cl.heldPresences)
+	if active {
+		cl.flushHeldPresences()
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("Client state: active=%v (held presences: %d)", active, held)
+}
+
+// flushHeldPresences requires csiMutex.
+func (cl *Client) flushHeldPresences() {
+	for _, held := range cl.heldPresences {
+		cl.writeStanza(held.presenceXML)
+	}
+	cl.heldPresences = nil
+}
+
+// writePresence sends the presence to the client. The availability
+// updates are held back while the client is inactive, only the latest
+// one of each sender is kept.
+func (cl *Client) writePresence(presence *clientPresence, presenceXML []byte) {
+	cl.csiMutex.Lock()
+	defer cl.csiMutex.Unlock()
+	if !cl.inactive || (presence.Type != "" && presence.Type != "unavailable") {
+		cl.flushHeldPresences()
+		cl.writeStanza(presenceXML)
+		return
+	}
+	var from string
+	if presence.From != nil {
+		from = presence.From.FullString()
+	}
+	for i, held := range cl.heldPresences {
+		if held.from == from {
+			cl.heldPresences = append(cl.heldPresences[:i], cl.heldPresences[i+1:]...)
+			break
+		}
+	}
+	cl.heldPresences = append(cl.heldPresences, heldPresence{from: from, presenceXML: presenceXML})
+	if len(cl.heldPresences) >= csiMaxHeldPresences {
+		cl.flushHeldPresences()
+	}
+}
+
+// writeMessage sends the message to the client. The messages carrying
+// nothing but a chat state are dropped while the client is inactive.
+// Any other message is sent right away, after the held presences so
+// that the client sees the stanzas in order. It returns false if the
+// message has been discarded, see writeStanza.
+func (cl *Client) writeMessage(msg *clientMessage, msgXML []byte) bool {
+	cl.csiMutex.Lock()
+	defer cl.csiMutex.Unlock()
+	if cl.inactive && messageIsChatStateOnly(msg) {
+		return true
+	}
+	cl.flushHeldPresences()
+	return cl.writeStanza(msgXML)
+}
+
+// messageIsChatStateOnly reports whether the message has a chat state
+// (XEP-0085) and nothing else of interest to the recipient.
+func messageIsChatStateOnly(msg *clientMessage) bool {
+	if msg.Type == messageTypeError || messageHasBody(msg) {
+		return false
+	}
+	hasChatState := false
+	rest := xmlPayloadRemoveElements(msg.Payload, func(startElem *xml.StartElement) bool {
+		switch {
+		case startElem.Name.Space == ChatStatesNS:
+			hasChatState = true
+			return true
+		case startElem.Name.Space == StanzaIDNS, startElem.Name.Local == "thread":
+			return true
+		}
+		return false
+	})
+	return hasChatState && len(bytes.TrimSpace(rest)) == 0
+}
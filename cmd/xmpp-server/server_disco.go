@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0030: Service Discovery
+
+// registerDiscoProviders registers the discovery providers of the
+// enabled modules.
+func (srv *Server) registerDiscoProviders() {
+	disco := srv.disco
+
+	disco.addServer(discoIdentityProvider(
+		&xmppdisco.Identity{Category: xmppdisco.IdentityCategoryServer, Type: "im", Name: "go-xmpp-server"},
+		DiscoInfoNS, DiscoItemsNS, CapsNS, "urn:xmpp:ping"))
+	disco.addServer(discoProvider{info: srv.serverCapsDiscoInfo})
+	disco.addServer(discoFeaturesProvider(CarbonsNS))
+	if srv.blocklistStore != nil {
+		disco.addServer(discoFeaturesProvider(BlockingNS))
+	}
+	if srv.vCardStore != nil {
+		disco.addServer(discoFeaturesProvider("vcard-temp"))
+	}
+	if srv.offlineMessageStore != nil {
+		disco.addServer(discoFeaturesProvider("msgoffline"))
+	}
+	if srv.flexibleOfflineEnabled() {
+		disco.addServer(discoFeaturesProvider(OfflineNS))
+		disco.addAccount(discoProvider{info: srv.offlineDiscoInfo, items: srv.offlineDiscoItems})
+	}
+
+	disco.addAccount(discoIdentityProvider(&xmppdisco.Identity{Category: "account", Type: "registered"}))
+	if srv.messageArchiveStore != nil {
+		disco.addAccount(discoProvider{info: srv.mamDiscoInfo})
+	}
+	if srv.fastTokenStore != nil {
+		disco.addAccount(discoFeaturesProvider(FASTDevicesNS))
+	}
+	if srv.pepEnabled() {
+		disco.addAccount(discoProvider{info: srv.pepDiscoInfo, items: srv.pepDiscoItems})
+	}
+
+	if srv.mucEnabled() {
+		disco.addServer(discoItemProvider(DiscoItem{JID: srv.groupsDomain, Name: "Chatrooms"}))
+		disco.addComponent(srv.groupsDomain, discoIdentityProvider(
+			&xmppdisco.Identity{Category: "conference", Type: "text", Name: "Chatrooms"},
+			DiscoInfoNS, DiscoItemsNS, MUCNS))
+		disco.addComponent(srv.groupsDomain, discoProvider{items: srv.mucServiceDiscoItems})
+	}
+	if srv.pubsubServiceEnabled() {
+		disco.addServer(discoItemProvider(DiscoItem{JID: srv.pubsubDomain, Name: "Publish-Subscribe"}))
+		disco.addComponent(srv.pubsubDomain, discoIdentityProvider(
+			&xmppdisco.Identity{Category: "pubsub", Type: "service", Name: "Publish-Subscribe"},
+			pubsubServiceFeatures...))
+		disco.addComponent(srv.pubsubDomain, discoProvider{items: srv.pubsubServiceDiscoItems})
+	}
+}
+
+// discoProviders returns the providers of the entity. The IQs addressed
+// to the full JIDs of the users have been routed to their clients
+// thus those which end up here are not answered.
+func (srv *Server) discoProviders(jid xmppcore.JID) ([]discoProvider, *xmppcore.StanzaError) {
+	if jid.Resource == "" {
+		if jid.Domain == srv.jid.Domain {
+			if jid.Local == "" {
+				return srv.disco.server, nil
+			}
+			return srv.disco.accounts, nil
+		}
+		if jid.Local == "" {
+			if providers := srv.disco.components[jid.Domain]; providers != nil {
+				return providers, nil
+			}
+		}
+	}
+	if jid.Domain != srv.jid.Domain && srv.disco.components[jid.Domain] == nil {
+		//TODO: s2s
+		return nil, &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionRemoteServerNotFound,
+		}
+	}
+	return nil, &xmppcore.StanzaError{
+		Type:      xmppcore.StanzaErrorTypeCancel,
+		Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+	}
+}
+
+// discoTarget returns the entity which the query is addressed to. A
+// query without 'to' is addressed to the sender's account.
+func discoTarget(cl *Client, iq *xmppcore.ClientIQ) xmppcore.JID {
+	if iq.To == nil || iq.To.IsEmpty() {
+		return *cl.jid.BareCopyPtr()
+	}
+	return *iq.To
+}
+
+func (srv *Server) handleClientDiscoInfo(cl *Client, iq *xmppcore.ClientIQ, node string) {
+	target := discoTarget(cl, iq)
+	providers, stanzaErr := srv.discoProviders(target)
+	if stanzaErr != nil {
+		srv.sendClientIQError(cl, iq, *stanzaErr)
+		return
+	}
+	result, found, err := discoInfo(providers, cl, target, node)
+	srv.sendDiscoResult(cl, iq, result, found, err)
+}
+
+func (srv *Server) handleClientDiscoItems(cl *Client, iq *xmppcore.ClientIQ, node string) {
+	target := discoTarget(cl, iq)
+	providers, stanzaErr := srv.discoProviders(target)
+	if stanzaErr != nil {
+		srv.sendClientIQError(cl, iq, *stanzaErr)
+		return
+	}
+	result, found, err := discoItems(providers, cl, target, node)
+	srv.sendDiscoResult(cl, iq, result, found, err)
+}
+
+func (srv *Server) sendDiscoResult(cl *Client, iq *xmppcore.ClientIQ, result interface{}, found bool, err error) {
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Error("Unable to discover: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	if !found {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+	srv.sendClientIQResult(cl, iq, result)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0484: Fast Authentication Streamlining Tokens
+
+// fastMechanism is the only HT mechanism offered as there's no channel
+// binding.
+const fastMechanism = "HT-SHA-256-NONE"
+
+// fastTokenSize is the number of random bytes of a token.
+const fastTokenSize = 32
+
+// fastTokenProof computes the HT-SHA-256 proof of the token with the
+// label, i.e., "Initiator" or "Responder", and no channel binding data.
+func fastTokenProof(token, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// fastProofHash is what's kept to check the client's proof. Without
+// channel binding the proof never changes thus keeping it as is would
+// let anyone who reads the store authenticate.
+func fastProofHash(proof []byte) []byte {
+	hash := sha256.Sum256(proof)
+	return hash[:]
+}
+
+// fastDeviceToken returns the stored token of the device, or nil.
+func (srv *Server) fastDeviceToken(local, userAgentID string) (*FASTToken, error) {
+	tokens, err := srv.fastTokenStore.FASTTokens(local)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		if token.UserAgentID == userAgentID {
+			return token, nil
+		}
+	}
+	return nil, nil
+}
+
+// verifyFASTToken checks the client's proof of the token of its device.
+// It returns the user's local part, the device's stored token and
+// whether the previous token was used, or the SASL failure condition.
+func (srv *Server) verifyFASTToken(
+	cl *Client, authBytes []byte, fast *FASTAuth,
+) (localpart string, stored *FASTToken, usedPrevious bool, condition string) {
+	authSegments := bytes.SplitN(authBytes, []byte{0}, 2)
+	if len(authSegments) != 2 || cl.userAgentID == "" {
+		return "", nil, false, "not-authorized"
+	}
+	localpart = string(authSegments[0]) //TODO: normalize
+
+	srv.fastTokenMutex.Lock()
+	defer srv.fastTokenMutex.Unlock()
+	stored, err := srv.fastDeviceToken(localpart, cl.userAgentID)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "user": localpart}).
+			Error("Unable to retrieve FAST tokens: ", err)
+		return "", nil, false, "temporary-auth-failure"
+	}
+	if stored == nil {
+		return "", nil, false, "not-authorized"
+	}
+
+	proofHash := fastProofHash(authSegments[1])
+	var expiry time.Time
+	switch {
+	case hmac.Equal(proofHash, stored.InitiatorHash):
+		expiry = stored.Expiry
+	case stored.PreviousInitiatorHash != nil && hmac.Equal(proofHash, stored.PreviousInitiatorHash):
+		usedPrevious, expiry = true, stored.PreviousExpiry
+	default:
+		return "", nil, false, "not-authorized"
+	}
+	if time.Now().After(expiry) {
+		return "", nil, false, "credentials-expired"
+	}
+	// The count protects against the replay of the 0-RTT data. It's
+	// stored right away so that a concurrent replay fails.
+	if fast != nil && fast.Count > 0 {
+		if fast.Count <= stored.Count {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "user": localpart}).
+				Warnf("FAST count replayed: %d", fast.Count)
+			return "", nil, false, "not-authorized"
+		}
+		stored.Count = fast.Count
+		if err = srv.fastTokenStore.PutFASTToken(localpart, stored); err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "user": localpart}).
+				Error("Unable to store FAST token: ", err)
+			return "", nil, false, "temporary-auth-failure"
+		}
+	}
+	return localpart, stored, usedPrevious, ""
+}
+
+// fastTokenResponder returns the server's proof of the token the client
+// has authenticated with.
+func fastTokenResponder(stored *FASTToken, usedPrevious bool) []byte {
+	if usedPrevious {
+		return stored.PreviousResponder
+	}
+	return stored.Responder
+}
+
+// updateFASTToken issues a new token to the authenticated client if it
+// has requested one or if it has authenticated with a token, which is
+// rotated on every use. The token used stays valid until the new one is
+// used in case the client misses it. It returns the token element for
+// the success, if any.
+func (srv *Server) updateFASTToken(
+	cl *Client, authenticate *SASL2Authenticate, stored *FASTToken, usedPrevious bool,
+) []byte {
+	if srv.fastTokenStore == nil || cl.userAgentID == "" {
+		return nil
+	}
+	if stored != nil && authenticate.FAST != nil {
+		if invalidate, _ := parseXMPPBoolean(authenticate.FAST.Invalidate); invalidate {
+			err := srv.fastTokenStore.DeleteFASTTokens(cl.jid.Local, []string{cl.userAgentID})
+			if err != nil {
+				log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+					Error("Unable to remove FAST token: ", err)
+			}
+			return nil
+		}
+	}
+	requested := authenticate.RequestToken != nil && authenticate.RequestToken.Mechanism == fastMechanism
+	if stored == nil && !requested {
+		return nil
+	}
+
+	tokenBytes := make([]byte, fastTokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		panic(err)
+	}
+	tokenString := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	token := &FASTToken{
+		UserAgentID:   cl.userAgentID,
+		InitiatorHash: fastProofHash(fastTokenProof(tokenString, "Initiator")),
+		Responder:     fastTokenProof(tokenString, "Responder"),
+		Expiry:        time.Now().Add(srv.fastTokenLifetime).UTC(),
+	}
+	if authenticate.UserAgent != nil {
+		token.Software = authenticate.UserAgent.Software
+		token.Device = authenticate.UserAgent.Device
+	}
+	if stored != nil {
+		if authenticate.UserAgent == nil {
+			token.Software, token.Device = stored.Software, stored.Device
+		}
+		if usedPrevious {
+			token.PreviousInitiatorHash = stored.PreviousInitiatorHash
+			token.PreviousResponder = stored.PreviousResponder
+			token.PreviousExpiry = stored.PreviousExpiry
+		} else {
+			token.PreviousInitiatorHash = stored.InitiatorHash
+			token.PreviousResponder = stored.Responder
+			token.PreviousExpiry = stored.Expiry
+		}
+	}
+
+	srv.fastTokenMutex.Lock()
+	defer srv.fastTokenMutex.Unlock()
+	// The count might have moved on since the verification
+	current, err := srv.fastDeviceToken(cl.jid.Local, cl.userAgentID)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to retrieve FAST tokens: ", err)
+		return nil
+	}
+	if current != nil {
+		token.Count = current.Count
+	}
+	if err := srv.fastTokenStore.PutFASTToken(cl.jid.Local, token); err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to store FAST token: ", err)
+		return nil
+	}
+	tokenXML, err := xml.Marshal(&FASTIssuedToken{
+		Expiry: xmppDateTimeString(token.Expiry),
+		Token:  tokenString,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return tokenXML
+}
+
+// handleClientFASTDevicesIQ lets the user list the devices which hold a
+// token and revoke their tokens.
+func (srv *Server) handleClientFASTDevicesIQ(cl *Client, iq *xmppcore.ClientIQ, payload interface{}) {
+	if iq.To != nil && !iq.To.Equals(*cl.jid.BareCopyPtr()) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	switch payload := payload.(type) {
+	case *FASTDevicesQuery:
+		tokens, err := srv.fastTokenStore.FASTTokens(cl.jid.Local)
+		if err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+				Error("Unable to retrieve FAST tokens: ", err)
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeWait,
+				Condition: xmppcore.StanzaErrorConditionInternalServerError,
+			})
+			return
+		}
+		result := &FASTDevicesQuery{}
+		for _, token := range tokens {
+			result.Devices = append(result.Devices, FASTDevice{
+				ID:       token.UserAgentID,
+				Software: token.Software,
+				Device:   token.Device,
+				Expiry:   xmppDateTimeString(token.Expiry),
+			})
+		}
+		srv.sendClientIQResult(cl, iq, result)
+	case *FASTDevicesRevoke:
+		var userAgentIDs []string
+		for _, device := range payload.Devices {
+			userAgentIDs = append(userAgentIDs, device.ID)
+		}
+		err := srv.fastTokenStore.DeleteFASTTokens(cl.jid.Local, userAgentIDs)
+		if err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+				Error("Unable to remove FAST tokens: ", err)
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeWait,
+				Condition: xmppcore.StanzaErrorConditionInternalServerError,
+			})
+			return
+		}
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Infof("FAST tokens revoked: %v", userAgentIDs)
+		srv.sendClientIQResult(cl, iq, nil)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// authenticateFAST authenticates with the token of the device and
+// returns the server's answer.
+func (c *testClient) authenticateFAST(local, token, userAgentID string, count int, fastAttrs string) (*testSASL2Result, string) {
+	c.t.Helper()
+	c.openStream()
+	return c.authenticate2(fastMechanism,
+		append([]byte(local+"\x00"), fastTokenProof(token, "Initiator")...),
+		testUserAgent(userAgentID)+`<fast xmlns='urn:xmpp:fast:0' count='`+strconv.Itoa(count)+`' `+fastAttrs+`/>`+
+			`<bind xmlns='urn:xmpp:bind:0'><tag>phone</tag></bind>`)
+}
+
+func TestFASTTokens(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FASTTokenStorage = "memory"
+	})
+	defer ts.close()
+
+	c := ts.newTestClient(newMemoryTransport(64))
+	c.openStream()
+	result, data := c.authenticate2("PLAIN", []byte("\x00alice\x00secret"), testUserAgent("d1")+
+		`<request-token xmlns='urn:xmpp:fast:0' mechanism='`+fastMechanism+`'/>`+
+		`<bind xmlns='urn:xmpp:bind:0'><tag>phone</tag></bind>`)
+	if result.XMLName.Local != "success" || result.Token == nil || result.Token.Token == "" {
+		t.Fatalf("expected a token, got %s", data)
+	}
+	token := result.Token.Token
+	c.close()
+
+	// Only the hash of the client's proof is kept
+	tokens, err := ts.fastTokenStore.FASTTokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := fastTokenProof(token, "Initiator")
+	if len(tokens) != 1 || tokens[0].UserAgentID != "d1" || tokens[0].Device != "Phone" ||
+		!bytes.Equal(tokens[0].InitiatorHash, fastProofHash(proof)) || bytes.Equal(tokens[0].InitiatorHash, proof) {
+		t.Fatalf("unexpected stored tokens: %+v", tokens)
+	}
+
+	// The token authenticates the device, and the server, and is rotated
+	c = ts.newTestClient(newMemoryTransport(64))
+	result, data = c.authenticateFAST("alice", token, "d1", 1, "")
+	if result.XMLName.Local != "success" || !strings.HasPrefix(c.jid, "alice@localhost/phone.") {
+		t.Fatalf("unexpected answer: %s", data)
+	}
+	responder := base64.StdEncoding.EncodeToString(fastTokenProof(token, "Responder"))
+	if result.AdditionalData != responder || result.Token == nil || result.Token.Token == token {
+		t.Fatalf("expected the server's proof and a new token, got %s", data)
+	}
+	previousToken, token := token, result.Token.Token
+	c.close()
+
+	for _, attempt := range []struct {
+		token, userAgentID string
+		count              int
+	}{
+		// The count can't be replayed
+		{token, "d1", 1},
+		// The token is the device's
+		{token, "d2", 2},
+	} {
+		c = ts.newTestClient(newMemoryTransport(64))
+		result, data = c.authenticateFAST("alice", attempt.token, attempt.userAgentID, attempt.count, "")
+		if result.XMLName.Local != "failure" || result.Condition == nil ||
+			result.Condition.XMLName.Local != "not-authorized" {
+			t.Fatalf("expected a not-authorized failure for %+v, got %s", attempt, data)
+		}
+		c.close()
+	}
+
+	// The previous token is accepted until the new one is used, in case
+	// the client has missed the new one
+	c = ts.newTestClient(newMemoryTransport(64))
+	result, data = c.authenticateFAST("alice", previousToken, "d1", 3, "")
+	responder = base64.StdEncoding.EncodeToString(fastTokenProof(previousToken, "Responder"))
+	if result.XMLName.Local != "success" || result.AdditionalData != responder || result.Token == nil {
+		t.Fatalf("unexpected answer: %s", data)
+	}
+	token = result.Token.Token
+	c.close()
+	c = ts.newTestClient(newMemoryTransport(64))
+	result, data = c.authenticateFAST("alice", token, "d1", 4, "")
+	if result.XMLName.Local != "success" || result.Token == nil {
+		t.Fatalf("unexpected answer: %s", data)
+	}
+	token = result.Token.Token
+	c.close()
+	c = ts.newTestClient(newMemoryTransport(64))
+	if result, data = c.authenticateFAST("alice", previousToken, "d1", 5, ""); result.XMLName.Local != "failure" {
+		t.Fatalf("expected the first token to be gone, got %s", data)
+	}
+	c.close()
+
+	// The client may have its token invalidated
+	c = ts.newTestClient(newMemoryTransport(64))
+	result, data = c.authenticateFAST("alice", token, "d1", 6, "invalidate='true'")
+	if result.XMLName.Local != "success" || result.Token != nil {
+		t.Fatalf("unexpected answer: %s", data)
+	}
+	c.close()
+	if tokens, err = ts.fastTokenStore.FASTTokens("alice"); err != nil || len(tokens) != 0 {
+		t.Fatalf("unexpected stored tokens: %+v %v", tokens, err)
+	}
+}
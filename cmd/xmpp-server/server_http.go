@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// listenHTTP serves the HTTP transports, i.e., WebSocket and BOSH.
+func (srv *Server) listenHTTP() {
+	mux := http.NewServeMux()
+	if srv.webSocketEnabled {
+		mux.HandleFunc(webSocketPath, srv.handleWebSocket)
+	}
+	if srv.boshEnabled {
+		mux.HandleFunc(boshPath, srv.handleBOSH)
+	}
+	httpServer := &http.Server{Handler: mux}
+	err := httpServer.Serve(srv.httpListener)
+	if err != nil && srv.stopState == 0 {
+		log.Error("HTTP listener error: ", err)
+	}
+}
@@ -6,22 +6,148 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/exavolt/go-xmpplib/xmppcore"
-	"github.com/exavolt/go-xmpplib/xmppim"
 )
 
 //TODO: move to xmppim
 
+// RFC 6121 5.2.2
+const (
+	messageTypeNormal    = "normal"
+	messageTypeChat      = "chat"
+	messageTypeGroupchat = "groupchat"
+	messageTypeHeadline  = "headline"
+	messageTypeError     = "error"
+)
+
+// clientMessage is a message stanza as it's routed by the server. Unlike
+// xmppim.ClientMessage, the child elements are kept as-is so that the
+// extension payloads are relayed intact.
+type clientMessage struct {
+	XMLName xml.Name      `xml:"jabber:client message"`
+	ID      string        `xml:"id,attr,omitempty"`
+	Type    string        `xml:"type,attr,omitempty"`
+	From    *xmppcore.JID `xml:"from,attr,omitempty"`
+	To      *xmppcore.JID `xml:"to,attr,omitempty"`
+	Payload []byte        `xml:",innerxml"`
+
+	// noCopy is set if the sender has opted the message out of carbons.
+	noCopy bool
+}
+
+// clientPresence is a presence stanza with its child elements kept as-is.
+type clientPresence struct {
+	XMLName xml.Name      `xml:"jabber:client presence"`
+	ID      string        `xml:"id,attr,omitempty"`
+	Type    string        `xml:"type,attr,omitempty"`
+	From    *xmppcore.JID `xml:"from,attr,omitempty"`
+	To      *xmppcore.JID `xml:"to,attr,omitempty"`
+	Payload []byte        `xml:",innerxml"`
+}
+
 func (srv *Server) handleClientPresence(cl *Client, startElem *xml.StartElement) {
-	var presence xmppim.ClientPresence
+	var presence clientPresence
 	err := cl.xmlDecoder.DecodeElement(&presence, startElem)
 	if err != nil {
 		panic(err)
 	}
+
+	fromJID := cl.jid
+	presence.From = &fromJID
+	if presence.Type == "" {
+		srv.addAvatarHash(cl, &presence)
+	}
+
+	if presence.To != nil && !presence.To.IsEmpty() {
+		// Directed presence. Leaving a room is allowed even if the user
+		// has blocked it.
+		if srv.isBlocked(cl.jid.Local, *presence.To) &&
+			!(presence.Type == "unavailable" && presence.To.Domain == srv.groupsDomain) {
+			return
+		}
+		if srv.mucEnabled() && presence.To.Domain == srv.groupsDomain {
+			srv.handleMUCPresence(cl, &presence)
+			return
+		}
+		srv.routePresence(&presence)
+		return
+	}
+
+	switch presence.Type {
+	case "":
+		initial := !cl.setPresence(&presence)
+		srv.broadcastPresence(cl, &presence)
+		srv.handleClientCaps(cl, &presence)
+		if initial {
+			// RFC 6121 4.3: the presence of the user's other resources
+			for _, ucl := range srv.userClients(cl.jid.Local) {
+				if ucl == cl {
+					continue
+				}
+				if uclPresence := ucl.availablePresence(); uclPresence != nil {
+					srv.deliverPresence(cl, uclPresence)
+				}
+			}
+			if !cl.flexibleOffline {
+				srv.deliverOfflineMessages(cl)
+			}
+		}
+	case "unavailable":
+		cl.setPresence(nil)
+		srv.broadcastPresence(cl, &presence)
+		srv.leaveMUCRooms(cl)
+	}
+}
+
+// broadcastPresence sends the client's presence to the user's available
+// resources.
+func (srv *Server) broadcastPresence(cl *Client, presence *clientPresence) {
 	//TODO: broadcast to those subscribed
+	for _, ucl := range srv.userClients(cl.jid.Local) {
+		if ucl.isAvailable() {
+			srv.deliverPresence(ucl, presence)
+		}
+	}
+}
+
+// routePresence delivers a directed presence.
+func (srv *Server) routePresence(presence *clientPresence) {
+	toJID := presence.To
+	if toJID.Domain != srv.jid.Domain || toJID.Local == "" {
+		//TODO: s2s and the components
+		return
+	}
+	if srv.isBlocked(toJID.Local, *presence.From) {
+		return
+	}
+	if presence.Type == "probe" {
+		//TODO: answer on behalf of the contact once there are subscriptions
+		return
+	}
+	if toJID.Resource != "" {
+		if rcl := srv.authenticatedClient(toJID.Local, toJID.Resource); rcl != nil {
+			srv.deliverPresence(rcl, presence)
+		}
+		return
+	}
+	for _, rcl := range srv.userClients(toJID.Local) {
+		if rcl.isAvailable() {
+			srv.deliverPresence(rcl, presence)
+		}
+	}
+}
+
+func (srv *Server) deliverPresence(rcl *Client, presence *clientPresence) {
+	presenceXML, err := xml.Marshal(presence)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": rcl.streamID, "jid": rcl.jid, "stanza": presence.ID}).
+			Warn("Unable to send a presence into a recipient")
+		return
+	}
+	rcl.writePresence(presence, presenceXML)
 }
 
 func (srv *Server) handleClientMessage(cl *Client, startElem *xml.StartElement) {
-	var incoming xmppim.ClientMessage
+	var incoming clientMessage
 	//NOTE:SEC: decoding the whole element might not the best practice
 	// because it could be cause DoS.
 	// generally we want to stream the child elements or limit the
@@ -31,74 +157,208 @@ func (srv *Server) handleClientMessage(cl *Client, startElem *xml.StartElement)
 		panic(err)
 	}
 
+	// RFC 6121 5.2.2: a message with no type or with a type we don't
+	// understand is a normal message.
+	switch incoming.Type {
+	case messageTypeNormal, messageTypeChat, messageTypeGroupchat,
+		messageTypeHeadline, messageTypeError:
+	default:
+		incoming.Type = messageTypeNormal
+	}
+
+	// RFC 6120 8.1.2.1: the server stamps the full JID of the sender.
+	fromJID := cl.jid
+	incoming.From = &fromJID
+
+	// RFC 6120 10.3.1: a stanza without 'to' is handled as if it was
+	// addressed to the bare JID of the sender.
 	if incoming.To == nil || incoming.To.IsEmpty() {
-		//TODO: skip the whole stanza
-		return //TODO: tell the client
+		incoming.To = cl.jid.BareCopyPtr()
+	}
+
+	if srv.isBlocked(cl.jid.Local, *incoming.To) {
+		srv.sendMessageBlockedError(cl, &incoming)
+		return
 	}
 
-	// We should parse the child elements. For now, let's just
-	// relay them as-is.
+	markPrivateMessage(&incoming)
+	srv.archiveOutboundMessage(&incoming)
+	srv.sendSentCarbons(cl, &incoming)
+	srv.routeMessage(&incoming)
+}
 
-	//TODO: this is inefficient. probably we want channels here.
-	srv.clientsMutex.RLock()
-	defer srv.clientsMutex.RUnlock()
+// routeMessage delivers a message according to the rules in RFC 6121
+// section 8. Undeliverable messages are bounced to the sender where the
+// spec calls for it.
+func (srv *Server) routeMessage(msg *clientMessage) {
+	toJID := msg.To
 
-	recipientResources := srv.authenticatedClients[incoming.To.Local]
-	if len(recipientResources) == 0 {
+	if srv.pubsubServiceEnabled() && toJID.Domain == srv.pubsubDomain {
+		srv.handlePubSubServiceMessage(msg)
 		return
 	}
 
-	fromJID := cl.jid.BareCopyPtr() //TODO: optional, bare or full (check the spec)
+	if srv.mucEnabled() && toJID.Domain == srv.groupsDomain {
+		srv.handleMUCMessage(msg)
+		return
+	}
 
-	if incoming.To.Resource == "" {
-		for _, rcl := range recipientResources {
-			outgoing := xmppim.ClientMessage{
-				ClientMessageAttributes: xmppim.ClientMessageAttributes{
-					StanzaCommonAttributes: xmppcore.StanzaCommonAttributes{
-						ID:   incoming.ID,
-						To:   &rcl.jid,
-						From: fromJID,
-					},
-					Type: incoming.Type,
-				},
-				Error:   incoming.Error,
-				Body:    incoming.Body,
-				Subject: incoming.Subject,
-				Thread:  incoming.Thread,
-			}
-			msgXML, err := xml.Marshal(&outgoing)
-			if err != nil {
-				log.WithFields(logrus.Fields{"stream": rcl.streamID, "jid": rcl.jid, "stanza": incoming.ID}).
-					Warn("Unable to send a message into a recipient")
-				continue
-			}
-			rcl.conn.Write(msgXML)
+	if toJID.Domain != srv.jid.Domain {
+		//TODO: s2s and the components
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionRemoteServerNotFound,
+		})
+		return
+	}
+
+	if toJID.Local == "" {
+		// Addressed to the server itself (RFC 6120 10.3.3). There's no
+		// resource of the server which could handle a message.
+		if toJID.Resource != "" {
+			srv.bounceMessage(msg, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionItemNotFound,
+			})
+			return
 		}
-	} else {
-		rcl := recipientResources[incoming.To.Resource]
-		if rcl == nil {
+		if msg.Type == messageTypeHeadline {
 			return
 		}
-		outgoing := xmppim.ClientMessage{
-			ClientMessageAttributes: xmppim.ClientMessageAttributes{
-				StanzaCommonAttributes: xmppcore.StanzaCommonAttributes{
-					ID:   incoming.ID,
-					To:   &rcl.jid,
-					From: fromJID,
-				},
-				Type: incoming.Type,
-			},
-			Error:   incoming.Error,
-			Body:    incoming.Body,
-			Subject: incoming.Subject,
-			Thread:  incoming.Thread,
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	}
+
+	if srv.isBlocked(toJID.Local, *msg.From) {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	}
+
+	if msg.Type == messageTypeChat || msg.Type == messageTypeNormal {
+		srv.archiveInboundMessage(msg)
+	}
+
+	// RFC 6121 8.5.3
+	if toJID.Resource != "" {
+		if rcl := srv.authenticatedClient(toJID.Local, toJID.Resource); rcl != nil {
+			srv.deliverMessage(rcl, msg)
+			srv.sendReceivedCarbons(rcl, msg)
+			return
+		}
+		// RFC 6121 8.5.3.2.1
+		switch msg.Type {
+		case messageTypeNormal, messageTypeChat:
+			// Treat it as if it was addressed to the bare JID
+		case messageTypeGroupchat:
+			srv.bounceMessage(msg, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+			})
+			return
+		default:
+			// Headline and error are silently ignored
+			return
+		}
+	}
+
+	// RFC 6121 8.5.2
+	var recipients []*Client
+	for _, rcl := range srv.userClients(toJID.Local) {
+		if rcl.isAvailable() {
+			recipients = append(recipients, rcl)
+		}
+	}
+	switch msg.Type {
+	case messageTypeError:
+		return
+	case messageTypeGroupchat:
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	case messageTypeHeadline:
+		for _, rcl := range recipients {
+			srv.deliverMessage(rcl, msg)
+		}
+		return
+	}
+
+	if len(recipients) == 0 {
+		// XEP-0160: messages without body, e.g., chat states, are not
+		// worth storing.
+		if !messageHasBody(msg) {
+			return
 		}
-		msgXML, err := xml.Marshal(&outgoing)
-		if err != nil {
-			log.WithFields(logrus.Fields{"stream": rcl.streamID, "jid": rcl.jid, "stanza": incoming.ID}).
-				Warn("Unable to send a message into a recipient")
+		if srv.storeOfflineMessage(msg) {
 			return
 		}
-		rcl.conn.Write(msgXML)
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
 	}
+	//TODO: only those with the highest non-negative priority
+	for _, rcl := range recipients {
+		srv.deliverMessage(rcl, msg)
+	}
+}
+
+// deliverMessage writes the message to the recipient's stream. It returns
+// false if the message has been discarded, see writeStanza.
+func (srv *Server) deliverMessage(rcl *Client, msg *clientMessage) bool {
+	msgXML, err := xml.Marshal(msg)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": rcl.streamID, "jid": rcl.jid, "stanza": msg.ID}).
+			Warn("Unable to send a message into a recipient")
+		return false
+	}
+	return rcl.writeMessage(msg, msgXML)
+}
+
+// bounceMessage returns the message to its sender as an error. Errors are
+// never bounced to prevent loops.
+func (srv *Server) bounceMessage(msg *clientMessage, stanzaError xmppcore.StanzaError) {
+	if msg.Type == messageTypeError || msg.From == nil || msg.From.IsEmpty() {
+		return
+	}
+	errorXML, err := xml.Marshal(&stanzaError)
+	if err != nil {
+		panic(err)
+	}
+	payload := make([]byte, 0, len(msg.Payload)+len(errorXML))
+	payload = append(payload, msg.Payload...)
+	payload = append(payload, errorXML...)
+	srv.routeMessage(&clientMessage{
+		ID:      msg.ID,
+		Type:    messageTypeError,
+		From:    msg.To,
+		To:      msg.From,
+		Payload: payload,
+	})
+}
+
+// rosterHasContact reports whether the contact is in the user's roster.
+func (srv *Server) rosterHasContact(local string, contact xmppcore.JID) bool {
+	//TODO: there's no roster storage yet
+	return false
+}
+
+// rosterLocalContacts returns the local parts of the users of this
+// server who are in the user's roster.
+func (srv *Server) rosterLocalContacts(local string) []string {
+	//TODO: there's no roster storage yet
+	return nil
+}
+
+func messageHasBody(msg *clientMessage) bool {
+	return xmlPayloadHasElement(msg.Payload, "", "body") ||
+		xmlPayloadHasElement(msg.Payload, xmppcore.JabberClientNS, "body")
 }
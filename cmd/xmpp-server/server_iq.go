@@ -10,7 +10,6 @@ import (
 	"github.com/exavolt/go-xmpplib/xmppim"
 	"github.com/exavolt/go-xmpplib/xmppping"
 	"github.com/exavolt/go-xmpplib/xmppvcard"
-	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,16 +24,92 @@ func (srv *Server) handleClientIQ(cl *Client, startElem *xml.StartElement) {
 		panic(err)
 	}
 
+	if iq.To != nil && srv.pubsubServiceEnabled() && iq.To.Domain == srv.pubsubDomain {
+		srv.handleClientPubSubServiceIQ(cl, &iq)
+		return
+	}
+
+	if iq.To != nil && srv.mucEnabled() && iq.To.Domain == srv.groupsDomain {
+		srv.handleClientMUCIQ(cl, &iq)
+		return
+	}
+
+	if iq.To != nil && iq.To.Local != "" && iq.To.Domain == srv.jid.Domain &&
+		!iq.To.Equals(*cl.jid.BareCopyPtr()) {
+		if srv.routeClientIQ(cl, &iq) {
+			return
+		}
+	}
+
 	switch iq.Type {
 	case xmppcore.IQTypeSet:
 		srv.handleClientIQSet(cl, &iq)
 	case xmppcore.IQTypeGet:
 		srv.handleClientIQGet(cl, &iq)
+	case xmppcore.IQTypeResult, xmppcore.IQTypeError:
+		srv.handleClientIQResponse(cl, &iq)
 	default:
 		panic(iq.Type)
 	}
 }
 
+// routeClientIQ handles an IQ addressed to another user or to another
+// resource of the same user. It returns false if the IQ is addressed to
+// the bare JID of another user and should be answered by the server on
+// behalf of the user.
+func (srv *Server) routeClientIQ(cl *Client, iq *xmppcore.ClientIQ) bool {
+	isRequest := iq.Type == xmppcore.IQTypeGet || iq.Type == xmppcore.IQTypeSet
+
+	if srv.isBlocked(cl.jid.Local, *iq.To) {
+		if isRequest {
+			resultXML, err := xml.Marshal(xmppcore.ClientIQ{
+				ID:      iq.ID,
+				Type:    xmppcore.IQTypeError,
+				From:    iq.To,
+				To:      &cl.jid,
+				Payload: []byte(blockedStanzaErrorXML),
+			})
+			if err != nil {
+				panic(err)
+			}
+			cl.writeStanza(resultXML)
+		}
+		return true
+	}
+	if srv.isBlocked(iq.To.Local, cl.jid) {
+		if isRequest {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+			})
+		}
+		return true
+	}
+
+	if iq.To.Resource == "" {
+		return false
+	}
+
+	rcl := srv.authenticatedClient(iq.To.Local, iq.To.Resource)
+	if rcl == nil {
+		if isRequest {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+			})
+		}
+		return true
+	}
+	fromJID := cl.jid
+	iq.From = &fromJID
+	iqXML, err := xml.Marshal(iq)
+	if err != nil {
+		panic(err)
+	}
+	rcl.writeStanza(iqXML)
+	return true
+}
+
 func (srv *Server) handleClientIQSet(cl *Client, iq *xmppcore.ClientIQ) {
 	// Only one payload
 	reader := bytes.NewReader(iq.Payload)
@@ -66,8 +141,43 @@ func (srv *Server) handleClientIQSet(cl *Client, iq *xmppcore.ClientIQ) {
 	case xmppcore.SessionSessionElementName:
 		element = &xmppcore.SessionIQSet{}
 	case xmppvcard.ElementName:
-		element = &xmppvcard.IQSet{}
-	default:
+		if srv.vCardStore != nil {
+			element = &xmppvcard.IQSet{}
+		}
+	case OfflineOfflineElementName:
+		if srv.flexibleOfflineEnabled() {
+			element = &OfflineQuery{}
+		}
+	case MAMQueryElementName:
+		if srv.messageArchiveStore != nil {
+			element = &MAMQuery{}
+		}
+	case MAMPrefsElementName:
+		if srv.messageArchiveStore != nil {
+			element = &MAMPrefs{}
+		}
+	case CarbonsEnableElementName:
+		element = &CarbonsEnable{}
+	case CarbonsDisableElementName:
+		element = &CarbonsDisable{}
+	case BlockingBlockElementName:
+		if srv.blocklistStore != nil {
+			element = &BlockingBlock{}
+		}
+	case BlockingUnblockElementName:
+		if srv.blocklistStore != nil {
+			element = &BlockingUnblock{}
+		}
+	case PubSubPubSubElementName:
+		if srv.pepEnabled() {
+			element = &PubSub{}
+		}
+	case FASTDevicesRevokeElementName:
+		if srv.fastTokenStore != nil {
+			element = &FASTDevicesRevoke{}
+		}
+	}
+	if element == nil {
 		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
 			Warnf("Unrecognized IQ Set: %s", startElem.Name)
 		decoder.Skip()
@@ -88,7 +198,7 @@ func (srv *Server) handleClientIQSet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 		return
 	}
 
@@ -98,57 +208,36 @@ func (srv *Server) handleClientIQSet(cl *Client, iq *xmppcore.ClientIQ) {
 	}
 
 	switch payload := element.(type) {
+	case *OfflineQuery:
+		srv.handleClientOfflineIQ(cl, iq, payload)
+		return
+	case *MAMQuery:
+		srv.handleClientMAMQuery(cl, iq, payload)
+		return
+	case *MAMPrefs:
+		srv.handleClientMAMPrefs(cl, iq, payload)
+		return
+	case *BlockingBlocklist, *BlockingBlock, *BlockingUnblock:
+		srv.handleClientBlockingIQ(cl, iq, payload)
+		return
+	case *PubSub:
+		srv.handleClientPEPIQ(cl, iq, payload)
+		return
+	case *FASTDevicesQuery, *FASTDevicesRevoke:
+		srv.handleClientFASTDevicesIQ(cl, iq, payload)
+		return
+	case *CarbonsEnable:
+		srv.handleClientCarbonsIQ(cl, iq, true)
+		return
+	case *CarbonsDisable:
+		srv.handleClientCarbonsIQ(cl, iq, false)
+		return
 	case *xmppcore.BindIQSet:
-		if payload.Resource == "" {
-			if cl.jid.Resource == "" {
-				cl.jid.Resource = uuid.New().String()
-			}
-		} else {
-			if cl.jid.Resource != "" {
-				if cl.jid.Resource != payload.Resource {
-					errorXML, err := xml.Marshal(xmppcore.StanzaError{
-						Type:      xmppcore.StanzaErrorTypeModify,
-						Condition: xmppcore.StanzaErrorConditionNotAcceptable,
-					})
-					if err != nil {
-						panic(err)
-					}
-					resultXML, err := xml.Marshal(xmppcore.ClientIQ{
-						ID:      iq.ID,
-						Type:    xmppcore.IQTypeError,
-						From:    &srv.jid,
-						To:      &cl.jid,
-						Payload: errorXML,
-					})
-					if err != nil {
-						panic(err)
-					}
-					cl.conn.Write(resultXML)
-					return
-				}
-			}
-			cl.jid.Resource = payload.Resource
-		}
-
-		cl.resourceBound = true
-		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
-			Info("Bound!")
-
-		resultPayloadXML, err := xml.Marshal(&xmppcore.BindIQResult{
-			JID: &cl.jid,
-		})
-		if err != nil {
-			panic(err)
-		}
-		resultXML, err := xml.Marshal(&xmppcore.ClientIQ{
-			ID:      iq.ID,
-			Type:    xmppcore.IQTypeResult,
-			Payload: resultPayloadXML,
+		// Binding more than one resource per stream is not supported
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionNotAllowed,
 		})
-		if err != nil {
-			panic(err)
-		}
-		cl.conn.Write(resultXML)
 		return
 	case *xmppcore.SessionIQSet:
 		resultXML, err := xml.Marshal(&xmppcore.ClientIQ{
@@ -160,20 +249,10 @@ func (srv *Server) handleClientIQSet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 		return
 	case *xmppvcard.IQSet:
-		//TODO: save the vCard
-		resultXML, err := xml.Marshal(&xmppcore.ClientIQ{
-			ID:   iq.ID,
-			Type: xmppcore.IQTypeResult,
-			From: &srv.jid,
-			To:   &cl.jid,
-		})
-		if err != nil {
-			panic(err)
-		}
-		cl.conn.Write(resultXML)
+		srv.handleClientVCardIQSet(cl, iq)
 		return
 	}
 
@@ -198,7 +277,7 @@ func (srv *Server) handleClientIQSet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 	}
 }
 
@@ -233,7 +312,7 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write([]byte(string(errorXML) + "\n</stream:stream>\n"))
+		cl.write([]byte(string(errorXML) + "\n</stream:stream>\n"))
 		//TODO: close connection, etc.
 		return
 	}
@@ -258,7 +337,7 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 		return
 	}
 
@@ -267,16 +346,43 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 	var element interface{}
 	switch startElem.Name.Space + " " + startElem.Name.Local {
 	case xmppdisco.InfoQueryElementName:
-		element = &xmppdisco.InfoIQGet{}
+		element = &DiscoInfo{}
 	case xmppdisco.ItemsQueryElementName:
-		element = &xmppdisco.ItemsIQGet{}
+		element = &DiscoItems{}
 	case xmppvcard.ElementName:
-		element = &xmppvcard.IQGet{}
+		if srv.vCardStore != nil {
+			element = &xmppvcard.IQGet{}
+		}
 	case xmppim.RosterQueryElementName:
 		element = &xmppim.RosterIQGet{}
 	case xmppping.ElementName:
 		element = &xmppping.IQGet{}
-	default:
+	case OfflineOfflineElementName:
+		if srv.flexibleOfflineEnabled() {
+			element = &OfflineQuery{}
+		}
+	case MAMQueryElementName:
+		if srv.messageArchiveStore != nil {
+			element = &MAMQuery{}
+		}
+	case MAMPrefsElementName:
+		if srv.messageArchiveStore != nil {
+			element = &MAMPrefs{}
+		}
+	case BlockingBlocklistElementName:
+		if srv.blocklistStore != nil {
+			element = &BlockingBlocklist{}
+		}
+	case PubSubPubSubElementName:
+		if srv.pepEnabled() {
+			element = &PubSub{}
+		}
+	case FASTDevicesQueryElementName:
+		if srv.fastTokenStore != nil {
+			element = &FASTDevicesQuery{}
+		}
+	}
+	if element == nil {
 		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
 			Warnf("Unrecognized IQ Get: %s", startElem.Name)
 		decoder.Skip()
@@ -297,7 +403,7 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 		return
 	}
 
@@ -306,74 +412,33 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		panic(err)
 	}
 
-	switch element.(type) {
-	case *xmppdisco.InfoIQGet:
-		//TODO: check the target resource etc.
-		if iq.To != nil && iq.To.Equals(srv.jid) {
-			queryResultXML, err := xml.Marshal(xmppdisco.InfoIQResult{
-				Identity: []xmppdisco.Identity{
-					{Category: xmppdisco.IdentityCategoryServer, Type: "im", Name: "go-xmpp-server"},
-				},
-				Feature: []xmppdisco.Feature{
-					{Var: "iq"},
-				},
-			})
-			if err != nil {
-				panic(err)
-			}
-			resultXML, err := xml.Marshal(xmppcore.ClientIQ{
-				ID:      iq.ID,
-				Type:    xmppcore.IQTypeResult,
-				From:    &srv.jid,
-				To:      &cl.jid,
-				Payload: queryResultXML,
-			})
-			if err != nil {
-				panic(err)
-			}
-			cl.conn.Write(resultXML)
-			return
-		}
-		panic("TODO: target resource")
-	case *xmppdisco.ItemsIQGet:
-		//TODO: check the target resource etc.
-		//TODO: conference, pubsub, etc.
-		if iq.To != nil && iq.To.Equals(srv.jid) {
-			queryResultXML, err := xml.Marshal(xmppdisco.ItemsIQResult{})
-			if err != nil {
-				panic(err)
-			}
-			resultXML, err := xml.Marshal(xmppcore.ClientIQ{
-				ID:      iq.ID,
-				Type:    xmppcore.IQTypeResult,
-				From:    &srv.jid,
-				To:      &cl.jid,
-				Payload: queryResultXML,
-			})
-			if err != nil {
-				panic(err)
-			}
-			cl.conn.Write(resultXML)
-			return
-		}
-		panic("TODO: target resource")
+	switch payload := element.(type) {
+	case *OfflineQuery:
+		srv.handleClientOfflineIQ(cl, iq, payload)
+		return
+	case *MAMQuery:
+		srv.handleClientMAMQuery(cl, iq, payload)
+		return
+	case *MAMPrefs:
+		srv.handleClientMAMPrefs(cl, iq, payload)
+		return
+	case *BlockingBlocklist, *BlockingBlock, *BlockingUnblock:
+		srv.handleClientBlockingIQ(cl, iq, payload)
+		return
+	case *PubSub:
+		srv.handleClientPEPIQ(cl, iq, payload)
+		return
+	case *FASTDevicesQuery, *FASTDevicesRevoke:
+		srv.handleClientFASTDevicesIQ(cl, iq, payload)
+		return
+	case *DiscoInfo:
+		srv.handleClientDiscoInfo(cl, iq, payload.Node)
+		return
+	case *DiscoItems:
+		srv.handleClientDiscoItems(cl, iq, payload.Node)
+		return
 	case *xmppvcard.IQGet:
-		//TODO: check `from` etc.
-		resultPayloadXML, err := xml.Marshal(xmppvcard.IQResult{})
-		if err != nil {
-			panic(err)
-		}
-		resultXML, err := xml.Marshal(xmppcore.ClientIQ{
-			ID:      iq.ID,
-			Type:    xmppcore.IQTypeResult,
-			From:    &srv.jid,
-			To:      &cl.jid,
-			Payload: resultPayloadXML,
-		})
-		if err != nil {
-			panic(err)
-		}
-		cl.conn.Write(resultXML)
+		srv.handleClientVCardIQGet(cl, iq)
 		return
 	case *xmppim.RosterIQGet:
 		if iq.To != nil && !iq.To.IsEmpty() {
@@ -393,10 +458,11 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 		return
 	case *xmppping.IQGet:
-		//TODO: support various cases (s2c, c2s, s2s, ...)
+		// The server pings the clients in server_ping.go
+		//TODO: s2s
 		resultXML, err := xml.Marshal(xmppcore.ClientIQ{
 			ID:   iq.ID,
 			Type: xmppcore.IQTypeResult,
@@ -406,7 +472,7 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
 		return
 	}
 
@@ -431,6 +497,163 @@ func (srv *Server) handleClientIQGet(cl *Client, iq *xmppcore.ClientIQ) {
 		if err != nil {
 			panic(err)
 		}
-		cl.conn.Write(resultXML)
+		cl.writeStanza(resultXML)
+	}
+}
+
+// sendClientIQResult sends the result of the IQ. The payload could be
+// nil, the raw XML or a value to be marshalled.
+func (srv *Server) sendClientIQResult(cl *Client, iq *xmppcore.ClientIQ, payload interface{}) {
+	var payloadXML []byte
+	switch payload := payload.(type) {
+	case nil:
+	case []byte:
+		payloadXML = payload
+	default:
+		var err error
+		payloadXML, err = xml.Marshal(payload)
+		if err != nil {
+			panic(err)
+		}
+	}
+	resultXML, err := xml.Marshal(xmppcore.ClientIQ{
+		ID:      iq.ID,
+		Type:    xmppcore.IQTypeResult,
+		From:    iq.To,
+		To:      &cl.jid,
+		Payload: payloadXML,
+	})
+	if err != nil {
+		panic(err)
+	}
+	cl.writeStanza(resultXML)
+}
+
+func (srv *Server) sendClientIQError(cl *Client, iq *xmppcore.ClientIQ, stanzaError xmppcore.StanzaError) {
+	errorXML, err := xml.Marshal(&stanzaError)
+	if err != nil {
+		panic(err)
+	}
+	resultXML, err := xml.Marshal(xmppcore.ClientIQ{
+		ID:      iq.ID,
+		Type:    xmppcore.IQTypeError,
+		From:    iq.To,
+		To:      &cl.jid,
+		Payload: errorXML,
+	})
+	if err != nil {
+		panic(err)
+	}
+	cl.writeStanza(resultXML)
+}
+
+// sendClientIQErrorXML sends an error with the raw error element, e.g.,
+// one with an application-specific condition.
+func (srv *Server) sendClientIQErrorXML(cl *Client, iq *xmppcore.ClientIQ, errorXML []byte) {
+	resultXML, err := xml.Marshal(xmppcore.ClientIQ{
+		ID:      iq.ID,
+		Type:    xmppcore.IQTypeError,
+		From:    iq.To,
+		To:      &cl.jid,
+		Payload: errorXML,
+	})
+	if err != nil {
+		panic(err)
+	}
+	cl.writeStanza(resultXML)
+}
+
+// sendClientIQRequest sends a server-initiated request to the client.
+// The callback is called with the client's response.
+func (srv *Server) sendClientIQRequest(cl *Client, iq *xmppcore.ClientIQ, callback func(*xmppcore.ClientIQ)) {
+	iq.ID = generateID()
+	if iq.From == nil {
+		iq.From = &srv.jid
+	}
+	toJID := cl.jid
+	iq.To = &toJID
+	iqXML, err := xml.Marshal(iq)
+	if err != nil {
+		panic(err)
+	}
+	cl.pendingIQsMutex.Lock()
+	if cl.pendingIQs == nil {
+		cl.pendingIQs = make(map[string]func(*xmppcore.ClientIQ))
+	}
+	cl.pendingIQs[iq.ID] = callback
+	cl.pendingIQsMutex.Unlock()
+	cl.writeStanza(iqXML)
+}
+
+// handleClientIQResponse passes the response to the server-initiated
+// request.
+func (srv *Server) handleClientIQResponse(cl *Client, iq *xmppcore.ClientIQ) {
+	cl.pendingIQsMutex.Lock()
+	callback := cl.pendingIQs[iq.ID]
+	delete(cl.pendingIQs, iq.ID)
+	cl.pendingIQsMutex.Unlock()
+	if callback == nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Debugf("Unexpected IQ %s", iq.Type)
+		return
+	}
+	callback(iq)
+}
+
+// decodeClientIQPayload decodes the only child element of the IQ into
+// the value returned by newElement for the element's name, which is the
+// namespace and the local name separated by a space. It sends the error
+// and returns nil if the element is not recognized or the payload is
+// invalid.
+func (srv *Server) decodeClientIQPayload(
+	cl *Client, iq *xmppcore.ClientIQ, newElement func(name string) interface{},
+) interface{} {
+	decoder := xml.NewDecoder(bytes.NewReader(iq.Payload))
+	var startElem *xml.StartElement
+	for startElem == nil {
+		token, err := decoder.Token()
+		if err != nil {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionBadRequest,
+			})
+			return nil
+		}
+		if elem, ok := token.(xml.StartElement); ok {
+			startElem = &elem
+		}
+	}
+
+	element := newElement(startElem.Name.Space + " " + startElem.Name.Local)
+	if element == nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Warnf("Unrecognized IQ %s to %s: %s", iq.Type, iq.To, startElem.Name)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionFeatureNotImplemented,
+		})
+		return nil
+	}
+	if err := decoder.DecodeElement(element, startElem); err != nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return nil
+	}
+	// An IQ stanza of type "get" or "set" MUST contain exactly
+	// one child element.
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return element
+		}
+		if _, ok := token.(xml.StartElement); ok || err != nil {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionBadRequest,
+			})
+			return nil
+		}
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppim"
+	"github.com/sirupsen/logrus"
+)
+
+// connIP returns the remote IP address of the connection.
+func connIP(transport clientTransport) string {
+	addr := transport.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// admitConnection counts the new connection in. It returns the stream
+// error condition if the connection is over one of the limits.
+func (srv *Server) admitConnection(transport clientTransport) string {
+	if srv.maxNegotiatingConns > 0 {
+		srv.clientsMutex.RLock()
+		negotiating := len(srv.negotiatingClients)
+		srv.clientsMutex.RUnlock()
+		if negotiating >= srv.maxNegotiatingConns {
+			return "resource-constraint"
+		}
+	}
+	ip := connIP(transport)
+	srv.connCountMutex.Lock()
+	defer srv.connCountMutex.Unlock()
+	if srv.maxConns > 0 && srv.connCount >= srv.maxConns {
+		return "resource-constraint"
+	}
+	if srv.maxConnsPerIP > 0 && srv.connCountByIP[ip] >= srv.maxConnsPerIP {
+		return "policy-violation"
+	}
+	srv.connCount++
+	srv.connCountByIP[ip]++
+	return ""
+}
+
+// releaseConnection counts out a connection admitted by
+// admitConnection.
+func (srv *Server) releaseConnection(transport clientTransport) {
+	ip := connIP(transport)
+	srv.connCountMutex.Lock()
+	defer srv.connCountMutex.Unlock()
+	srv.connCount--
+	if srv.connCountByIP[ip] <= 1 {
+		delete(srv.connCountByIP, ip)
+	} else {
+		srv.connCountByIP[ip]--
+	}
+}
+
+// rejectConnection opens the stream only to send the error then closes
+// the connection (RFC 6120 4.9.1.1).
+func (srv *Server) rejectConnection(transport clientTransport, condition string) {
+	defer transport.Close()
+	log.WithFields(logrus.Fields{"remote": transport.RemoteAddr().String()}).
+		Warn("Connection rejected: ", condition)
+	transport.SetWriteDeadline(time.Now().Add(srv.clientWriteTimeout))
+	transport.Write([]byte(fmt.Sprintf(xml.Header+
+		"<stream:stream from='%s' xmlns='%s'"+
+		" xmlns:stream='%s' version='1.0'>"+
+		"<stream:error><%s xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>"+
+		"</stream:stream>",
+		xmlEscapeString(srv.jid.FullString()), xmppcore.JabberClientNS,
+		xmppcore.JabberStreamsNS, condition)))
+}
+
+// userClass returns the rate limiting class of the user.
+func (srv *Server) userClass(local string) string {
+	if class := srv.userClasses[local]; class != "" {
+		return class
+	}
+	return UserClassNormal
+}
+
+// newSessionLimiter returns nil if the user's class is not limited.
+func (srv *Server) newSessionLimiter(local string) *sessionLimiter {
+	limits, ok := srv.rateLimits[srv.userClass(local)]
+	if !ok {
+		return nil
+	}
+	srv.accountLimitersMutex.Lock()
+	account := srv.accountLimiters[local]
+	if account == nil {
+		account = &accountLimiter{
+			stanzas: newTokenBucket(limits.AccountStanzas),
+			bytes:   newTokenBucket(limits.AccountBytes),
+		}
+		srv.accountLimiters[local] = account
+	}
+	account.sessions++
+	srv.accountLimitersMutex.Unlock()
+	return &sessionLimiter{
+		local:   local,
+		stanzas: newTokenBucket(limits.SessionStanzas),
+		bytes:   newTokenBucket(limits.SessionBytes),
+		account: account,
+	}
+}
+
+// releaseSessionLimiter forgets the account's limiter along with its
+// last session.
+func (srv *Server) releaseSessionLimiter(limiter *sessionLimiter) {
+	srv.accountLimitersMutex.Lock()
+	defer srv.accountLimitersMutex.Unlock()
+	limiter.account.sessions--
+	if limiter.account.sessions <= 0 && srv.accountLimiters[limiter.local] == limiter.account {
+		delete(srv.accountLimiters, limiter.local)
+	}
+}
+
+// throttleClientRead slows down the reads of the client which is over
+// its byte rate. It returns false if the client is too far over it.
+func (srv *Server) throttleClientRead(cl *Client, n int) bool {
+	if cl.limiter == nil {
+		return true
+	}
+	delay, ok := cl.limiter.reserveBytes(n)
+	if !ok {
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// limitTransportReads applies the session's byte rate to the reads of
+// the transport if it reads from the connection ahead of the elements.
+func limitTransportReads(transport clientTransport, limiter *sessionLimiter) {
+	if t, ok := transport.(readLimitedTransport); ok && limiter != nil {
+		t.SetReadLimiter(limiter)
+	}
+}
+
+// throttleClientStanza slows down the client which is over its stanza
+// rate. It returns false if the client is too far over it and the
+// stanza has to be rejected.
+func (srv *Server) throttleClientStanza(cl *Client) bool {
+	if cl.limiter == nil {
+		return true
+	}
+	delay, ok := cl.limiter.reserveStanza()
+	if !ok {
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// rejectClientStanza answers the stanza with the error without
+// processing it. Presences are dropped.
+func (srv *Server) rejectClientStanza(cl *Client, startElem *xml.StartElement, stanzaErr xmppcore.StanzaError) {
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Info("Stanza rejected: ", stanzaErr.Condition)
+	switch startElem.Name.Space + " " + startElem.Name.Local {
+	case xmppcore.ClientIQElementName:
+		var iq xmppcore.ClientIQ
+		err := cl.xmlDecoder.DecodeElement(&iq, startElem)
+		if err != nil {
+			panic(err)
+		}
+		if iq.Type == xmppcore.IQTypeGet || iq.Type == xmppcore.IQTypeSet {
+			srv.sendClientIQError(cl, &iq, stanzaErr)
+		}
+	case xmppim.ClientMessageElementName:
+		var msg clientMessage
+		err := cl.xmlDecoder.DecodeElement(&msg, startElem)
+		if err != nil {
+			panic(err)
+		}
+		if msg.Type == messageTypeError {
+			return
+		}
+		// Sent back directly as the client might not be routable yet
+		errorXML, err := xml.Marshal(&stanzaErr)
+		if err != nil {
+			panic(err)
+		}
+		toJID := cl.jid
+		srv.deliverMessage(cl, &clientMessage{
+			ID:      msg.ID,
+			Type:    messageTypeError,
+			From:    msg.To,
+			To:      &toJID,
+			Payload: append(msg.Payload, errorXML...),
+		})
+	default:
+		cl.xmlDecoder.Skip()
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendTestPings sends n pings, with the ids prefixed with the prefix,
+// without waiting for the responses. It returns false if the transport
+// is closed. Unlike send, it may be called from another goroutine.
+func (c *testClient) sendTestPings(prefix string, n int) bool {
+	for i := 0; i < n; i++ {
+		pingXML := `<iq type='get' id='` + prefix + strconv.Itoa(i) + `' to='localhost'><ping xmlns='urn:xmpp:ping'/></iq>`
+		if !c.transport.Send([]byte(pingXML)) {
+			return false
+		}
+	}
+	return true
+}
+
+// receiveTestPongs receives the responses to the n pings and returns the
+// number of those which are resource-constraint errors.
+func (c *testClient) receiveTestPongs(n int) int {
+	c.t.Helper()
+	rejected := 0
+	for received := 0; received < n; {
+		data := c.receive()
+		if !strings.HasPrefix(data, "<iq") {
+			continue
+		}
+		received++
+		if strings.Contains(data, "<resource-constraint") {
+			rejected++
+		}
+	}
+	return rejected
+}
+
+func TestSessionStanzaRateLimit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimits = map[string]UserClassLimits{
+			UserClassNormal: {SessionStanzas: RateLimit{Rate: 2, Burst: 2}},
+		}
+		cfg.UserClasses = map[string]string{"root": UserClassAdmin}
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	root := ts.connect("root", "console")
+
+	// The session is slowed down rather than refused
+	start := time.Now()
+	alice.sendTestPings("p", 4)
+	if rejected := alice.receiveTestPongs(4); rejected != 0 {
+		t.Fatalf("%d stanzas rejected", rejected)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("4 stanzas handled in %v", elapsed)
+	}
+
+	// The classes without limits aren't slowed down
+	start = time.Now()
+	root.sendTestPings("p", 20)
+	if rejected := root.receiveTestPongs(20); rejected != 0 {
+		t.Fatalf("%d stanzas rejected", rejected)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("20 stanzas handled in %v", elapsed)
+	}
+
+	alice.close()
+	root.close()
+}
+
+func TestAccountStanzaRateLimit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimits = map[string]UserClassLimits{
+			UserClassNormal: {AccountStanzas: RateLimit{Rate: 1}},
+		}
+	})
+	defer ts.close()
+	var sessions []*testClient
+	for _, resource := range []string{"phone", "laptop", "tablet", "desk"} {
+		sessions = append(sessions, ts.connect("alice", resource))
+	}
+	bob := ts.connect("bob", "desk")
+
+	// The sessions share the account's rate. As they wait on each other,
+	// some of the stanzas are over the limit.
+	sent := make(chan bool, len(sessions))
+	for _, c := range sessions {
+		go func(c *testClient) {
+			sent <- c.sendTestPings("p", 2)
+		}(c)
+	}
+	rejected := 0
+	for _, c := range sessions {
+		rejected += c.receiveTestPongs(2)
+		if !<-sent {
+			t.Fatal("transport closed")
+		}
+	}
+	if rejected == 0 {
+		t.Fatal("expected stanzas over the account's limit to be rejected")
+	}
+	// The other accounts have their own rate
+	bob.sendTestPings("p", 1)
+	if bob.receiveTestPongs(1) != 0 {
+		t.Fatal("unexpected rejection for another account")
+	}
+
+	for _, c := range sessions {
+		c.close()
+	}
+	bob.close()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0313: Message Archive Management
+
+const (
+	mamDefaultPageSize = 50
+	mamMaxPageSize     = 250
+)
+
+func isArchivableMessage(msg *clientMessage) bool {
+	return (msg.Type == messageTypeChat || msg.Type == messageTypeNormal) &&
+		messageHasBody(msg)
+}
+
+func (srv *Server) archivePreferences(owner string) *ArchivePreferences {
+	prefs, err := srv.messageArchiveStore.ArchivePreferences(owner)
+	if err != nil {
+		log.WithFields(logrus.Fields{"archive": owner}).
+			Error("Unable to retrieve archive preferences: ", err)
+	}
+	if prefs == nil {
+		prefs = &ArchivePreferences{Default: srv.messageArchiveDefault}
+	}
+	return prefs
+}
+
+// shouldArchiveMessage applies the owner's archiving preferences to
+// a message exchanged with the contact.
+func (srv *Server) shouldArchiveMessage(owner xmppcore.JID, contact xmppcore.JID) bool {
+	prefs := srv.archivePreferences(owner.FullString())
+	contactBare := contact.BareCopyPtr().FullString()
+	contactFull := contact.FullString()
+	for _, jid := range prefs.Never {
+		if jid == contactBare || jid == contactFull {
+			return false
+		}
+	}
+	for _, jid := range prefs.Always {
+		if jid == contactBare || jid == contactFull {
+			return true
+		}
+	}
+	switch prefs.Default {
+	case MAMDefaultAlways:
+		return true
+	case MAMDefaultRoster:
+		// Not accepted until there's a roster storage
+		return srv.rosterHasContact(owner.Local, contact)
+	}
+	return false
+}
+
+// archiveOutboundMessage archives the message in the sender's archive.
+func (srv *Server) archiveOutboundMessage(msg *clientMessage) {
+	if srv.messageArchiveStore == nil || !isArchivableMessage(msg) {
+		return
+	}
+	owner := msg.From.BareCopyPtr()
+	if msg.To.BareCopyPtr().Equals(*owner) {
+		// It will be archived as an inbound message
+		return
+	}
+	if !srv.shouldArchiveMessage(*owner, *msg.To) {
+		return
+	}
+	srv.appendArchivedMessage(owner.FullString(), msg.To.FullString(), "", generateID(), msg)
+}
+
+// archiveInboundMessage archives the message in the recipient's archive
+// and stamps the message with the archive's stanza-id (XEP-0359).
+func (srv *Server) archiveInboundMessage(msg *clientMessage) {
+	owner := msg.To.BareCopyPtr()
+	ownerStr := owner.FullString()
+
+	// XEP-0359: stanza-ids which claim to be ours can't be trusted
+	msg.Payload = xmlPayloadRemoveElements(msg.Payload, func(startElem *xml.StartElement) bool {
+		return startElem.Name.Space == StanzaIDNS && startElem.Name.Local == "stanza-id" &&
+			xmlStartElementAttr(startElem, "by") == ownerStr
+	})
+
+	if srv.messageArchiveStore == nil || !isArchivableMessage(msg) {
+		return
+	}
+	if !srv.shouldArchiveMessage(*owner, *msg.From) {
+		return
+	}
+	stanzaID := generateID()
+	stanzaIDXML, err := xml.Marshal(&StanzaID{ID: stanzaID, By: ownerStr})
+	if err != nil {
+		panic(err)
+	}
+	msg.Payload = append(msg.Payload, stanzaIDXML...)
+	srv.appendArchivedMessage(ownerStr, msg.From.FullString(), "", stanzaID, msg)
+}
+
+func (srv *Server) appendArchivedMessage(archive, with, realJID, stanzaID string, msg *clientMessage) {
+	msgXML, err := xml.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	err = srv.messageArchiveStore.AppendArchivedMessage(archive, &ArchivedMessage{
+		ID:      stanzaID,
+		With:    with,
+		RealJID: realJID,
+		Stamp:   time.Now().UTC(),
+		Stanza:  msgXML,
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{"archive": archive, "stanza": msg.ID}).
+			Error("Unable to archive message: ", err)
+	}
+}
+
+// mamDiscoInfo advertises the archive on the user's own account.
+func (srv *Server) mamDiscoInfo(cl *Client, jid xmppcore.JID, node string, result *DiscoInfo) (bool, error) {
+	if node != "" {
+		return false, nil
+	}
+	if cl != nil && jid.Equals(*cl.jid.BareCopyPtr()) {
+		result.Feature = append(result.Feature,
+			xmppdisco.Feature{Var: MAMNS},
+			xmppdisco.Feature{Var: MAMExtendedNS})
+	}
+	return true, nil
+}
+
+func (srv *Server) handleClientMAMQuery(cl *Client, iq *xmppcore.ClientIQ, query *MAMQuery) {
+	owner := cl.jid.BareCopyPtr()
+	if iq.To != nil && !iq.To.Equals(*owner) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+	srv.queryMessageArchive(cl, iq, owner, query, false)
+}
+
+// queryMessageArchive handles the query on the archive of the entity,
+// be it a user or a room. The access has been checked by the caller.
+// queryMessageArchive answers the query on the archive. The real JIDs of
+// the senders of the rooms' messages are included if withRealJIDs is set.
+func (srv *Server) queryMessageArchive(
+	cl *Client, iq *xmppcore.ClientIQ, archiveJID *xmppcore.JID, query *MAMQuery, withRealJIDs bool,
+) {
+	if iq.Type == xmppcore.IQTypeGet {
+		srv.sendClientIQResult(cl, iq, &MAMQuery{
+			Form: &DataForm{
+				Type: "form",
+				Fields: []DataFormField{
+					{Var: "FORM_TYPE", Type: "hidden", Values: []string{MAMNS}},
+					{Var: "with", Type: "jid-single"},
+					{Var: "start", Type: "text-single"},
+					{Var: "end", Type: "text-single"},
+					{Var: "before-id", Type: "text-single"},
+					{Var: "after-id", Type: "text-single"},
+				},
+			},
+		})
+		return
+	}
+
+	archiveQuery, ok := mamArchiveQuery(query)
+	if !ok {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	result, err := srv.messageArchiveStore.QueryArchivedMessages(archiveJID.FullString(), archiveQuery)
+	if err != nil {
+		if err == ErrArchiveItemNotFound {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionItemNotFound,
+			})
+			return
+		}
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Error("Unable to query message archive: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+
+	srv.sendMAMQueryResult(cl, iq, archiveJID, query.QueryID, result, withRealJIDs)
+}
+
+// sendMAMQueryResult sends the messages of the result followed by the
+// IQ result which concludes the query.
+func (srv *Server) sendMAMQueryResult(
+	cl *Client, iq *xmppcore.ClientIQ, archiveJID *xmppcore.JID, queryID string, result *ArchiveQueryResult,
+	withRealJIDs bool,
+) {
+	for _, archivedMsg := range result.Messages {
+		stanza := archivedMsg.Stanza
+		if withRealJIDs && archivedMsg.RealJID != "" {
+			stanza = mucStanzaWithRealJID(stanza, archivedMsg.RealJID)
+		}
+		resultXML, err := xml.Marshal(&MAMResult{
+			QueryID: queryID,
+			ID:      archivedMsg.ID,
+			Forwarded: Forwarded{
+				Delay:  &Delay{Stamp: xmppDateTimeString(archivedMsg.Stamp)},
+				Stanza: stanza,
+			},
+		})
+		if err != nil {
+			panic(err)
+		}
+		srv.deliverMessage(cl, &clientMessage{
+			ID:      generateID(),
+			From:    archiveJID,
+			To:      &cl.jid,
+			Payload: resultXML,
+		})
+	}
+
+	count := result.Count
+	set := &RSMSet{Count: &count}
+	if n := len(result.Messages); n > 0 {
+		first, last := result.Messages[0].ID, result.Messages[n-1].ID
+		index := result.First
+		set.First = &RSMFirst{Index: &index, Value: first}
+		set.Last = &last
+	}
+	srv.sendClientIQResult(cl, iq, &MAMFin{
+		Complete: result.Complete,
+		Set:      set,
+	})
+}
+
+// mamArchiveQuery translates the query form and the RSM set into an
+// archive query.
+func mamArchiveQuery(query *MAMQuery) (*ArchiveQuery, bool) {
+	archiveQuery := &ArchiveQuery{Max: mamDefaultPageSize}
+
+	if query.Form != nil {
+		for _, field := range query.Form.Fields {
+			var value string
+			if len(field.Values) > 0 {
+				value = field.Values[0]
+			}
+			if value == "" {
+				continue
+			}
+			var err error
+			switch field.Var {
+			case "FORM_TYPE":
+				if value != MAMNS {
+					return nil, false
+				}
+			case "with":
+				var withJID xmppcore.JID
+				withJID, err = xmppcore.ParseJID(value)
+				archiveQuery.With = withJID.FullString()
+			case "start":
+				archiveQuery.Start, err = time.Parse(time.RFC3339, value)
+			case "end":
+				archiveQuery.End, err = time.Parse(time.RFC3339, value)
+			case "after-id":
+				archiveQuery.AfterID = value
+			case "before-id":
+				archiveQuery.BeforeID = value
+			default:
+				return nil, false
+			}
+			if err != nil {
+				return nil, false
+			}
+		}
+	}
+
+	if set := query.Set; set != nil {
+		if set.Max != nil {
+			if *set.Max < 0 {
+				return nil, false
+			}
+			archiveQuery.Max = *set.Max
+			if archiveQuery.Max > mamMaxPageSize {
+				archiveQuery.Max = mamMaxPageSize
+			}
+		}
+		if set.After != nil && *set.After != "" {
+			if archiveQuery.AfterID != "" {
+				return nil, false
+			}
+			archiveQuery.AfterID = *set.After
+		}
+		if set.Before != nil {
+			// An empty before requests the last page
+			archiveQuery.FromEnd = true
+			if *set.Before != "" {
+				if archiveQuery.BeforeID != "" {
+					return nil, false
+				}
+				archiveQuery.BeforeID = *set.Before
+			}
+		}
+	}
+
+	return archiveQuery, true
+}
+
+func (srv *Server) handleClientMAMPrefs(cl *Client, iq *xmppcore.ClientIQ, prefs *MAMPrefs) {
+	owner := cl.jid.BareCopyPtr().FullString()
+	if iq.To != nil && !iq.To.Equals(*cl.jid.BareCopyPtr()) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	if iq.Type == xmppcore.IQTypeSet {
+		switch prefs.Default {
+		case MAMDefaultAlways, MAMDefaultNever:
+		case MAMDefaultRoster:
+			// Without a roster it would archive nothing at all
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionFeatureNotImplemented,
+			})
+			return
+		default:
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionBadRequest,
+			})
+			return
+		}
+		newPrefs := &ArchivePreferences{Default: prefs.Default}
+		for _, jidStr := range prefs.Always.JIDs {
+			jid, err := xmppcore.ParseJID(jidStr)
+			if err != nil {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeModify,
+					Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+				})
+				return
+			}
+			newPrefs.Always = append(newPrefs.Always, jid.FullString())
+		}
+		for _, jidStr := range prefs.Never.JIDs {
+			jid, err := xmppcore.ParseJID(jidStr)
+			if err != nil {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeModify,
+					Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+				})
+				return
+			}
+			newPrefs.Never = append(newPrefs.Never, jid.FullString())
+		}
+		if err := srv.messageArchiveStore.SetArchivePreferences(owner, newPrefs); err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+				Error("Unable to store archive preferences: ", err)
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeWait,
+				Condition: xmppcore.StanzaErrorConditionInternalServerError,
+			})
+			return
+		}
+	}
+
+	currentPrefs := srv.archivePreferences(owner)
+	srv.sendClientIQResult(cl, iq, &MAMPrefs{
+		Default: currentPrefs.Default,
+		Always:  MAMPrefsJIDs{JIDs: currentPrefs.Always},
+		Never:   MAMPrefsJIDs{JIDs: currentPrefs.Never},
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testMAMPage is a page of the results of a MAM query.
+type testMAMPage struct {
+	ids    []string
+	bodies []string
+	// realJIDs are those of the senders of the rooms' messages, empty
+	// if not disclosed.
+	realJIDs []string
+	complete bool
+	count    int
+	index    *int
+	first    string
+	last     string
+}
+
+// queryMAM sends the query, with the RSM set's content, and returns the
+// page of results.
+func (c *testClient) queryMAM(to, setXML string) *testMAMPage {
+	c.t.Helper()
+	id := generateID()
+	toAttr := ""
+	if to != "" {
+		toAttr = ` to='` + to + `'`
+	}
+	c.send(`<iq type='set' id='` + id + `'` + toAttr + `><query xmlns='urn:xmpp:mam:2' queryid='q'>` +
+		`<set xmlns='http://jabber.org/protocol/rsm'>` + setXML + `</set></query></iq>`)
+	page := &testMAMPage{}
+	for {
+		data := c.receive()
+		if strings.HasPrefix(data, "<message") {
+			var msg struct {
+				Result *struct {
+					ID        string `xml:"id,attr"`
+					Forwarded struct {
+						Message struct {
+							Body string `xml:"body"`
+							Item struct {
+								JID string `xml:"jid,attr"`
+							} `xml:"http://jabber.org/protocol/muc#user x>item"`
+						} `xml:"jabber:client message"`
+					} `xml:"urn:xmpp:forward:0 forwarded"`
+				} `xml:"urn:xmpp:mam:2 result"`
+			}
+			if err := xml.Unmarshal([]byte(data), &msg); err != nil {
+				c.t.Fatal(err)
+			}
+			if msg.Result != nil {
+				page.ids = append(page.ids, msg.Result.ID)
+				page.bodies = append(page.bodies, msg.Result.Forwarded.Message.Body)
+				page.realJIDs = append(page.realJIDs, msg.Result.Forwarded.Message.Item.JID)
+			}
+			continue
+		}
+		if !strings.HasPrefix(data, "<iq") || !strings.Contains(data, id) {
+			continue
+		}
+		var iq struct {
+			Type string `xml:"type,attr"`
+			Fin  *struct {
+				Complete bool `xml:"complete,attr"`
+				Set      struct {
+					Count int `xml:"count"`
+					First struct {
+						Index *int   `xml:"index,attr"`
+						Value string `xml:",chardata"`
+					} `xml:"first"`
+					Last string `xml:"last"`
+				} `xml:"http://jabber.org/protocol/rsm set"`
+			} `xml:"urn:xmpp:mam:2 fin"`
+		}
+		if err := xml.Unmarshal([]byte(data), &iq); err != nil {
+			c.t.Fatal(err)
+		}
+		if iq.Type != "result" || iq.Fin == nil {
+			c.t.Fatalf("unexpected query result: %s", data)
+		}
+		page.complete = iq.Fin.Complete
+		page.count = iq.Fin.Set.Count
+		page.index = iq.Fin.Set.First.Index
+		page.first = iq.Fin.Set.First.Value
+		page.last = iq.Fin.Set.Last
+		return page
+	}
+}
+
+func TestMAMPaging(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MessageArchiveStorage = "disk"
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	bob := ts.connect("bob", "laptop")
+	bob.available()
+
+	for i := 0; i < 5; i++ {
+		alice.send(`<message type='chat' to='bob@localhost'><body>` + strconv.Itoa(i) + `</body></message>`)
+		bob.expect("<message")
+	}
+
+	page := alice.queryMAM("", `<max>2</max>`)
+	if strings.Join(page.bodies, ",") != "0,1" || page.count != 5 || page.complete ||
+		page.index == nil || *page.index != 0 || page.first != page.ids[0] || page.last != page.ids[1] {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page = alice.queryMAM("", `<max>2</max><after>`+page.last+`</after>`)
+	if strings.Join(page.bodies, ",") != "2,3" || page.count != 5 || page.complete ||
+		page.index == nil || *page.index != 2 {
+		t.Fatalf("unexpected second page: %+v", page)
+	}
+	page = alice.queryMAM("", `<max>2</max><after>`+page.last+`</after>`)
+	if strings.Join(page.bodies, ",") != "4" || page.count != 5 || !page.complete ||
+		page.index == nil || *page.index != 4 {
+		t.Fatalf("unexpected last page: %+v", page)
+	}
+
+	// Backwards from the end
+	page = bob.queryMAM("", `<max>2</max><before/>`)
+	if strings.Join(page.bodies, ",") != "3,4" || page.count != 5 || page.complete ||
+		page.index == nil || *page.index != 3 {
+		t.Fatalf("unexpected last page: %+v", page)
+	}
+	page = bob.queryMAM("", `<max>2</max><before>`+page.first+`</before>`)
+	if strings.Join(page.bodies, ",") != "1,2" || page.count != 5 || page.index == nil || *page.index != 1 {
+		t.Fatalf("unexpected previous page: %+v", page)
+	}
+
+	alice.close()
+	bob.close()
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0045: Multi-User Chat
+
+// XEP-0045 15.6.2
+const (
+	mucStatusNonAnonymous       = 100
+	mucStatusSelfPresence       = 110
+	mucStatusRoomCreated        = 201
+	mucStatusBanned             = 301
+	mucStatusNickChanged        = 303
+	mucStatusKicked             = 307
+	mucStatusAffiliationRemoved = 321
+	mucStatusMembersOnly        = 322
+)
+
+// mucRoom is the live state of a room. The persistent rooms are loaded
+// from the store when they're first needed and the temporary rooms are
+// destroyed once the last occupant leaves.
+type mucRoom struct {
+	jid  xmppcore.JID
+	info MUCRoom
+	// locked is set for a newly created room until its owner has
+	// configured it (XEP-0045 10.1.1).
+	locked bool
+	// destroyed is set once the room is removed from the server.
+	destroyed bool
+	occupants map[string]*mucOccupant // key is nick
+	history   []mucHistoryMessage
+	mutex     sync.Mutex
+}
+
+type mucOccupant struct {
+	nick   string
+	client *Client
+	role   string
+	// payload is the child elements of the occupant's last presence.
+	payload []byte
+}
+
+type mucHistoryMessage struct {
+	msg   *clientMessage
+	stamp time.Time
+}
+
+func defaultMUCRoomConfig() MUCRoomConfig {
+	return MUCRoomConfig{
+		Public:        true,
+		WhoIs:         MUCWhoIsModerators,
+		ChangeSubject: true,
+		AllowInvites:  true,
+		Archive:       true,
+	}
+}
+
+func (srv *Server) mucEnabled() bool {
+	return srv.mucStore != nil
+}
+
+func (room *mucRoom) occupantJID(nick string) xmppcore.JID {
+	return xmppcore.JID{Local: room.jid.Local, Domain: room.jid.Domain, Resource: nick}
+}
+
+func (room *mucRoom) occupantByJID(jid xmppcore.JID) *mucOccupant {
+	for _, occupant := range room.occupants {
+		if occupant.client.jid.Equals(jid) {
+			return occupant
+		}
+	}
+	return nil
+}
+
+func (room *mucRoom) affiliation(jid xmppcore.JID) string {
+	if affiliation := room.info.Affiliations[jid.BareCopyPtr().FullString()]; affiliation != "" {
+		return affiliation
+	}
+	return MUCAffiliationNone
+}
+
+// defaultRole is the role of an occupant when they join the room
+// (XEP-0045 5.1.2).
+func (room *mucRoom) defaultRole(affiliation string) string {
+	switch affiliation {
+	case MUCAffiliationOwner, MUCAffiliationAdmin:
+		return MUCRoleModerator
+	case MUCAffiliationMember:
+		return MUCRoleParticipant
+	}
+	if room.info.Config.Moderated {
+		return MUCRoleVisitor
+	}
+	return MUCRoleParticipant
+}
+
+func (room *mucRoom) occupantItem(occupant *mucOccupant) MUCItem {
+	return MUCItem{
+		Affiliation: room.affiliation(occupant.client.jid),
+		Role:        occupant.role,
+	}
+}
+
+// mucRoom returns the live room. A persistent room is loaded from the
+// storage. If there's no such room and the creator is not nil, a new
+// locked room is created.
+func (srv *Server) mucRoom(name string, creator *xmppcore.JID) (room *mucRoom, created bool, err error) {
+	srv.mucRoomsMutex.Lock()
+	defer srv.mucRoomsMutex.Unlock()
+	if room = srv.mucRooms[name]; room != nil {
+		return room, false, nil
+	}
+	info, err := srv.mucStore.MUCRoom(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if info == nil {
+		if creator == nil {
+			return nil, false, nil
+		}
+		info = &MUCRoom{
+			Name:   name,
+			Config: defaultMUCRoomConfig(),
+			Affiliations: map[string]string{
+				creator.BareCopyPtr().FullString(): MUCAffiliationOwner,
+			},
+		}
+		created = true
+	}
+	room = &mucRoom{
+		jid:       xmppcore.JID{Local: name, Domain: srv.groupsDomain},
+		info:      *info,
+		locked:    created,
+		occupants: make(map[string]*mucOccupant),
+	}
+	if !created {
+		srv.loadMUCHistory(room)
+	}
+	srv.mucRooms[name] = room
+	return room, created, nil
+}
+
+// removeMUCRoom removes the room from the live rooms. It must be called
+// with the room's mutex held.
+func (srv *Server) removeMUCRoom(room *mucRoom) {
+	room.destroyed = true
+	srv.mucRoomsMutex.Lock()
+	if srv.mucRooms[room.jid.Local] == room {
+		delete(srv.mucRooms, room.jid.Local)
+	}
+	srv.mucRoomsMutex.Unlock()
+}
+
+// saveMUCRoom stores the persistent room. It must be called with the
+// room's mutex held.
+func (srv *Server) saveMUCRoom(room *mucRoom) {
+	if !room.info.Config.Persistent || room.locked {
+		return
+	}
+	if err := srv.mucStore.SaveMUCRoom(&room.info); err != nil {
+		log.WithFields(logrus.Fields{"jid": room.jid}).
+			Error("Unable to save the room: ", err)
+	}
+}
+
+// mucPresencePayload strips the MUC elements, which are meant for the
+// room, from the occupant's presence.
+func mucPresencePayload(payload []byte) []byte {
+	return xmlPayloadRemoveElements(payload, func(startElem *xml.StartElement) bool {
+		return startElem.Name.Local == "x" &&
+			(startElem.Name.Space == MUCNS || startElem.Name.Space == MUCUserNS)
+	})
+}
+
+// mucGroupchatPayload strips what only the room may add from the
+// occupant's groupchat message: the MUC user data, and the stanza-ids
+// which claim to be the room's (XEP-0359).
+func mucGroupchatPayload(room *mucRoom, payload []byte) []byte {
+	roomStr := room.jid.FullString()
+	return xmlPayloadRemoveElements(payload, func(startElem *xml.StartElement) bool {
+		switch {
+		case startElem.Name.Space == MUCUserNS && startElem.Name.Local == "x":
+			return true
+		case startElem.Name.Space == StanzaIDNS && startElem.Name.Local == "stanza-id":
+			return xmlStartElementAttr(startElem, "by") == roomStr
+		}
+		return false
+	})
+}
+
+// sendMUCPresence sends the occupant's presence to the recipient. The
+// occupant's real JID is included if the recipient is allowed to see it.
+func (srv *Server) sendMUCPresence(
+	room *mucRoom, occupant, recipient *mucOccupant,
+	presenceType string, payload []byte, item MUCItem, statuses ...int,
+) {
+	userElem := MUCUser{Items: []MUCItem{item}}
+	if room.info.Config.WhoIs == MUCWhoIsAnyone || recipient.role == MUCRoleModerator ||
+		recipient == occupant {
+		userElem.Items[0].JID = occupant.client.jid.FullString()
+	}
+	if recipient == occupant {
+		userElem.Statuses = append(userElem.Statuses, MUCStatus{Code: mucStatusSelfPresence})
+		if room.info.Config.WhoIs == MUCWhoIsAnyone {
+			userElem.Statuses = append(userElem.Statuses, MUCStatus{Code: mucStatusNonAnonymous})
+		}
+	}
+	for _, code := range statuses {
+		userElem.Statuses = append(userElem.Statuses, MUCStatus{Code: code})
+	}
+	userXML, err := xml.Marshal(&userElem)
+	if err != nil {
+		panic(err)
+	}
+	presencePayload := make([]byte, 0, len(payload)+len(userXML))
+	presencePayload = append(presencePayload, payload...)
+	presencePayload = append(presencePayload, userXML...)
+
+	fromJID := room.occupantJID(occupant.nick)
+	toJID := recipient.client.jid
+	srv.deliverPresence(recipient.client, &clientPresence{
+		Type:    presenceType,
+		From:    &fromJID,
+		To:      &toJID,
+		Payload: presencePayload,
+	})
+}
+
+// broadcastMUCPresence sends the occupant's presence to all the
+// occupants and to the occupant itself.
+func (srv *Server) broadcastMUCPresence(
+	room *mucRoom, occupant *mucOccupant,
+	presenceType string, payload []byte, item MUCItem, statuses ...int,
+) {
+	for _, recipient := range room.occupants {
+		if recipient != occupant {
+			srv.sendMUCPresence(room, occupant, recipient, presenceType, payload, item, statuses...)
+		}
+	}
+	srv.sendMUCPresence(room, occupant, occupant, presenceType, payload, item, statuses...)
+}
+
+func (srv *Server) sendMUCPresenceError(cl *Client, presence *clientPresence, stanzaError xmppcore.StanzaError) {
+	errorXML, err := xml.Marshal(&stanzaError)
+	if err != nil {
+		panic(err)
+	}
+	toJID := cl.jid
+	srv.deliverPresence(cl, &clientPresence{
+		ID:      presence.ID,
+		Type:    "error",
+		From:    presence.To,
+		To:      &toJID,
+		Payload: errorXML,
+	})
+}
+
+// handleMUCPresence handles the presences addressed to the rooms.
+func (srv *Server) handleMUCPresence(cl *Client, presence *clientPresence) {
+	if presence.To.Local == "" {
+		// Nothing to do with the presence to the service
+		return
+	}
+	switch presence.Type {
+	case "":
+		if presence.To.Resource == "" {
+			// XEP-0045 7.2.1: the nick is required
+			srv.sendMUCPresenceError(cl, presence, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+			})
+			return
+		}
+		srv.handleMUCAvailablePresence(cl, presence)
+	case "unavailable":
+		room, _, err := srv.mucRoom(presence.To.Local, nil)
+		if err != nil || room == nil {
+			return
+		}
+		room.mutex.Lock()
+		defer room.mutex.Unlock()
+		if occupant := room.occupantByJID(cl.jid); occupant != nil {
+			srv.removeMUCOccupant(room, occupant, mucPresencePayload(presence.Payload), MUCItem{})
+		}
+	}
+}
+
+func (srv *Server) handleMUCAvailablePresence(cl *Client, presence *clientPresence) {
+	nick := presence.To.Resource
+	var join MUCJoin
+	isJoin := xmlPayloadDecodeElement(presence.Payload, MUCNS, "x", &join)
+	payload := mucPresencePayload(presence.Payload)
+
+	var room *mucRoom
+	var created bool
+	for {
+		var err error
+		var creator *xmppcore.JID
+		if isJoin {
+			creator = &cl.jid
+		}
+		room, created, err = srv.mucRoom(presence.To.Local, creator)
+		if err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+				Error("Unable to load the room: ", err)
+			srv.sendMUCPresenceError(cl, presence, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeWait,
+				Condition: xmppcore.StanzaErrorConditionInternalServerError,
+			})
+			return
+		}
+		if room == nil {
+			srv.sendMUCPresenceError(cl, presence, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionItemNotFound,
+			})
+			return
+		}
+		room.mutex.Lock()
+		if !room.destroyed {
+			break
+		}
+		// The room was destroyed while we were waiting for it
+		room.mutex.Unlock()
+	}
+	defer room.mutex.Unlock()
+
+	if occupant := room.occupantByJID(cl.jid); occupant != nil {
+		if occupant.nick == nick {
+			// Presence update
+			occupant.payload = payload
+			srv.broadcastMUCPresence(room, occupant, "", payload, room.occupantItem(occupant))
+			return
+		}
+		srv.changeMUCNick(cl, presence, room, occupant, payload)
+		return
+	}
+
+	affiliation := room.affiliation(cl.jid)
+	if joinError := srv.mucJoinError(room, nick, affiliation, &join); joinError != nil {
+		srv.sendMUCPresenceError(cl, presence, *joinError)
+		return
+	}
+
+	occupant := &mucOccupant{
+		nick:    nick,
+		client:  cl,
+		role:    room.defaultRole(affiliation),
+		payload: payload,
+	}
+
+	// XEP-0045 7.2.3: the existing occupants first, then the new
+	// occupant's presence, then the history and the subject.
+	for _, other := range room.occupants {
+		srv.sendMUCPresence(room, other, occupant, "", other.payload, room.occupantItem(other))
+	}
+	room.occupants[nick] = occupant
+	if created {
+		srv.broadcastMUCPresence(room, occupant, "", payload, room.occupantItem(occupant), mucStatusRoomCreated)
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Infof("Room %s created", room.jid.FullString())
+	} else {
+		srv.broadcastMUCPresence(room, occupant, "", payload, room.occupantItem(occupant))
+	}
+	srv.sendMUCHistory(room, occupant, join.History)
+	srv.sendMUCSubject(room, occupant)
+}
+
+// mucJoinError checks whether the user can join the room (XEP-0045
+// 7.2). It returns nil if the user can join.
+func (srv *Server) mucJoinError(room *mucRoom, nick, affiliation string, join *MUCJoin) *xmppcore.StanzaError {
+	switch {
+	case room.locked && affiliation != MUCAffiliationOwner:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		}
+	case room.occupants[nick] != nil:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionConflict,
+		}
+	case affiliation == MUCAffiliationOutcast:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		}
+	case room.info.Config.MembersOnly && affiliation == MUCAffiliationNone:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionRegistrationRequired,
+		}
+	case room.info.Config.Password != "" && join.Password != room.info.Config.Password &&
+		affiliation != MUCAffiliationOwner:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionNotAuthorized,
+		}
+	case room.info.Config.MaxUsers > 0 && len(room.occupants) >= room.info.Config.MaxUsers &&
+		affiliation != MUCAffiliationOwner && affiliation != MUCAffiliationAdmin:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		}
+	}
+	return nil
+}
+
+// changeMUCNick handles the nick change (XEP-0045 7.6).
+func (srv *Server) changeMUCNick(cl *Client, presence *clientPresence, room *mucRoom, occupant *mucOccupant, payload []byte) {
+	newNick := presence.To.Resource
+	if room.occupants[newNick] != nil {
+		srv.sendMUCPresenceError(cl, presence, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionConflict,
+		})
+		return
+	}
+	item := room.occupantItem(occupant)
+	item.Nick = newNick
+	srv.broadcastMUCPresence(room, occupant, "unavailable", nil, item, mucStatusNickChanged)
+
+	delete(room.occupants, occupant.nick)
+	occupant.nick = newNick
+	occupant.payload = payload
+	room.occupants[newNick] = occupant
+	srv.broadcastMUCPresence(room, occupant, "", payload, room.occupantItem(occupant))
+}
+
+// removeMUCOccupant removes the occupant and tells everyone about it. The
+// item carries the actor and the reason, if any. A temporary room is
+// destroyed once it's empty. It must be called with the room's mutex
+// held.
+func (srv *Server) removeMUCOccupant(room *mucRoom, occupant *mucOccupant, payload []byte, item MUCItem, statuses ...int) {
+	delete(room.occupants, occupant.nick)
+	item.Affiliation = room.affiliation(occupant.client.jid)
+	item.Role = MUCRoleNone
+	srv.broadcastMUCPresence(room, occupant, "unavailable", payload, item, statuses...)
+	if len(room.occupants) == 0 && (!room.info.Config.Persistent || room.locked) {
+		srv.removeMUCRoom(room)
+		log.WithFields(logrus.Fields{"jid": room.jid}).
+			Info("Temporary room destroyed")
+	}
+}
+
+// leaveMUCRooms removes the client from all the rooms it's in, e.g.,
+// when it goes offline.
+func (srv *Server) leaveMUCRooms(cl *Client) {
+	if !srv.mucEnabled() {
+		return
+	}
+	srv.mucRoomsMutex.Lock()
+	rooms := make([]*mucRoom, 0, len(srv.mucRooms))
+	for _, room := range srv.mucRooms {
+		rooms = append(rooms, room)
+	}
+	srv.mucRoomsMutex.Unlock()
+	for _, room := range rooms {
+		room.mutex.Lock()
+		if occupant := room.occupantByJID(cl.jid); occupant != nil && !room.destroyed {
+			srv.removeMUCOccupant(room, occupant, nil, MUCItem{})
+		}
+		room.mutex.Unlock()
+	}
+}
+
+// sendMUCHistory sends the room's recent messages to the new occupant
+// as requested (XEP-0045 7.2.15).
+func (srv *Server) sendMUCHistory(room *mucRoom, occupant *mucOccupant, req *MUCHistory) {
+	history := room.history
+	if req != nil {
+		if req.MaxChars != nil && *req.MaxChars == 0 {
+			return
+		}
+		if req.MaxStanzas != nil {
+			if *req.MaxStanzas <= 0 {
+				return
+			}
+			if *req.MaxStanzas < len(history) {
+				history = history[len(history)-*req.MaxStanzas:]
+			}
+		}
+		var since time.Time
+		if req.Seconds != nil {
+			since = time.Now().Add(-time.Duration(*req.Seconds) * time.Second)
+		}
+		if req.Since != "" {
+			if t, err := time.Parse(time.RFC3339, req.Since); err == nil && t.After(since) {
+				since = t
+			}
+		}
+		if !since.IsZero() {
+			for len(history) > 0 && history[0].stamp.Before(since) {
+				history = history[1:]
+			}
+		}
+	}
+
+	for _, historyMsg := range history {
+		delayXML, err := xml.Marshal(&Delay{
+			From:  room.jid.FullString(),
+			Stamp: xmppDateTimeString(historyMsg.stamp),
+		})
+		if err != nil {
+			panic(err)
+		}
+		payload := make([]byte, 0, len(historyMsg.msg.Payload)+len(delayXML))
+		payload = append(payload, historyMsg.msg.Payload...)
+		payload = append(payload, delayXML...)
+		toJID := occupant.client.jid
+		srv.deliverMessage(occupant.client, &clientMessage{
+			ID:      historyMsg.msg.ID,
+			Type:    messageTypeGroupchat,
+			From:    historyMsg.msg.From,
+			To:      &toJID,
+			Payload: payload,
+		})
+	}
+}
+
+type messageSubjectElem struct {
+	Text string `xml:",chardata"`
+}
+
+func (srv *Server) sendMUCSubject(room *mucRoom, occupant *mucOccupant) {
+	subjectXML, err := xml.Marshal(&struct {
+		XMLName xml.Name `xml:"subject"`
+		Text    string   `xml:",chardata"`
+	}{Text: room.info.Subject})
+	if err != nil {
+		panic(err)
+	}
+	fromJID := room.jid
+	if room.info.SubjectNick != "" {
+		fromJID = room.occupantJID(room.info.SubjectNick)
+	}
+	toJID := occupant.client.jid
+	srv.deliverMessage(occupant.client, &clientMessage{
+		ID:      generateID(),
+		Type:    messageTypeGroupchat,
+		From:    &fromJID,
+		To:      &toJID,
+		Payload: subjectXML,
+	})
+}
+
+// messageSubject returns the subject of the message if it has one.
+func messageSubject(msg *clientMessage) (string, bool) {
+	var subject messageSubjectElem
+	if xmlPayloadDecodeElement(msg.Payload, "", "subject", &subject) ||
+		xmlPayloadDecodeElement(msg.Payload, xmppcore.JabberClientNS, "subject", &subject) {
+		return subject.Text, true
+	}
+	return "", false
+}
+
+// handleMUCMessage handles the messages addressed to the rooms and to
+// their occupants.
+func (srv *Server) handleMUCMessage(msg *clientMessage) {
+	if msg.Type == messageTypeError {
+		return
+	}
+	if msg.To.Local == "" {
+		if msg.Type != messageTypeHeadline {
+			srv.bounceMessage(msg, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+			})
+		}
+		return
+	}
+	room, _, err := srv.mucRoom(msg.To.Local, nil)
+	if err != nil || room == nil {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.destroyed {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+
+	sender := room.occupantByJID(*msg.From)
+	switch {
+	case msg.To.Resource != "":
+		srv.handleMUCPrivateMessage(room, sender, msg)
+	case msg.Type == messageTypeGroupchat:
+		srv.handleMUCGroupchatMessage(room, sender, msg)
+	case xmlPayloadHasElement(msg.Payload, MUCUserNS, "x"):
+		srv.handleMUCInvites(room, sender, msg)
+	default:
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+	}
+}
+
+func (srv *Server) handleMUCGroupchatMessage(room *mucRoom, sender *mucOccupant, msg *clientMessage) {
+	if sender == nil {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	if sender.role == MUCRoleVisitor {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	hasBody := messageHasBody(msg)
+	if subject, ok := messageSubject(msg); ok && !hasBody {
+		// XEP-0045 8.1
+		if sender.role != MUCRoleModerator && !room.info.Config.ChangeSubject {
+			srv.bounceMessage(msg, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeAuth,
+				Condition: xmppcore.StanzaErrorConditionForbidden,
+			})
+			return
+		}
+		room.info.Subject = subject
+		room.info.SubjectNick = sender.nick
+		srv.saveMUCRoom(room)
+	}
+
+	fromJID := room.occupantJID(sender.nick)
+	roomMsg := &clientMessage{
+		ID:      msg.ID,
+		Type:    messageTypeGroupchat,
+		From:    &fromJID,
+		Payload: mucGroupchatPayload(room, msg.Payload),
+	}
+	srv.archiveMUCMessage(room, sender, roomMsg)
+	if hasBody {
+		srv.appendMUCHistory(room, roomMsg)
+	}
+	for _, recipient := range room.occupants {
+		toJID := recipient.client.jid
+		srv.deliverMessage(recipient.client, &clientMessage{
+			ID:      roomMsg.ID,
+			Type:    roomMsg.Type,
+			From:    roomMsg.From,
+			To:      &toJID,
+			Payload: roomMsg.Payload,
+		})
+	}
+}
+
+func (srv *Server) appendMUCHistory(room *mucRoom, msg *clientMessage) {
+	if srv.mucMaxHistory <= 0 {
+		return
+	}
+	room.history = append(room.history, mucHistoryMessage{msg: msg, stamp: time.Now().UTC()})
+	if len(room.history) > srv.mucMaxHistory {
+		room.history = append([]mucHistoryMessage{}, room.history[len(room.history)-srv.mucMaxHistory:]...)
+	}
+}
+
+// handleMUCPrivateMessage delivers a private message to an occupant
+// (XEP-0045 7.5).
+func (srv *Server) handleMUCPrivateMessage(room *mucRoom, sender *mucOccupant, msg *clientMessage) {
+	if sender == nil {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	if msg.Type == messageTypeGroupchat {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	recipient := room.occupants[msg.To.Resource]
+	if recipient == nil {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+	userXML, err := xml.Marshal(&MUCUser{})
+	if err != nil {
+		panic(err)
+	}
+	payload := make([]byte, 0, len(msg.Payload)+len(userXML))
+	payload = append(payload, msg.Payload...)
+	payload = append(payload, userXML...)
+	fromJID := room.occupantJID(sender.nick)
+	toJID := recipient.client.jid
+	srv.deliverMessage(recipient.client, &clientMessage{
+		ID:      msg.ID,
+		Type:    msg.Type,
+		From:    &fromJID,
+		To:      &toJID,
+		Payload: payload,
+	})
+}
+
+// handleMUCInvites relays the mediated invitations (XEP-0045 7.8.2).
+func (srv *Server) handleMUCInvites(room *mucRoom, sender *mucOccupant, msg *clientMessage) {
+	var userElem MUCUser
+	if !xmlPayloadDecodeElement(msg.Payload, MUCUserNS, "x", &userElem) || len(userElem.Invites) == 0 {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	if sender == nil {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	affiliation := room.affiliation(sender.client.jid)
+	privileged := affiliation == MUCAffiliationOwner || affiliation == MUCAffiliationAdmin
+	if !privileged && (room.info.Config.MembersOnly || !room.info.Config.AllowInvites) {
+		srv.bounceMessage(msg, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	for _, invite := range userElem.Invites {
+		inviteeJID, err := xmppcore.ParseJID(invite.To)
+		if err != nil || inviteeJID.Domain == srv.groupsDomain {
+			continue
+		}
+		// The invitees of the admins become members of a members-only
+		// room so that they can join.
+		if room.info.Config.MembersOnly && room.affiliation(inviteeJID) == MUCAffiliationNone {
+			if room.info.Affiliations == nil {
+				room.info.Affiliations = make(map[string]string)
+			}
+			room.info.Affiliations[inviteeJID.BareCopyPtr().FullString()] = MUCAffiliationMember
+			srv.saveMUCRoom(room)
+		}
+		inviteXML, err := xml.Marshal(&MUCUser{
+			Invites: []MUCInvite{{
+				From:   sender.client.jid.FullString(),
+				Reason: invite.Reason,
+			}},
+			Password: room.info.Config.Password,
+		})
+		if err != nil {
+			panic(err)
+		}
+		fromJID := room.jid
+		srv.routeMessage(&clientMessage{
+			ID:      generateID(),
+			Type:    messageTypeNormal,
+			From:    &fromJID,
+			To:      &inviteeJID,
+			Payload: inviteXML,
+		})
+	}
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+	"github.com/sirupsen/logrus"
+)
+
+// handleClientMUCIQ handles the IQs addressed to the MUC service, to the
+// rooms and to the occupants.
+func (srv *Server) handleClientMUCIQ(cl *Client, iq *xmppcore.ClientIQ) {
+	if iq.To.Resource != "" && iq.To.Local != "" {
+		srv.routeMUCOccupantIQ(cl, iq)
+		return
+	}
+	if iq.Type != xmppcore.IQTypeGet && iq.Type != xmppcore.IQTypeSet {
+		return
+	}
+	if iq.To.Resource != "" {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	}
+
+	element := srv.decodeClientIQPayload(cl, iq, func(name string) interface{} {
+		switch name {
+		case xmppdisco.InfoQueryElementName:
+			if iq.Type == xmppcore.IQTypeGet {
+				return &DiscoInfo{}
+			}
+		case xmppdisco.ItemsQueryElementName:
+			if iq.Type == xmppcore.IQTypeGet {
+				return &DiscoItems{}
+			}
+		case MUCOwnerQueryElementName:
+			if iq.To.Local != "" {
+				return &MUCOwnerQuery{}
+			}
+		case MUCAdminQueryElementName:
+			if iq.To.Local != "" {
+				return &MUCAdminQuery{}
+			}
+		case MAMQueryElementName:
+			if iq.To.Local != "" {
+				return &MAMQuery{}
+			}
+		}
+		return nil
+	})
+	if element == nil {
+		return
+	}
+
+	if iq.To.Local == "" {
+		switch payload := element.(type) {
+		case *DiscoInfo:
+			srv.handleClientDiscoInfo(cl, iq, payload.Node)
+		case *DiscoItems:
+			srv.handleClientDiscoItems(cl, iq, payload.Node)
+		}
+		return
+	}
+
+	room, _, err := srv.mucRoom(iq.To.Local, nil)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to load the room: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	if room == nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.destroyed {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+
+	switch payload := element.(type) {
+	case *DiscoInfo:
+		srv.handleMUCRoomDiscoInfo(cl, iq, room)
+	case *DiscoItems:
+		// The occupants are not disclosed
+		srv.sendClientIQResult(cl, iq, &DiscoItems{Items: []DiscoItem{}})
+	case *MUCOwnerQuery:
+		srv.handleMUCOwnerQuery(cl, iq, room, payload)
+	case *MUCAdminQuery:
+		srv.handleMUCAdminQuery(cl, iq, room, payload)
+	case *MAMQuery:
+		srv.handleMUCMAMQuery(cl, iq, room, payload)
+	}
+}
+
+// routeMUCOccupantIQ relays the IQs between the occupants without
+// disclosing their real JIDs (XEP-0045 7.5).
+func (srv *Server) routeMUCOccupantIQ(cl *Client, iq *xmppcore.ClientIQ) {
+	isRequest := iq.Type == xmppcore.IQTypeGet || iq.Type == xmppcore.IQTypeSet
+	room, _, err := srv.mucRoom(iq.To.Local, nil)
+	if err != nil || room == nil {
+		if isRequest {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionItemNotFound,
+			})
+		}
+		return
+	}
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	sender := room.occupantByJID(cl.jid)
+	recipient := room.occupants[iq.To.Resource]
+	if sender == nil || recipient == nil {
+		if isRequest {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+			})
+		}
+		return
+	}
+	fromJID := room.occupantJID(sender.nick)
+	toJID := recipient.client.jid
+	iqXML, err := xml.Marshal(&xmppcore.ClientIQ{
+		ID:      iq.ID,
+		Type:    iq.Type,
+		From:    &fromJID,
+		To:      &toJID,
+		Payload: iq.Payload,
+	})
+	if err != nil {
+		panic(err)
+	}
+	recipient.client.writeStanza(iqXML)
+}
+
+// mucServiceDiscoItems lists the public rooms (XEP-0045 6.3).
+func (srv *Server) mucServiceDiscoItems(cl *Client, jid xmppcore.JID, node string, result *DiscoItems) (bool, error) {
+	if node != "" {
+		return false, nil
+	}
+	storedRooms, err := srv.mucStore.MUCRooms()
+	if err != nil {
+		return false, err
+	}
+	rooms := make(map[string]MUCRoom, len(storedRooms))
+	for _, info := range storedRooms {
+		rooms[info.Name] = *info
+	}
+	srv.mucRoomsMutex.Lock()
+	liveRooms := make([]*mucRoom, 0, len(srv.mucRooms))
+	for _, room := range srv.mucRooms {
+		liveRooms = append(liveRooms, room)
+	}
+	srv.mucRoomsMutex.Unlock()
+	for _, room := range liveRooms {
+		room.mutex.Lock()
+		if room.locked || room.destroyed {
+			delete(rooms, room.jid.Local)
+		} else {
+			rooms[room.jid.Local] = room.info
+		}
+		room.mutex.Unlock()
+	}
+
+	for name, info := range rooms {
+		if !info.Config.Public {
+			continue
+		}
+		roomName := info.Config.Title
+		if roomName == "" {
+			roomName = name
+		}
+		roomJID := xmppcore.JID{Local: name, Domain: srv.groupsDomain}
+		result.Items = append(result.Items, DiscoItem{JID: roomJID.FullString(), Name: roomName})
+	}
+	return true, nil
+}
+
+// handleMUCRoomDiscoInfo describes the room (XEP-0045 6.4).
+func (srv *Server) handleMUCRoomDiscoInfo(cl *Client, iq *xmppcore.ClientIQ, room *mucRoom) {
+	config := room.info.Config
+	mucFeature := func(set bool, ifSet, ifNotSet string) xmppdisco.Feature {
+		if set {
+			return xmppdisco.Feature{Var: ifSet}
+		}
+		return xmppdisco.Feature{Var: ifNotSet}
+	}
+	features := []xmppdisco.Feature{
+		{Var: MUCNS},
+		mucFeature(config.Persistent, "muc_persistent", "muc_temporary"),
+		mucFeature(config.Public, "muc_public", "muc_hidden"),
+		mucFeature(config.MembersOnly, "muc_membersonly", "muc_open"),
+		mucFeature(config.Moderated, "muc_moderated", "muc_unmoderated"),
+		mucFeature(config.Password != "", "muc_passwordprotected", "muc_unsecured"),
+		mucFeature(config.WhoIs == MUCWhoIsAnyone, "muc_nonanonymous", "muc_semianonymous"),
+	}
+	if srv.mucArchiveEnabled(room) {
+		features = append(features, xmppdisco.Feature{Var: MAMNS})
+	}
+	srv.sendClientIQResult(cl, iq, &DiscoInfo{
+		Identity: []xmppdisco.Identity{
+			{Category: "conference", Type: "text", Name: config.Title},
+		},
+		Feature: features,
+		Forms: []DataForm{{
+			Type: "result",
+			Fields: []DataFormField{
+				{Var: "FORM_TYPE", Type: "hidden", Values: []string{MUCRoomInfoFormType}},
+				{Var: "muc#roominfo_description", Label: "Description",
+					Values: []string{config.Description}},
+				{Var: "muc#roominfo_subject", Label: "Subject",
+					Values: []string{room.info.Subject}},
+				{Var: "muc#roominfo_occupants", Label: "Number of occupants",
+					Values: []string{strconv.Itoa(len(room.occupants))}},
+			},
+		}},
+	})
+}
+
+func (srv *Server) mucRoomConfigForm(config MUCRoomConfig) *DataForm {
+	boolValue := func(value bool) []string {
+		return []string{strconv.FormatBool(value)}
+	}
+	maxUsers := "none"
+	if config.MaxUsers > 0 {
+		maxUsers = strconv.Itoa(config.MaxUsers)
+	}
+	form := &DataForm{
+		Type:  "form",
+		Title: "Room configuration",
+		Fields: []DataFormField{
+			{Var: "FORM_TYPE", Type: "hidden", Values: []string{MUCRoomConfigFormType}},
+			{Var: "muc#roomconfig_roomname", Type: "text-single", Label: "Natural-Language Room Name",
+				Values: []string{config.Title}},
+			{Var: "muc#roomconfig_roomdesc", Type: "text-single", Label: "Short Description of Room",
+				Values: []string{config.Description}},
+			{Var: "muc#roomconfig_persistentroom", Type: "boolean", Label: "Make Room Persistent?",
+				Values: boolValue(config.Persistent)},
+			{Var: "muc#roomconfig_publicroom", Type: "boolean", Label: "Make Room Publicly Searchable?",
+				Values: boolValue(config.Public)},
+			{Var: "muc#roomconfig_membersonly", Type: "boolean", Label: "Make Room Members-Only?",
+				Values: boolValue(config.MembersOnly)},
+			{Var: "muc#roomconfig_moderatedroom", Type: "boolean", Label: "Make Room Moderated?",
+				Values: boolValue(config.Moderated)},
+			{Var: "muc#roomconfig_changesubject", Type: "boolean", Label: "Allow Occupants to Change Subject?",
+				Values: boolValue(config.ChangeSubject)},
+			{Var: "muc#roomconfig_allowinvites", Type: "boolean", Label: "Allow Occupants to Invite Others?",
+				Values: boolValue(config.AllowInvites)},
+			{Var: "muc#roomconfig_passwordprotectedroom", Type: "boolean", Label: "Password Required to Enter?",
+				Values: boolValue(config.Password != "")},
+			{Var: "muc#roomconfig_roomsecret", Type: "text-private", Label: "Password",
+				Values: []string{config.Password}},
+			{Var: "muc#roomconfig_whois", Type: "list-single", Label: "Who May Discover Real JIDs?",
+				Values: []string{config.WhoIs}, Options: []DataFormOption{
+					{Label: "Moderators Only", Value: MUCWhoIsModerators},
+					{Label: "Anyone", Value: MUCWhoIsAnyone},
+				}},
+			{Var: "muc#roomconfig_maxusers", Type: "list-single", Label: "Maximum Number of Occupants",
+				Values: []string{maxUsers}, Options: []DataFormOption{
+					{Value: "10"}, {Value: "20"}, {Value: "30"}, {Value: "50"},
+					{Value: "100"}, {Value: "none"},
+				}},
+		},
+	}
+	if srv.messageArchiveStore != nil {
+		form.Fields = append(form.Fields, DataFormField{
+			Var: "muc#roomconfig_enablearchiving", Type: "boolean", Label: "Enable Message Archiving?",
+			Values: boolValue(config.Archive),
+		})
+	}
+	return form
+}
+
+// applyMUCRoomConfigForm applies the submitted room configuration. It
+// returns false if any of the values is not acceptable.
+func applyMUCRoomConfigForm(config *MUCRoomConfig, form *DataForm) bool {
+	passwordProtected := config.Password != ""
+	password := config.Password
+	for _, field := range form.Fields {
+		var value string
+		if len(field.Values) > 0 {
+			value = field.Values[0]
+		}
+		var boolTarget *bool
+		switch field.Var {
+		case "FORM_TYPE":
+			if value != MUCRoomConfigFormType {
+				return false
+			}
+		case "muc#roomconfig_roomname":
+			config.Title = value
+		case "muc#roomconfig_roomdesc":
+			config.Description = value
+		case "muc#roomconfig_persistentroom":
+			boolTarget = &config.Persistent
+		case "muc#roomconfig_publicroom":
+			boolTarget = &config.Public
+		case "muc#roomconfig_membersonly":
+			boolTarget = &config.MembersOnly
+		case "muc#roomconfig_moderatedroom":
+			boolTarget = &config.Moderated
+		case "muc#roomconfig_changesubject":
+			boolTarget = &config.ChangeSubject
+		case "muc#roomconfig_allowinvites":
+			boolTarget = &config.AllowInvites
+		case "muc#roomconfig_enablearchiving":
+			boolTarget = &config.Archive
+		case "muc#roomconfig_passwordprotectedroom":
+			boolTarget = &passwordProtected
+		case "muc#roomconfig_roomsecret":
+			password = value
+		case "muc#roomconfig_whois":
+			switch value {
+			case MUCWhoIsModerators, MUCWhoIsAnyone:
+				config.WhoIs = value
+			default:
+				return false
+			}
+		case "muc#roomconfig_maxusers":
+			if value == "none" || value == "" {
+				config.MaxUsers = 0
+				continue
+			}
+			maxUsers, err := strconv.Atoi(value)
+			if err != nil || maxUsers < 1 {
+				return false
+			}
+			config.MaxUsers = maxUsers
+		}
+		if boolTarget != nil {
+			boolValue, ok := parseXMPPBoolean(value)
+			if !ok {
+				return false
+			}
+			*boolTarget = boolValue
+		}
+	}
+	if passwordProtected {
+		if password == "" {
+			return false
+		}
+		config.Password = password
+	} else {
+		config.Password = ""
+	}
+	return true
+}
+
+// handleMUCOwnerQuery handles the room configuration and destruction
+// (XEP-0045 10).
+func (srv *Server) handleMUCOwnerQuery(cl *Client, iq *xmppcore.ClientIQ, room *mucRoom, query *MUCOwnerQuery) {
+	if room.affiliation(cl.jid) != MUCAffiliationOwner {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	if iq.Type == xmppcore.IQTypeGet {
+		srv.sendClientIQResult(cl, iq, &MUCOwnerQuery{Form: srv.mucRoomConfigForm(room.info.Config)})
+		return
+	}
+
+	if query.Destroy != nil {
+		srv.sendClientIQResult(cl, iq, nil)
+		srv.destroyMUCRoom(room, query.Destroy)
+		return
+	}
+	if query.Form == nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	switch query.Form.Type {
+	case "cancel":
+		srv.sendClientIQResult(cl, iq, nil)
+		// XEP-0045 10.1.3: cancelling the initial configuration
+		// destroys the room.
+		if room.locked {
+			srv.destroyMUCRoom(room, &MUCDestroy{})
+		}
+		return
+	case "submit":
+	default:
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+
+	// An empty form accepts the default configuration, i.e., an
+	// instant room (XEP-0045 10.1.2).
+	config := room.info.Config
+	if !applyMUCRoomConfigForm(&config, query.Form) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	wasPersistent := room.info.Config.Persistent && !room.locked
+	room.info.Config = config
+	room.locked = false
+	if wasPersistent && !config.Persistent {
+		if err := srv.mucStore.DeleteMUCRoom(room.info.Name); err != nil {
+			log.WithFields(logrus.Fields{"jid": room.jid}).
+				Error("Unable to delete the room: ", err)
+		}
+	}
+	srv.saveMUCRoom(room)
+	srv.sendClientIQResult(cl, iq, nil)
+
+	// The members-only rooms are only for the members
+	if config.MembersOnly {
+		for _, occupant := range room.occupants {
+			if room.affiliation(occupant.client.jid) == MUCAffiliationNone {
+				srv.removeMUCOccupant(room, occupant, nil, MUCItem{}, mucStatusMembersOnly)
+			}
+		}
+	}
+}
+
+// destroyMUCRoom removes the room and tells the occupants about it
+// (XEP-0045 10.9). It must be called with the room's mutex held.
+func (srv *Server) destroyMUCRoom(room *mucRoom, destroy *MUCDestroy) {
+	for _, occupant := range room.occupants {
+		userXML, err := xml.Marshal(&MUCUser{
+			Items:   []MUCItem{{Affiliation: MUCAffiliationNone, Role: MUCRoleNone}},
+			Destroy: destroy,
+		})
+		if err != nil {
+			panic(err)
+		}
+		fromJID := room.occupantJID(occupant.nick)
+		toJID := occupant.client.jid
+		srv.deliverPresence(occupant.client, &clientPresence{
+			Type:    "unavailable",
+			From:    &fromJID,
+			To:      &toJID,
+			Payload: userXML,
+		})
+	}
+	room.occupants = make(map[string]*mucOccupant)
+	if err := srv.mucStore.DeleteMUCRoom(room.info.Name); err != nil {
+		log.WithFields(logrus.Fields{"jid": room.jid}).
+			Error("Unable to delete the room: ", err)
+	}
+	srv.removeMUCRoom(room)
+	log.WithFields(logrus.Fields{"jid": room.jid}).
+		Info("Room destroyed")
+}
+
+// mucAffiliationRank orders the affiliations by their privileges.
+func mucAffiliationRank(affiliation string) int {
+	switch affiliation {
+	case MUCAffiliationOwner:
+		return 4
+	case MUCAffiliationAdmin:
+		return 3
+	case MUCAffiliationMember:
+		return 2
+	case MUCAffiliationNone:
+		return 1
+	}
+	return 0
+}
+
+// handleMUCAdminQuery handles the moderator and admin use cases
+// (XEP-0045 8, 9).
+func (srv *Server) handleMUCAdminQuery(cl *Client, iq *xmppcore.ClientIQ, room *mucRoom, query *MUCAdminQuery) {
+	requester := room.occupantByJID(cl.jid)
+	requesterAffiliation := room.affiliation(cl.jid)
+	isModerator := requester != nil && requester.role == MUCRoleModerator
+	isAdmin := mucAffiliationRank(requesterAffiliation) >= mucAffiliationRank(MUCAffiliationAdmin)
+
+	if len(query.Items) == 0 {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+
+	if iq.Type == xmppcore.IQTypeGet {
+		item := query.Items[0]
+		var items []MUCItem
+		switch {
+		case item.Affiliation != "":
+			if !isAdmin {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeAuth,
+					Condition: xmppcore.StanzaErrorConditionForbidden,
+				})
+				return
+			}
+			for jidStr, affiliation := range room.info.Affiliations {
+				if affiliation == item.Affiliation {
+					items = append(items, MUCItem{Affiliation: affiliation, JID: jidStr})
+				}
+			}
+		case item.Role != "":
+			if !isModerator {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeAuth,
+					Condition: xmppcore.StanzaErrorConditionForbidden,
+				})
+				return
+			}
+			for _, occupant := range room.occupants {
+				if occupant.role == item.Role {
+					items = append(items, MUCItem{
+						Affiliation: room.affiliation(occupant.client.jid),
+						Role:        occupant.role,
+						Nick:        occupant.nick,
+						JID:         occupant.client.jid.FullString(),
+					})
+				}
+			}
+		default:
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionBadRequest,
+			})
+			return
+		}
+		srv.sendClientIQResult(cl, iq, &MUCAdminQuery{Items: items})
+		return
+	}
+
+	// All the changes are checked before any of them is applied
+	for _, item := range query.Items {
+		if stanzaError := srv.mucAdminItemError(room, requester, requesterAffiliation, item); stanzaError != nil {
+			srv.sendClientIQError(cl, iq, *stanzaError)
+			return
+		}
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+
+	actor := &MUCActor{}
+	if requester != nil {
+		actor.Nick = requester.nick
+	}
+	for _, item := range query.Items {
+		if item.Affiliation != "" {
+			srv.setMUCAffiliation(room, item, actor)
+		} else {
+			srv.setMUCRole(room, item, actor)
+		}
+	}
+}
+
+// mucAdminItemError checks whether the requester is allowed to make the
+// change. It returns nil if the change is allowed.
+func (srv *Server) mucAdminItemError(
+	room *mucRoom, requester *mucOccupant, requesterAffiliation string, item MUCItem,
+) *xmppcore.StanzaError {
+	notAllowed := &xmppcore.StanzaError{
+		Type:      xmppcore.StanzaErrorTypeCancel,
+		Condition: xmppcore.StanzaErrorConditionNotAllowed,
+	}
+	requesterRank := mucAffiliationRank(requesterAffiliation)
+
+	if item.Affiliation != "" {
+		targetJID, ok := srv.mucItemJID(room, item)
+		if !ok {
+			return &xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+			}
+		}
+		newRank := mucAffiliationRank(item.Affiliation)
+		if newRank == 0 && item.Affiliation != MUCAffiliationOutcast {
+			return &xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionBadRequest,
+			}
+		}
+		if requesterRank < mucAffiliationRank(MUCAffiliationAdmin) {
+			return &xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeAuth,
+				Condition: xmppcore.StanzaErrorConditionForbidden,
+			}
+		}
+		// The admins only manage the members and the outcasts
+		if requesterAffiliation != MUCAffiliationOwner &&
+			(newRank >= mucAffiliationRank(MUCAffiliationAdmin) ||
+				mucAffiliationRank(room.affiliation(targetJID)) >= mucAffiliationRank(MUCAffiliationAdmin)) {
+			return notAllowed
+		}
+		// The room must keep at least one owner
+		if room.affiliation(targetJID) == MUCAffiliationOwner && item.Affiliation != MUCAffiliationOwner {
+			owners := 0
+			for _, affiliation := range room.info.Affiliations {
+				if affiliation == MUCAffiliationOwner {
+					owners++
+				}
+			}
+			if owners <= 1 {
+				return &xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeCancel,
+					Condition: xmppcore.StanzaErrorConditionConflict,
+				}
+			}
+		}
+		return nil
+	}
+
+	if requester == nil || requester.role != MUCRoleModerator {
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		}
+	}
+	target := room.occupants[item.Nick]
+	if target == nil {
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		}
+	}
+	switch item.Role {
+	case MUCRoleNone, MUCRoleVisitor, MUCRoleParticipant:
+		// A moderator can't kick or silence those with higher
+		// affiliation (XEP-0045 8.2).
+		if mucAffiliationRank(room.affiliation(target.client.jid)) > requesterRank ||
+			mucAffiliationRank(room.affiliation(target.client.jid)) >= mucAffiliationRank(MUCAffiliationAdmin) {
+			return notAllowed
+		}
+	case MUCRoleModerator:
+		if requesterRank < mucAffiliationRank(MUCAffiliationAdmin) {
+			return notAllowed
+		}
+	default:
+		return &xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		}
+	}
+	return nil
+}
+
+// mucItemJID returns the bare JID which the item refers to, either
+// directly or through the nick of an occupant.
+func (srv *Server) mucItemJID(room *mucRoom, item MUCItem) (xmppcore.JID, bool) {
+	if item.JID != "" {
+		jid, err := xmppcore.ParseJID(item.JID)
+		if err != nil {
+			return xmppcore.JID{}, false
+		}
+		return *jid.BareCopyPtr(), true
+	}
+	if occupant := room.occupants[item.Nick]; occupant != nil {
+		return *occupant.client.jid.BareCopyPtr(), true
+	}
+	return xmppcore.JID{}, false
+}
+
+func (srv *Server) setMUCRole(room *mucRoom, item MUCItem, actor *MUCActor) {
+	occupant := room.occupants[item.Nick]
+	if occupant == nil || occupant.role == item.Role {
+		return
+	}
+	if item.Role == MUCRoleNone {
+		// Kick (XEP-0045 8.2)
+		srv.removeMUCOccupant(room, occupant, nil, MUCItem{Actor: actor, Reason: item.Reason}, mucStatusKicked)
+		return
+	}
+	occupant.role = item.Role
+	presenceItem := room.occupantItem(occupant)
+	presenceItem.Actor = actor
+	presenceItem.Reason = item.Reason
+	srv.broadcastMUCPresence(room, occupant, "", occupant.payload, presenceItem)
+}
+
+func (srv *Server) setMUCAffiliation(room *mucRoom, item MUCItem, actor *MUCActor) {
+	targetJID, ok := srv.mucItemJID(room, item)
+	if !ok {
+		return
+	}
+	targetKey := targetJID.FullString()
+	if item.Affiliation == MUCAffiliationNone {
+		delete(room.info.Affiliations, targetKey)
+	} else {
+		if room.info.Affiliations == nil {
+			room.info.Affiliations = make(map[string]string)
+		}
+		room.info.Affiliations[targetKey] = item.Affiliation
+	}
+	srv.saveMUCRoom(room)
+
+	for _, occupant := range room.occupants {
+		if !occupant.client.jid.BareCopyPtr().Equals(targetJID) {
+			continue
+		}
+		switch {
+		case item.Affiliation == MUCAffiliationOutcast:
+			// Ban (XEP-0045 9.1)
+			srv.removeMUCOccupant(room, occupant, nil, MUCItem{Actor: actor, Reason: item.Reason}, mucStatusBanned)
+		case item.Affiliation == MUCAffiliationNone && room.info.Config.MembersOnly:
+			srv.removeMUCOccupant(room, occupant, nil, MUCItem{Actor: actor, Reason: item.Reason},
+				mucStatusAffiliationRemoved)
+		default:
+			occupant.role = room.defaultRole(item.Affiliation)
+			presenceItem := room.occupantItem(occupant)
+			presenceItem.Actor = actor
+			presenceItem.Reason = item.Reason
+			srv.broadcastMUCPresence(room, occupant, "", occupant.payload, presenceItem)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0313 7: the archives of the rooms. Each room's archive is
+// identified by the room's bare JID and the messages are archived as
+// they were broadcast, i.e., from the occupants' room JIDs. The senders'
+// real JIDs are archived apart from the messages and disclosed as the
+// room's configuration allows at the time of the query.
+
+func (srv *Server) mucArchiveEnabled(room *mucRoom) bool {
+	return srv.messageArchiveStore != nil && room.info.Config.Archive
+}
+
+// archiveMUCMessage archives the groupchat message which is about to be
+// broadcast and stamps it with the room's stanza-id (XEP-0359). The
+// message's payload must have been stripped with mucGroupchatPayload. It
+// must be called with the room's mutex held.
+func (srv *Server) archiveMUCMessage(room *mucRoom, sender *mucOccupant, msg *clientMessage) {
+	if !srv.mucArchiveEnabled(room) || !messageHasBody(msg) {
+		return
+	}
+	roomStr := room.jid.FullString()
+	stanzaID := generateID()
+	stanzaIDXML, err := xml.Marshal(&StanzaID{ID: stanzaID, By: roomStr})
+	if err != nil {
+		panic(err)
+	}
+	msg.Payload = append(msg.Payload, stanzaIDXML...)
+
+	// The sender could have made up the real JID
+	archivedMsg := &clientMessage{
+		ID:      msg.ID,
+		Type:    msg.Type,
+		From:    msg.From,
+		Payload: mucPresencePayload(msg.Payload),
+	}
+	srv.appendArchivedMessage(roomStr, msg.From.FullString(), sender.client.jid.FullString(), stanzaID, archivedMsg)
+}
+
+// mucStanzaWithRealJID adds the sender's real JID to the archived message
+// (XEP-0313 7.1.2).
+func mucStanzaWithRealJID(stanza []byte, realJID string) []byte {
+	var msg clientMessage
+	if err := xml.Unmarshal(stanza, &msg); err != nil {
+		return stanza
+	}
+	userXML, err := xml.Marshal(&MUCUser{Items: []MUCItem{{JID: realJID}}})
+	if err != nil {
+		panic(err)
+	}
+	msg.Payload = append(msg.Payload, userXML...)
+	msgXML, err := xml.Marshal(&msg)
+	if err != nil {
+		panic(err)
+	}
+	return msgXML
+}
+
+// loadMUCHistory fills the history of the room, which has just been
+// loaded from the storage, with the most recent messages of its archive
+// so that the history survives the restarts.
+func (srv *Server) loadMUCHistory(room *mucRoom) {
+	if !srv.mucArchiveEnabled(room) || srv.mucMaxHistory <= 0 {
+		return
+	}
+	result, err := srv.messageArchiveStore.QueryArchivedMessages(room.jid.FullString(), &ArchiveQuery{
+		Max:     srv.mucMaxHistory,
+		FromEnd: true,
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{"jid": room.jid}).
+			Error("Unable to load the room's history: ", err)
+		return
+	}
+	for _, archivedMsg := range result.Messages {
+		var msg clientMessage
+		if err = xml.Unmarshal(archivedMsg.Stanza, &msg); err != nil {
+			log.WithFields(logrus.Fields{"jid": room.jid, "stanza": archivedMsg.ID}).
+				Warn("Unable to read an archived message: ", err)
+			continue
+		}
+		room.history = append(room.history, mucHistoryMessage{msg: &msg, stamp: archivedMsg.Stamp})
+	}
+}
+
+// handleMUCMAMQuery handles the queries on the room's archive. The
+// archive is available to those who could join the room.
+func (srv *Server) handleMUCMAMQuery(cl *Client, iq *xmppcore.ClientIQ, room *mucRoom, query *MAMQuery) {
+	if !srv.mucArchiveEnabled(room) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	}
+	affiliation := room.affiliation(cl.jid)
+	allowed := affiliation != MUCAffiliationOutcast
+	if allowed && room.occupantByJID(cl.jid) == nil {
+		if room.info.Config.MembersOnly &&
+			mucAffiliationRank(affiliation) < mucAffiliationRank(MUCAffiliationMember) {
+			allowed = false
+		}
+		if room.info.Config.Password != "" &&
+			mucAffiliationRank(affiliation) < mucAffiliationRank(MUCAffiliationAdmin) {
+			allowed = false
+		}
+	}
+	if !allowed {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+	// As with the occupants' presences, the real JIDs are for everyone
+	// in non-anonymous rooms and for the moderators otherwise
+	withRealJIDs := room.info.Config.WhoIs == MUCWhoIsAnyone
+	if occupant := room.occupantByJID(cl.jid); occupant != nil && occupant.role == MUCRoleModerator {
+		withRealJIDs = true
+	}
+	srv.queryMessageArchive(cl, iq, &room.jid, query, withRealJIDs)
+}
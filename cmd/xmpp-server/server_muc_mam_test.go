@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// joinTestRoom joins the room with the nick and returns what the server
+// has sent in return.
+func (c *testClient) joinTestRoom(room, nick string) []string {
+	c.t.Helper()
+	c.send(`<presence to='` + room + `/` + nick + `'><x xmlns='http://jabber.org/protocol/muc'/></presence>`)
+	return c.sync()
+}
+
+func TestMUCMAMRealJIDs(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MUCStorage = "memory"
+		cfg.MessageArchiveStorage = "memory"
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	alice.available()
+	bob := ts.connect("bob", "laptop")
+	bob.available()
+
+	alice.joinTestRoom("room@groups.localhost", "alice")
+	alice.request(`<iq type='set' id='config' to='room@groups.localhost'>` +
+		`<query xmlns='http://jabber.org/protocol/muc#owner'><x xmlns='jabber:x:data' type='submit'/></query></iq>`)
+	bob.joinTestRoom("room@groups.localhost", "bob")
+	alice.sync()
+
+	// The real JID made up by the sender is dropped
+	bob.send(`<message type='groupchat' to='room@groups.localhost'><body>Hello</body>` +
+		`<x xmlns='http://jabber.org/protocol/muc#user'><item jid='carol@localhost/made-up'/></x></message>`)
+	for _, received := range append(alice.sync(), bob.sync()...) {
+		if strings.Contains(received, "muc#user") {
+			t.Fatalf("real JID disclosed: %s", received)
+		}
+	}
+
+	// The room is semi-anonymous: the real JIDs are for the moderators
+	page := bob.queryMAM("room@groups.localhost", `<max>10</max>`)
+	if strings.Join(page.bodies, ",") != "Hello" || page.realJIDs[0] != "" {
+		t.Fatalf("unexpected page for a participant: %+v", page)
+	}
+	page = alice.queryMAM("room@groups.localhost", `<max>10</max>`)
+	if strings.Join(page.bodies, ",") != "Hello" || page.realJIDs[0] != "bob@localhost/laptop" {
+		t.Fatalf("unexpected page for a moderator: %+v", page)
+	}
+
+	// and for everyone once the room is non-anonymous
+	alice.request(`<iq type='set' id='whois' to='room@groups.localhost'>` +
+		`<query xmlns='http://jabber.org/protocol/muc#owner'><x xmlns='jabber:x:data' type='submit'>` +
+		`<field var='muc#roomconfig_whois'><value>anyone</value></field></x></query></iq>`)
+	bob.sync()
+	page = bob.queryMAM("room@groups.localhost", `<max>10</max>`)
+	if strings.Join(page.bodies, ",") != "Hello" || page.realJIDs[0] != "bob@localhost/laptop" {
+		t.Fatalf("unexpected page for a participant of a non-anonymous room: %+v", page)
+	}
+
+	alice.close()
+	bob.close()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// testMUCPresence is the part of an occupant's presence which the tests
+// look at.
+type testMUCPresence struct {
+	From string `xml:"from,attr"`
+	Type string `xml:"type,attr"`
+	X    struct {
+		Item struct {
+			Affiliation string `xml:"affiliation,attr"`
+			Role        string `xml:"role,attr"`
+		} `xml:"item"`
+		Statuses []struct {
+			Code int `xml:"code,attr"`
+		} `xml:"status"`
+	} `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+// mucPresence returns the last presence of the occupant among the
+// elements, or nil.
+func mucPresence(t *testing.T, elems []string, occupantJID string) *testMUCPresence {
+	t.Helper()
+	var last *testMUCPresence
+	for _, data := range elems {
+		if !strings.HasPrefix(data, "<presence") {
+			continue
+		}
+		var presence testMUCPresence
+		if err := xml.Unmarshal([]byte(data), &presence); err != nil {
+			t.Fatalf("invalid presence %s: %v", data, err)
+		}
+		if presence.From == occupantJID {
+			last = &presence
+		}
+	}
+	return last
+}
+
+// setMUCRole asks the room to change the role of the occupant and
+// returns the response.
+func (c *testClient) setMUCRole(room, nick, role string) string {
+	c.t.Helper()
+	return c.request(`<iq type='set' id='role-` + nick + `' to='` + room + `'>` +
+		`<query xmlns='http://jabber.org/protocol/muc#admin'><item nick='` + nick + `' role='` + role + `'/></query></iq>`)
+}
+
+func TestMUCRoles(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MUCStorage = "memory"
+	})
+	defer ts.close()
+	const room = "room@groups.localhost"
+	alice := ts.connect("alice", "phone")
+	alice.available()
+	bob := ts.connect("bob", "laptop")
+	bob.available()
+	carol := ts.connect("carol", "desk")
+	carol.available()
+
+	// The owner creates a moderated room
+	if presence := mucPresence(t, alice.joinTestRoom(room, "alice"), room+"/alice"); presence == nil ||
+		presence.X.Item.Role != MUCRoleModerator || presence.X.Item.Affiliation != MUCAffiliationOwner {
+		t.Fatalf("unexpected presence of the owner: %+v", presence)
+	}
+	alice.request(`<iq type='set' id='config' to='` + room + `'>` +
+		`<query xmlns='http://jabber.org/protocol/muc#owner'><x xmlns='jabber:x:data' type='submit'>` +
+		`<field var='muc#roomconfig_moderatedroom'><value>1</value></field></x></query></iq>`)
+
+	// The others join as visitors who can't speak
+	if presence := mucPresence(t, bob.joinTestRoom(room, "bob"), room+"/bob"); presence == nil ||
+		presence.X.Item.Role != MUCRoleVisitor {
+		t.Fatalf("unexpected presence of a visitor: %+v", presence)
+	}
+	carol.joinTestRoom(room, "carol")
+	alice.sync()
+	bob.sync()
+	bob.send(`<message type='groupchat' id='m1' to='` + room + `'><body>Hello</body></message>`)
+	if received := bob.expect("<message"); !strings.Contains(received, "<forbidden") {
+		t.Fatalf("expected a forbidden error, got %s", received)
+	}
+	if response := bob.setMUCRole(room, "carol", MUCRoleParticipant); !strings.Contains(response, "<forbidden") {
+		t.Fatalf("expected a forbidden error, got %s", response)
+	}
+
+	// The moderator gives a voice to the visitor
+	if response := alice.setMUCRole(room, "bob", MUCRoleParticipant); strings.Contains(response, "error") {
+		t.Fatalf("unexpected error: %s", response)
+	}
+	for _, c := range []*testClient{alice, bob, carol} {
+		if presence := mucPresence(t, c.sync(), room+"/bob"); presence == nil || presence.X.Item.Role != MUCRoleParticipant {
+			t.Fatalf("unexpected presence of the participant: %+v", presence)
+		}
+	}
+	bob.send(`<message type='groupchat' id='m2' to='` + room + `'><body>Hello</body></message>`)
+	if msg := parseTestMessage(t, alice.expect("<message")); msg.Body != "Hello" || msg.From != room+"/bob" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	bob.sync()
+	carol.sync()
+
+	// A participant can't kick, and no one can kick the owner
+	if response := bob.setMUCRole(room, "carol", MUCRoleNone); !strings.Contains(response, "<forbidden") {
+		t.Fatalf("expected a forbidden error, got %s", response)
+	}
+	alice.request(`<iq type='set' id='admin' to='` + room + `'>` +
+		`<query xmlns='http://jabber.org/protocol/muc#admin'><item jid='bob@localhost' affiliation='admin'/></query></iq>`)
+	if presence := mucPresence(t, bob.sync(), room+"/bob"); presence == nil || presence.X.Item.Role != MUCRoleModerator {
+		t.Fatalf("expected the admin to be a moderator: %+v", presence)
+	}
+	if response := bob.setMUCRole(room, "alice", MUCRoleNone); !strings.Contains(response, "<not-allowed") {
+		t.Fatalf("expected a not-allowed error, got %s", response)
+	}
+
+	// The moderators list the occupants by role and kick them
+	response := bob.request(`<iq type='get' id='visitors' to='` + room + `'>` +
+		`<query xmlns='http://jabber.org/protocol/muc#admin'><item role='visitor'/></query></iq>`)
+	if !strings.Contains(response, "carol@localhost/desk") || strings.Contains(response, "alice@localhost") {
+		t.Fatalf("unexpected visitors: %s", response)
+	}
+	if response = bob.setMUCRole(room, "carol", MUCRoleNone); strings.Contains(response, "error") {
+		t.Fatalf("unexpected error: %s", response)
+	}
+	presence := mucPresence(t, carol.sync(), room+"/carol")
+	if presence == nil || presence.Type != "unavailable" || len(presence.X.Statuses) == 0 {
+		t.Fatalf("expected carol to be kicked: %+v", presence)
+	}
+	kicked := false
+	for _, status := range presence.X.Statuses {
+		kicked = kicked || status.Code == mucStatusKicked
+	}
+	if !kicked {
+		t.Fatalf("expected the kicked status: %+v", presence)
+	}
+	carol.send(`<message type='groupchat' id='m3' to='` + room + `'><body>Hello</body></message>`)
+	if received := carol.expect("<message"); !strings.Contains(received, "<not-acceptable") {
+		t.Fatalf("expected a not-acceptable error, got %s", received)
+	}
+
+	alice.close()
+	bob.close()
+	carol.close()
+}
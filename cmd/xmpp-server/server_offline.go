@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0160: Best Practices for Handling Offline Messages
+// XEP-0013: Flexible Offline Message Retrieval
+
+func (srv *Server) flexibleOfflineEnabled() bool {
+	return srv.offlineMessageStore != nil && srv.flexibleOfflineRetrieval
+}
+
+// storeOfflineMessage returns false if the message wasn't stored, e.g.,
+// the offline storage is disabled or the recipient's quota has been
+// reached.
+func (srv *Server) storeOfflineMessage(msg *clientMessage) bool {
+	if srv.offlineMessageStore == nil {
+		return false
+	}
+	msgXML, err := xml.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	stored, err := srv.offlineMessageStore.PutOfflineMessage(msg.To.Local, &OfflineMessage{
+		ID:     uuid.New().String(),
+		From:   msg.From.FullString(),
+		Stamp:  time.Now().UTC(),
+		Stanza: msgXML,
+	}, srv.offlineMessageQuota)
+	if err != nil {
+		log.WithFields(logrus.Fields{"user": msg.To.Local, "stanza": msg.ID}).
+			Error("Unable to store offline message: ", err)
+		return false
+	}
+	if !stored {
+		log.WithFields(logrus.Fields{"user": msg.To.Local, "stanza": msg.ID}).
+			Info("Offline message quota reached")
+	}
+	return stored
+}
+
+// offlineMessageStanza reconstructs the stored message with the delay
+// stamp (XEP-0203) as required by XEP-0160. If flexible is true, the
+// message is annotated with its XEP-0013 node.
+func (srv *Server) offlineMessageStanza(offlineMsg *OfflineMessage, flexible bool) *clientMessage {
+	var msg clientMessage
+	err := xml.Unmarshal(offlineMsg.Stanza, &msg)
+	if err != nil {
+		log.WithFields(logrus.Fields{"offlineMessage": offlineMsg.ID}).
+			Error("Unable to decode offline message: ", err)
+		return nil
+	}
+	delayXML, err := xml.Marshal(&Delay{
+		From:  srv.jid.FullString(),
+		Stamp: xmppDateTimeString(offlineMsg.Stamp),
+		Text:  "Offline Storage",
+	})
+	if err != nil {
+		panic(err)
+	}
+	msg.Payload = append(msg.Payload, delayXML...)
+	if flexible {
+		offlineXML, err := xml.Marshal(&OfflineQuery{
+			Items: []OfflineItem{{Node: offlineMsg.ID}},
+		})
+		if err != nil {
+			panic(err)
+		}
+		msg.Payload = append(msg.Payload, offlineXML...)
+	}
+	return &msg
+}
+
+// deliverOfflineMessages sends all the stored messages to the client
+// then removes the delivered ones from the storage. The messages which
+// can't be decoded are kept, e.g., for the user to remove them with
+// XEP-0013.
+func (srv *Server) deliverOfflineMessages(cl *Client) {
+	if srv.offlineMessageStore == nil {
+		return
+	}
+	offlineMsgs, err := srv.offlineMessageStore.OfflineMessages(cl.jid.Local)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to retrieve offline messages: ", err)
+		return
+	}
+	if len(offlineMsgs) == 0 {
+		return
+	}
+	deliveredIDs := make([]string, 0, len(offlineMsgs))
+	for _, offlineMsg := range offlineMsgs {
+		msg := srv.offlineMessageStanza(offlineMsg, false)
+		if msg != nil && srv.deliverMessage(cl, msg) {
+			deliveredIDs = append(deliveredIDs, offlineMsg.ID)
+		}
+	}
+	if len(deliveredIDs) < len(offlineMsgs) {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Warnf("Kept %d undeliverable offline messages", len(offlineMsgs)-len(deliveredIDs))
+	}
+	if len(deliveredIDs) == 0 {
+		return
+	}
+	err = srv.offlineMessageStore.DeleteOfflineMessages(cl.jid.Local, deliveredIDs)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to remove delivered offline messages: ", err)
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("Delivered %d offline messages", len(deliveredIDs))
+}
+
+// offlineDiscoInfo describes the offline messages node of the user's own
+// account (XEP-0013 2.2).
+func (srv *Server) offlineDiscoInfo(cl *Client, jid xmppcore.JID, node string, result *DiscoInfo) (bool, error) {
+	if node != OfflineNS || cl == nil || !jid.Equals(*cl.jid.BareCopyPtr()) {
+		return false, nil
+	}
+	cl.flexibleOffline = true
+	offlineMsgs, err := srv.offlineMessageStore.OfflineMessages(cl.jid.Local)
+	if err != nil {
+		return false, err
+	}
+	result.Identity = append(result.Identity, xmppdisco.Identity{Category: "automation", Type: "message-list"})
+	result.Feature = append(result.Feature, xmppdisco.Feature{Var: OfflineNS})
+	result.Forms = append(result.Forms, DataForm{
+		Type: "result",
+		Fields: []DataFormField{
+			{Var: "FORM_TYPE", Type: "hidden", Values: []string{OfflineNS}},
+			{Var: "number_of_messages", Values: []string{strconv.Itoa(len(offlineMsgs))}},
+		},
+	})
+	return true, nil
+}
+
+// offlineDiscoItems lists the headers of the offline messages (XEP-0013
+// 2.3).
+func (srv *Server) offlineDiscoItems(cl *Client, jid xmppcore.JID, node string, result *DiscoItems) (bool, error) {
+	if node != OfflineNS || cl == nil || !jid.Equals(*cl.jid.BareCopyPtr()) {
+		return false, nil
+	}
+	cl.flexibleOffline = true
+	offlineMsgs, err := srv.offlineMessageStore.OfflineMessages(cl.jid.Local)
+	if err != nil {
+		return false, err
+	}
+	bareJID := jid.FullString()
+	for _, offlineMsg := range offlineMsgs {
+		result.Items = append(result.Items, DiscoItem{
+			JID:  bareJID,
+			Node: offlineMsg.ID,
+			Name: offlineMsg.From,
+		})
+	}
+	return true, nil
+}
+
+func (srv *Server) handleClientOfflineIQ(cl *Client, iq *xmppcore.ClientIQ, query *OfflineQuery) {
+	cl.flexibleOffline = true
+
+	offlineMsgs, err := srv.offlineMessageStore.OfflineMessages(cl.jid.Local)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to retrieve offline messages: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	offlineMsgMap := make(map[string]*OfflineMessage, len(offlineMsgs))
+	for _, offlineMsg := range offlineMsgs {
+		offlineMsgMap[offlineMsg.ID] = offlineMsg
+	}
+
+	if iq.Type == xmppcore.IQTypeGet {
+		if query.Fetch != nil {
+			for _, offlineMsg := range offlineMsgs {
+				if msg := srv.offlineMessageStanza(offlineMsg, true); msg != nil {
+					srv.deliverMessage(cl, msg)
+				}
+			}
+			srv.sendClientIQResult(cl, iq, nil)
+			return
+		}
+		var viewMsgs []*OfflineMessage
+		for _, item := range query.Items {
+			if item.Action != "view" {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeModify,
+					Condition: xmppcore.StanzaErrorConditionBadRequest,
+				})
+				return
+			}
+			offlineMsg := offlineMsgMap[item.Node]
+			if offlineMsg == nil {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeCancel,
+					Condition: xmppcore.StanzaErrorConditionItemNotFound,
+				})
+				return
+			}
+			viewMsgs = append(viewMsgs, offlineMsg)
+		}
+		for _, offlineMsg := range viewMsgs {
+			if msg := srv.offlineMessageStanza(offlineMsg, true); msg != nil {
+				srv.deliverMessage(cl, msg)
+			}
+		}
+		srv.sendClientIQResult(cl, iq, nil)
+		return
+	}
+
+	// IQ set
+	var removeIDs []string
+	if query.Purge == nil {
+		removeIDs = make([]string, 0, len(query.Items))
+		for _, item := range query.Items {
+			if item.Action != "remove" {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeModify,
+					Condition: xmppcore.StanzaErrorConditionBadRequest,
+				})
+				return
+			}
+			if offlineMsgMap[item.Node] == nil {
+				srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+					Type:      xmppcore.StanzaErrorTypeCancel,
+					Condition: xmppcore.StanzaErrorConditionItemNotFound,
+				})
+				return
+			}
+			removeIDs = append(removeIDs, item.Node)
+		}
+	}
+	err = srv.offlineMessageStore.DeleteOfflineMessages(cl.jid.Local, removeIDs)
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to remove offline messages: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+}
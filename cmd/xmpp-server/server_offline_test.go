@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOfflineMessagesDroppedOnOverflowAreKept(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.OfflineStorage = "memory"
+		cfg.ClientWriteQueueSize = 1
+		cfg.ClientWriteQueueOverflow = writeQueueOverflowDrop
+	})
+	defer ts.close()
+
+	const count = 20
+	alice := ts.connect("alice", "phone")
+	for i := 0; i < count; i++ {
+		alice.send(`<message type='chat' id='m` + strconv.Itoa(i) + `' to='bob@localhost'><body>` +
+			strconv.Itoa(i) + `</body></message>`)
+	}
+	alice.expectNothing()
+
+	// The transport takes the elements one at a time thus most of the
+	// offline messages overflow the queue
+	received := map[string]bool{}
+	collect := func(elems []string) {
+		for _, data := range elems {
+			if !strings.HasPrefix(data, "<message") {
+				continue
+			}
+			msg := parseTestMessage(t, data)
+			if received[msg.Body] {
+				t.Fatalf("message %s received twice", msg.Body)
+			}
+			received[msg.Body] = true
+		}
+	}
+	// Each session gets at least one message before the queue overflows
+	for session := 0; session < count && len(received) < count; session++ {
+		bob := ts.connectTransport(newMemoryTransport(0), "bob", "laptop")
+		bob.send(`<presence/>`)
+		collect(bob.drain(200 * time.Millisecond))
+		// Even the stream's footer may overflow the queue
+		bob.transport.Close()
+		if session == 0 && len(received) == count {
+			t.Skip("no message overflowed the queue")
+		}
+	}
+	if len(received) != count {
+		t.Fatalf("received %d of the %d offline messages", len(received), count)
+	}
+	alice.close()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0163: Personal Eventing Protocol
+
+var pepFeatures = []string{
+	PubSubNS + "#access-open",
+	PubSubNS + "#access-presence",
+	PubSubNS + "#access-whitelist",
+	PubSubNS + "#auto-create",
+	PubSubNS + "#last-published",
+	PubSubNS + "#publish",
+	PubSubNS + "#publish-options",
+	PubSubNS + "#retract-items",
+	PubSubNS + "#retrieve-items",
+}
+
+func (srv *Server) pepEnabled() bool {
+	return srv.pubsubStore != nil && srv.pep
+}
+
+// pepService returns the PEP service of the user which the IQ is
+// addressed to. An IQ without 'to' is addressed to the sender's account.
+func (srv *Server) pepService(cl *Client, iq *xmppcore.ClientIQ) pubsubService {
+	if iq.To == nil || iq.To.IsEmpty() {
+		return pubsubService{jid: *cl.jid.BareCopyPtr(), pep: true}
+	}
+	return pubsubService{jid: *iq.To.BareCopyPtr(), pep: true}
+}
+
+func (srv *Server) handleClientPEPIQ(cl *Client, iq *xmppcore.ClientIQ, pubsub *PubSub) {
+	if iq.To != nil && !iq.To.IsEmpty() &&
+		(iq.To.Local == "" || iq.To.Resource != "") {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	}
+	srv.handlePubSubIQ(cl, iq, srv.pepService(cl, iq), pubsub)
+}
+
+// pepDiscoInfo advertises the PEP service on the accounts.
+func (srv *Server) pepDiscoInfo(cl *Client, jid xmppcore.JID, node string, result *DiscoInfo) (bool, error) {
+	if node != "" {
+		return false, nil
+	}
+	result.Identity = append(result.Identity, xmppdisco.Identity{Category: "pubsub", Type: "pep"})
+	for _, feature := range pepFeatures {
+		result.Feature = append(result.Feature, xmppdisco.Feature{Var: feature})
+	}
+	return true, nil
+}
+
+// pepDiscoItems lists the nodes of the user's PEP service which are
+// accessible to the requester.
+func (srv *Server) pepDiscoItems(cl *Client, jid xmppcore.JID, node string, result *DiscoItems) (bool, error) {
+	if node != "" {
+		return false, nil
+	}
+	service := pubsubService{jid: jid, pep: true}
+	nodes, err := srv.pubsubStore.PubSubNodes(service.key())
+	if err != nil {
+		return false, err
+	}
+	for _, node := range nodes {
+		if srv.pubsubAccessError(service, node, cl.jid) != nil {
+			continue
+		}
+		result.Items = append(result.Items, DiscoItem{JID: service.key(), Node: node.Name})
+	}
+	return true, nil
+}
+
+// pepNotificationRecipients returns the available resources of the
+// owner and of the owner's contacts which are interested in the node's
+// events as indicated by the "+notify" features in their entity
+// capabilities, and which the node's access model lets retrieve the
+// items.
+func (srv *Server) pepNotificationRecipients(service pubsubService, node *PubSubNode) []*Client {
+	candidates := srv.userClients(service.jid.Local)
+	for _, contact := range srv.rosterLocalContacts(service.jid.Local) {
+		candidates = append(candidates, srv.userClients(contact)...)
+	}
+	var recipients []*Client
+	for _, rcl := range candidates {
+		if !rcl.isAvailable() || !rcl.hasFeature(node.Name+"+notify") {
+			continue
+		}
+		if srv.pubsubAccessError(service, node, rcl.jid) != nil {
+			continue
+		}
+		recipients = append(recipients, rcl)
+	}
+	return recipients
+}
+
+// sendPEPLastPublishedItems sends the last published item of each node
+// of the user's and the user's contacts' services the client is
+// interested in (XEP-0163 4.3.2).
+func (srv *Server) sendPEPLastPublishedItems(cl *Client) {
+	if !srv.pepEnabled() {
+		return
+	}
+	srv.sendPEPServiceLastPublishedItems(cl, pubsubService{jid: *cl.jid.BareCopyPtr(), pep: true})
+	for _, contact := range srv.rosterLocalContacts(cl.jid.Local) {
+		contactJID := xmppcore.JID{Local: contact, Domain: srv.jid.Domain}
+		srv.sendPEPServiceLastPublishedItems(cl, pubsubService{jid: contactJID, pep: true})
+	}
+}
+
+func (srv *Server) sendPEPServiceLastPublishedItems(cl *Client, service pubsubService) {
+	nodes, err := srv.pubsubStore.PubSubNodes(service.key())
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Error("Unable to load the PEP nodes: ", err)
+		return
+	}
+	for _, node := range nodes {
+		if !cl.hasFeature(node.Name + "+notify") {
+			continue
+		}
+		if srv.pubsubAccessError(service, node, cl.jid) != nil {
+			continue
+		}
+		items, err := srv.pubsubStore.PubSubItems(service.key(), node.Name, nil, 1)
+		if err != nil {
+			log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+				Error("Unable to load the PEP items: ", err)
+			continue
+		}
+		if len(items) == 0 {
+			continue
+		}
+		eventXML, err := xml.Marshal(&PubSubEvent{
+			Items: &PubSubEventItems{
+				Node:  node.Name,
+				Items: []PubSubItemElem{{ID: items[0].ID, Payload: items[0].Payload}},
+			},
+		})
+		if err != nil {
+			panic(err)
+		}
+		srv.deliverMessage(cl, &clientMessage{
+			ID:      generateID(),
+			Type:    messageTypeHeadline,
+			From:    &service.jid,
+			To:      &cl.jid,
+			Payload: eventXML,
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPEPNode = "urn:xmpp:test"
+
+func newTestPEPServer(t *testing.T) *testServer {
+	return newTestServer(t, func(cfg *Config) {
+		cfg.PEPEnabled = true
+		cfg.PubSubStorage = "memory"
+	})
+}
+
+func testPEPPublish(c *testClient, owner, itemID, payload string) string {
+	c.t.Helper()
+	return c.request(`<iq type='set' id='publish-` + itemID + `' to='` + owner + `'>` +
+		`<pubsub xmlns='http://jabber.org/protocol/pubsub'><publish node='` + testPEPNode + `'>` +
+		`<item id='` + itemID + `'><data xmlns='` + testPEPNode + `'>` + payload + `</data></item>` +
+		`</publish></pubsub></iq>`)
+}
+
+// countPEPEvents counts the events of the test node among the elements.
+func countPEPEvents(received []string) int {
+	count := 0
+	for _, data := range received {
+		if strings.HasPrefix(data, "<message") && strings.Contains(data, "pubsub#event") &&
+			strings.Contains(data, testPEPNode) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPEPNotifiesOnlyTheOwnersResources(t *testing.T) {
+	ts := newTestPEPServer(t)
+	defer ts.close()
+
+	phone := ts.connect("alice", "phone")
+	phone.announceFeatures("v1", testPEPNode+"+notify")
+	tablet := ts.connect("alice", "tablet")
+	tablet.announceFeatures("v1", testPEPNode+"+notify")
+	bob := ts.connect("bob", "laptop")
+	bob.announceFeatures("v1", testPEPNode+"+notify")
+
+	if response := testPEPPublish(phone, "alice@localhost", "current", "1"); !strings.Contains(response, "type=\"result\"") {
+		t.Fatalf("unexpected publish response: %s", response)
+	}
+	if n := countPEPEvents(phone.sync()); n != 1 {
+		t.Fatalf("the publisher's resource got %d events", n)
+	}
+	if n := countPEPEvents(tablet.sync()); n != 1 {
+		t.Fatalf("the owner's other resource got %d events", n)
+	}
+	// Without a roster, the other users aren't contacts
+	bob.expectNothing()
+
+	// The last item goes to the owner's new sessions only
+	desktop := ts.connect("alice", "desktop")
+	if n := countPEPEvents(desktop.announceFeatures("v1", testPEPNode+"+notify")); n != 1 {
+		t.Fatalf("the owner's new resource got %d last items", n)
+	}
+	bob2 := ts.connect("bob", "phone")
+	if n := countPEPEvents(bob2.announceFeatures("v1", testPEPNode+"+notify")); n != 0 {
+		t.Fatalf("another user got %d last items", n)
+	}
+
+	// The presence access model keeps the items from the non-contacts
+	response := bob.request(`<iq type='get' id='items' to='alice@localhost'>` +
+		`<pubsub xmlns='http://jabber.org/protocol/pubsub'><items node='` + testPEPNode + `'/></pubsub></iq>`)
+	if !strings.Contains(response, "type=\"error\"") || !strings.Contains(response, "presence-subscription-required") {
+		t.Fatalf("unexpected items response: %s", response)
+	}
+
+	for _, c := range []*testClient{phone, tablet, bob, desktop, bob2} {
+		c.close()
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppping"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0199: XMPP Ping
+
+// pingClient checks on the idle client. Any traffic from the client
+// counts as the answer thus the response itself is not looked at. It
+// returns false if the client can't be pinged because it's still
+// negotiating the stream.
+func (srv *Server) pingClient(cl *Client) bool {
+	if !cl.resourceBound() {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Info("Client idle during negotiation")
+		return false
+	}
+	pingXML, err := xml.Marshal(&xmppping.IQGet{})
+	if err != nil {
+		panic(err)
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Debug("Pinging idle client")
+	srv.sendClientIQRequest(cl, &xmppcore.ClientIQ{
+		Type:    xmppcore.IQTypeGet,
+		Payload: pingXML,
+	}, func(*xmppcore.ClientIQ) {})
+	return true
+}
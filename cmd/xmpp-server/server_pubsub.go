@@ -0,0 +1,770 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0060: Publish-Subscribe
+
+// pubsubMaxItemsLimit is the maximum number of items a node can keep.
+const pubsubMaxItemsLimit = 1000
+
+// pubsubService is the target of a pubsub request.
+type pubsubService struct {
+	jid xmppcore.JID
+	// pep is true for the PEP services (XEP-0163) which are hosted on the
+	// users' bare JIDs.
+	pep bool
+}
+
+func (service pubsubService) key() string {
+	return service.jid.FullString()
+}
+
+func (service pubsubService) defaultNodeConfig() PubSubNodeConfig {
+	if service.pep {
+		return PubSubNodeConfig{
+			AccessModel:  PubSubAccessModelPresence,
+			PublishModel: PubSubPublishModelPublishers,
+			MaxItems:     1,
+		}
+	}
+	return PubSubNodeConfig{
+		AccessModel:   PubSubAccessModelOpen,
+		PublishModel:  PubSubPublishModelPublishers,
+		MaxItems:      10,
+		NotifyDelete:  true,
+		NotifyRetract: true,
+	}
+}
+
+// pubsubErrorXML builds a stanza error with an application-specific
+// condition from the pubsub#errors namespace.
+func pubsubErrorXML(errorType, condition, pubsubCondition string) []byte {
+	return []byte(fmt.Sprintf(`<error type='%s'>`+
+		`<%s xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>`+
+		`<%s xmlns='%s'/>`+
+		`</error>`, errorType, condition, pubsubCondition, PubSubErrorsNS))
+}
+
+func (srv *Server) pubsubAffiliation(service pubsubService, node *PubSubNode, jid xmppcore.JID) string {
+	bareJID := jid.BareCopyPtr().FullString()
+	if service.pep && bareJID == service.key() {
+		return PubSubAffiliationOwner
+	}
+	if affiliation := node.Affiliations[bareJID]; affiliation != "" {
+		return affiliation
+	}
+	return PubSubAffiliationNone
+}
+
+// pubsubSubscription returns the state of the subscription of the JID
+// or, for a full JID, of its bare JID.
+func pubsubSubscription(node *PubSubNode, jid xmppcore.JID) string {
+	if subscription := node.Subscriptions[jid.FullString()]; subscription != "" {
+		return subscription
+	}
+	if subscription := node.Subscriptions[jid.BareCopyPtr().FullString()]; subscription != "" {
+		return subscription
+	}
+	return PubSubSubscriptionNone
+}
+
+// pubsubAccessError returns the error for the entity if the node's
+// access model doesn't allow the entity to retrieve the items. It
+// returns nil if the access is allowed.
+func (srv *Server) pubsubAccessError(service pubsubService, node *PubSubNode, jid xmppcore.JID) []byte {
+	switch srv.pubsubAffiliation(service, node, jid) {
+	case PubSubAffiliationOwner, PubSubAffiliationPublisher, PubSubAffiliationMember:
+		return nil
+	case PubSubAffiliationOutcast:
+		return pubsubErrorXML("auth", "forbidden", "outcast")
+	}
+	switch node.Config.AccessModel {
+	case PubSubAccessModelOpen:
+		return nil
+	case PubSubAccessModelPresence:
+		if service.pep && srv.rosterHasContact(service.jid.Local, jid) {
+			return nil
+		}
+		return pubsubErrorXML("auth", "not-authorized", "presence-subscription-required")
+	case PubSubAccessModelRoster:
+		if service.pep && srv.rosterHasContact(service.jid.Local, jid) {
+			return nil
+		}
+		return pubsubErrorXML("auth", "not-authorized", "not-in-roster-group")
+	case PubSubAccessModelAuthorize:
+		if pubsubSubscription(node, jid) == PubSubSubscriptionSubscribed {
+			return nil
+		}
+		return pubsubErrorXML("auth", "not-authorized", "not-subscribed")
+	case PubSubAccessModelWhitelist:
+		return pubsubErrorXML("cancel", "not-allowed", "closed-node")
+	}
+	return pubsubErrorXML("auth", "forbidden", "unsupported-access-model")
+}
+
+func (srv *Server) pubsubCanPublish(service pubsubService, node *PubSubNode, jid xmppcore.JID) bool {
+	switch srv.pubsubAffiliation(service, node, jid) {
+	case PubSubAffiliationOwner, PubSubAffiliationPublisher:
+		return true
+	case PubSubAffiliationOutcast:
+		return false
+	}
+	switch node.Config.PublishModel {
+	case PubSubPublishModelOpen:
+		return true
+	case PubSubPublishModelSubscribers:
+		return pubsubSubscription(node, jid) == PubSubSubscriptionSubscribed
+	}
+	return false
+}
+
+// applyPubSubConfigForm applies the fields of a configuration or
+// publish-options form. It returns false if any of the values is not
+// acceptable.
+func applyPubSubConfigForm(service pubsubService, config *PubSubNodeConfig, form *DataForm) bool {
+	for _, field := range form.Fields {
+		var value string
+		if len(field.Values) > 0 {
+			value = field.Values[0]
+		}
+		switch field.Var {
+		case "pubsub#title":
+			config.Title = value
+		case "pubsub#access_model":
+			switch value {
+			case PubSubAccessModelOpen, PubSubAccessModelWhitelist:
+			case PubSubAccessModelPresence, PubSubAccessModelRoster:
+				if !service.pep {
+					return false
+				}
+			case PubSubAccessModelAuthorize:
+				if service.pep {
+					return false
+				}
+			default:
+				return false
+			}
+			config.AccessModel = value
+		case "pubsub#publish_model":
+			switch value {
+			case PubSubPublishModelPublishers, PubSubPublishModelSubscribers, PubSubPublishModelOpen:
+				config.PublishModel = value
+			default:
+				return false
+			}
+		case "pubsub#max_items":
+			if value == "max" {
+				config.MaxItems = pubsubMaxItemsLimit
+				continue
+			}
+			maxItems, err := strconv.Atoi(value)
+			if err != nil || maxItems < 1 {
+				return false
+			}
+			if maxItems > pubsubMaxItemsLimit {
+				maxItems = pubsubMaxItemsLimit
+			}
+			config.MaxItems = maxItems
+		case "pubsub#notify_delete":
+			notify, ok := parseXMPPBoolean(value)
+			if !ok {
+				return false
+			}
+			config.NotifyDelete = notify
+		case "pubsub#notify_retract":
+			notify, ok := parseXMPPBoolean(value)
+			if !ok {
+				return false
+			}
+			config.NotifyRetract = notify
+		}
+	}
+	return true
+}
+
+// pubsubConfigForm builds the node configuration form (XEP-0060 16.4.4).
+func pubsubConfigForm(service pubsubService, config PubSubNodeConfig) *DataForm {
+	accessModels := []string{PubSubAccessModelOpen, PubSubAccessModelAuthorize, PubSubAccessModelWhitelist}
+	if service.pep {
+		accessModels = []string{PubSubAccessModelOpen, PubSubAccessModelPresence, PubSubAccessModelWhitelist}
+	}
+	accessModelOptions := make([]DataFormOption, 0, len(accessModels))
+	for _, accessModel := range accessModels {
+		accessModelOptions = append(accessModelOptions, DataFormOption{Value: accessModel})
+	}
+	return &DataForm{
+		Type: "form",
+		Fields: []DataFormField{
+			{Var: "FORM_TYPE", Type: "hidden", Values: []string{PubSubNodeConfigFormType}},
+			{Var: "pubsub#title", Type: "text-single", Label: "A friendly name for the node",
+				Values: []string{config.Title}},
+			{Var: "pubsub#access_model", Type: "list-single", Label: "Who may subscribe and retrieve items",
+				Values: []string{config.AccessModel}, Options: accessModelOptions},
+			{Var: "pubsub#publish_model", Type: "list-single", Label: "Who may publish items",
+				Values: []string{config.PublishModel}, Options: []DataFormOption{
+					{Value: PubSubPublishModelPublishers},
+					{Value: PubSubPublishModelSubscribers},
+					{Value: PubSubPublishModelOpen},
+				}},
+			{Var: "pubsub#max_items", Type: "text-single", Label: "Max # of items to persist",
+				Values: []string{strconv.Itoa(config.MaxItems)}},
+			{Var: "pubsub#notify_delete", Type: "boolean", Label: "Notify subscribers when the node is deleted",
+				Values: []string{strconv.FormatBool(config.NotifyDelete)}},
+			{Var: "pubsub#notify_retract", Type: "boolean", Label: "Notify subscribers when items are removed from the node",
+				Values: []string{strconv.FormatBool(config.NotifyRetract)}},
+		},
+	}
+}
+
+func (srv *Server) handlePubSubIQ(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, pubsub *PubSub) {
+	switch {
+	case iq.Type == xmppcore.IQTypeSet && pubsub.Publish != nil:
+		srv.handlePubSubPublish(cl, iq, service, pubsub)
+	case iq.Type == xmppcore.IQTypeSet && pubsub.Retract != nil:
+		srv.handlePubSubRetract(cl, iq, service, pubsub.Retract)
+	case iq.Type == xmppcore.IQTypeGet && pubsub.Items != nil:
+		srv.handlePubSubItems(cl, iq, service, pubsub.Items)
+	case service.pep:
+		// Subscriptions to the PEP nodes are implied by the "+notify"
+		// features.
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionFeatureNotImplemented,
+		})
+	case iq.Type == xmppcore.IQTypeSet && pubsub.Create != nil:
+		srv.handlePubSubCreate(cl, iq, service, pubsub)
+	case iq.Type == xmppcore.IQTypeSet && pubsub.Subscribe != nil:
+		srv.handlePubSubSubscribe(cl, iq, service, pubsub.Subscribe)
+	case iq.Type == xmppcore.IQTypeSet && pubsub.Unsubscribe != nil:
+		srv.handlePubSubUnsubscribe(cl, iq, service, pubsub.Unsubscribe)
+	case iq.Type == xmppcore.IQTypeGet && pubsub.Subscriptions != nil:
+		srv.handlePubSubSubscriptions(cl, iq, service, pubsub.Subscriptions)
+	case iq.Type == xmppcore.IQTypeGet && pubsub.Affiliations != nil:
+		srv.handlePubSubAffiliations(cl, iq, service, pubsub.Affiliations)
+	default:
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionFeatureNotImplemented,
+		})
+	}
+}
+
+// pubsubNodeForRequest loads the node for a request. It sends the error
+// and returns nil if the node can't be loaded.
+func (srv *Server) pubsubNodeForRequest(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, nodeName string) *PubSubNode {
+	if nodeName == "" {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "nodeid-required"))
+		return nil
+	}
+	node, err := srv.pubsubStore.PubSubNode(service.key(), nodeName)
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return nil
+	}
+	if node == nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return nil
+	}
+	return node
+}
+
+func (srv *Server) handlePubSubCreate(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, pubsub *PubSub) {
+	nodeName := pubsub.Create.Node
+	instant := nodeName == ""
+	if instant {
+		nodeName = generateID()
+	}
+	node := &PubSubNode{
+		Name:   nodeName,
+		Config: service.defaultNodeConfig(),
+		Affiliations: map[string]string{
+			cl.jid.BareCopyPtr().FullString(): PubSubAffiliationOwner,
+		},
+	}
+	if pubsub.Configure != nil && pubsub.Configure.Form != nil {
+		if !applyPubSubConfigForm(service, &node.Config, pubsub.Configure.Form) {
+			srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "not-acceptable", "unsupported-access-model"))
+			return
+		}
+	}
+
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	existing, err := srv.pubsubStore.PubSubNode(service.key(), nodeName)
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	if existing != nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionConflict,
+		})
+		return
+	}
+	if err = srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("PubSub node %q created on %s", nodeName, service.key())
+
+	if instant {
+		srv.sendClientIQResult(cl, iq, &PubSub{Create: &PubSubNodeElement{Node: nodeName}})
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+}
+
+func (srv *Server) handlePubSubPublish(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, pubsub *PubSub) {
+	publish := pubsub.Publish
+	if publish.Node == "" {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "nodeid-required"))
+		return
+	}
+	if len(publish.Items) == 0 {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "item-required"))
+		return
+	}
+	if len(publish.Items) > 1 {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "invalid-payload"))
+		return
+	}
+	itemElem := publish.Items[0]
+	if len(itemElem.Payload) == 0 {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "payload-required"))
+		return
+	}
+
+	node := srv.pubsubPublishNode(cl, iq, service, pubsub)
+	if node == nil {
+		return
+	}
+
+	item := &PubSubItem{
+		ID:        itemElem.ID,
+		Publisher: cl.jid.BareCopyPtr().FullString(),
+		Stamp:     time.Now().UTC(),
+		Payload:   itemElem.Payload,
+	}
+	if item.ID == "" {
+		item.ID = generateID()
+	}
+	err := srv.pubsubStore.PublishPubSubItem(service.key(), node.Name, item, node.Config.MaxItems)
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+
+	srv.sendClientIQResult(cl, iq, &PubSub{
+		Publish: &PubSubPublish{
+			Node:  node.Name,
+			Items: []PubSubItemElem{{ID: item.ID}},
+		},
+	})
+
+	srv.notifyPubSubEvent(service, node, &PubSubEvent{
+		Items: &PubSubEventItems{
+			Node:  node.Name,
+			Items: []PubSubItemElem{{ID: item.ID, Payload: item.Payload}},
+		},
+	})
+}
+
+// pubsubPublishNode returns the node to publish to, creating the PEP
+// node if needed, or nil once the error has been sent. The creation
+// holds pubsubNodesMutex so that it doesn't race with the other
+// publishes nor with the node's configuration.
+func (srv *Server) pubsubPublishNode(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, pubsub *PubSub) *PubSubNode {
+	publish := pubsub.Publish
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node, err := srv.pubsubStore.PubSubNode(service.key(), publish.Node)
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return nil
+	}
+	if node == nil {
+		// Only PEP nodes are auto-created
+		if !service.pep {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeCancel,
+				Condition: xmppcore.StanzaErrorConditionItemNotFound,
+			})
+			return nil
+		}
+		if cl.jid.BareCopyPtr().FullString() != service.key() {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeAuth,
+				Condition: xmppcore.StanzaErrorConditionForbidden,
+			})
+			return nil
+		}
+		node = &PubSubNode{
+			Name:   publish.Node,
+			Config: service.defaultNodeConfig(),
+			Affiliations: map[string]string{
+				service.key(): PubSubAffiliationOwner,
+			},
+		}
+		if pubsub.PublishOptions != nil && pubsub.PublishOptions.Form != nil {
+			if !applyPubSubConfigForm(service, &node.Config, pubsub.PublishOptions.Form) {
+				srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "not-acceptable", "invalid-options"))
+				return nil
+			}
+		}
+		if err = srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+			srv.sendPubSubStoreError(cl, iq, err)
+			return nil
+		}
+	} else {
+		if !srv.pubsubCanPublish(service, node, cl.jid) {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeAuth,
+				Condition: xmppcore.StanzaErrorConditionForbidden,
+			})
+			return nil
+		}
+		// XEP-0060 7.1.5: the publish-options are preconditions for the
+		// existing nodes.
+		if pubsub.PublishOptions != nil && pubsub.PublishOptions.Form != nil {
+			config := node.Config
+			if !applyPubSubConfigForm(service, &config, pubsub.PublishOptions.Form) || config != node.Config {
+				srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("cancel", "conflict", "precondition-not-met"))
+				return nil
+			}
+		}
+	}
+
+	return node
+}
+
+func (srv *Server) handlePubSubRetract(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, retract *PubSubRetract) {
+	if retract.Node == "" {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "nodeid-required"))
+		return
+	}
+	if len(retract.Items) != 1 || retract.Items[0].ID == "" {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "item-required"))
+		return
+	}
+	node := srv.pubsubNodeForRequest(cl, iq, service, retract.Node)
+	if node == nil {
+		return
+	}
+	switch srv.pubsubAffiliation(service, node, cl.jid) {
+	case PubSubAffiliationOwner, PubSubAffiliationPublisher:
+	default:
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	itemID := retract.Items[0].ID
+	retracted, err := srv.pubsubStore.RetractPubSubItem(service.key(), node.Name, itemID)
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	if !retracted {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+
+	notify, _ := parseXMPPBoolean(retract.Notify)
+	if notify || node.Config.NotifyRetract {
+		srv.notifyPubSubEvent(service, node, &PubSubEvent{
+			Items: &PubSubEventItems{
+				Node:     node.Name,
+				Retracts: []PubSubEventRetract{{ID: itemID}},
+			},
+		})
+	}
+}
+
+func (srv *Server) handlePubSubItems(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, itemsReq *PubSubItems) {
+	node := srv.pubsubNodeForRequest(cl, iq, service, itemsReq.Node)
+	if node == nil {
+		return
+	}
+	if errorXML := srv.pubsubAccessError(service, node, cl.jid); errorXML != nil {
+		srv.sendClientIQErrorXML(cl, iq, errorXML)
+		return
+	}
+
+	var ids []string
+	for _, itemElem := range itemsReq.Items {
+		if itemElem.ID != "" {
+			ids = append(ids, itemElem.ID)
+		}
+	}
+	items, err := srv.pubsubStore.PubSubItems(service.key(), node.Name, ids, itemsReq.MaxItems)
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	// The store returns the newest first
+	itemElems := make([]PubSubItemElem, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		itemElems = append(itemElems, PubSubItemElem{ID: items[i].ID, Payload: items[i].Payload})
+	}
+	srv.sendClientIQResult(cl, iq, &PubSub{
+		Items: &PubSubItems{
+			Node:  node.Name,
+			Items: itemElems,
+		},
+	})
+}
+
+func (srv *Server) handlePubSubSubscribe(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, subscribe *PubSubSubscription) {
+	subscriberJID, err := xmppcore.ParseJID(subscribe.JID)
+	if err != nil || !subscriberJID.BareCopyPtr().Equals(*cl.jid.BareCopyPtr()) {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "invalid-jid"))
+		return
+	}
+
+	srv.pubsubNodesMutex.Lock()
+	node := srv.pubsubNodeForRequest(cl, iq, service, subscribe.Node)
+	if node == nil {
+		srv.pubsubNodesMutex.Unlock()
+		return
+	}
+
+	subscription := PubSubSubscriptionSubscribed
+	switch srv.pubsubAffiliation(service, node, subscriberJID) {
+	case PubSubAffiliationOwner, PubSubAffiliationPublisher, PubSubAffiliationMember:
+	case PubSubAffiliationOutcast:
+		srv.pubsubNodesMutex.Unlock()
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	default:
+		switch node.Config.AccessModel {
+		case PubSubAccessModelOpen:
+		case PubSubAccessModelAuthorize:
+			subscription = PubSubSubscriptionPending
+		default:
+			srv.pubsubNodesMutex.Unlock()
+			srv.sendClientIQErrorXML(cl, iq, srv.pubsubAccessError(service, node, subscriberJID))
+			return
+		}
+	}
+
+	subscriberKey := subscriberJID.FullString()
+	if current := node.Subscriptions[subscriberKey]; current != "" {
+		// Already subscribed or waiting for the approval
+		subscription = current
+	} else {
+		if node.Subscriptions == nil {
+			node.Subscriptions = make(map[string]string)
+		}
+		node.Subscriptions[subscriberKey] = subscription
+		if err = srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+			srv.pubsubNodesMutex.Unlock()
+			srv.sendPubSubStoreError(cl, iq, err)
+			return
+		}
+		if subscription == PubSubSubscriptionPending {
+			srv.sendPubSubAuthorizationRequests(service, node, subscriberKey)
+		}
+	}
+	srv.pubsubNodesMutex.Unlock()
+
+	srv.sendClientIQResult(cl, iq, &PubSub{
+		Subscription: &PubSubSubscription{
+			Node:         node.Name,
+			JID:          subscriberKey,
+			Subscription: subscription,
+		},
+	})
+	if subscription == PubSubSubscriptionSubscribed {
+		srv.sendPubSubLastPublishedItem(service, node, subscriberJID)
+	}
+}
+
+func (srv *Server) handlePubSubUnsubscribe(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, unsubscribe *PubSubSubscription) {
+	subscriberJID, err := xmppcore.ParseJID(unsubscribe.JID)
+	if err != nil || !subscriberJID.BareCopyPtr().Equals(*cl.jid.BareCopyPtr()) {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("modify", "bad-request", "invalid-jid"))
+		return
+	}
+
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node := srv.pubsubNodeForRequest(cl, iq, service, unsubscribe.Node)
+	if node == nil {
+		return
+	}
+	subscriberKey := subscriberJID.FullString()
+	if node.Subscriptions[subscriberKey] == "" {
+		srv.sendClientIQErrorXML(cl, iq, pubsubErrorXML("cancel", "unexpected-request", "not-subscribed"))
+		return
+	}
+	delete(node.Subscriptions, subscriberKey)
+	if err = srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+}
+
+// handlePubSubSubscriptions lists the requester's subscriptions
+// (XEP-0060 5.6).
+func (srv *Server) handlePubSubSubscriptions(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, req *PubSubSubscriptions) {
+	nodes, err := srv.pubsubStore.PubSubNodes(service.key())
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	bareJID := cl.jid.BareCopyPtr()
+	subscriptions := []PubSubSubscription{}
+	for _, node := range nodes {
+		if req.Node != "" && node.Name != req.Node {
+			continue
+		}
+		for jidStr, subscription := range node.Subscriptions {
+			jid, err := xmppcore.ParseJID(jidStr)
+			if err != nil || !jid.BareCopyPtr().Equals(*bareJID) {
+				continue
+			}
+			subscriptions = append(subscriptions, PubSubSubscription{
+				Node:         node.Name,
+				JID:          jidStr,
+				Subscription: subscription,
+			})
+		}
+	}
+	srv.sendClientIQResult(cl, iq, &PubSub{
+		Subscriptions: &PubSubSubscriptions{Node: req.Node, Subscriptions: subscriptions},
+	})
+}
+
+// handlePubSubAffiliations lists the requester's affiliations
+// (XEP-0060 5.7).
+func (srv *Server) handlePubSubAffiliations(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, req *PubSubAffiliations) {
+	nodes, err := srv.pubsubStore.PubSubNodes(service.key())
+	if err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	bareJID := cl.jid.BareCopyPtr().FullString()
+	affiliations := []PubSubAffiliation{}
+	for _, node := range nodes {
+		if req.Node != "" && node.Name != req.Node {
+			continue
+		}
+		if affiliation := node.Affiliations[bareJID]; affiliation != "" {
+			affiliations = append(affiliations, PubSubAffiliation{
+				Node:        node.Name,
+				Affiliation: affiliation,
+			})
+		}
+	}
+	srv.sendClientIQResult(cl, iq, &PubSub{
+		Affiliations: &PubSubAffiliations{Node: req.Node, Affiliations: affiliations},
+	})
+}
+
+func (srv *Server) sendPubSubStoreError(cl *Client, iq *xmppcore.ClientIQ, err error) {
+	if err == ErrPubSubNodeNotFound {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionItemNotFound,
+		})
+		return
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+		Error("PubSub storage error: ", err)
+	srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+		Type:      xmppcore.StanzaErrorTypeWait,
+		Condition: xmppcore.StanzaErrorConditionInternalServerError,
+	})
+}
+
+// notifyPubSubEvent sends the event to the entities which should be
+// notified of the events of the node.
+func (srv *Server) notifyPubSubEvent(service pubsubService, node *PubSubNode, event *PubSubEvent) {
+	eventXML, err := xml.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	if service.pep {
+		for _, rcl := range srv.pepNotificationRecipients(service, node) {
+			srv.deliverMessage(rcl, &clientMessage{
+				ID:      generateID(),
+				Type:    messageTypeHeadline,
+				From:    &service.jid,
+				To:      &rcl.jid,
+				Payload: eventXML,
+			})
+		}
+		return
+	}
+	for jidStr, subscription := range node.Subscriptions {
+		if subscription != PubSubSubscriptionSubscribed {
+			continue
+		}
+		subscriberJID, err := xmppcore.ParseJID(jidStr)
+		if err != nil {
+			continue
+		}
+		srv.sendPubSubEventMessage(service, subscriberJID, eventXML)
+	}
+}
+
+func (srv *Server) sendPubSubEventMessage(service pubsubService, to xmppcore.JID, eventXML []byte) {
+	fromJID := service.jid
+	srv.routeMessage(&clientMessage{
+		ID:      generateID(),
+		Type:    messageTypeHeadline,
+		From:    &fromJID,
+		To:      &to,
+		Payload: eventXML,
+	})
+}
+
+// sendPubSubLastPublishedItem sends the node's last item to the new
+// subscriber.
+func (srv *Server) sendPubSubLastPublishedItem(service pubsubService, node *PubSubNode, subscriberJID xmppcore.JID) {
+	items, err := srv.pubsubStore.PubSubItems(service.key(), node.Name, nil, 1)
+	if err != nil {
+		log.WithFields(logrus.Fields{"jid": subscriberJID}).
+			Error("Unable to load the PubSub items: ", err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+	eventXML, err := xml.Marshal(&PubSubEvent{
+		Items: &PubSubEventItems{
+			Node:  node.Name,
+			Items: []PubSubItemElem{{ID: items[0].ID, Payload: items[0].Payload}},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	srv.sendPubSubEventMessage(service, subscriberJID, eventXML)
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0060 8: Owner Use Cases
+
+func (srv *Server) handlePubSubOwnerIQ(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, owner *PubSubOwner) {
+	switch {
+	case iq.Type == xmppcore.IQTypeGet && owner.Configure != nil:
+		srv.handlePubSubOwnerConfigureGet(cl, iq, service, owner.Configure)
+	case iq.Type == xmppcore.IQTypeSet && owner.Configure != nil:
+		srv.handlePubSubOwnerConfigureSet(cl, iq, service, owner.Configure)
+	case iq.Type == xmppcore.IQTypeGet && owner.Default != nil:
+		srv.sendClientIQResult(cl, iq, &PubSubOwner{
+			Default: &PubSubFormElement{Form: pubsubConfigForm(service, service.defaultNodeConfig())},
+		})
+	case iq.Type == xmppcore.IQTypeSet && owner.Delete != nil:
+		srv.handlePubSubOwnerDelete(cl, iq, service, owner.Delete)
+	case iq.Type == xmppcore.IQTypeSet && owner.Purge != nil:
+		srv.handlePubSubOwnerPurge(cl, iq, service, owner.Purge)
+	case iq.Type == xmppcore.IQTypeGet && owner.Subscriptions != nil:
+		srv.handlePubSubOwnerSubscriptionsGet(cl, iq, service, owner.Subscriptions)
+	case iq.Type == xmppcore.IQTypeSet && owner.Subscriptions != nil:
+		srv.handlePubSubOwnerSubscriptionsSet(cl, iq, service, owner.Subscriptions)
+	case iq.Type == xmppcore.IQTypeGet && owner.Affiliations != nil:
+		srv.handlePubSubOwnerAffiliationsGet(cl, iq, service, owner.Affiliations)
+	case iq.Type == xmppcore.IQTypeSet && owner.Affiliations != nil:
+		srv.handlePubSubOwnerAffiliationsSet(cl, iq, service, owner.Affiliations)
+	default:
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionFeatureNotImplemented,
+		})
+	}
+}
+
+// pubsubOwnerNode loads the node for an owner request. It sends the
+// error and returns nil if the node can't be loaded or if the requester
+// is not an owner of the node.
+func (srv *Server) pubsubOwnerNode(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, nodeName string) *PubSubNode {
+	node := srv.pubsubNodeForRequest(cl, iq, service, nodeName)
+	if node == nil {
+		return nil
+	}
+	if srv.pubsubAffiliation(service, node, cl.jid) != PubSubAffiliationOwner {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return nil
+	}
+	return node
+}
+
+func (srv *Server) handlePubSubOwnerConfigureGet(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, configure *PubSubFormElement) {
+	node := srv.pubsubOwnerNode(cl, iq, service, configure.Node)
+	if node == nil {
+		return
+	}
+	srv.sendClientIQResult(cl, iq, &PubSubOwner{
+		Configure: &PubSubFormElement{
+			Node: node.Name,
+			Form: pubsubConfigForm(service, node.Config),
+		},
+	})
+}
+
+func (srv *Server) handlePubSubOwnerConfigureSet(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, configure *PubSubFormElement) {
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node := srv.pubsubOwnerNode(cl, iq, service, configure.Node)
+	if node == nil {
+		return
+	}
+	if configure.Form == nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	// XEP-0060 8.2.5: the owner cancelled the configuration
+	if configure.Form.Type == "cancel" {
+		srv.sendClientIQResult(cl, iq, nil)
+		return
+	}
+	if configure.Form.Type != "submit" ||
+		dataFormValue(configure.Form, "FORM_TYPE") != PubSubNodeConfigFormType ||
+		!applyPubSubConfigForm(service, &node.Config, configure.Form) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	if err := srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+}
+
+func (srv *Server) handlePubSubOwnerDelete(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, deleteElem *PubSubNodeElement) {
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node := srv.pubsubOwnerNode(cl, iq, service, deleteElem.Node)
+	if node == nil {
+		return
+	}
+	if err := srv.pubsubStore.DeletePubSubNode(service.key(), node.Name); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("PubSub node %q deleted from %s", node.Name, service.key())
+	srv.sendClientIQResult(cl, iq, nil)
+
+	if node.Config.NotifyDelete {
+		srv.notifyPubSubEvent(service, node, &PubSubEvent{
+			Delete: &PubSubNodeElement{Node: node.Name},
+		})
+	}
+}
+
+func (srv *Server) handlePubSubOwnerPurge(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, purge *PubSubNodeElement) {
+	node := srv.pubsubOwnerNode(cl, iq, service, purge.Node)
+	if node == nil {
+		return
+	}
+	if err := srv.pubsubStore.PurgePubSubItems(service.key(), node.Name); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+
+	if node.Config.NotifyRetract {
+		srv.notifyPubSubEvent(service, node, &PubSubEvent{
+			Purge: &PubSubNodeElement{Node: node.Name},
+		})
+	}
+}
+
+func (srv *Server) handlePubSubOwnerSubscriptionsGet(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, req *PubSubSubscriptions) {
+	node := srv.pubsubOwnerNode(cl, iq, service, req.Node)
+	if node == nil {
+		return
+	}
+	subscriptions := make([]PubSubSubscription, 0, len(node.Subscriptions))
+	for jidStr, subscription := range node.Subscriptions {
+		subscriptions = append(subscriptions, PubSubSubscription{
+			JID:          jidStr,
+			Subscription: subscription,
+		})
+	}
+	srv.sendClientIQResult(cl, iq, &PubSubOwner{
+		Subscriptions: &PubSubSubscriptions{Node: node.Name, Subscriptions: subscriptions},
+	})
+}
+
+// handlePubSubOwnerSubscriptionsSet modifies the subscriptions, which is
+// also how the owners approve the pending subscriptions (XEP-0060 8.8.2).
+func (srv *Server) handlePubSubOwnerSubscriptionsSet(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, req *PubSubSubscriptions) {
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node := srv.pubsubOwnerNode(cl, iq, service, req.Node)
+	if node == nil {
+		return
+	}
+
+	type subscriptionChange struct {
+		jid          xmppcore.JID
+		subscription string
+	}
+	var changes []subscriptionChange
+	for _, item := range req.Subscriptions {
+		subscriberJID, err := xmppcore.ParseJID(item.JID)
+		if err != nil {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+			})
+			return
+		}
+		switch item.Subscription {
+		case PubSubSubscriptionNone, PubSubSubscriptionPending, PubSubSubscriptionSubscribed:
+		default:
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+			})
+			return
+		}
+		changes = append(changes, subscriptionChange{jid: subscriberJID, subscription: item.Subscription})
+	}
+
+	var notifications []subscriptionChange
+	for _, change := range changes {
+		subscriberKey := change.jid.FullString()
+		current := node.Subscriptions[subscriberKey]
+		if current == "" {
+			current = PubSubSubscriptionNone
+		}
+		if current == change.subscription {
+			continue
+		}
+		if change.subscription == PubSubSubscriptionNone {
+			delete(node.Subscriptions, subscriberKey)
+		} else {
+			if node.Subscriptions == nil {
+				node.Subscriptions = make(map[string]string)
+			}
+			node.Subscriptions[subscriberKey] = change.subscription
+		}
+		notifications = append(notifications, change)
+	}
+	if err := srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+
+	for _, change := range notifications {
+		srv.notifyPubSubSubscription(service, node, change.jid, change.subscription)
+	}
+}
+
+func (srv *Server) handlePubSubOwnerAffiliationsGet(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, req *PubSubAffiliations) {
+	node := srv.pubsubOwnerNode(cl, iq, service, req.Node)
+	if node == nil {
+		return
+	}
+	affiliations := make([]PubSubAffiliation, 0, len(node.Affiliations))
+	for jidStr, affiliation := range node.Affiliations {
+		affiliations = append(affiliations, PubSubAffiliation{
+			JID:         jidStr,
+			Affiliation: affiliation,
+		})
+	}
+	srv.sendClientIQResult(cl, iq, &PubSubOwner{
+		Affiliations: &PubSubAffiliations{Node: node.Name, Affiliations: affiliations},
+	})
+}
+
+func (srv *Server) handlePubSubOwnerAffiliationsSet(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, req *PubSubAffiliations) {
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node := srv.pubsubOwnerNode(cl, iq, service, req.Node)
+	if node == nil {
+		return
+	}
+
+	affiliations := make(map[string]string, len(node.Affiliations))
+	for jidStr, affiliation := range node.Affiliations {
+		affiliations[jidStr] = affiliation
+	}
+	var outcasts []xmppcore.JID
+	for _, item := range req.Affiliations {
+		affiliatedJID, err := xmppcore.ParseJID(item.JID)
+		if err != nil {
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionJIDMalformed,
+			})
+			return
+		}
+		bareJID := affiliatedJID.BareCopyPtr()
+		switch item.Affiliation {
+		case PubSubAffiliationNone:
+			delete(affiliations, bareJID.FullString())
+		case PubSubAffiliationOwner, PubSubAffiliationPublisher, PubSubAffiliationMember:
+			affiliations[bareJID.FullString()] = item.Affiliation
+		case PubSubAffiliationOutcast:
+			affiliations[bareJID.FullString()] = item.Affiliation
+			outcasts = append(outcasts, *bareJID)
+		default:
+			srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+				Type:      xmppcore.StanzaErrorTypeModify,
+				Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+			})
+			return
+		}
+	}
+	// A node can't be left without an owner
+	hasOwner := false
+	for _, affiliation := range affiliations {
+		if affiliation == PubSubAffiliationOwner {
+			hasOwner = true
+			break
+		}
+	}
+	if !hasOwner {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	node.Affiliations = affiliations
+
+	// The outcasts lose their subscriptions
+	for _, outcastJID := range outcasts {
+		for jidStr := range node.Subscriptions {
+			subscriberJID, err := xmppcore.ParseJID(jidStr)
+			if err == nil && subscriberJID.BareCopyPtr().Equals(outcastJID) {
+				delete(node.Subscriptions, jidStr)
+			}
+		}
+	}
+
+	if err := srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+		srv.sendPubSubStoreError(cl, iq, err)
+		return
+	}
+	srv.sendClientIQResult(cl, iq, nil)
+}
+
+// sendPubSubAuthorizationRequests asks the node's owners to approve the
+// subscription (XEP-0060 8.6).
+func (srv *Server) sendPubSubAuthorizationRequests(service pubsubService, node *PubSubNode, subscriber string) {
+	formXML, err := xml.Marshal(&DataForm{
+		Type:  "form",
+		Title: "PubSub subscriber request",
+		Fields: []DataFormField{
+			{Var: "FORM_TYPE", Type: "hidden", Values: []string{PubSubSubscribeAuthorizationFormType}},
+			{Var: "pubsub#node", Type: "text-single", Label: "Node ID", Values: []string{node.Name}},
+			{Var: "pubsub#subscriber_jid", Type: "jid-single", Label: "Subscriber Address", Values: []string{subscriber}},
+			{Var: "pubsub#allow", Type: "boolean", Label: "Allow this JID to subscribe to this pubsub node?",
+				Values: []string{"false"}},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for jidStr, affiliation := range node.Affiliations {
+		if affiliation != PubSubAffiliationOwner {
+			continue
+		}
+		ownerJID, err := xmppcore.ParseJID(jidStr)
+		if err != nil {
+			continue
+		}
+		fromJID := service.jid
+		srv.routeMessage(&clientMessage{
+			ID:      generateID(),
+			Type:    messageTypeNormal,
+			From:    &fromJID,
+			To:      &ownerJID,
+			Payload: formXML,
+		})
+	}
+}
+
+// handlePubSubAuthorizationResponse handles the owner's answer to an
+// authorization request.
+func (srv *Server) handlePubSubAuthorizationResponse(msg *clientMessage, form *DataForm) {
+	service := pubsubService{jid: *msg.To.BareCopyPtr()}
+	allow, ok := parseXMPPBoolean(dataFormValue(form, "pubsub#allow"))
+	if !ok {
+		return
+	}
+	subscriberJID, err := xmppcore.ParseJID(dataFormValue(form, "pubsub#subscriber_jid"))
+	if err != nil {
+		return
+	}
+
+	srv.pubsubNodesMutex.Lock()
+	defer srv.pubsubNodesMutex.Unlock()
+
+	node, err := srv.pubsubStore.PubSubNode(service.key(), dataFormValue(form, "pubsub#node"))
+	if err != nil || node == nil {
+		return
+	}
+	if srv.pubsubAffiliation(service, node, *msg.From) != PubSubAffiliationOwner {
+		return
+	}
+	subscriberKey := subscriberJID.FullString()
+	if node.Subscriptions[subscriberKey] != PubSubSubscriptionPending {
+		return
+	}
+	subscription := PubSubSubscriptionNone
+	if allow {
+		subscription = PubSubSubscriptionSubscribed
+		node.Subscriptions[subscriberKey] = subscription
+	} else {
+		delete(node.Subscriptions, subscriberKey)
+	}
+	if err = srv.pubsubStore.SavePubSubNode(service.key(), node); err != nil {
+		log.WithFields(logrus.Fields{"jid": msg.From}).
+			Error("PubSub storage error: ", err)
+		return
+	}
+	srv.notifyPubSubSubscription(service, node, subscriberJID, subscription)
+}
+
+// notifyPubSubSubscription notifies the subscriber of the change of the
+// state of its subscription (XEP-0060 8.8.4).
+func (srv *Server) notifyPubSubSubscription(service pubsubService, node *PubSubNode, subscriberJID xmppcore.JID, subscription string) {
+	eventXML, err := xml.Marshal(&PubSubEvent{
+		Subscription: &PubSubSubscription{
+			Node:         node.Name,
+			JID:          subscriberJID.FullString(),
+			Subscription: subscription,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	srv.sendPubSubEventMessage(service, subscriberJID, eventXML)
+	if subscription == PubSubSubscriptionSubscribed {
+		srv.sendPubSubLastPublishedItem(service, node, subscriberJID)
+	}
+}
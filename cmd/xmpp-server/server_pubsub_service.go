@@ -0,0 +1,178 @@
+package main
+
+import (
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+)
+
+// The publish-subscribe component on the pubsub subdomain.
+
+var pubsubServiceFeatures = []string{
+	DiscoInfoNS,
+	DiscoItemsNS,
+	PubSubNS,
+	PubSubNS + "#access-authorize",
+	PubSubNS + "#access-open",
+	PubSubNS + "#access-whitelist",
+	PubSubNS + "#config-node",
+	PubSubNS + "#create-and-configure",
+	PubSubNS + "#create-nodes",
+	PubSubNS + "#delete-nodes",
+	PubSubNS + "#get-pending",
+	PubSubNS + "#instant-nodes",
+	PubSubNS + "#item-ids",
+	PubSubNS + "#manage-subscriptions",
+	PubSubNS + "#modify-affiliations",
+	PubSubNS + "#outcast-affiliation",
+	PubSubNS + "#persistent-items",
+	PubSubNS + "#publish",
+	PubSubNS + "#publisher-affiliation",
+	PubSubNS + "#purge-nodes",
+	PubSubNS + "#retract-items",
+	PubSubNS + "#retrieve-affiliations",
+	PubSubNS + "#retrieve-default",
+	PubSubNS + "#retrieve-items",
+	PubSubNS + "#retrieve-subscriptions",
+	PubSubNS + "#subscribe",
+	PubSubNS + "#subscription-notifications",
+}
+
+func (srv *Server) pubsubServiceEnabled() bool {
+	return srv.pubsubStore != nil && srv.pubsubDomain != ""
+}
+
+func (srv *Server) pubsubServiceJID() xmppcore.JID {
+	return xmppcore.JID{Domain: srv.pubsubDomain}
+}
+
+// handleClientPubSubServiceIQ handles the IQs addressed to the pubsub
+// component.
+func (srv *Server) handleClientPubSubServiceIQ(cl *Client, iq *xmppcore.ClientIQ) {
+	if iq.Type != xmppcore.IQTypeGet && iq.Type != xmppcore.IQTypeSet {
+		// The component doesn't make any request
+		return
+	}
+	if iq.To.Local != "" || iq.To.Resource != "" {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeCancel,
+			Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+		})
+		return
+	}
+
+	element := srv.decodeClientIQPayload(cl, iq, func(name string) interface{} {
+		switch name {
+		case xmppdisco.InfoQueryElementName:
+			if iq.Type == xmppcore.IQTypeGet {
+				return &DiscoInfo{}
+			}
+		case xmppdisco.ItemsQueryElementName:
+			if iq.Type == xmppcore.IQTypeGet {
+				return &DiscoItems{}
+			}
+		case PubSubPubSubElementName:
+			return &PubSub{}
+		case PubSubOwnerPubSubElementName:
+			return &PubSubOwner{}
+		}
+		return nil
+	})
+	if element == nil {
+		return
+	}
+
+	service := pubsubService{jid: srv.pubsubServiceJID()}
+	switch payload := element.(type) {
+	case *DiscoInfo:
+		srv.handlePubSubServiceDiscoInfo(cl, iq, service, payload.Node)
+	case *DiscoItems:
+		srv.handlePubSubServiceDiscoItems(cl, iq, service, payload.Node)
+	case *PubSub:
+		srv.handlePubSubIQ(cl, iq, service, payload)
+	case *PubSubOwner:
+		srv.handlePubSubOwnerIQ(cl, iq, service, payload)
+	}
+}
+
+func (srv *Server) handlePubSubServiceDiscoInfo(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, nodeName string) {
+	if nodeName == "" {
+		srv.handleClientDiscoInfo(cl, iq, "")
+		return
+	}
+
+	node := srv.pubsubNodeForRequest(cl, iq, service, nodeName)
+	if node == nil {
+		return
+	}
+	// XEP-0060 5.4
+	srv.sendClientIQResult(cl, iq, &DiscoInfo{
+		Node: node.Name,
+		Identity: []xmppdisco.Identity{
+			{Category: "pubsub", Type: "leaf", Name: node.Config.Title},
+		},
+		Feature: []xmppdisco.Feature{{Var: PubSubNS}},
+		Forms: []DataForm{{
+			Type: "result",
+			Fields: []DataFormField{
+				{Var: "FORM_TYPE", Type: "hidden", Values: []string{PubSubMetaDataFormType}},
+				{Var: "pubsub#title", Values: []string{node.Config.Title}},
+				{Var: "pubsub#access_model", Values: []string{node.Config.AccessModel}},
+				{Var: "pubsub#publish_model", Values: []string{node.Config.PublishModel}},
+			},
+		}},
+	})
+}
+
+func (srv *Server) handlePubSubServiceDiscoItems(cl *Client, iq *xmppcore.ClientIQ, service pubsubService, nodeName string) {
+	if nodeName == "" {
+		srv.handleClientDiscoItems(cl, iq, "")
+		return
+	}
+	// There are only leaf nodes
+	if node := srv.pubsubNodeForRequest(cl, iq, service, nodeName); node != nil {
+		srv.sendClientIQResult(cl, iq, &DiscoItems{Node: nodeName, Items: []DiscoItem{}})
+	}
+}
+
+// pubsubServiceDiscoItems lists the nodes. The whitelisted nodes are
+// only listed to their affiliates.
+func (srv *Server) pubsubServiceDiscoItems(cl *Client, jid xmppcore.JID, node string, result *DiscoItems) (bool, error) {
+	if node != "" {
+		return false, nil
+	}
+	service := pubsubService{jid: jid}
+	nodes, err := srv.pubsubStore.PubSubNodes(service.key())
+	if err != nil {
+		return false, err
+	}
+	for _, node := range nodes {
+		if node.Config.AccessModel == PubSubAccessModelWhitelist &&
+			srv.pubsubAccessError(service, node, cl.jid) != nil {
+			continue
+		}
+		result.Items = append(result.Items, DiscoItem{JID: service.key(), Node: node.Name, Name: node.Config.Title})
+	}
+	return true, nil
+}
+
+// handlePubSubServiceMessage handles the messages addressed to the
+// pubsub component, i.e., the answers to the authorization requests.
+func (srv *Server) handlePubSubServiceMessage(msg *clientMessage) {
+	if msg.Type == messageTypeError {
+		return
+	}
+	var form DataForm
+	if xmlPayloadDecodeElement(msg.Payload, DataFormsNS, "x", &form) && form.Type == "submit" &&
+		dataFormValue(&form, "FORM_TYPE") == PubSubSubscribeAuthorizationFormType &&
+		msg.To.Local == "" && msg.To.Resource == "" {
+		srv.handlePubSubAuthorizationResponse(msg, &form)
+		return
+	}
+	if msg.Type == messageTypeHeadline {
+		return
+	}
+	srv.bounceMessage(msg, xmppcore.StanzaError{
+		Type:      xmppcore.StanzaErrorTypeCancel,
+		Condition: xmppcore.StanzaErrorConditionServiceUnavailable,
+	})
+}
@@ -23,9 +23,36 @@ func (srv *Server) handleClientSASLAuth(cl *Client, startElem *xml.StartElement)
 	if err != nil {
 		panic(err)
 	}
+	localpart, resourcepart, authOK := srv.verifySASLPlain(authBytes)
+	if authOK {
+		authRespXML, err := xml.Marshal(&xmppcore.SASLSuccess{})
+		if err != nil {
+			panic(err)
+		}
+		cl.write(authRespXML)
+		cl.jid.Local = localpart
+		// The resource, if any, is bound later on the client's request
+		cl.jid.Resource = resourcepart
+		srv.finishClientAuthentication(cl)
+	} else {
+		authRespXML, err := xml.Marshal(&xmppcore.SASLFailure{
+			Condition: xmppcore.SASLFailureConditionNotAuthorized,
+			Text:      "Invalid username or password",
+		})
+		if err != nil {
+			panic(err)
+		}
+		cl.write(authRespXML)
+	}
+}
+
+// verifySASLPlain checks the PLAIN (RFC 4616) response. It returns the
+// user's local part and the resource provided by the verifier, if any.
+// A malformed response fails the authentication.
+func (srv *Server) verifySASLPlain(authBytes []byte) (localpart, resourcepart string, authOK bool) {
 	authSegments := bytes.SplitN(authBytes, []byte{0}, 3)
 	if len(authSegments) != 3 {
-		panic("there should be 3 parts here")
+		return "", "", false
 	}
 	var assumedLocal string
 	// if len(authSegments[0]) > 0 {
@@ -54,24 +81,5 @@ func (srv *Server) handleClientSASLAuth(cl *Client, startElem *xml.StartElement)
 	} else if localpart == "" {
 		localpart = string(authSegments[1]) //TODO: normalize
 	}
-	if authOK {
-		authRespXML, err := xml.Marshal(&xmppcore.SASLSuccess{})
-		if err != nil {
-			panic(err)
-		}
-		cl.conn.Write(authRespXML)
-		cl.authenticated = true
-		cl.jid.Local = localpart
-		cl.jid.Resource = resourcepart
-		srv.finishClientNegotiation(cl)
-	} else {
-		authRespXML, err := xml.Marshal(&xmppcore.SASLFailure{
-			Condition: xmppcore.SASLFailureConditionNotAuthorized,
-			Text:      "Invalid username or password",
-		})
-		if err != nil {
-			panic(err)
-		}
-		cl.conn.Write(authRespXML)
-	}
+	return localpart, resourcepart, authOK
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0388: Extensible SASL Profile
+// XEP-0386: Bind 2
+
+const saslNS = "urn:ietf:params:xml:ns:xmpp-sasl"
+
+// sasl2Authentication returns the SASL2 stream feature along with the
+// features which can be negotiated inline.
+func (srv *Server) sasl2Authentication(mechanisms []string) *SASL2Authentication {
+	bind := &Bind2Feature{Inline: []Bind2FeatureVar{{Var: CarbonsNS}}}
+	inline := &SASL2Inline{Bind: bind}
+	if srv.fastTokenStore != nil {
+		inline.FAST = &FASTFeature{Mechanisms: []string{fastMechanism}}
+	}
+	if srv.smEnabled {
+		bind.Inline = append(bind.Inline, Bind2FeatureVar{Var: SMNS})
+		inline.SM = &SMFeature{}
+	}
+	return &SASL2Authentication{Mechanisms: mechanisms, Inline: inline}
+}
+
+func sasl2Failure(condition, text string) *SASL2Failure {
+	failureXML := "<" + condition + " xmlns='" + saslNS + "'/>"
+	if text != "" {
+		failureXML += "<text>" + xmlEscapeString(text) + "</text>"
+	}
+	return &SASL2Failure{Condition: []byte(failureXML)}
+}
+
+// handleClientSASL2Authenticate authenticates the client, with its
+// credentials or with the FAST token of its device, and then
+// negotiates the requested inline features, i.e., the resumption of a
+// previous session or the resource binding, in the same exchange. There
+// is no stream restart. It returns the resumed session, if any.
+func (srv *Server) handleClientSASL2Authenticate(cl *Client, startElem *xml.StartElement) *Client {
+	var authenticate SASL2Authenticate
+	err := cl.xmlDecoder.DecodeElement(&authenticate, startElem)
+	if err != nil {
+		panic(err)
+	}
+
+	switch {
+	case authenticate.Mechanism == "PLAIN" && srv.saslPlainAuthVerifier != nil:
+	case authenticate.Mechanism == fastMechanism && srv.fastTokenStore != nil:
+	default:
+		cl.writeElement(sasl2Failure("invalid-mechanism", ""))
+		return nil
+	}
+	authBytes, err := base64.StdEncoding.DecodeString(authenticate.InitialResponse)
+	if err != nil {
+		cl.writeElement(sasl2Failure("incorrect-encoding", ""))
+		return nil
+	}
+	if authenticate.UserAgent != nil {
+		cl.userAgentID = authenticate.UserAgent.ID
+	}
+	var localpart, resourcepart, additionalData string
+	var fastToken *FASTToken
+	var fastPreviousUsed bool
+	if authenticate.Mechanism == fastMechanism {
+		var condition string
+		localpart, fastToken, fastPreviousUsed, condition = srv.verifyFASTToken(cl, authBytes, authenticate.FAST)
+		if condition != "" {
+			cl.writeElement(sasl2Failure(condition, ""))
+			return nil
+		}
+		// HT mechanisms authenticate the server as well
+		additionalData = base64.StdEncoding.EncodeToString(fastTokenResponder(fastToken, fastPreviousUsed))
+	} else {
+		var authOK bool
+		localpart, resourcepart, authOK = srv.verifySASLPlain(authBytes)
+		if !authOK {
+			cl.writeElement(sasl2Failure("not-authorized", "Invalid username or password"))
+			return nil
+		}
+	}
+	cl.jid.Local = localpart
+	cl.jid.Resource = resourcepart
+	srv.finishClientAuthentication(cl)
+
+	successPayload := srv.updateFASTToken(cl, &authenticate, fastToken, fastPreviousUsed)
+	if authenticate.Resume != nil && srv.smEnabled {
+		tokenXML := successPayload
+		prev, failed := srv.resumeClientSession(cl, authenticate.Resume, func(prev *Client, resumedXML []byte) []byte {
+			successXML, err := xml.Marshal(&SASL2Success{
+				AdditionalData:          additionalData,
+				AuthorizationIdentifier: prev.jid.FullString(),
+				Payload:                 append(tokenXML, resumedXML...),
+			})
+			if err != nil {
+				panic(err)
+			}
+			return successXML
+		})
+		if prev != nil {
+			return prev
+		}
+		// The client may still bind a new session
+		failedXML, err := xml.Marshal(failed)
+		if err != nil {
+			panic(err)
+		}
+		successPayload = append(successPayload, failedXML...)
+	}
+
+	if authenticate.Bind != nil {
+		boundXML, condition := srv.bindClient2(cl, authenticate.Bind)
+		if condition != "" {
+			// The authentication can't be taken back
+			cl.writeElement(sasl2Failure("aborted", "Unable to bind the session"))
+			cl.closeStream(condition)
+			return nil
+		}
+		successPayload = append(successPayload, boundXML...)
+	}
+
+	authorizationIdentifier := cl.jid.BareCopyPtr().FullString()
+	if cl.resourceBound() {
+		authorizationIdentifier = cl.jid.FullString()
+	}
+	cl.writeElement(&SASL2Success{
+		AdditionalData:          additionalData,
+		AuthorizationIdentifier: authorizationIdentifier,
+		Payload:                 successPayload,
+	})
+	if !cl.resourceBound() {
+		// The client goes on with the resource binding right away
+		cl.state = clientStateRestarted
+		cl.write(srv.clientStreamFeatures(cl))
+	}
+	return nil
+}
+
+// bindClient2 binds the client's session along with the inline features.
+// It returns the bound element or the stream error condition if the
+// session can't be bound.
+func (srv *Server) bindClient2(cl *Client, bind *Bind2Bind) ([]byte, string) {
+	// The resource provided by the authentication, if any, takes
+	// precedence. The client's tag is only a hint.
+	if cl.jid.Resource == "" {
+		cl.jid.Resource = srv.generateResource(cl.jid.Local, bind.Tag)
+	}
+	switch srv.finishClientNegotiation(cl) {
+	case "":
+	case "conflict":
+		return nil, "conflict"
+	default:
+		return nil, "resource-constraint"
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Info("Bound inline")
+
+	var payload []byte
+	if bind.CarbonsEnable != nil {
+		cl.setCarbonsEnabled(true)
+	}
+	if bind.SMEnable != nil && srv.smEnabled {
+		smXML, err := xml.Marshal(srv.enableClientSM(cl, bind.SMEnable))
+		if err != nil {
+			panic(err)
+		}
+		payload = append(payload, smXML...)
+	}
+	boundXML, err := xml.Marshal(&Bind2Bound{Payload: payload})
+	if err != nil {
+		panic(err)
+	}
+	return boundXML, ""
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSASL2Result is the part of the SASL2 success or failure which the
+// tests look at.
+type testSASL2Result struct {
+	XMLName                 xml.Name
+	AdditionalData          string `xml:"additional-data"`
+	AuthorizationIdentifier string `xml:"authorization-identifier"`
+	Token                   *struct {
+		Token string `xml:"token,attr"`
+	} `xml:"urn:xmpp:fast:0 token"`
+	Bound *struct {
+		Enabled *struct {
+			ID string `xml:"id,attr"`
+		} `xml:"urn:xmpp:sm:3 enabled"`
+	} `xml:"urn:xmpp:bind:0 bound"`
+	Resumed *struct {
+		H uint32 `xml:"h,attr"`
+	} `xml:"urn:xmpp:sm:3 resumed"`
+	Failed *struct{} `xml:"urn:xmpp:sm:3 failed"`
+	// Condition is the failure's SASL condition.
+	Condition *struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// authenticate2 sends the SASL2 authentication with the mechanism and
+// the elements which go along with the initial response, and returns
+// the server's answer along with the raw element. A successful inline
+// binding sets the client's JID.
+func (c *testClient) authenticate2(mechanism string, initialResponse []byte, elementsXML string) (*testSASL2Result, string) {
+	c.t.Helper()
+	c.send(`<authenticate xmlns='urn:xmpp:sasl:2' mechanism='` + mechanism + `'><initial-response>` +
+		base64.StdEncoding.EncodeToString(initialResponse) + `</initial-response>` + elementsXML + `</authenticate>`)
+	data := c.receive()
+	var result testSASL2Result
+	if err := xml.Unmarshal([]byte(data), &result); err != nil {
+		c.t.Fatalf("invalid SASL2 answer %s: %v", data, err)
+	}
+	if result.XMLName.Space != SASL2NS {
+		c.t.Fatalf("unexpected SASL2 answer %s", data)
+	}
+	if result.XMLName.Local == "success" && strings.Contains(result.AuthorizationIdentifier, "/") {
+		c.jid = result.AuthorizationIdentifier
+	}
+	return &result, data
+}
+
+// waitDetached waits for the session of the full JID to lose its
+// connection and to wait to be resumed.
+func (ts *testServer) waitDetached(fullJID string) {
+	ts.t.Helper()
+	local := fullJID[:strings.Index(fullJID, "@")]
+	resource := fullJID[strings.Index(fullJID, "/")+1:]
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cl := ts.authenticatedClient(local, resource); cl != nil && cl.detached() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.t.Fatalf("the session of %s hasn't been detached", fullJID)
+}
+
+// testUserAgent is the user agent element of the device.
+func testUserAgent(id string) string {
+	return `<user-agent id='` + id + `'><software>Test</software><device>Phone</device></user-agent>`
+}
+
+func TestSASL2InlineBind(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamManagementEnabled = true
+		cfg.StreamResumptionTimeout = 60
+	})
+	defer ts.close()
+
+	alice := ts.newTestClient(newMemoryTransport(64))
+	if !alice.transport.OpenStream("localhost") {
+		t.Fatal("transport closed")
+	}
+	alice.expect("<stream:stream")
+	features := alice.expect("<stream:features")
+	if !strings.Contains(features, "urn:xmpp:sasl:2") || !strings.Contains(features, "urn:xmpp:bind:0") {
+		t.Fatalf("SASL2 with Bind 2 not offered: %s", features)
+	}
+
+	// The session is bound in the same exchange, with the inline
+	// features enabled
+	result, data := alice.authenticate2("PLAIN", []byte("\x00alice\x00secret"), testUserAgent("d1")+
+		`<bind xmlns='urn:xmpp:bind:0'><tag>Phone</tag>`+
+		`<enable xmlns='urn:xmpp:sm:3' resume='true'/><enable xmlns='urn:xmpp:carbons:2'/></bind>`)
+	if result.XMLName.Local != "success" || !strings.HasPrefix(alice.jid, "alice@localhost/phone.") {
+		t.Fatalf("unexpected success: %s", data)
+	}
+	if result.Bound == nil || result.Bound.Enabled == nil || result.Bound.Enabled.ID == "" {
+		t.Fatalf("expected stream management to be enabled: %s", data)
+	}
+	if ts.authenticatedClient("alice", alice.jid[strings.Index(alice.jid, "/")+1:]) == nil {
+		t.Fatal("the session isn't bound")
+	}
+
+	// Carbons are enabled
+	laptop := ts.connect("alice", "laptop")
+	bob := ts.connect("bob", "laptop")
+	bob.send(`<message type='chat' id='m1' to='alice@localhost/laptop'><body>Hello</body></message>`)
+	laptop.expect("<message")
+	if received := alice.expect("<message"); !strings.Contains(received, "<received") ||
+		!strings.Contains(received, "Hello") {
+		t.Fatalf("expected a carbon, got %s", received)
+	}
+
+	// A client may bind the usual way after the authentication, without
+	// a stream restart
+	carol := ts.newTestClient(newMemoryTransport(64))
+	carol.openStream()
+	result, data = carol.authenticate2("PLAIN", []byte("\x00carol\x00secret"), "")
+	if result.XMLName.Local != "success" || result.AuthorizationIdentifier != "carol@localhost" {
+		t.Fatalf("unexpected success: %s", data)
+	}
+	carol.expect("<stream:features")
+	carol.bind("desk")
+	if carol.jid != "carol@localhost/desk" {
+		t.Fatalf("unexpected bound JID %s", carol.jid)
+	}
+
+	// A mechanism which isn't offered fails
+	dave := ts.newTestClient(newMemoryTransport(64))
+	dave.openStream()
+	result, data = dave.authenticate2("SCRAM-SHA-1", []byte("n,,n=dave,r=abc"), "")
+	if result.XMLName.Local != "failure" || result.Condition == nil ||
+		result.Condition.XMLName.Local != "invalid-mechanism" {
+		t.Fatalf("expected an invalid-mechanism failure, got %s", data)
+	}
+
+	alice.close()
+	laptop.close()
+	bob.close()
+	carol.close()
+	dave.close()
+}
+
+func TestSASL2InlineResume(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamManagementEnabled = true
+		cfg.StreamResumptionTimeout = 60
+	})
+	defer ts.close()
+	bob := ts.connect("bob", "laptop")
+
+	alice := ts.newTestClient(newMemoryTransport(64))
+	alice.openStream()
+	result, data := alice.authenticate2("PLAIN", []byte("\x00alice\x00secret"), testUserAgent("d1")+
+		`<bind xmlns='urn:xmpp:bind:0'><tag>phone</tag><enable xmlns='urn:xmpp:sm:3' resume='true'/></bind>`)
+	if result.Bound == nil || result.Bound.Enabled == nil {
+		t.Fatalf("expected stream management to be enabled: %s", data)
+	}
+	smID, boundJID := result.Bound.Enabled.ID, alice.jid
+
+	// The connection is lost along with a message
+	alice.transport.Close()
+	ts.waitDetached(boundJID)
+	bob.send(`<message type='chat' id='m1' to='` + boundJID + `'><body>Hello</body></message>`)
+	bob.sync()
+
+	again := ts.newTestClient(newMemoryTransport(64))
+	again.openStream()
+	result, data = again.authenticate2("PLAIN", []byte("\x00alice\x00secret"), testUserAgent("d1")+
+		`<resume xmlns='urn:xmpp:sm:3' previd='`+smID+`' h='0'/>`)
+	if result.XMLName.Local != "success" || result.Resumed == nil || result.AuthorizationIdentifier != boundJID {
+		t.Fatalf("unexpected success: %s", data)
+	}
+	if msg := parseTestMessage(t, again.expect("<message")); msg.Body != "Hello" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// A session which can't be resumed leaves the client to bind a new one
+	other := ts.newTestClient(newMemoryTransport(64))
+	other.openStream()
+	result, data = other.authenticate2("PLAIN", []byte("\x00alice\x00secret"),
+		`<resume xmlns='urn:xmpp:sm:3' previd='unknown' h='0'/>`+
+			`<bind xmlns='urn:xmpp:bind:0'><tag>laptop</tag></bind>`)
+	if result.XMLName.Local != "success" || result.Failed == nil || !strings.HasPrefix(other.jid, "alice@localhost/laptop.") {
+		t.Fatalf("unexpected success: %s", data)
+	}
+
+	again.close()
+	other.close()
+	bob.close()
+}
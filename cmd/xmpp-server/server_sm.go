@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0198: Stream Management
+
+// smAckRequestInterval is the number of stanzas sent to the client
+// between the server's ack requests.
+const smAckRequestInterval = 5
+
+// smResumeWaitTimeout limits how long a resumption waits for the
+// previous connection to be let go.
+const smResumeWaitTimeout = 10 * time.Second
+
+// streamManagement is guarded by the client's connMutex.
+type streamManagement struct {
+	// id is the resumption id, empty if the session is not resumable.
+	id      string
+	timeout time.Duration
+
+	// inbound is the number of stanzas handled from the client and
+	// outbound is the number of stanzas sent to the client. Both wrap
+	// around at 2^32.
+	inbound  uint32
+	outbound uint32
+	// unacked are the stanzas sent to the client which it hasn't
+	// acknowledged yet, oldest first.
+	unacked [][]byte
+
+	// timer runs while the session waits to be resumed.
+	timer *time.Timer
+	// ended is set once the session can't be resumed anymore.
+	ended bool
+}
+
+// ack removes the stanzas acknowledged by the client's handled count. It
+// returns false if the count acknowledges more than what was sent.
+func (sm *streamManagement) ack(h uint32) bool {
+	acked := h - (sm.outbound - uint32(len(sm.unacked)))
+	if acked > uint32(len(sm.unacked)) {
+		return false
+	}
+	if acked > 0 {
+		sm.unacked = append([][]byte(nil), sm.unacked[acked:]...)
+	}
+	return true
+}
+
+// writeStanza sends the stanza to the client. With Stream Management
+// enabled, the stanza is kept until the client acknowledges it, even
+// while the session waits to be resumed. It returns false if the stanza
+// has been discarded: neither queued to be sent nor kept for the client.
+// Without Stream Management, there's no telling whether a queued stanza
+// makes it to the client.
+func (cl *Client) writeStanza(stanzaXML []byte) bool {
+	cl.connMutex.Lock()
+	defer cl.connMutex.Unlock()
+	sm := cl.sm
+	kept := sm != nil && !sm.ended
+	if kept {
+		sm.outbound++
+		sm.unacked = append(sm.unacked, stanzaXML)
+	}
+	if cl.outbox == nil {
+		return kept
+	}
+	queued := cl.enqueue(stanzaXML)
+	if kept && len(sm.unacked)%smAckRequestInterval == 0 {
+		cl.enqueue([]byte("<r xmlns='" + SMNS + "'/>"))
+	}
+	return kept || queued
+}
+
+// countHandledStanza counts a stanza from the client once it has been
+// handled.
+func (cl *Client) countHandledStanza() {
+	cl.connMutex.Lock()
+	if cl.sm != nil {
+		cl.sm.inbound++
+	}
+	cl.connMutex.Unlock()
+}
+
+func smFailed(condition string, h *uint32) *SMFailed {
+	return &SMFailed{
+		H:         h,
+		Condition: []byte("<" + condition + " xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>"),
+	}
+}
+
+func (srv *Server) handleClientSMEnable(cl *Client, startElem *xml.StartElement) {
+	var enable SMEnable
+	err := cl.xmlDecoder.DecodeElement(&enable, startElem)
+	if err != nil {
+		panic(err)
+	}
+
+	if !cl.resourceBound() {
+		cl.writeElement(smFailed("unexpected-request", nil))
+		return
+	}
+	cl.writeElement(srv.enableClientSM(cl, &enable))
+}
+
+// enableClientSM enables Stream Management on the bound session. It
+// returns the element answering the request, i.e., either SMEnabled or
+// SMFailed.
+func (srv *Server) enableClientSM(cl *Client, enable *SMEnable) interface{} {
+	cl.connMutex.Lock()
+	if cl.sm != nil {
+		cl.connMutex.Unlock()
+		return smFailed("unexpected-request", nil)
+	}
+	sm := &streamManagement{}
+	enabled := SMEnabled{}
+	if resume, _ := parseXMPPBoolean(enable.Resume); resume && srv.smResumptionTimeout > 0 {
+		id, err := srv.generateStreamID()
+		if err != nil {
+			panic(err)
+		}
+		sm.id = id
+		sm.timeout = srv.smResumptionTimeout
+		if maxTimeout := time.Duration(enable.Max) * time.Second; maxTimeout > 0 && maxTimeout < sm.timeout {
+			sm.timeout = maxTimeout
+		}
+		enabled.ID = id
+		enabled.Resume = "true"
+		enabled.Max = int(sm.timeout / time.Second)
+	}
+	cl.sm = sm
+	cl.connMutex.Unlock()
+
+	if sm.id != "" {
+		srv.smSessionsMutex.Lock()
+		srv.smSessions[sm.id] = cl
+		srv.smSessionsMutex.Unlock()
+	}
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("Stream management enabled (resumable: %v)", sm.id != "")
+	return &enabled
+}
+
+func (srv *Server) handleClientSMRequest(cl *Client, startElem *xml.StartElement) {
+	var request SMRequest
+	err := cl.xmlDecoder.DecodeElement(&request, startElem)
+	if err != nil {
+		panic(err)
+	}
+	cl.connMutex.Lock()
+	h := cl.sm.inbound
+	cl.connMutex.Unlock()
+	cl.writeElement(&SMAnswer{H: h})
+}
+
+// handleClientSMAnswer returns false if the stream has been closed
+// because the client acknowledged stanzas which were never sent.
+func (srv *Server) handleClientSMAnswer(cl *Client, startElem *xml.StartElement) bool {
+	var answer SMAnswer
+	err := cl.xmlDecoder.DecodeElement(&answer, startElem)
+	if err != nil {
+		panic(err)
+	}
+	cl.connMutex.Lock()
+	ok := cl.sm.ack(answer.H)
+	sent := cl.sm.outbound
+	cl.connMutex.Unlock()
+	if ok {
+		return true
+	}
+
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Warnf("Acknowledged count too high: %d", answer.H)
+	cl.closingStream = true
+	cl.write([]byte(`<stream:error>` +
+		`<undefined-condition xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+		`<handled-count-too-high xmlns='` + SMNS + `' h='` + strconv.FormatUint(uint64(answer.H), 10) + `' send-count='` +
+		strconv.FormatUint(uint64(sent), 10) + `'/>` +
+		`</stream:error></stream:stream>`))
+	return false
+}
+
+// handleClientSMResume returns the resumed session, or nil if the
+// resumption failed and the client carries on with its current session.
+func (srv *Server) handleClientSMResume(cl *Client, startElem *xml.StartElement) *Client {
+	var resume SMResume
+	err := cl.xmlDecoder.DecodeElement(&resume, startElem)
+	if err != nil {
+		panic(err)
+	}
+	if cl.state != clientStateRestarted || cl.sm != nil {
+		cl.writeElement(smFailed("unexpected-request", nil))
+		return nil
+	}
+	prev, failed := srv.resumeClientSession(cl, &resume, nil)
+	if failed != nil {
+		cl.writeElement(failed)
+	}
+	return prev
+}
+
+// resumeClientSession moves the connection of the newly authenticated
+// client into the previous session. The resumed element is passed through
+// wrap, if set, before it's sent ahead of the unacknowledged stanzas.
+func (srv *Server) resumeClientSession(
+	cl *Client, resume *SMResume, wrap func(prev *Client, resumedXML []byte) []byte,
+) (*Client, *SMFailed) {
+	srv.smSessionsMutex.Lock()
+	prev := srv.smSessions[resume.PrevID]
+	srv.smSessionsMutex.Unlock()
+	if prev == nil || prev.jid.Local != cl.jid.Local {
+		return nil, smFailed("item-not-found", nil)
+	}
+
+	prev.connMutex.Lock()
+	// The previous connection might still look alive, e.g., the client
+	// noticed the network change before the server did. Its goroutine
+	// has to let go of the session first.
+	for prev.transport != nil && !prev.sm.ended {
+		prevTransport, prevDone := prev.transport, prev.connDone
+		prev.connMutex.Unlock()
+		prevTransport.Close()
+		select {
+		case <-prevDone:
+		case <-time.After(smResumeWaitTimeout):
+			return nil, smFailed("resource-constraint", nil)
+		}
+		prev.connMutex.Lock()
+	}
+	if prev.sm.ended {
+		prev.connMutex.Unlock()
+		return nil, smFailed("item-not-found", nil)
+	}
+	if !prev.sm.ack(resume.H) {
+		h := prev.sm.inbound
+		prev.connMutex.Unlock()
+		return nil, smFailed("unexpected-request", &h)
+	}
+	if prev.sm.timer != nil {
+		prev.sm.timer.Stop()
+		prev.sm.timer = nil
+	}
+	cl.connMutex.Lock()
+	prev.transport, prev.outbox, prev.connDone = cl.transport, cl.outbox, cl.connDone
+	cl.transport, cl.outbox = nil, nil
+	cl.connMutex.Unlock()
+	limitTransportReads(prev.transport, prev.limiter)
+	resumedXML, err := xml.Marshal(&SMResumed{PrevID: prev.sm.id, H: prev.sm.inbound})
+	if err != nil {
+		panic(err)
+	}
+	if wrap != nil {
+		resumedXML = wrap(prev, resumedXML)
+	}
+	// Queued as a whole so that the retransmission can't overflow the
+	// queue.
+	for _, stanzaXML := range prev.sm.unacked {
+		resumedXML = append(resumedXML, stanzaXML...)
+	}
+	prev.enqueue(resumedXML)
+	prev.connMutex.Unlock()
+
+	// The new client was only a vehicle for the authentication
+	srv.clientsMutex.Lock()
+	if srv.negotiatingClients[cl.streamID] == cl {
+		delete(srv.negotiatingClients, cl.streamID)
+	}
+	if srv.authenticatedClients[prev.jid.Local] == nil {
+		srv.authenticatedClients[prev.jid.Local] = make(map[string]*Client)
+	}
+	srv.authenticatedClients[prev.jid.Local][prev.jid.Resource] = prev
+	srv.clientsMutex.Unlock()
+
+	log.WithFields(logrus.Fields{"stream": prev.streamID, "jid": prev.jid}).
+		Infof("Session resumed by %s", cl.streamID)
+	return prev, nil
+}
+
+// detachClient keeps the resumable session of the client which has lost
+// the connection. It returns false if the session has to be ended.
+func (srv *Server) detachClient(cl *Client, transport clientTransport) bool {
+	cl.connMutex.Lock()
+	defer cl.connMutex.Unlock()
+	if cl.transport != transport {
+		// Resumed on another connection
+		return true
+	}
+	sm := cl.sm
+	if sm == nil || sm.id == "" || sm.ended || cl.closingStream || srv.stopState != 0 {
+		return false
+	}
+	cl.transport = nil
+	cl.outbox = nil
+	sm.timer = time.AfterFunc(sm.timeout, func() {
+		srv.expireClientSession(cl, sm)
+	})
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Infof("Session kept for %s to be resumed", sm.timeout)
+	return true
+}
+
+func (srv *Server) expireClientSession(cl *Client, sm *streamManagement) {
+	cl.connMutex.Lock()
+	if cl.transport != nil || sm.ended {
+		cl.connMutex.Unlock()
+		return
+	}
+	sm.ended = true
+	cl.connMutex.Unlock()
+
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Info("Session resumption timed out")
+	srv.endClientSession(cl)
+}
+
+// storeUnackedMessages puts the messages the client never acknowledged
+// into the offline storage so that they reach the user's next session.
+func (srv *Server) storeUnackedMessages(cl *Client, unacked [][]byte) {
+	stored := 0
+	for _, stanzaXML := range unacked {
+		var msg clientMessage
+		if err := xml.Unmarshal(stanzaXML, &msg); err != nil {
+			// Not a message
+			continue
+		}
+		if msg.Type != messageTypeChat && msg.Type != messageTypeNormal && msg.Type != "" {
+			continue
+		}
+		if msg.From == nil || msg.To == nil || msg.To.Local != cl.jid.Local || !messageHasBody(&msg) {
+			continue
+		}
+		if srv.storeOfflineMessage(&msg) {
+			stored++
+		}
+	}
+	if stored > 0 {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Infof("Stored %d unacknowledged messages as offline messages", stored)
+	}
+}
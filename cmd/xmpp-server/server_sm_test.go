@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableSM enables the resumable Stream Management and returns the
+// resumption id.
+func (c *testClient) enableSM(attrs string) string {
+	c.t.Helper()
+	c.send(`<enable xmlns='urn:xmpp:sm:3' resume='true' ` + attrs + `/>`)
+	var enabled struct {
+		ID string `xml:"id,attr"`
+	}
+	if err := xml.Unmarshal([]byte(c.expect("<enabled")), &enabled); err != nil || enabled.ID == "" {
+		c.t.Fatalf("unexpected enabled: %+v %v", enabled, err)
+	}
+	return enabled.ID
+}
+
+// receivedBodies returns the bodies of the messages among the elements.
+func receivedBodies(t *testing.T, elems []string) []string {
+	t.Helper()
+	var bodies []string
+	for _, data := range elems {
+		if strings.HasPrefix(data, "<message") {
+			bodies = append(bodies, parseTestMessage(t, data).Body)
+		}
+	}
+	return bodies
+}
+
+// resumeSM authenticates a new client and requests the resumption of the
+// session with the handled count. It returns the client along with what
+// the server has answered.
+func (ts *testServer) resumeSM(local, id string, h int) (*testClient, []string) {
+	ts.t.Helper()
+	c := ts.newTestClient(newMemoryTransport(64))
+	c.openStream()
+	c.authenticate(local)
+	c.openStream()
+	c.send(`<resume xmlns='urn:xmpp:sm:3' previd='` + id + `' h='` + strconv.Itoa(h) + `'/>`)
+	return c, c.sync()
+}
+
+func TestSMResume(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamManagementEnabled = true
+		cfg.StreamResumptionTimeout = 60
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	id := alice.enableSM("")
+	bob := ts.connect("bob", "laptop")
+
+	for i := 1; i <= 6; i++ {
+		bob.send(`<message type='chat' to='alice@localhost/phone'><body>` + strconv.Itoa(i) + `</body></message>`)
+	}
+	bob.sync()
+	// The server asks for an ack every few stanzas
+	received := alice.drain(200 * time.Millisecond)
+	if strings.Join(receivedBodies(t, received), ",") != "1,2,3,4,5,6" ||
+		!strings.Contains(strings.Join(received, ""), "<r xmlns") {
+		t.Fatalf("unexpected elements: %v", received)
+	}
+	alice.send(`<a xmlns='urn:xmpp:sm:3' h='3'/>`)
+	alice.send(`<message type='chat' to='bob@localhost/laptop'><body>Hi</body></message>`)
+	bob.expect("<message")
+
+	// The connection is lost, then a message comes while the session
+	// waits to be resumed
+	alice.transport.Close()
+	ts.waitDetached("alice@localhost/phone")
+	bob.send(`<message type='chat' to='alice@localhost/phone'><body>7</body></message>`)
+	bob.sync()
+
+	// The stanzas the client hasn't acknowledged are sent again
+	resumed, received := ts.resumeSM("alice", id, 4)
+	if len(received) == 0 || !strings.HasPrefix(received[0], "<resumed") || !strings.Contains(received[0], "h='1'") &&
+		!strings.Contains(received[0], `h="1"`) {
+		t.Fatalf("expected the session to be resumed with the handled count, got %v", received)
+	}
+	if bodies := strings.Join(receivedBodies(t, append(received, resumed.drain(100*time.Millisecond)...)), ","); bodies != "5,6,7" {
+		t.Fatalf("unexpected messages after the resumption: %s", bodies)
+	}
+	bob.send(`<message type='chat' to='alice@localhost/phone'><body>8</body></message>`)
+	if msg := parseTestMessage(t, resumed.expect("<message")); msg.Body != "8" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// The session can't be resumed twice at once: the previous
+	// connection is let go
+	again, received := ts.resumeSM("alice", id, 8)
+	if len(received) == 0 || !strings.HasPrefix(received[0], "<resumed") {
+		t.Fatalf("expected the session to be resumed, got %v", received)
+	}
+	resumed.expectClosed()
+
+	again.close()
+	bob.close()
+}
+
+func TestSMResumeFailures(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamManagementEnabled = true
+		cfg.StreamResumptionTimeout = 60
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	id := alice.enableSM("")
+	alice.transport.Close()
+	ts.waitDetached("alice@localhost/phone")
+
+	for _, attempt := range []struct {
+		local, id string
+		h         int
+		condition string
+	}{
+		{"alice", "unknown", 0, "<item-not-found"},
+		// The session is the user's
+		{"bob", id, 0, "<item-not-found"},
+		// More than what was sent is acknowledged
+		{"alice", id, 1, "<unexpected-request"},
+	} {
+		c, received := ts.resumeSM(attempt.local, attempt.id, attempt.h)
+		if len(received) == 0 || !strings.HasPrefix(received[0], "<failed") ||
+			!strings.Contains(received[0], attempt.condition) {
+			t.Fatalf("expected %s for %+v, got %v", attempt.condition, attempt, received)
+		}
+		// The client may bind a new session
+		c.bind("tablet")
+		c.close()
+	}
+
+	// The failures leave the session to be resumed
+	c, received := ts.resumeSM("alice", id, 0)
+	if len(received) == 0 || !strings.HasPrefix(received[0], "<resumed") {
+		t.Fatalf("expected the session to be resumed, got %v", received)
+	}
+
+	// Acknowledging what was never sent ends the stream
+	c.send(`<a xmlns='urn:xmpp:sm:3' h='5'/>`)
+	if received := strings.Join(c.expectClosed(), ""); !strings.Contains(received, "handled-count-too-high") {
+		t.Fatalf("expected a handled-count-too-high stream error, got %s", received)
+	}
+}
+
+func TestSMResumptionTimeout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamManagementEnabled = true
+		cfg.StreamResumptionTimeout = 60
+		cfg.OfflineStorage = "memory"
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+	alice.available()
+	// The client asks for a shorter timeout
+	id := alice.enableSM("max='1'")
+	bob := ts.connect("bob", "laptop")
+
+	bob.send(`<message type='chat' to='alice@localhost/phone'><body>Unacked</body></message>`)
+	alice.expect("<message")
+	alice.transport.Close()
+	ts.waitDetached("alice@localhost/phone")
+
+	// Once the session has expired, the message the client never
+	// acknowledged is kept offline
+	for deadline := time.Now().Add(5 * time.Second); ts.authenticatedClient("alice", "phone") != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("the session hasn't expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c, received := ts.resumeSM("alice", id, 0)
+	if len(received) == 0 || !strings.Contains(received[0], "<item-not-found") {
+		t.Fatalf("expected the session to be gone, got %v", received)
+	}
+	c.bind("phone")
+	c.send(`<presence/>`)
+	if bodies := strings.Join(receivedBodies(t, c.drain(200*time.Millisecond)), ","); bodies != "Unacked" {
+		t.Fatalf("unexpected offline messages: %s", bodies)
+	}
+
+	c.close()
+	bob.close()
+}
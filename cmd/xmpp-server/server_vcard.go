@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0054: vcard-temp
+// XEP-0153: vCard-Based Avatars
+
+const emptyVCardXML = `<vCard xmlns='vcard-temp'/>`
+
+// vCardPhotoData returns the decoded photo embedded in the vCard.
+func vCardPhotoData(vCard []byte) ([]byte, error) {
+	var vCardPhoto VCardPhoto
+	if err := xml.Unmarshal(vCard, &vCardPhoto); err != nil {
+		return nil, err
+	}
+	binVal := bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, []byte(vCardPhoto.Photo.BinVal))
+	if len(binVal) == 0 {
+		return nil, nil
+	}
+	photo := make([]byte, base64.StdEncoding.DecodedLen(len(binVal)))
+	n, err := base64.StdEncoding.Decode(photo, binVal)
+	if err != nil {
+		return nil, err
+	}
+	return photo[:n], nil
+}
+
+type avatarHashEntry struct {
+	hash string
+	ok   bool
+}
+
+// photoHash returns the XEP-0153 hash of the photo, empty if there's no
+// photo.
+func photoHash(photo []byte) string {
+	if len(photo) == 0 {
+		return ""
+	}
+	sum := sha1.Sum(photo)
+	return hex.EncodeToString(sum[:])
+}
+
+// avatarHash returns the XEP-0153 hash of the user's avatar. The hash is
+// empty if the user has no avatar. ok is false if the user has no vCard.
+func (srv *Server) avatarHash(bareJID string) (hash string, ok bool) {
+	if srv.vCardStore == nil {
+		return "", false
+	}
+	srv.avatarHashesMutex.Lock()
+	entry, cached := srv.avatarHashes[bareJID]
+	srv.avatarHashesMutex.Unlock()
+	if cached {
+		return entry.hash, entry.ok
+	}
+
+	vCard, err := srv.vCardStore.VCard(bareJID)
+	if err != nil {
+		log.WithFields(logrus.Fields{"jid": bareJID}).
+			Error("Unable to retrieve vCard: ", err)
+		return "", false
+	}
+	if vCard != nil {
+		entry.ok = true
+		if photo, err := vCardPhotoData(vCard); err == nil {
+			entry.hash = photoHash(photo)
+		}
+	}
+	srv.setAvatarHash(bareJID, entry)
+	return entry.hash, entry.ok
+}
+
+func (srv *Server) setAvatarHash(bareJID string, entry avatarHashEntry) {
+	srv.avatarHashesMutex.Lock()
+	srv.avatarHashes[bareJID] = entry
+	srv.avatarHashesMutex.Unlock()
+}
+
+// addAvatarHash adds the avatar hash to the available presence if the
+// client didn't provide one.
+func (srv *Server) addAvatarHash(cl *Client, presence *clientPresence) {
+	if xmlPayloadHasElement(presence.Payload, VCardUpdateNS, "x") {
+		return
+	}
+	hash, ok := srv.avatarHash(cl.jid.BareCopyPtr().FullString())
+	if !ok {
+		return
+	}
+	updateXML, err := xml.Marshal(&VCardUpdate{Photo: &hash})
+	if err != nil {
+		panic(err)
+	}
+	presence.Payload = append(presence.Payload, updateXML...)
+}
+
+func (srv *Server) handleClientVCardIQSet(cl *Client, iq *xmppcore.ClientIQ) {
+	owner := cl.jid.BareCopyPtr()
+	if iq.To != nil && !iq.To.Equals(*owner) {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeAuth,
+			Condition: xmppcore.StanzaErrorConditionForbidden,
+		})
+		return
+	}
+
+	vCard := bytes.TrimSpace(iq.Payload)
+	if len(vCard) > srv.vCardMaxSize {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Infof("vCard is too large: %d bytes", len(vCard))
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+	photo, err := vCardPhotoData(vCard)
+	if err != nil {
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionBadRequest,
+		})
+		return
+	}
+	if len(photo) > srv.vCardMaxPhotoSize {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Infof("vCard photo is too large: %d bytes", len(photo))
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeModify,
+			Condition: xmppcore.StanzaErrorConditionNotAcceptable,
+		})
+		return
+	}
+
+	oldHash, _ := srv.avatarHash(owner.FullString())
+	if err = srv.vCardStore.SetVCard(owner.FullString(), vCard); err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Error("Unable to store vCard: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	newHash := photoHash(photo)
+	srv.setAvatarHash(owner.FullString(), avatarHashEntry{hash: newHash, ok: true})
+	srv.sendClientIQResult(cl, iq, nil)
+
+	// XEP-0153: let the others know that the avatar has changed
+	if newHash != oldHash {
+		for _, ucl := range srv.userClients(cl.jid.Local) {
+			current := ucl.availablePresence()
+			if current == nil {
+				continue
+			}
+			presence := *current
+			presence.Payload = xmlPayloadRemoveElements(presence.Payload, func(startElem *xml.StartElement) bool {
+				return startElem.Name.Space == VCardUpdateNS && startElem.Name.Local == "x"
+			})
+			srv.addAvatarHash(ucl, &presence)
+			if !ucl.replacePresence(current, &presence) {
+				// The session has sent a newer presence meanwhile
+				continue
+			}
+			srv.broadcastPresence(ucl, &presence)
+		}
+	}
+}
+
+func (srv *Server) handleClientVCardIQGet(cl *Client, iq *xmppcore.ClientIQ) {
+	target := cl.jid.BareCopyPtr()
+	if iq.To != nil {
+		target = iq.To.BareCopyPtr()
+	}
+	if target.Local == "" {
+		// The server's vCard
+		srv.sendClientIQResult(cl, iq, []byte(emptyVCardXML))
+		return
+	}
+
+	vCard, err := srv.vCardStore.VCard(target.FullString())
+	if err != nil {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid, "stanza": iq.ID}).
+			Error("Unable to retrieve vCard: ", err)
+		srv.sendClientIQError(cl, iq, xmppcore.StanzaError{
+			Type:      xmppcore.StanzaErrorTypeWait,
+			Condition: xmppcore.StanzaErrorConditionInternalServerError,
+		})
+		return
+	}
+	if vCard == nil {
+		vCard = []byte(emptyVCardXML)
+	}
+	srv.sendClientIQResult(cl, iq, vCard)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func setTestVCard(c *testClient, vCardContent string) string {
+	c.t.Helper()
+	return c.request(`<iq type='set' id='` + generateID() + `'><vCard xmlns='vcard-temp'>` +
+		vCardContent + `</vCard></iq>`)
+}
+
+func testVCardPhoto(size int) string {
+	return `<PHOTO><TYPE>image/png</TYPE><BINVAL>` +
+		base64.StdEncoding.EncodeToString(make([]byte, size)) + `</BINVAL></PHOTO>`
+}
+
+func TestVCardSizeLimits(t *testing.T) {
+	// The limits apply by default
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.VCardStorage = "memory"
+	})
+	defer ts.close()
+	alice := ts.connect("alice", "phone")
+
+	response := setTestVCard(alice, `<FN>Alice</FN>`+testVCardPhoto(65*1024))
+	if !strings.Contains(response, "type='error'") && !strings.Contains(response, `type="error"`) ||
+		!strings.Contains(response, "<not-acceptable") {
+		t.Fatalf("expected a not-acceptable error for the photo, got %s", response)
+	}
+	response = setTestVCard(alice, `<FN>Alice</FN><DESC>`+strings.Repeat("a", 129*1024)+`</DESC>`)
+	if !strings.Contains(response, "<not-acceptable") {
+		t.Fatalf("expected a not-acceptable error for the vCard, got %s", response)
+	}
+	response = setTestVCard(alice, `<FN>Alice</FN>`+testVCardPhoto(60*1024))
+	if strings.Contains(response, "error") {
+		t.Fatalf("unexpected error: %s", response)
+	}
+	response = alice.request(`<iq type='get' id='get'><vCard xmlns='vcard-temp'/></iq>`)
+	if !strings.Contains(response, "<FN>Alice</FN>") {
+		t.Fatalf("unexpected vCard: %s", response)
+	}
+
+	alice.close()
+}
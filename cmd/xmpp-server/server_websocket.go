@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/exavolt/xmpp-server/cmd/xmpp-server/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// RFC 7395: An XMPP Subprotocol for WebSocket
+
+const webSocketPath = "/xmpp-websocket"
+
+// webSocketMaxMessageSize limits the size of the messages from the
+// clients, each of which is a single element.
+const webSocketMaxMessageSize = 256 * 1024
+
+func (srv *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if srv.stopState != 0 {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ws, err := websocket.Upgrade(w, r, "xmpp", webSocketMaxMessageSize)
+	if err != nil {
+		log.WithFields(logrus.Fields{"remote": r.RemoteAddr}).
+			Warn("WebSocket handshake failed: ", err)
+		return
+	}
+	srv.acceptClient(newWebSocketTransport(ws))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+)
+
+// clientTransport carries a client's stream, whatever the framing. What
+// it reads is the stream's header, its top-level elements and its
+// footer. What it's given to write is what the server would write on a
+// TCP stream (RFC 6120 4), i.e., whole elements except for the stream's
+// header and footer.
+type clientTransport interface {
+	// ReadElement returns the next part of the client's stream. The
+	// content of an element, if any, is to be read with its decoder. It
+	// fails with a timeout net.Error once the read deadline has passed,
+	// and the read may be tried again.
+	ReadElement() (*streamElement, error)
+	SetReadDeadline(t time.Time) error
+	Write(data []byte) error
+	// WriteKeepalive keeps the connection from being seen as idle, e.g.,
+	// by the NATs along the way.
+	WriteKeepalive() error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// readLimitedTransport is a transport which reads from the connection
+// ahead of the elements. The session's byte rate applies to these reads
+// rather than to the elements read.
+type readLimitedTransport interface {
+	SetReadLimiter(limiter *sessionLimiter)
+}
+
+// streamElement is a part of the client's stream.
+type streamElement struct {
+	// start is the start tag of the element or the stream's header.
+	start xml.StartElement
+	// footer is set for the stream's end tag.
+	footer bool
+	// decoder reads the element's content, right after the start tag.
+	decoder *xml.Decoder
+	// size is the number of bytes the element took on the transport.
+	size int
+}
+
+func (elem *streamElement) isHeader() bool {
+	return elem.start.Name.Space == xmppcore.JabberStreamsNS && elem.start.Name.Local == "stream"
+}
+
+// streamHeaderElement returns the stream's header with the attributes.
+func streamHeaderElement(attr []xml.Attr) *streamElement {
+	return &streamElement{start: xml.StartElement{
+		Name: xml.Name{Space: xmppcore.JabberStreamsNS, Local: "stream"},
+		Attr: attr,
+	}}
+}
+
+// newStreamElement parses the top-level element in the scope of the
+// namespaces declared by the stream's header, if any. The default
+// namespace is jabber:client otherwise.
+func newStreamElement(header *xml.StartElement, elemXML []byte) (*streamElement, error) {
+	var scope bytes.Buffer
+	scope.WriteString("<stream:stream")
+	declared := false
+	if header != nil {
+		for _, attr := range header.Attr {
+			switch {
+			case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+				declared = true
+				scope.WriteString(" xmlns='" + xmlEscapeString(attr.Value) + "'")
+			case attr.Name.Space == "xmlns" && attr.Name.Local != "stream":
+				scope.WriteString(" xmlns:" + attr.Name.Local + "='" + xmlEscapeString(attr.Value) + "'")
+			}
+		}
+	}
+	if !declared {
+		scope.WriteString(" xmlns='" + xmppcore.JabberClientNS + "'")
+	}
+	scope.WriteString(" xmlns:stream='" + xmppcore.JabberStreamsNS + "'>")
+
+	decoder := xml.NewDecoder(bytes.NewReader(append(scope.Bytes(), elemXML...)))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return &streamElement{start: start, decoder: decoder, size: len(elemXML)}, nil
+		}
+	}
+}
+
+// elementQueue is the reading side of a transport whose elements are
+// queued by another goroutine. It implements the read deadline.
+type elementQueue struct {
+	queue chan *streamElement
+	// err is what the reads fail with once closed is closed and the
+	// queue has been drained.
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	deadline      time.Time
+	deadlineMutex sync.Mutex
+}
+
+func newElementQueue(size int) *elementQueue {
+	return &elementQueue{
+		queue:  make(chan *streamElement, size),
+		closed: make(chan struct{}),
+	}
+}
+
+// push queues the element. It returns false if the queue is closed.
+func (q *elementQueue) push(elem *streamElement) bool {
+	select {
+	case <-q.closed:
+		return false
+	default:
+	}
+	select {
+	case q.queue <- elem:
+		return true
+	case <-q.closed:
+		return false
+	}
+}
+
+// close makes the reads fail with the error once the queued elements
+// have been read.
+func (q *elementQueue) close(err error) {
+	q.closeOnce.Do(func() {
+		q.err = err
+		close(q.closed)
+	})
+}
+
+func (q *elementQueue) ReadElement() (*streamElement, error) {
+	select {
+	case elem := <-q.queue:
+		return elem, nil
+	default:
+	}
+	q.deadlineMutex.Lock()
+	deadline := q.deadline
+	q.deadlineMutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case elem := <-q.queue:
+		return elem, nil
+	case <-q.closed:
+		// What was queued before the closing comes first
+		select {
+		case elem := <-q.queue:
+			return elem, nil
+		default:
+		}
+		return nil, q.err
+	case <-timeout:
+		return nil, transportTimeoutError{}
+	}
+}
+
+func (q *elementQueue) SetReadDeadline(t time.Time) error {
+	q.deadlineMutex.Lock()
+	q.deadline = t
+	q.deadlineMutex.Unlock()
+	return nil
+}
+
+type transportTimeoutError struct{}
+
+func (transportTimeoutError) Error() string   { return "read timeout" }
+func (transportTimeoutError) Timeout() bool   { return true }
+func (transportTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/sirupsen/logrus"
+)
+
+// XEP-0124: Bidirectional-streams Over Synchronous HTTP (BOSH)
+// XEP-0206: XMPP Over BOSH
+
+// boshMaxOutgoingSize limits the size of what a session holds for the
+// client's requests.
+const boshMaxOutgoingSize = 256 * 1024
+
+// boshSession is the transport of a BOSH session. The payloads of the
+// requests are read in the order of their ids, and what's written is
+// held until there's a request to respond with.
+type boshSession struct {
+	*elementQueue
+	sid        string
+	to, lang   string
+	wait       time.Duration
+	hold       int
+	inactivity time.Duration
+	remoteAddr net.Addr
+	// onClose is called once the session is closed.
+	onClose func()
+
+	mutex sync.Mutex
+	// cond is signaled when lastRID changes, when the outgoing elements
+	// are taken, when the write deadline passes or when the session
+	// terminates.
+	cond *sync.Cond
+	// creationRID is the id of the request which created the session.
+	creationRID uint64
+	// lastRID is the id of the last request whose payload has been
+	// passed on.
+	lastRID uint64
+	// held are the requests waiting for something to respond with,
+	// oldest first.
+	held []*boshRequest
+	// outgoing are the elements waiting for a request and outgoingSize
+	// is their total size.
+	outgoing     [][]byte
+	outgoingSize int
+	// writeDeadline is when a write waiting for room in outgoing fails.
+	writeDeadline time.Time
+	// authid is the id of the stream.
+	authid string
+	from   string
+	// terminated is set once the stream has ended. condition is the
+	// terminal binding condition, if any.
+	terminated bool
+	condition  string
+	// responses keep the latest responses, keyed by the request id, to
+	// be sent again if the client repeats a request.
+	responses       map[uint64][]byte
+	inactivityTimer *time.Timer
+	closeOnce       sync.Once
+}
+
+var _ clientTransport = &boshSession{}
+
+type boshRequest struct {
+	rid      uint64
+	response chan []byte
+}
+
+// boshAddr is the address of the client as given by the HTTP server.
+type boshAddr string
+
+func (addr boshAddr) Network() string { return "tcp" }
+func (addr boshAddr) String() string  { return string(addr) }
+
+func newBOSHSession(sid string, body *BOSHBody, wait time.Duration, hold int, inactivity time.Duration) *boshSession {
+	s := &boshSession{
+		// The payloads are pushed by the requests in turn, which are
+		// not to wait for the reader.
+		elementQueue: newElementQueue(hold + 1),
+		sid:          sid,
+		to:           body.To,
+		lang:         body.Lang,
+		wait:         wait,
+		hold:         hold,
+		inactivity:   inactivity,
+		creationRID:  body.RID,
+		lastRID:      body.RID - 1,
+		responses:    make(map[uint64][]byte),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// handleRequest passes the request's payload on and then holds the
+// request until there's something to respond with or the wait time
+// elapses. It returns the response body.
+func (s *boshSession) handleRequest(body *BOSHBody) []byte {
+	s.mutex.Lock()
+	if body.RID <= s.lastRID {
+		// The client hasn't received the response
+		response, ok := s.responses[body.RID]
+		s.mutex.Unlock()
+		if !ok {
+			return boshTerminateBody("item-not-found")
+		}
+		return response
+	}
+	if body.RID > s.lastRID+uint64(s.hold)+1 {
+		s.mutex.Unlock()
+		s.Close()
+		return boshTerminateBody("item-not-found")
+	}
+	// The requests may arrive out of order over their connections
+	for body.RID != s.lastRID+1 && !s.terminated {
+		s.cond.Wait()
+	}
+	if s.terminated {
+		s.mutex.Unlock()
+		return boshTerminateBody(s.condition)
+	}
+	if s.inactivityTimer != nil {
+		s.inactivityTimer.Stop()
+		s.inactivityTimer = nil
+	}
+	s.mutex.Unlock()
+
+	// The following requests wait for lastRID thus the elements are
+	// pushed in order.
+	var elems []*streamElement
+	switch {
+	case body.RID == s.creationRID:
+		elems = append(elems, s.clientStreamHeader(body.XMPPVersion))
+	case body.Restart == "true" || body.Restart == "1":
+		elems = append(elems, s.clientStreamHeader("1.0"))
+	default:
+		collector := &streamElementCollector{}
+		if err := splitStreamData(body.Payload, collector); err != nil {
+			s.mutex.Lock()
+			s.lastRID = body.RID
+			s.mutex.Unlock()
+			s.Close()
+			return boshTerminateBody("bad-request")
+		}
+		elems = collector.elems
+		if body.Type == "terminate" {
+			elems = append(elems, &streamElement{footer: true})
+		}
+	}
+	for _, elem := range elems {
+		s.push(elem)
+	}
+	if body.Type == "terminate" {
+		// Nothing follows the stream's end
+		s.elementQueue.close(io.EOF)
+	}
+
+	request := &boshRequest{rid: body.RID, response: make(chan []byte, 1)}
+	s.mutex.Lock()
+	s.lastRID = body.RID
+	s.cond.Broadcast()
+	s.held = append(s.held, request)
+	s.flushLocked()
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+	select {
+	case response := <-request.response:
+		return response
+	case <-timer.C:
+	}
+	s.mutex.Lock()
+	for i, held := range s.held {
+		if held == request {
+			s.held = append(s.held[:i], s.held[i+1:]...)
+			s.respondLocked(request)
+			break
+		}
+	}
+	s.startInactivityTimerLocked()
+	s.mutex.Unlock()
+	return <-request.response
+}
+
+// flushLocked responds to the held requests while there's something to
+// respond with or while there are more requests than the client may
+// hold.
+func (s *boshSession) flushLocked() {
+	for len(s.held) > 0 {
+		if len(s.outgoing) == 0 && !s.terminated && len(s.held) <= s.hold {
+			break
+		}
+		// The session's creation is responded along with the stream
+		// features.
+		if s.held[0].rid == s.creationRID && len(s.outgoing) == 0 && !s.terminated {
+			break
+		}
+		request := s.held[0]
+		s.held = s.held[1:]
+		s.respondLocked(request)
+	}
+	s.startInactivityTimerLocked()
+}
+
+func (s *boshSession) respondLocked(request *boshRequest) {
+	var response bytes.Buffer
+	response.WriteString("<body xmlns='" + BOSHNS + "' xmlns:stream='" + xmppcore.JabberStreamsNS + "'")
+	if request.rid == s.creationRID {
+		response.WriteString(" sid='" + s.sid + "'" +
+			" wait='" + strconv.Itoa(int(s.wait/time.Second)) + "'" +
+			" hold='" + strconv.Itoa(s.hold) + "'" +
+			" requests='" + strconv.Itoa(s.hold+1) + "'" +
+			" inactivity='" + strconv.Itoa(int(s.inactivity/time.Second)) + "'" +
+			" polling='" + strconv.Itoa(int(boshPolling/time.Second)) + "'" +
+			" ver='" + boshVersion + "'" +
+			" xmlns:xmpp='" + XBOSHNS + "' xmpp:version='1.0' xmpp:restartlogic='true'")
+		if s.from != "" {
+			response.WriteString(" from='" + xmlEscapeString(s.from) + "'")
+		}
+		if s.authid != "" {
+			response.WriteString(" authid='" + xmlEscapeString(s.authid) + "'")
+		}
+	}
+	if s.terminated {
+		response.WriteString(" type='terminate'")
+		if s.condition != "" {
+			response.WriteString(" condition='" + s.condition + "'")
+		}
+	}
+	response.WriteString(">")
+	for _, elem := range s.outgoing {
+		response.Write(elem)
+	}
+	s.outgoing, s.outgoingSize = nil, 0
+	s.cond.Broadcast()
+	response.WriteString("</body>")
+
+	s.responses[request.rid] = response.Bytes()
+	delete(s.responses, request.rid-uint64(s.hold)-1)
+	request.response <- response.Bytes()
+}
+
+// startInactivityTimerLocked closes the session if the client doesn't
+// make any request in time once it holds none.
+func (s *boshSession) startInactivityTimerLocked() {
+	if len(s.held) > 0 || s.terminated || s.inactivityTimer != nil {
+		return
+	}
+	s.inactivityTimer = time.AfterFunc(s.inactivity, func() {
+		log.WithFields(logrus.Fields{"sid": s.sid}).
+			Info("BOSH session inactive")
+		s.Close()
+	})
+}
+
+// clientStreamHeader returns the header of the stream the client opens
+// with the session's creation or restart.
+func (s *boshSession) clientStreamHeader(version string) *streamElement {
+	attr := []xml.Attr{{Name: xml.Name{Local: "to"}, Value: s.to}}
+	if version != "" {
+		attr = append(attr, xml.Attr{Name: xml.Name{Local: "version"}, Value: version})
+	}
+	if s.lang != "" {
+		attr = append(attr, xml.Attr{Name: xml.Name{Space: xmlNS, Local: "lang"}, Value: s.lang})
+	}
+	return streamHeaderElement(attr)
+}
+
+// boshTerminateBody returns the body which tells the client that its
+// session is gone.
+func boshTerminateBody(condition string) []byte {
+	body := "<body xmlns='" + BOSHNS + "' type='terminate'"
+	if condition != "" {
+		body += " condition='" + condition + "'"
+	}
+	return []byte(body + "/>")
+}
+
+// Write holds the data until there's a request to respond with. While
+// the session holds too much already, the write waits for the client to
+// make requests, as it would for a slow reader on TCP, and fails once
+// the write deadline has passed.
+func (s *boshSession) Write(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var timer *time.Timer
+	for s.outgoingSize >= boshMaxOutgoingSize && !s.terminated {
+		if !s.writeDeadline.IsZero() {
+			if !time.Now().Before(s.writeDeadline) {
+				return transportTimeoutError{}
+			}
+			if timer == nil {
+				timer = time.AfterFunc(time.Until(s.writeDeadline), func() {
+					s.mutex.Lock()
+					s.cond.Broadcast()
+					s.mutex.Unlock()
+				})
+				defer timer.Stop()
+			}
+		}
+		s.cond.Wait()
+	}
+	if s.terminated {
+		return io.ErrClosedPipe
+	}
+	if err := splitStreamData(data, s); err != nil {
+		return err
+	}
+	s.flushLocked()
+	return nil
+}
+
+// WriteKeepalive does nothing as the requests keep the session alive.
+func (s *boshSession) WriteKeepalive() error {
+	return nil
+}
+
+func (s *boshSession) streamHeader(header *xml.StartElement) error {
+	for _, attr := range header.Attr {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "id":
+			s.authid = attr.Value
+		case attr.Name.Space == "" && attr.Name.Local == "from":
+			s.from = attr.Value
+		}
+	}
+	return nil
+}
+
+func (s *boshSession) streamElement(elem []byte) error {
+	if bytes.HasPrefix(elem, []byte("<stream:error")) {
+		s.condition = "remote-stream-error"
+	}
+	s.outgoing = append(s.outgoing, append([]byte{}, elem...))
+	s.outgoingSize += len(elem)
+	return nil
+}
+
+func (s *boshSession) streamFooter() error {
+	s.terminated = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// Close terminates the session. The held requests are responded with
+// what's left.
+func (s *boshSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.elementQueue.close(io.EOF)
+		s.mutex.Lock()
+		s.terminated = true
+		s.cond.Broadcast()
+		s.flushLocked()
+		if s.inactivityTimer != nil {
+			s.inactivityTimer.Stop()
+			s.inactivityTimer = nil
+		}
+		s.mutex.Unlock()
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+	return nil
+}
+
+func (s *boshSession) RemoteAddr() net.Addr { return s.remoteAddr }
+
+// SetWriteDeadline limits how long a write waits for the client to take
+// what the session holds.
+func (s *boshSession) SetWriteDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.writeDeadline = t
+	s.mutex.Unlock()
+	return nil
+}
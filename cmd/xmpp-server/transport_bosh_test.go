@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// boshTestClient makes the requests of a BOSH session, one at a time.
+type boshTestClient struct {
+	ts  *testServer
+	sid string
+	rid uint64
+}
+
+// request sends the body with the attributes and the payload and returns
+// the response body.
+func (c *boshTestClient) request(attrs, payload string) string {
+	c.ts.t.Helper()
+	c.rid++
+	bodyXML := `<body xmlns='http://jabber.org/protocol/httpbind' xmlns:xmpp='urn:xmpp:xbosh' rid='` +
+		strconv.FormatUint(c.rid, 10) + `'`
+	if c.sid != "" {
+		bodyXML += ` sid='` + c.sid + `'`
+	}
+	bodyXML += ` ` + attrs + `>` + payload + `</body>`
+	recorder := httptest.NewRecorder()
+	c.ts.handleBOSH(recorder, httptest.NewRequest("POST", boshPath, strings.NewReader(bodyXML)))
+	return recorder.Body.String()
+}
+
+// expect makes empty requests until a response has the substring. The
+// responses are held up to the session's wait.
+func (c *boshTestClient) expect(substr string) string {
+	c.ts.t.Helper()
+	for i := 0; i < 5; i++ {
+		if response := c.request("", ""); strings.Contains(response, substr) {
+			return response
+		}
+	}
+	c.ts.t.Fatalf("expected %s", substr)
+	return ""
+}
+
+// connectBOSH creates a session, authenticates with PLAIN and binds the
+// resource.
+func (ts *testServer) connectBOSH(local, resource string) *boshTestClient {
+	ts.t.Helper()
+	c := &boshTestClient{ts: ts, rid: 1000}
+	response := c.request(`to='localhost' wait='1' hold='1' xmpp:version='1.0'`, "")
+	var body struct {
+		SID string `xml:"sid,attr"`
+	}
+	if err := xml.Unmarshal([]byte(response), &body); err != nil || body.SID == "" {
+		ts.t.Fatalf("unexpected session creation response: %s", response)
+	}
+	c.sid = body.SID
+	if !strings.Contains(response, "mechanisms") {
+		c.expect("mechanisms")
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + local + "\x00secret"))
+	if response = c.request("", `<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>`+
+		credentials+`</auth>`); !strings.Contains(response, "<success") {
+		c.expect("<success")
+	}
+	if response = c.request(`to='localhost' xmpp:restart='true'`, ""); !strings.Contains(response, "bind") {
+		c.expect("bind")
+	}
+	if response = c.request("", `<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>`+
+		`<resource>`+resource+`</resource></bind></iq>`); !strings.Contains(response, "</jid>") {
+		response = c.expect("</jid>")
+	}
+	if !strings.Contains(response, local+"@localhost/"+resource) {
+		ts.t.Fatalf("unexpected bind response: %s", response)
+	}
+	return c
+}
+
+func TestBOSHSession(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	alice := ts.connectBOSH("alice", "web")
+	bob := ts.connect("bob", "laptop")
+
+	// Several elements go into a request's body
+	response := alice.request("", `<message type='chat' id='m1' to='`+bob.jid+`'><body>One</body></message>`+
+		`<message type='chat' id='m2' to='`+bob.jid+`'><body>Two</body></message>`)
+	if strings.Contains(response, "terminate") {
+		t.Fatalf("unexpected response: %s", response)
+	}
+	if msg := parseTestMessage(t, bob.expect("<message")); msg.Body != "One" || msg.From != "alice@localhost/web" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if msg := parseTestMessage(t, bob.expect("<message")); msg.Body != "Two" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// and the elements for the client wait for its next request
+	bob.send(`<message type='chat' id='m3' to='alice@localhost/web'><body>Three</body></message>`)
+	bob.sync()
+	alice.expect("<body>Three</body>")
+
+	response = alice.request("type='terminate'", "<presence type='unavailable'/>")
+	if !strings.Contains(response, "type='terminate'") {
+		t.Fatalf("expected the session to be terminated, got %s", response)
+	}
+	if response = alice.request("", ""); !strings.Contains(response, "terminate") {
+		t.Fatalf("expected the session to be gone, got %s", response)
+	}
+
+	bob.close()
+}
+
+func TestBOSHSessionWriteWaitsForRequests(t *testing.T) {
+	s := newBOSHSession("sid", &BOSHBody{RID: 1, To: "localhost"}, time.Second, 1, time.Minute)
+	defer s.Close()
+
+	elem := []byte(`<message><body>` + strings.Repeat("a", 16*1024) + `</body></message>`)
+	s.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	written := 0
+	for {
+		err := s.Write(elem)
+		if err != nil {
+			if !isTimeoutError(err) {
+				t.Fatal(err)
+			}
+			break
+		}
+		written += len(elem)
+		if written > boshMaxOutgoingSize+len(elem) {
+			t.Fatalf("%d bytes written without a request", written)
+		}
+	}
+
+	// A request takes what's held
+	go s.handleRequest(&BOSHBody{RID: 1, To: "localhost"})
+	s.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := s.Write(elem); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBOSHOutgoingOverflow(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ClientWriteQueueSize = 8
+		cfg.ClientWriteTimeout = 1
+		cfg.ClientWriteQueueOverflow = writeQueueOverflowDisconnect
+	})
+	defer ts.close()
+	alice := ts.connectBOSH("alice", "web")
+	bob := ts.connect("bob", "laptop")
+
+	// alice makes no requests meanwhile. The messages are more than the
+	// session and the write queue hold.
+	body := strings.Repeat("a", 16*1024)
+	for i := 0; i < boshMaxOutgoingSize/len(body)+16; i++ {
+		bob.send(`<message type='chat' to='alice@localhost/web'><body>` + body + `</body></message>`)
+	}
+	bob.sync()
+
+	response := alice.request("", "")
+	if len(response) > boshMaxOutgoingSize+2*len(body) {
+		t.Fatalf("the session held %d bytes", len(response))
+	}
+	if !strings.Contains(response, "type='terminate'") {
+		response = alice.request("", "")
+	}
+	if !strings.Contains(response, "type='terminate'") {
+		t.Fatalf("expected the session to be terminated, got %d bytes", len(response))
+	}
+
+	bob.close()
+}
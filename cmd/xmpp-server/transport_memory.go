@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// memoryTransport is an in-process transport, e.g., for the tests. The
+// client's side hands it the elements with OpenStream, Send and
+// CloseStream, and gets what the server writes from Received, one
+// top-level element at a time.
+type memoryTransport struct {
+	*elementQueue
+	// received is what the server has written: the stream's header as
+	// its start tag, the elements, and the stream's footer as its end
+	// tag.
+	received chan []byte
+	closed   chan struct{}
+	// mutex serializes the writes, which may race with Close.
+	mutex     sync.Mutex
+	closeOnce sync.Once
+}
+
+var _ clientTransport = &memoryTransport{}
+
+// newMemoryTransport creates a transport whose received queue holds up
+// to size elements. The server's writes block while the queue is full.
+func newMemoryTransport(size int) *memoryTransport {
+	return &memoryTransport{
+		elementQueue: newElementQueue(0),
+		received:     make(chan []byte, size),
+		closed:       make(chan struct{}),
+	}
+}
+
+// OpenStream opens, or restarts, the client's stream to the domain.
+func (t *memoryTransport) OpenStream(to string) bool {
+	return t.push(streamHeaderElement([]xml.Attr{
+		{Name: xml.Name{Local: "to"}, Value: to},
+		{Name: xml.Name{Local: "version"}, Value: "1.0"},
+	}))
+}
+
+// Send hands the client's element, in the jabber:client namespace unless
+// it declares its own, to the server. It blocks until the server reads
+// it and returns false if the transport is closed.
+func (t *memoryTransport) Send(elemXML []byte) bool {
+	elem, err := newStreamElement(nil, elemXML)
+	if err != nil {
+		panic(err)
+	}
+	return t.push(elem)
+}
+
+// CloseStream closes the client's stream.
+func (t *memoryTransport) CloseStream() bool {
+	return t.push(&streamElement{footer: true})
+}
+
+// Received returns the queue of what the server has written. It's closed
+// along with the transport.
+func (t *memoryTransport) Received() <-chan []byte {
+	return t.received
+}
+
+func (t *memoryTransport) Write(data []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	select {
+	case <-t.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	return splitStreamData(data, t)
+}
+
+func (t *memoryTransport) streamHeader(header *xml.StartElement) error {
+	start := "<stream:stream"
+	for _, attr := range header.Attr {
+		name := attr.Name.Local
+		if attr.Name.Space != "" {
+			name = attr.Name.Space + ":" + name
+		}
+		start += " " + name + "='" + xmlEscapeString(attr.Value) + "'"
+	}
+	return t.receive([]byte(start + ">"))
+}
+
+func (t *memoryTransport) streamElement(elem []byte) error {
+	return t.receive(append([]byte{}, elem...))
+}
+
+func (t *memoryTransport) streamFooter() error {
+	return t.receive([]byte("</stream:stream>"))
+}
+
+func (t *memoryTransport) receive(data []byte) error {
+	select {
+	case t.received <- data:
+		return nil
+	case <-t.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// WriteKeepalive does nothing as there's no connection to keep alive.
+func (t *memoryTransport) WriteKeepalive() error {
+	return nil
+}
+
+// SetWriteDeadline does nothing. The writes block until the client's
+// side takes what's written or the transport is closed.
+func (t *memoryTransport) SetWriteDeadline(tm time.Time) error {
+	return nil
+}
+
+func (t *memoryTransport) RemoteAddr() net.Addr {
+	return memoryAddr{}
+}
+
+func (t *memoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.elementQueue.close(io.EOF)
+		close(t.closed)
+		// The pending writes give up before the queue is closed
+		t.mutex.Lock()
+		close(t.received)
+		t.mutex.Unlock()
+	})
+	return nil
+}
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
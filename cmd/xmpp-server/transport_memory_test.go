@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuthVerifier accepts any password.
+type testAuthVerifier struct{}
+
+func (testAuthVerifier) VerifySASLPlainAuth(
+	username, password []byte,
+) (localpart string, resourcepart string, success bool, err error) {
+	return string(username), "", true, nil
+}
+
+// testServer is a server whose clients connect over memory transports.
+// Its data, if any, is kept in a temporary directory.
+type testServer struct {
+	*Server
+	t       *testing.T
+	dataDir string
+	clients []*testClient
+}
+
+// newTestServer creates a server for the domain localhost. The
+// configuration may be adjusted by configure, if not nil.
+func newTestServer(t *testing.T, configure func(cfg *Config)) *testServer {
+	t.Helper()
+	dataDir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Name: "test", Domain: "localhost", Port: "0", DataDir: dataDir}
+	if configure != nil {
+		configure(cfg)
+	}
+	srv, err := New(cfg)
+	if err != nil {
+		os.RemoveAll(dataDir)
+		t.Fatal(err)
+	}
+	srv.saslPlainAuthVerifier = testAuthVerifier{}
+	return &testServer{Server: srv, t: t, dataDir: dataDir}
+}
+
+// close closes the clients which are still connected, e.g., after
+// a failure, then releases the server's listeners and data.
+func (ts *testServer) close() {
+	for _, c := range ts.clients {
+		c.transport.Close()
+	}
+	ts.clientsWaitGroup.Wait()
+	ts.netListener.Close()
+	if ts.httpListener != nil {
+		ts.httpListener.Close()
+	}
+	os.RemoveAll(ts.dataDir)
+}
+
+// testClient is the client's side of a memory transport.
+type testClient struct {
+	t         *testing.T
+	transport *memoryTransport
+	// jid is the bound full JID.
+	jid string
+}
+
+// newTestClient connects a client over the transport. The client has
+// yet to open its stream.
+func (ts *testServer) newTestClient(transport *memoryTransport) *testClient {
+	c := &testClient{t: ts.t, transport: transport}
+	ts.clients = append(ts.clients, c)
+	ts.acceptClient(c.transport)
+	return c
+}
+
+// connect negotiates the stream, authenticates with PLAIN and binds the
+// resource.
+func (ts *testServer) connect(local, resource string) *testClient {
+	ts.t.Helper()
+	return ts.connectTransport(newMemoryTransport(64), local, resource)
+}
+
+// connectTransport connects as connect does over the transport.
+func (ts *testServer) connectTransport(transport *memoryTransport, local, resource string) *testClient {
+	ts.t.Helper()
+	c := ts.newTestClient(transport)
+	c.openStream()
+	c.authenticate(local)
+	c.openStream()
+	c.bind(resource)
+	return c
+}
+
+// receive returns what the server has written next.
+func (c *testClient) receive() string {
+	c.t.Helper()
+	select {
+	case data, ok := <-c.transport.Received():
+		if !ok {
+			c.t.Fatal("transport closed")
+		}
+		return string(data)
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for the server")
+	}
+	return ""
+}
+
+// expect receives the next element and checks that it starts with the
+// prefix.
+func (c *testClient) expect(prefix string) string {
+	c.t.Helper()
+	data := c.receive()
+	if !strings.HasPrefix(data, prefix) {
+		c.t.Fatalf("expected %s, got %s", prefix, data)
+	}
+	return data
+}
+
+// expectClosed receives until the server closes the transport and
+// returns what it has received.
+func (c *testClient) expectClosed() []string {
+	c.t.Helper()
+	var received []string
+	for {
+		select {
+		case data, ok := <-c.transport.Received():
+			if !ok {
+				return received
+			}
+			received = append(received, string(data))
+		case <-time.After(5 * time.Second):
+			c.t.Fatal("timed out waiting for the server to close the stream")
+		}
+	}
+}
+
+func (c *testClient) send(elemXML string) {
+	c.t.Helper()
+	if !c.transport.Send([]byte(elemXML)) {
+		c.t.Fatal("transport closed")
+	}
+}
+
+// sync pings the server and returns what the server has written before
+// the pong, i.e., everything that was pending for the client.
+func (c *testClient) sync() []string {
+	c.t.Helper()
+	id := generateID()
+	c.send(`<iq type='get' id='` + id + `'><ping xmlns='urn:xmpp:ping'/></iq>`)
+	var received []string
+	for {
+		data := c.receive()
+		if strings.HasPrefix(data, "<iq") && strings.Contains(data, id) {
+			return received
+		}
+		received = append(received, data)
+	}
+}
+
+// drain receives until the server has sent nothing for the duration,
+// e.g., when the pong of sync could be dropped.
+func (c *testClient) drain(quiet time.Duration) []string {
+	c.t.Helper()
+	var received []string
+	for {
+		select {
+		case data, ok := <-c.transport.Received():
+			if !ok {
+				return received
+			}
+			received = append(received, string(data))
+		case <-time.After(quiet):
+			return received
+		}
+	}
+}
+
+// expectNothing checks that the server has nothing pending for the
+// client.
+func (c *testClient) expectNothing() {
+	c.t.Helper()
+	if received := c.sync(); len(received) > 0 {
+		c.t.Fatalf("expected nothing, got %s", strings.Join(received, "\n"))
+	}
+}
+
+// request sends the IQ and returns the response, skipping what comes
+// before it.
+func (c *testClient) request(iqXML string) string {
+	c.t.Helper()
+	var iq struct {
+		ID string `xml:"id,attr"`
+	}
+	if err := xml.Unmarshal([]byte(iqXML), &iq); err != nil || iq.ID == "" {
+		c.t.Fatalf("invalid request %s", iqXML)
+	}
+	c.send(iqXML)
+	for {
+		data := c.receive()
+		if strings.HasPrefix(data, "<iq") &&
+			(strings.Contains(data, "id='"+iq.ID+"'") || strings.Contains(data, `id="`+iq.ID+`"`)) {
+			return data
+		}
+	}
+}
+
+func (c *testClient) openStream() {
+	c.t.Helper()
+	if !c.transport.OpenStream("localhost") {
+		c.t.Fatal("transport closed")
+	}
+	c.expect("<stream:stream")
+	c.expect("<stream:features")
+}
+
+func (c *testClient) authenticate(local string) {
+	c.t.Helper()
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + local + "\x00secret"))
+	c.send(`<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>` + credentials + `</auth>`)
+	c.expect("<success")
+}
+
+// bind binds the resource and keeps the bound JID.
+func (c *testClient) bind(resource string) {
+	c.t.Helper()
+	var result struct {
+		Type string `xml:"type,attr"`
+		Bind struct {
+			JID string `xml:"jid"`
+		} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	}
+	response := c.request(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>` +
+		`<resource>` + resource + `</resource></bind></iq>`)
+	if err := xml.Unmarshal([]byte(response), &result); err != nil {
+		c.t.Fatal(err)
+	}
+	if result.Type != "result" || result.Bind.JID == "" {
+		c.t.Fatalf("unexpected bind result: %s", response)
+	}
+	c.jid = result.Bind.JID
+}
+
+// available sends the initial presence and returns what the server has
+// sent in return.
+func (c *testClient) available() []string {
+	c.t.Helper()
+	c.send(`<presence/>`)
+	return c.sync()
+}
+
+// announceFeatures sends available presence with the entity
+// capabilities of the features, then answers the server's disco#info
+// query. It returns what the server has sent after the answer.
+func (c *testClient) announceFeatures(ver string, features ...string) []string {
+	c.t.Helper()
+	c.send(`<presence><c xmlns='http://jabber.org/protocol/caps' node='test' ver='` + ver + `'/></presence>`)
+	var query struct {
+		ID    string `xml:"id,attr"`
+		Query *struct {
+			Node string `xml:"node,attr"`
+		} `xml:"http://jabber.org/protocol/disco#info query"`
+	}
+	for {
+		data := c.receive()
+		if !strings.HasPrefix(data, "<iq") {
+			continue
+		}
+		if err := xml.Unmarshal([]byte(data), &query); err != nil {
+			c.t.Fatal(err)
+		}
+		if query.Query != nil {
+			break
+		}
+	}
+	var featuresXML string
+	for _, feature := range features {
+		featuresXML += `<feature var='` + feature + `'/>`
+	}
+	c.send(`<iq type='result' id='` + query.ID + `' to='localhost'>` +
+		`<query xmlns='http://jabber.org/protocol/disco#info' node='` + query.Query.Node + `'>` +
+		featuresXML + `</query></iq>`)
+	return c.sync()
+}
+
+// close closes the stream and waits for the server to close its side.
+func (c *testClient) close() {
+	c.t.Helper()
+	c.transport.CloseStream()
+	defer c.transport.Close()
+	for {
+		select {
+		case data, ok := <-c.transport.Received():
+			if !ok || string(data) == "</stream:stream>" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			c.t.Fatal("timed out waiting for the server to close the stream")
+		}
+	}
+}
+
+// testMessage is the part of a message which the tests look at.
+type testMessage struct {
+	ID   string `xml:"id,attr"`
+	Type string `xml:"type,attr"`
+	From string `xml:"from,attr"`
+	To   string `xml:"to,attr"`
+	Body string `xml:"body"`
+}
+
+func parseTestMessage(t *testing.T, data string) *testMessage {
+	t.Helper()
+	var msg testMessage
+	if err := xml.Unmarshal([]byte(data), &msg); err != nil {
+		t.Fatalf("invalid message %s: %v", data, err)
+	}
+	return &msg
+}
+
+func TestMemoryTransportMessage(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	alice := ts.connect("alice", "phone")
+	if alice.jid != "alice@localhost/phone" {
+		t.Fatalf("unexpected JID %s", alice.jid)
+	}
+	bob := ts.connect("bob", "laptop")
+
+	alice.send(`<message type='chat' id='m1' to='` + bob.jid + `'><body>Hello</body></message>`)
+	msg := parseTestMessage(t, bob.expect("<message"))
+	if msg.ID != "m1" || msg.From != alice.jid || msg.To != bob.jid || msg.Body != "Hello" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	alice.close()
+	bob.close()
+}
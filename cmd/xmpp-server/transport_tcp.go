@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/pkg/errors"
+)
+
+// RFC 6120 4: the stream over a TCP connection
+
+// tcpMaxElementSize limits the size of the elements from the client, as
+// webSocketMaxMessageSize and boshMaxRequestSize do for the other
+// transports.
+const tcpMaxElementSize = 256 * 1024
+
+// errElementTooLarge is the error of the read of an element larger than
+// tcpMaxElementSize.
+var errElementTooLarge = errors.New("element too large")
+
+// tcpTransport reads the client's stream from the connection in its own
+// goroutine, one element ahead of the reader, so that the read deadlines
+// never interrupt the parsing of an element.
+type tcpTransport struct {
+	conn net.Conn
+	*elementQueue
+
+	limiter      *sessionLimiter
+	limiterMutex sync.Mutex
+}
+
+var _ clientTransport = &tcpTransport{}
+var _ readLimitedTransport = &tcpTransport{}
+
+func newTCPTransport(conn net.Conn) *tcpTransport {
+	t := &tcpTransport{
+		conn:         conn,
+		elementQueue: newElementQueue(0),
+	}
+	go t.readElements()
+	return t
+}
+
+func (t *tcpTransport) readElements() {
+	reader := &recordingReader{reader: t.conn, maxSize: tcpMaxElementSize, onRead: t.throttleRead}
+	decoder := xml.NewDecoder(reader)
+	var header *xml.StartElement
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			t.elementQueue.close(err)
+			return
+		}
+		var elem *streamElement
+		switch token := token.(type) {
+		case xml.StartElement:
+			if token.Name.Space == xmppcore.JabberStreamsNS && token.Name.Local == "stream" {
+				header = &token
+				elem = streamHeaderElement(token.Attr)
+				elem.size = int(decoder.InputOffset() - offset)
+				break
+			}
+			if err = decoder.Skip(); err != nil {
+				t.elementQueue.close(err)
+				return
+			}
+			elem, err = newStreamElement(header, reader.recorded(offset, decoder.InputOffset()))
+			if err != nil {
+				t.elementQueue.close(err)
+				return
+			}
+		case xml.EndElement:
+			// Only the stream's end tag can be at the top level
+			elem = &streamElement{footer: true}
+		}
+		reader.discard(decoder.InputOffset())
+		if elem != nil && !t.push(elem) {
+			return
+		}
+	}
+}
+
+// SetReadLimiter applies the session's byte rate to the reads from the
+// connection. The reads are slowed down before the elements are parsed,
+// whatever their size.
+func (t *tcpTransport) SetReadLimiter(limiter *sessionLimiter) {
+	t.limiterMutex.Lock()
+	t.limiter = limiter
+	t.limiterMutex.Unlock()
+}
+
+// throttleRead fails with errRateLimited if the client is too far over
+// its byte rate.
+func (t *tcpTransport) throttleRead(n int) error {
+	t.limiterMutex.Lock()
+	limiter := t.limiter
+	t.limiterMutex.Unlock()
+	if limiter == nil {
+		return nil
+	}
+	delay, ok := limiter.reserveBytes(n)
+	if !ok {
+		return errRateLimited
+	}
+	time.Sleep(delay)
+	return nil
+}
+
+func (t *tcpTransport) Write(data []byte) error {
+	_, err := t.conn.Write(data)
+	return err
+}
+
+// WriteKeepalive sends a whitespace keepalive (RFC 6120 4.6.1).
+func (t *tcpTransport) WriteKeepalive() error {
+	return t.Write([]byte(" "))
+}
+
+func (t *tcpTransport) SetWriteDeadline(tm time.Time) error {
+	return t.conn.SetWriteDeadline(tm)
+}
+
+func (t *tcpTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *tcpTransport) Close() error {
+	t.elementQueue.close(io.EOF)
+	return t.conn.Close()
+}
+
+// recordingReader keeps what has been read so that the parser's input
+// can be taken back by the offsets.
+type recordingReader struct {
+	reader io.Reader
+	buf    []byte
+	// base is the offset of the first byte in buf.
+	base int64
+	// maxSize, if set, limits what is kept, i.e., the size of an element.
+	// The read fails with errElementTooLarge past it.
+	maxSize int
+	// onRead, if set, is called with the number of bytes read. The read
+	// fails with its error, if any.
+	onRead func(n int) error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	if r.maxSize > 0 && len(r.buf) > r.maxSize {
+		return n, errElementTooLarge
+	}
+	if r.onRead != nil && n > 0 {
+		if readErr := r.onRead(n); readErr != nil {
+			return n, readErr
+		}
+	}
+	return n, err
+}
+
+// recorded returns the input between the offsets.
+func (r *recordingReader) recorded(start, end int64) []byte {
+	return append([]byte{}, r.buf[start-r.base:end-r.base]...)
+}
+
+// discard forgets the input before the offset.
+func (r *recordingReader) discard(offset int64) {
+	r.buf = r.buf[offset-r.base:]
+	r.base = offset
+}
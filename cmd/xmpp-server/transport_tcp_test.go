@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpTestClient is the client's side of a TCP transport over a pipe.
+type tcpTestClient struct {
+	t        *testing.T
+	conn     net.Conn
+	received []byte
+}
+
+func (ts *testServer) newTCPTestClient() *tcpTestClient {
+	serverConn, clientConn := net.Pipe()
+	ts.acceptClient(newTCPTransport(serverConn))
+	return &tcpTestClient{t: ts.t, conn: clientConn}
+}
+
+func (c *tcpTestClient) send(data string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect receives until the server has written the substring and returns
+// what it has written up to it.
+func (c *tcpTestClient) expect(substr string) string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	for {
+		if i := bytes.Index(c.received, []byte(substr)); i >= 0 {
+			data := string(c.received[:i+len(substr)])
+			c.received = c.received[i+len(substr):]
+			return data
+		}
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.t.Fatalf("expected %s, got %s: %v", substr, c.received, err)
+		}
+		c.received = append(c.received, buf[:n]...)
+	}
+}
+
+// expectClosed receives until the server closes the connection and
+// returns what it has written.
+func (c *tcpTestClient) expectClosed() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		c.received = append(c.received, buf[:n]...)
+		if err == io.EOF {
+			return string(c.received)
+		}
+		if err != nil {
+			c.t.Fatalf("expected the connection to be closed, got %s: %v", c.received, err)
+		}
+	}
+}
+
+func (c *tcpTestClient) openStream() {
+	c.t.Helper()
+	c.send(`<?xml version='1.0'?><stream:stream to='localhost' version='1.0' ` +
+		`xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>`)
+	c.expect("</stream:features>")
+}
+
+func (c *tcpTestClient) connect(local, resource string) {
+	c.t.Helper()
+	c.openStream()
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + local + "\x00secret"))
+	c.send(`<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>` + credentials + `</auth>`)
+	c.expect("<success")
+	c.openStream()
+	c.send(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>` +
+		`<resource>` + resource + `</resource></bind></iq>`)
+	if response := c.expect("</iq>"); !strings.Contains(response, "type=\"result\"") &&
+		!strings.Contains(response, "type='result'") {
+		c.t.Fatalf("unexpected bind result: %s", response)
+	}
+}
+
+func TestTCPTransportElementTooLarge(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	c := ts.newTCPTestClient()
+	defer c.conn.Close()
+
+	c.openStream()
+	// The server stops reading midway
+	go c.conn.Write([]byte(`<message><body>` + strings.Repeat("a", tcpMaxElementSize) + `</body></message>`))
+	if received := c.expectClosed(); !strings.Contains(received, "<policy-violation") {
+		t.Fatalf("expected a policy-violation stream error, got %s", received)
+	}
+}
+
+func TestTCPTransportByteRateLimit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimits = map[string]UserClassLimits{
+			UserClassNormal: {SessionBytes: RateLimit{Rate: 1024}},
+		}
+	})
+	defer ts.close()
+	c := ts.newTCPTestClient()
+	defer c.conn.Close()
+
+	c.connect("alice", "phone")
+	// The element is never finished: the bytes are what is charged
+	go c.conn.Write([]byte(`<message to='bob@localhost'><body>` + strings.Repeat("a", 8*1024)))
+	if received := c.expectClosed(); !strings.Contains(received, "<policy-violation") {
+		t.Fatalf("expected a policy-violation stream error, got %s", received)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppcore"
+	"github.com/exavolt/xmpp-server/cmd/xmpp-server/websocket"
+)
+
+// RFC 7395: An XMPP Subprotocol for WebSocket
+
+// webSocketTransport reads the client's stream from the messages, each of
+// which is an element. The <open/> and <close/> elements are read as the
+// stream's header and footer. What's written is sent as one message per
+// top-level element with the stream's header and footer sent as <open/>
+// and <close/>.
+type webSocketTransport struct {
+	ws *websocket.Conn
+	*elementQueue
+}
+
+var _ clientTransport = &webSocketTransport{}
+
+func newWebSocketTransport(ws *websocket.Conn) *webSocketTransport {
+	t := &webSocketTransport{
+		ws:           ws,
+		elementQueue: newElementQueue(0),
+	}
+	go t.readMessages()
+	return t
+}
+
+func (t *webSocketTransport) readMessages() {
+	for {
+		message, err := t.ws.ReadMessage()
+		if err != nil {
+			t.elementQueue.close(err)
+			return
+		}
+		elem, err := webSocketStreamElement(message)
+		if err != nil {
+			t.elementQueue.close(err)
+			return
+		}
+		if !t.push(elem) {
+			return
+		}
+	}
+}
+
+// webSocketStreamElement returns what the message is in the stream.
+func webSocketStreamElement(message []byte) (*streamElement, error) {
+	elem, err := newStreamElement(nil, message)
+	if err != nil {
+		return nil, err
+	}
+	switch elem.start.Name.Space + " " + elem.start.Name.Local {
+	case FramingOpenElementName:
+		var attr []xml.Attr
+		for _, a := range elem.start.Attr {
+			if a.Name.Space != "xmlns" && !(a.Name.Space == "" && a.Name.Local == "xmlns") {
+				attr = append(attr, a)
+			}
+		}
+		elem = streamHeaderElement(attr)
+	case FramingCloseElementName:
+		elem = &streamElement{footer: true}
+	}
+	elem.size = len(message)
+	return elem, nil
+}
+
+// Write sends the data as messages.
+func (t *webSocketTransport) Write(data []byte) error {
+	return splitStreamData(data, t)
+}
+
+// WriteKeepalive sends a ping.
+func (t *webSocketTransport) WriteKeepalive() error {
+	return t.ws.WritePing()
+}
+
+func (t *webSocketTransport) streamHeader(header *xml.StartElement) error {
+	var open bytes.Buffer
+	open.WriteString("<open xmlns='" + FramingNS + "'")
+	for _, attr := range header.Attr {
+		switch {
+		case attr.Name.Space == "" && (attr.Name.Local == "from" || attr.Name.Local == "to" ||
+			attr.Name.Local == "id" || attr.Name.Local == "version"):
+			open.WriteString(" " + attr.Name.Local + "='" + xmlEscapeString(attr.Value) + "'")
+		case attr.Name.Space == "xml" && attr.Name.Local == "lang":
+			open.WriteString(" xml:lang='" + xmlEscapeString(attr.Value) + "'")
+		}
+	}
+	open.WriteString("/>")
+	return t.ws.WriteMessage(open.Bytes())
+}
+
+func (t *webSocketTransport) streamElement(elem []byte) error {
+	// Each message stands on its own thus the stream prefix has to be
+	// declared in there (RFC 7395 3.3.3).
+	if bytes.HasPrefix(elem, []byte("<stream:")) {
+		nameEnd := bytes.IndexAny(elem, " />")
+		decl := " xmlns:stream='" + xmppcore.JabberStreamsNS + "'"
+		elem = append(append(append([]byte{}, elem[:nameEnd]...), decl...), elem[nameEnd:]...)
+	}
+	return t.ws.WriteMessage(elem)
+}
+
+func (t *webSocketTransport) streamFooter() error {
+	return t.ws.WriteMessage([]byte("<close xmlns='" + FramingNS + "'/>"))
+}
+
+func (t *webSocketTransport) Close() error {
+	t.elementQueue.close(io.EOF)
+	return t.ws.Close()
+}
+
+func (t *webSocketTransport) RemoteAddr() net.Addr { return t.ws.NetConn().RemoteAddr() }
+
+func (t *webSocketTransport) SetWriteDeadline(tm time.Time) error {
+	return t.ws.SetWriteDeadline(tm)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webSocketTestClient speaks the WebSocket protocol just enough for the
+// XMPP framing.
+type webSocketTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (ts *testServer) dialWebSocket(httpServer *httptest.Server) *webSocketTestClient {
+	ts.t.Helper()
+	conn, err := net.Dial("tcp", httpServer.Listener.Addr().String())
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	conn.Write([]byte("GET " + webSocketPath + " HTTP/1.1\r\nHost: localhost\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Protocol: xmpp\r\n\r\n"))
+	c := &webSocketTestClient{t: ts.t, conn: conn, reader: bufio.NewReader(conn)}
+	response, err := http.ReadResponse(c.reader, nil)
+	if err != nil {
+		conn.Close()
+		ts.t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		ts.t.Fatalf("unexpected handshake response: %s", response.Status)
+	}
+	return c
+}
+
+// send sends the data as a masked text message.
+func (c *webSocketTestClient) send(data string) {
+	c.t.Helper()
+	frame := []byte{0x81}
+	switch {
+	case len(data) < 126:
+		frame = append(frame, 0x80|byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, 0x80|126, byte(len(data)>>8), byte(len(data)))
+	default:
+		frame = append(frame, 0x80|127)
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+		frame = append(frame, size[:]...)
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i := 0; i < len(data); i++ {
+		frame = append(frame, data[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive returns the payload of the next text message. It returns
+// io.EOF for a close frame.
+func (c *webSocketTestClient) receive() (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return "", err
+	}
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return "", err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return "", err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return "", err
+	}
+	if header[0]&0x0f == 0x8 {
+		return "", io.EOF
+	}
+	return string(payload), nil
+}
+
+// expect receives the next text message and checks that it starts with
+// the prefix.
+func (c *webSocketTestClient) expect(prefix string) string {
+	c.t.Helper()
+	message, err := c.receive()
+	if err != nil {
+		c.t.Fatalf("expected %s: %v", prefix, err)
+	}
+	if !strings.HasPrefix(message, prefix) {
+		c.t.Fatalf("expected %s, got %s", prefix, message)
+	}
+	return message
+}
+
+func (c *webSocketTestClient) openStream() {
+	c.t.Helper()
+	c.send(`<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' to='localhost' version='1.0'/>`)
+	c.expect("<open")
+	c.expect("<stream:features")
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	httpServer := httptest.NewServer(http.HandlerFunc(ts.handleWebSocket))
+	defer httpServer.Close()
+	alice := ts.dialWebSocket(httpServer)
+	defer alice.conn.Close()
+	bob := ts.connect("bob", "laptop")
+
+	alice.openStream()
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	alice.send(`<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>` + credentials + `</auth>`)
+	alice.expect("<success")
+	alice.openStream()
+	alice.send(`<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>` +
+		`<resource>web</resource></bind></iq>`)
+	if response := alice.expect("<iq"); !strings.Contains(response, "alice@localhost/web") {
+		t.Fatalf("unexpected bind response: %s", response)
+	}
+
+	// Each message is an element, in the scope of jabber:client
+	bob.send(`<message type='chat' id='m1' to='alice@localhost/web'><body>One</body></message>`)
+	bob.send(`<message type='chat' id='m2' to='alice@localhost/web'><body>Two</body></message>`)
+	for _, body := range []string{"One", "Two"} {
+		msg := parseTestMessage(t, alice.expect("<message"))
+		if msg.Body != body || msg.From != bob.jid {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+	}
+	alice.send(`<message xmlns='jabber:client' type='chat' id='m3' to='` + bob.jid + `'><body>Three</body></message>`)
+	if msg := parseTestMessage(t, bob.expect("<message")); msg.Body != "Three" || msg.From != "alice@localhost/web" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	alice.send(`<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>`)
+	alice.expect("<close")
+
+	bob.close()
+}
+
+func TestWebSocketMessageTooLarge(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+	httpServer := httptest.NewServer(http.HandlerFunc(ts.handleWebSocket))
+	defer httpServer.Close()
+	c := ts.dialWebSocket(httpServer)
+	defer c.conn.Close()
+
+	c.openStream()
+	c.send(`<message><body>` + strings.Repeat("a", webSocketMaxMessageSize) + `</body></message>`)
+	for {
+		if _, err := c.receive(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("expected a close frame, got %v", err)
+			}
+			break
+		}
+	}
+}
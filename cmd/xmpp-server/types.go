@@ -2,25 +2,410 @@ package main
 
 import (
 	"encoding/xml"
-	"net"
+	"sync"
+	"time"
 
 	"github.com/exavolt/go-xmpplib/xmppcore"
 )
 
 type Client struct {
-	conn          net.Conn
-	streamID      string
+	// transport is replaced when the session is resumed on another
+	// connection and is nil while the session waits to be resumed.
+	// connMutex guards it along with outbox and sm.
+	transport clientTransport
+	connMutex sync.Mutex
+	// outbox is the queue of the connection's writer goroutine.
+	outbox chan []byte
+	// dropOnOverflow is set if the data which doesn't fit in the outbox
+	// is dropped instead of disconnecting the client.
+	dropOnOverflow bool
+
+	streamID string
+	// xmlDecoder reads the content of the element being handled.
 	xmlDecoder    *xml.Decoder
 	jid           xmppcore.JID
-	authenticated bool
-	resourceBound bool
+	state         clientState
 	closingStream bool
+	// userAgentID identifies the client's installation as declared in
+	// the SASL2 (XEP-0388) authentication.
+	userAgentID string
+
+	// flexibleOffline is set if the client retrieves its offline messages
+	// with XEP-0013 instead of having them sent on initial presence.
+	flexibleOffline bool
+
+	// The fields below are read by the other sessions thus sessionMutex
+	// guards them.
+	//
+	// available is set once the client has sent its initial presence
+	// and cleared by an unavailable presence.
+	available bool
+	// presence is the client's last broadcast presence.
+	presence *clientPresence
+	// carbonsEnabled is set if the client has enabled Message Carbons
+	// (XEP-0280).
+	carbonsEnabled bool
+	// blocklistRequested is set once the client has retrieved its
+	// blocklist and thus is interested in the blocklist pushes.
+	blocklistRequested bool
+	sessionMutex       sync.Mutex
+
+	// inactive is set while the client indicates that it's not being
+	// used (XEP-0352). csiMutex guards it along with the presences held
+	// back meanwhile.
+	inactive      bool
+	heldPresences []heldPresence
+	csiMutex      sync.Mutex
+
+	// capsVer is the entity capabilities (XEP-0115) verification string
+	// of the features.
+	capsVer       string
+	features      map[string]bool
+	featuresMutex sync.RWMutex
+
+	// pendingIQs are the callbacks for the responses of the
+	// server-initiated IQs, keyed by the IQ id.
+	pendingIQs      map[string]func(*xmppcore.ClientIQ)
+	pendingIQsMutex sync.Mutex
+
+	// sm is the Stream Management (XEP-0198) state, nil until the client
+	// has enabled it.
+	sm *streamManagement
+	// limiter is the rate limiter of the authenticated session, nil if
+	// the user's class is not limited.
+	limiter *sessionLimiter
+	// connDone is closed once the goroutine serving the current
+	// connection has let go of the session.
+	connDone chan struct{}
 }
 
 func (cl *Client) JID() xmppcore.JID {
 	return cl.jid
 }
 
+// clientState is how far the client has gone in the stream negotiation
+// (RFC 6120 4.3). The states only move forward.
+type clientState int
+
+const (
+	clientStateConnected clientState = iota
+	// The stream is encrypted
+	clientStateTLS
+	// The SASL authentication succeeded, waiting for the stream restart
+	clientStateAuthenticated
+	// The stream has been restarted, waiting for the resource binding
+	clientStateRestarted
+	// A resource is bound thus the client may exchange stanzas
+	clientStateBound
+)
+
+func (cl *Client) authenticated() bool {
+	return cl.state >= clientStateAuthenticated
+}
+
+func (cl *Client) resourceBound() bool {
+	return cl.state == clientStateBound
+}
+
+func (cl *Client) isAvailable() bool {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	return cl.available
+}
+
+// availablePresence returns the client's last broadcast presence, or nil
+// if the client is not available.
+func (cl *Client) availablePresence() *clientPresence {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	if !cl.available {
+		return nil
+	}
+	return cl.presence
+}
+
+// setPresence records the client's broadcast presence, nil once the
+// client is unavailable. It returns whether the client was available.
+func (cl *Client) setPresence(presence *clientPresence) bool {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	wasAvailable := cl.available
+	cl.available = presence != nil
+	cl.presence = presence
+	return wasAvailable
+}
+
+// replacePresence updates the client's broadcast presence unless the
+// client has changed it meanwhile. It returns false if it has.
+func (cl *Client) replacePresence(old, presence *clientPresence) bool {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	if !cl.available || cl.presence != old {
+		return false
+	}
+	cl.presence = presence
+	return true
+}
+
+func (cl *Client) isCarbonsEnabled() bool {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	return cl.carbonsEnabled
+}
+
+func (cl *Client) setCarbonsEnabled(enabled bool) {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	cl.carbonsEnabled = enabled
+}
+
+func (cl *Client) isBlocklistRequested() bool {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	return cl.blocklistRequested
+}
+
+func (cl *Client) setBlocklistRequested() {
+	cl.sessionMutex.Lock()
+	defer cl.sessionMutex.Unlock()
+	cl.blocklistRequested = true
+}
+
+func (cl *Client) hasFeature(feature string) bool {
+	cl.featuresMutex.RLock()
+	defer cl.featuresMutex.RUnlock()
+	return cl.features[feature]
+}
+
+func (cl *Client) setFeatures(capsVer string, features map[string]bool) {
+	cl.featuresMutex.Lock()
+	defer cl.featuresMutex.Unlock()
+	cl.capsVer = capsVer
+	cl.features = features
+}
+
 type SASLPlainAuthVerifier interface {
 	VerifySASLPlainAuth(username, password []byte) (localpart string, resourcepart string, success bool, err error)
 }
+
+// OfflineMessageStore keeps the messages sent to users while they are
+// offline (XEP-0160).
+type OfflineMessageStore interface {
+	// PutOfflineMessage stores a message for the user. It returns false
+	// if the user has reached the quota. A quota of 0 means no limit.
+	PutOfflineMessage(local string, msg *OfflineMessage, quota int) (stored bool, err error)
+	// OfflineMessages returns the user's messages, oldest first.
+	OfflineMessages(local string) ([]*OfflineMessage, error)
+	// DeleteOfflineMessages removes the user's messages with the
+	// provided ids. If ids is nil, all the user's messages are removed.
+	DeleteOfflineMessages(local string, ids []string) error
+}
+
+type OfflineMessage struct {
+	ID     string    `json:"id"`
+	From   string    `json:"from"`
+	Stamp  time.Time `json:"stamp"`
+	Stanza []byte    `json:"stanza"`
+}
+
+// MessageArchiveStore keeps the message archives (XEP-0313). Each archive
+// is identified by the bare JID of its owner.
+type MessageArchiveStore interface {
+	AppendArchivedMessage(archive string, msg *ArchivedMessage) error
+	QueryArchivedMessages(archive string, query *ArchiveQuery) (*ArchiveQueryResult, error)
+	// ArchivePreferences returns nil if the owner hasn't set any.
+	ArchivePreferences(archive string) (*ArchivePreferences, error)
+	SetArchivePreferences(archive string, prefs *ArchivePreferences) error
+}
+
+type ArchivedMessage struct {
+	// ID is the stanza-id (XEP-0359) assigned by the archive.
+	ID string
+	// With is the JID of the other party.
+	With string
+	// RealJID is the real JID of the sender of a room's message. It's
+	// kept apart from the stanza, which is archived as it was broadcast,
+	// as who may see it depends on the room's current configuration.
+	RealJID string
+	Stamp   time.Time
+	Stanza  []byte
+}
+
+// ArchiveQuery selects archived messages. The time range and the ids are
+// exclusive of the referenced messages except for Start and End which
+// are inclusive.
+type ArchiveQuery struct {
+	// With matches the exact JID if it's a full JID, or all the JIDs of
+	// the entity if it's a bare JID.
+	With     string
+	Start    time.Time
+	End      time.Time
+	AfterID  string
+	BeforeID string
+	// Max limits the number of returned messages. A negative value means
+	// no limit.
+	Max int
+	// FromEnd selects the last Max messages instead of the first ones.
+	FromEnd bool
+}
+
+type ArchiveQueryResult struct {
+	Messages []*ArchivedMessage
+	// Count is the number of the messages matching the query regardless
+	// of Max and of the ids which the query pages from.
+	Count int
+	// First is the index of the first message among those counted.
+	First int
+	// Complete is true if there are no more messages in the direction of
+	// the query.
+	Complete bool
+}
+
+// ArchivePreferences determines which messages get archived.
+type ArchivePreferences struct {
+	// Default is "always", "never" or "roster".
+	Default string   `json:"default"`
+	Always  []string `json:"always,omitempty"`
+	Never   []string `json:"never,omitempty"`
+}
+
+// BlocklistStore keeps the users' blocklists (XEP-0191). The entries are
+// JIDs in any of the forms: domain, domain/resource, local@domain or
+// local@domain/resource.
+type BlocklistStore interface {
+	Blocklist(local string) ([]string, error)
+	BlockJIDs(local string, jids []string) error
+	// UnblockJIDs removes the JIDs from the user's blocklist. If jids is
+	// nil, the blocklist is cleared.
+	UnblockJIDs(local string, jids []string) error
+}
+
+// VCardStore keeps the vCards (XEP-0054) of the users. The vCards are
+// stored as the raw vCard elements.
+type VCardStore interface {
+	// VCard returns nil if there's no vCard stored for the JID.
+	VCard(bareJID string) ([]byte, error)
+	SetVCard(bareJID string, vCard []byte) error
+}
+
+// PubSubStore keeps the nodes and the items of the publish-subscribe
+// services (XEP-0060), including the PEP services (XEP-0163). A service
+// is identified by its JID.
+type PubSubStore interface {
+	// PubSubNode returns nil if the node doesn't exist.
+	PubSubNode(service, node string) (*PubSubNode, error)
+	PubSubNodes(service string) ([]*PubSubNode, error)
+	// SavePubSubNode creates the node or updates its metadata.
+	SavePubSubNode(service string, node *PubSubNode) error
+	DeletePubSubNode(service, node string) error
+	// PublishPubSubItem adds the item, replacing the one with the same
+	// id, then removes the oldest items so that the node keeps at most
+	// maxItems items.
+	PublishPubSubItem(service, node string, item *PubSubItem, maxItems int) error
+	// PubSubItems returns the node's items, newest first. If ids is not
+	// empty, only those items are returned. A max of 0 means no limit.
+	PubSubItems(service, node string, ids []string, max int) ([]*PubSubItem, error)
+	// RetractPubSubItem returns false if there's no such item.
+	RetractPubSubItem(service, node, id string) (bool, error)
+	// PurgePubSubItems removes all the items of the node.
+	PurgePubSubItems(service, node string) error
+}
+
+type PubSubNode struct {
+	Name   string           `json:"name"`
+	Config PubSubNodeConfig `json:"config"`
+	// Affiliations maps the bare JIDs to their affiliations.
+	Affiliations map[string]string `json:"affiliations,omitempty"`
+	// Subscriptions maps the subscribers' JIDs, bare or full, to the
+	// states of their subscriptions.
+	Subscriptions map[string]string `json:"subscriptions,omitempty"`
+}
+
+type PubSubNodeConfig struct {
+	Title         string `json:"title,omitempty"`
+	AccessModel   string `json:"access_model"`
+	PublishModel  string `json:"publish_model,omitempty"`
+	MaxItems      int    `json:"max_items"`
+	NotifyDelete  bool   `json:"notify_delete,omitempty"`
+	NotifyRetract bool   `json:"notify_retract,omitempty"`
+}
+
+type PubSubItem struct {
+	ID        string    `json:"id"`
+	Publisher string    `json:"publisher"`
+	Stamp     time.Time `json:"stamp"`
+	Payload   []byte    `json:"payload"`
+}
+
+// MUCRoomStore keeps the persistent rooms (XEP-0045).
+type MUCRoomStore interface {
+	MUCRooms() ([]*MUCRoom, error)
+	// MUCRoom returns nil if there's no such room.
+	MUCRoom(name string) (*MUCRoom, error)
+	SaveMUCRoom(room *MUCRoom) error
+	DeleteMUCRoom(name string) error
+}
+
+type MUCRoom struct {
+	// Name is the local part of the room's JID.
+	Name   string        `json:"name"`
+	Config MUCRoomConfig `json:"config"`
+	// Affiliations maps the bare JIDs to their affiliations.
+	Affiliations map[string]string `json:"affiliations,omitempty"`
+	Subject      string            `json:"subject,omitempty"`
+	SubjectNick  string            `json:"subject_nick,omitempty"`
+}
+
+type MUCRoomConfig struct {
+	Title         string `json:"title,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Persistent    bool   `json:"persistent"`
+	Public        bool   `json:"public"`
+	MembersOnly   bool   `json:"members_only"`
+	Moderated     bool   `json:"moderated"`
+	Password      string `json:"password,omitempty"`
+	WhoIs         string `json:"whois"`
+	MaxUsers      int    `json:"max_users,omitempty"`
+	ChangeSubject bool   `json:"change_subject"`
+	AllowInvites  bool   `json:"allow_invites"`
+	// Archive enables the room's message archive (XEP-0313). It has no
+	// effect if the server has no message archive storage.
+	Archive bool `json:"archive"`
+}
+
+// FASTToken is the FAST (XEP-0484) token of one of the user's devices.
+// The token itself isn't kept. What's kept is the SHA-256 hash of the
+// client's HT-SHA-256 proof of the token, to be compared with the hash
+// of the proof the client sends (see fastProofHash), and the server's
+// proof to send back.
+type FASTToken struct {
+	// UserAgentID is the id the device declared in the SASL2
+	// authentication.
+	UserAgentID string `json:"user_agent_id"`
+	Software    string `json:"software,omitempty"`
+	Device      string `json:"device,omitempty"`
+	// InitiatorHash is the hash of the client's proof of the token and
+	// Responder is the server's proof.
+	InitiatorHash []byte    `json:"initiator_hash"`
+	Responder     []byte    `json:"responder"`
+	Expiry        time.Time `json:"expiry"`
+	// The previous token is the one which the current token has
+	// replaced. It's accepted until the device has used the new one.
+	PreviousInitiatorHash []byte    `json:"previous_initiator_hash,omitempty"`
+	PreviousResponder     []byte    `json:"previous_responder,omitempty"`
+	PreviousExpiry        time.Time `json:"previous_expiry"`
+	// Count is the highest count the device has authenticated with, for
+	// the replay protection.
+	Count uint64 `json:"count,omitempty"`
+}
+
+// FASTTokenStore keeps the FAST tokens of the users' devices, at most one
+// per device.
+type FASTTokenStore interface {
+	FASTTokens(local string) ([]*FASTToken, error)
+	// PutFASTToken adds the token, replacing the device's one.
+	PutFASTToken(local string, token *FASTToken) error
+	// DeleteFASTTokens removes the tokens of the devices. If
+	// userAgentIDs is nil, all the user's tokens are removed.
+	DeleteFASTTokens(local string, userAgentIDs []string) error
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/xml"
+
+	"github.com/google/uuid"
 )
 
 func xmlEscapeString(s string) string {
@@ -10,3 +13,126 @@ func xmlEscapeString(s string) string {
 	xml.Escape(&b, []byte(s))
 	return b.String()
 }
+
+func xmlStartElementAttr(startElem *xml.StartElement, local string) string {
+	for _, attr := range startElem.Attr {
+		if attr.Name.Space == "" && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// xmlPayloadHasElement reports whether the payload has a top-level
+// element with the name.
+func xmlPayloadHasElement(payload []byte, space, local string) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 0 && t.Name.Space == space && t.Name.Local == local {
+				return true
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// xmlPayloadRemoveElements returns the payload without the top-level
+// elements for which the match function returns true.
+func xmlPayloadRemoveElements(payload []byte, match func(*xml.StartElement) bool) []byte {
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	var result []byte
+	var copied int64
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		startElem, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		matched := match(&startElem)
+		if err = decoder.Skip(); err != nil {
+			break
+		}
+		if matched {
+			result = append(result, payload[copied:offset]...)
+			copied = decoder.InputOffset()
+		}
+	}
+	if copied == 0 {
+		return payload
+	}
+	return append(result, payload[copied:]...)
+}
+
+func generateID() string {
+	idRaw := uuid.New()
+	return base64.RawURLEncoding.EncodeToString(idRaw[:])
+}
+
+// xmlPayloadDecodeElement decodes the first top-level element with the
+// name into v. It returns false if there's no such element.
+func xmlPayloadDecodeElement(payload []byte, space, local string, v interface{}) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		startElem, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if startElem.Name.Space == space && startElem.Name.Local == local {
+			return decoder.DecodeElement(v, &startElem) == nil
+		}
+		if err = decoder.Skip(); err != nil {
+			return false
+		}
+	}
+}
+
+// dataFormValue returns the first value of the form's field.
+func dataFormValue(form *DataForm, name string) string {
+	for _, field := range form.Fields {
+		if field.Var == name && len(field.Values) > 0 {
+			return field.Values[0]
+		}
+	}
+	return ""
+}
+
+// parseXMPPBoolean parses a boolean as defined in XEP-0004.
+func parseXMPPBoolean(s string) (value bool, ok bool) {
+	switch s {
+	case "1", "true":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// xmlElementAppendChildren inserts the children at the end of the
+// marshalled element.
+func xmlElementAppendChildren(elemXML []byte, childrenXML []byte) []byte {
+	i := bytes.LastIndex(elemXML, []byte("</"))
+	if i < 0 {
+		panic("not a marshalled element")
+	}
+	result := make([]byte, 0, len(elemXML)+len(childrenXML))
+	result = append(result, elemXML[:i]...)
+	result = append(result, childrenXML...)
+	return append(result, elemXML[i:]...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// diskVCardStore keeps each vCard in its own file.
+type diskVCardStore struct {
+	dir   string
+	mutex sync.RWMutex
+}
+
+var _ VCardStore = &diskVCardStore{}
+
+func newDiskVCardStore(dir string) (*diskVCardStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create vCard directory")
+	}
+	return &diskVCardStore{dir: dir}, nil
+}
+
+func (store *diskVCardStore) fileName(bareJID string) string {
+	return filepath.Join(store.dir, base64.RawURLEncoding.EncodeToString([]byte(bareJID))+".xml")
+}
+
+func (store *diskVCardStore) VCard(bareJID string) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	vCard, err := ioutil.ReadFile(store.fileName(bareJID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return vCard, nil
+}
+
+func (store *diskVCardStore) SetVCard(bareJID string, vCard []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	fileName := store.fileName(bareJID)
+	if err := ioutil.WriteFile(fileName+".tmp", vCard, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"sync"
+)
+
+type memoryVCardStore struct {
+	vCards map[string][]byte
+	mutex  sync.RWMutex
+}
+
+var _ VCardStore = &memoryVCardStore{}
+
+func newMemoryVCardStore() *memoryVCardStore {
+	return &memoryVCardStore{
+		vCards: make(map[string][]byte),
+	}
+}
+
+func (store *memoryVCardStore) VCard(bareJID string) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.vCards[bareJID], nil
+}
+
+func (store *memoryVCardStore) SetVCard(bareJID string, vCard []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.vCards[bareJID] = vCard
+	return nil
+}
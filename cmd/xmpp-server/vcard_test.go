@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testVCardStore(t *testing.T, store VCardStore) {
+	if vCard, err := store.VCard("alice@localhost"); err != nil || vCard != nil {
+		t.Fatalf("unexpected vCard: %s %v", vCard, err)
+	}
+	for _, vCard := range []string{
+		"<vCard xmlns='vcard-temp'><FN>Alice</FN></vCard>",
+		"<vCard xmlns='vcard-temp'><FN>Alice Liddell</FN></vCard>",
+	} {
+		if err := store.SetVCard("alice@localhost", []byte(vCard)); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := store.VCard("alice@localhost")
+		if err != nil || string(stored) != vCard {
+			t.Fatalf("unexpected vCard: %s %v", stored, err)
+		}
+	}
+	if vCard, err := store.VCard("bob@localhost"); err != nil || vCard != nil {
+		t.Fatalf("unexpected vCard: %s %v", vCard, err)
+	}
+}
+
+func TestMemoryVCardStore(t *testing.T) {
+	testVCardStore(t, newMemoryVCardStore())
+}
+
+func TestDiskVCardStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xmpp-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDiskVCardStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVCardStore(t, store)
+
+	// The vCards are kept across restarts
+	if store, err = newDiskVCardStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	vCard, err := store.VCard("alice@localhost")
+	if err != nil || string(vCard) != "<vCard xmlns='vcard-temp'><FN>Alice Liddell</FN></vCard>" {
+		t.Fatalf("unexpected vCard: %s %v", vCard, err)
+	}
+}
@@ -0,0 +1,299 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455) as much as the XMPP subprotocol needs: text messages, the
+// control frames and no extensions.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The frame opcodes (RFC 6455 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// The status codes of the close frames (RFC 6455 7.4.1)
+const (
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	CloseInvalidData   = 1007
+	CloseTooBig        = 1009
+)
+
+// closeTimeout limits how long sending the close frame may take.
+const closeTimeout = 5 * time.Second
+
+var (
+	errProtocol   = errors.New("websocket: protocol error")
+	errTooBig     = errors.New("websocket: message too big")
+	errInvalidUTF = errors.New("websocket: invalid UTF-8 text")
+)
+
+// Conn is an established WebSocket connection. ReadMessage must not be
+// called concurrently, the writes may.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// maxMessageSize limits the size of the messages read, 0 means no
+	// limit.
+	maxMessageSize int
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the opening handshake (RFC 6455 4.2) of the request
+// with the subprotocol, which the client has to offer. If the request
+// is not a valid handshake, the HTTP error is sent and an error is
+// returned.
+func Upgrade(w http.ResponseWriter, r *http.Request, subprotocol string, maxMessageSize int) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket handshake expected", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid WebSocket key", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid key")
+	}
+	if !headerHasToken(r.Header, "Sec-WebSocket-Protocol", subprotocol) {
+		http.Error(w, "Subprotocol "+subprotocol+" expected", http.StatusBadRequest)
+		return nil, errors.New("websocket: subprotocol not offered")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Unable to upgrade the connection", http.StatusInternalServerError)
+		return nil, errors.New("websocket: connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	acceptHash := sha1.Sum([]byte(key + acceptGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(acceptHash[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + subprotocol + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return &Conn{
+		conn:           conn,
+		reader:         rw.Reader,
+		maxMessageSize: maxMessageSize,
+	}, nil
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ReadMessage returns the payload of the next data message. The control
+// frames are handled meanwhile. It returns io.EOF once the client has
+// closed the connection.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	var messageOpcode byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			switch err {
+			case errTooBig:
+				c.WriteClose(CloseTooBig)
+			case errProtocol:
+				c.WriteClose(CloseProtocolError)
+			}
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.WriteClose(CloseNormal)
+			return nil, io.EOF
+		case opText, opBinary:
+			if messageOpcode != 0 {
+				c.WriteClose(CloseProtocolError)
+				return nil, errProtocol
+			}
+			messageOpcode = opcode
+		case opContinuation:
+			if messageOpcode == 0 {
+				c.WriteClose(CloseProtocolError)
+				return nil, errProtocol
+			}
+		default:
+			c.WriteClose(CloseProtocolError)
+			return nil, errProtocol
+		}
+
+		if c.maxMessageSize > 0 && len(message)+len(payload) > c.maxMessageSize {
+			c.WriteClose(CloseTooBig)
+			return nil, errTooBig
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if messageOpcode == opText && !utf8.Valid(message) {
+			c.WriteClose(CloseInvalidData)
+			return nil, errInvalidUTF
+		}
+		return message, nil
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	// No extension has been negotiated and the client has to mask its
+	// frames.
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		return false, 0, nil, errProtocol
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= opClose && (!fin || length > 125) {
+		return false, 0, nil, errProtocol
+	}
+	if c.maxMessageSize > 0 && length > uint64(c.maxMessageSize) {
+		return false, 0, nil, errTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends the data as a text message.
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// WritePing sends a ping, e.g., to keep the connection alive.
+func (c *Conn) WritePing() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// WriteClose sends the close frame with the status code. Nothing can be
+// sent afterwards.
+func (c *Conn) WriteClose(code uint16) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	return c.writeFrame(opClose, payload[:])
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return errors.New("websocket: connection closed")
+	}
+	if opcode == opClose {
+		c.closeSent = true
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	}
+	// The server's frames are not masked
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(length))
+		frame = append(append(frame, 127), extended[:]...)
+	}
+	frame = append(frame, payload...)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// SetWriteDeadline sets the deadline of the writes to the underlying
+// connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Close sends the close frame, unless already sent, then closes the
+// underlying connection. A write in progress is aborted first.
+func (c *Conn) Close() error {
+	c.conn.SetWriteDeadline(time.Now())
+	c.WriteClose(CloseNormal)
+	return c.conn.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// What happens when a client's write queue is full
+const (
+	writeQueueOverflowDisconnect = "disconnect"
+	writeQueueOverflowDrop       = "drop"
+)
+
+// write queues the data, e.g., a stream header or a nonza, to be sent to
+// the client. It never blocks on the network.
+func (cl *Client) write(data []byte) {
+	cl.connMutex.Lock()
+	defer cl.connMutex.Unlock()
+	cl.enqueue(data)
+}
+
+// writeElement sends the nonza, e.g., a Stream Management element, which
+// is not counted as a stanza.
+func (cl *Client) writeElement(v interface{}) {
+	elemXML, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	cl.write(elemXML)
+}
+
+// closeStream closes the client's stream with the stream error then
+// closes the connection once everything queued has been sent.
+func (cl *Client) closeStream(condition string) {
+	cl.connMutex.Lock()
+	defer cl.connMutex.Unlock()
+	cl.closingStream = true
+	cl.enqueue([]byte("<stream:error><" + condition + " xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>" +
+		"</stream:stream>"))
+	cl.enqueue(nil)
+}
+
+// enqueue requires connMutex. The data is discarded if the client has
+// no connection. Nil data makes the writer close the connection. It
+// returns false if the data has been discarded.
+func (cl *Client) enqueue(data []byte) bool {
+	if cl.outbox == nil {
+		return false
+	}
+	select {
+	case cl.outbox <- data:
+		return true
+	default:
+	}
+	if cl.dropOnOverflow {
+		log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+			Warn("Write queue is full, dropping data")
+		return false
+	}
+	// The serving goroutine notices the closed connection and ends, or
+	// keeps, the session.
+	log.WithFields(logrus.Fields{"stream": cl.streamID, "jid": cl.jid}).
+		Warn("Write queue is full, disconnecting client")
+	cl.transport.Close()
+	return false
+}
+
+// writeClient sends the queued data to the transport until the queue
+// is closed or nil data is queued, then closes the transport. A write
+// which doesn't complete within the timeout closes the transport. If the
+// interval is set, a keepalive is sent whenever nothing else has been
+// sent for that long.
+func (srv *Server) writeClient(transport clientTransport, outbox <-chan []byte, streamID string) {
+	defer transport.Close()
+	var keepalive <-chan time.Time
+	if srv.clientKeepaliveInterval > 0 {
+		ticker := time.NewTicker(srv.clientKeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	// Whitespace is only allowed once the stream header has been sent.
+	opened, active := false, false
+	for {
+		var err error
+		select {
+		case data, ok := <-outbox:
+			if !ok || data == nil {
+				return
+			}
+			opened, active = true, true
+			transport.SetWriteDeadline(time.Now().Add(srv.clientWriteTimeout))
+			err = transport.Write(data)
+		case <-keepalive:
+			if active || !opened {
+				active = false
+				continue
+			}
+			transport.SetWriteDeadline(time.Now().Add(srv.clientWriteTimeout))
+			err = transport.WriteKeepalive()
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{"stream": streamID}).
+				Warn("Unable to write to client: ", err)
+			return
+		}
+	}
+}
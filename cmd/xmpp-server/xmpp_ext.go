@@ -0,0 +1,722 @@
+package main
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/exavolt/go-xmpplib/xmppdisco"
+)
+
+// Local definitions of the protocol extensions which are not provided
+// by go-xmpplib yet.
+//TODO: move these to go-xmpplib
+
+// XEP-0082
+func xmppDateTimeString(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// XEP-0203
+const DelayNS = "urn:xmpp:delay"
+
+type Delay struct {
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	From    string   `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"`
+	Text    string   `xml:",chardata"`
+}
+
+// XEP-0004
+const DataFormsNS = "jabber:x:data"
+
+type DataForm struct {
+	XMLName xml.Name        `xml:"jabber:x:data x"`
+	Type    string          `xml:"type,attr"`
+	Title   string          `xml:"title,omitempty"`
+	Fields  []DataFormField `xml:"field"`
+}
+
+type DataFormField struct {
+	Var     string           `xml:"var,attr,omitempty"`
+	Type    string           `xml:"type,attr,omitempty"`
+	Label   string           `xml:"label,attr,omitempty"`
+	Values  []string         `xml:"value"`
+	Options []DataFormOption `xml:"option"`
+}
+
+type DataFormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// XEP-0030 with the node attribute
+const (
+	DiscoInfoNS  = "http://jabber.org/protocol/disco#info"
+	DiscoItemsNS = "http://jabber.org/protocol/disco#items"
+)
+
+type DiscoInfo struct {
+	XMLName  xml.Name             `xml:"http://jabber.org/protocol/disco#info query"`
+	Node     string               `xml:"node,attr,omitempty"`
+	Identity []xmppdisco.Identity `xml:"identity"`
+	Feature  []xmppdisco.Feature  `xml:"feature"`
+	Forms    []DataForm           `xml:"jabber:x:data x"`
+}
+
+type DiscoItems struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Items   []DiscoItem `xml:"item"`
+}
+
+type DiscoItem struct {
+	JID  string `xml:"jid,attr"`
+	Node string `xml:"node,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+// XEP-0013
+const (
+	OfflineNS                 = "http://jabber.org/protocol/offline"
+	OfflineOfflineElementName = OfflineNS + " offline"
+)
+
+type OfflineQuery struct {
+	XMLName xml.Name      `xml:"http://jabber.org/protocol/offline offline"`
+	Fetch   *struct{}     `xml:"fetch"`
+	Purge   *struct{}     `xml:"purge"`
+	Items   []OfflineItem `xml:"item"`
+}
+
+type OfflineItem struct {
+	Action string `xml:"action,attr,omitempty"`
+	Node   string `xml:"node,attr"`
+}
+
+// XEP-0297
+type Forwarded struct {
+	XMLName xml.Name `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay   *Delay   `xml:"urn:xmpp:delay delay,omitempty"`
+	Stanza  []byte   `xml:",innerxml"`
+}
+
+// XEP-0359
+const StanzaIDNS = "urn:xmpp:sid:0"
+
+type StanzaID struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	ID      string   `xml:"id,attr"`
+	By      string   `xml:"by,attr"`
+}
+
+// XEP-0059
+const RSMNS = "http://jabber.org/protocol/rsm"
+
+type RSMSet struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/rsm set"`
+	Max     *int      `xml:"max,omitempty"`
+	After   *string   `xml:"after,omitempty"`
+	Before  *string   `xml:"before,omitempty"`
+	Count   *int      `xml:"count,omitempty"`
+	First   *RSMFirst `xml:"first,omitempty"`
+	Last    *string   `xml:"last,omitempty"`
+}
+
+type RSMFirst struct {
+	Index *int   `xml:"index,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// XEP-0313
+const (
+	MAMNS               = "urn:xmpp:mam:2"
+	MAMExtendedNS       = "urn:xmpp:mam:2#extended"
+	MAMQueryElementName = MAMNS + " query"
+	MAMPrefsElementName = MAMNS + " prefs"
+	MAMDefaultAlways    = "always"
+	MAMDefaultNever     = "never"
+	MAMDefaultRoster    = "roster"
+)
+
+type MAMQuery struct {
+	XMLName xml.Name  `xml:"urn:xmpp:mam:2 query"`
+	QueryID string    `xml:"queryid,attr,omitempty"`
+	Node    string    `xml:"node,attr,omitempty"`
+	Form    *DataForm `xml:"jabber:x:data x,omitempty"`
+	Set     *RSMSet   `xml:"http://jabber.org/protocol/rsm set,omitempty"`
+}
+
+type MAMResult struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:mam:2 result"`
+	QueryID   string    `xml:"queryid,attr,omitempty"`
+	ID        string    `xml:"id,attr"`
+	Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+type MAMFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr,omitempty"`
+	Set      *RSMSet  `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+type MAMPrefs struct {
+	XMLName xml.Name     `xml:"urn:xmpp:mam:2 prefs"`
+	Default string       `xml:"default,attr,omitempty"`
+	Always  MAMPrefsJIDs `xml:"always"`
+	Never   MAMPrefsJIDs `xml:"never"`
+}
+
+type MAMPrefsJIDs struct {
+	JIDs []string `xml:"jid"`
+}
+
+// XEP-0280
+const (
+	CarbonsNS                 = "urn:xmpp:carbons:2"
+	CarbonsEnableElementName  = CarbonsNS + " enable"
+	CarbonsDisableElementName = CarbonsNS + " disable"
+)
+
+type CarbonsEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 enable"`
+}
+
+type CarbonsDisable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 disable"`
+}
+
+type CarbonsSent struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:carbons:2 sent"`
+	Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+type CarbonsReceived struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:carbons:2 received"`
+	Forwarded Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// XEP-0334
+const HintsNS = "urn:xmpp:hints"
+
+// XEP-0191
+const (
+	BlockingNS                   = "urn:xmpp:blocking"
+	BlockingErrorsNS             = "urn:xmpp:blocking:errors"
+	BlockingBlocklistElementName = BlockingNS + " blocklist"
+	BlockingBlockElementName     = BlockingNS + " block"
+	BlockingUnblockElementName   = BlockingNS + " unblock"
+)
+
+type BlockingBlocklist struct {
+	XMLName xml.Name       `xml:"urn:xmpp:blocking blocklist"`
+	Items   []BlockingItem `xml:"item"`
+}
+
+type BlockingBlock struct {
+	XMLName xml.Name       `xml:"urn:xmpp:blocking block"`
+	Items   []BlockingItem `xml:"item"`
+}
+
+type BlockingUnblock struct {
+	XMLName xml.Name       `xml:"urn:xmpp:blocking unblock"`
+	Items   []BlockingItem `xml:"item"`
+}
+
+type BlockingItem struct {
+	JID string `xml:"jid,attr"`
+}
+
+// XEP-0054
+type VCardPhoto struct {
+	XMLName xml.Name `xml:"vcard-temp vCard"`
+	Photo   struct {
+		Type   string `xml:"TYPE"`
+		BinVal string `xml:"BINVAL"`
+	} `xml:"PHOTO"`
+}
+
+// XEP-0153
+const VCardUpdateNS = "vcard-temp:x:update"
+
+type VCardUpdate struct {
+	XMLName xml.Name `xml:"vcard-temp:x:update x"`
+	Photo   *string  `xml:"photo"`
+}
+
+// XEP-0115
+const CapsNS = "http://jabber.org/protocol/caps"
+
+type EntityCaps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+// CapsDiscoInfo is the disco#info result as needed to verify the entity
+// capabilities, i.e., with the languages of the identities.
+type CapsDiscoInfo struct {
+	XMLName    xml.Name            `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string              `xml:"node,attr,omitempty"`
+	Identities []CapsDiscoIdentity `xml:"identity"`
+	Features   []xmppdisco.Feature `xml:"feature"`
+	Forms      []DataForm          `xml:"jabber:x:data x"`
+}
+
+type CapsDiscoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Name     string `xml:"name,attr,omitempty"`
+}
+
+// XEP-0060
+const (
+	PubSubNS                     = "http://jabber.org/protocol/pubsub"
+	PubSubEventNS                = PubSubNS + "#event"
+	PubSubOwnerNS                = PubSubNS + "#owner"
+	PubSubErrorsNS               = PubSubNS + "#errors"
+	PubSubPubSubElementName      = PubSubNS + " pubsub"
+	PubSubOwnerPubSubElementName = PubSubOwnerNS + " pubsub"
+)
+
+type PubSub struct {
+	XMLName        xml.Name             `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Create         *PubSubNodeElement   `xml:"create,omitempty"`
+	Configure      *PubSubFormElement   `xml:"configure,omitempty"`
+	Subscribe      *PubSubSubscription  `xml:"subscribe,omitempty"`
+	Unsubscribe    *PubSubSubscription  `xml:"unsubscribe,omitempty"`
+	Subscription   *PubSubSubscription  `xml:"subscription,omitempty"`
+	Subscriptions  *PubSubSubscriptions `xml:"subscriptions,omitempty"`
+	Affiliations   *PubSubAffiliations  `xml:"affiliations,omitempty"`
+	Publish        *PubSubPublish       `xml:"publish,omitempty"`
+	PublishOptions *PubSubFormElement   `xml:"publish-options,omitempty"`
+	Items          *PubSubItems         `xml:"items,omitempty"`
+	Retract        *PubSubRetract       `xml:"retract,omitempty"`
+}
+
+type PubSubOwner struct {
+	XMLName       xml.Name             `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+	Configure     *PubSubFormElement   `xml:"configure,omitempty"`
+	Default       *PubSubFormElement   `xml:"default,omitempty"`
+	Delete        *PubSubNodeElement   `xml:"delete,omitempty"`
+	Purge         *PubSubNodeElement   `xml:"purge,omitempty"`
+	Subscriptions *PubSubSubscriptions `xml:"subscriptions,omitempty"`
+	Affiliations  *PubSubAffiliations  `xml:"affiliations,omitempty"`
+}
+
+// PubSubNodeElement is an element which only identifies a node, e.g.,
+// create and delete.
+type PubSubNodeElement struct {
+	Node string `xml:"node,attr,omitempty"`
+}
+
+type PubSubSubscription struct {
+	Node         string `xml:"node,attr,omitempty"`
+	JID          string `xml:"jid,attr"`
+	Subscription string `xml:"subscription,attr,omitempty"`
+}
+
+type PubSubSubscriptions struct {
+	Node          string               `xml:"node,attr,omitempty"`
+	Subscriptions []PubSubSubscription `xml:"subscription"`
+}
+
+type PubSubAffiliation struct {
+	Node        string `xml:"node,attr,omitempty"`
+	JID         string `xml:"jid,attr,omitempty"`
+	Affiliation string `xml:"affiliation,attr"`
+}
+
+type PubSubAffiliations struct {
+	Node         string              `xml:"node,attr,omitempty"`
+	Affiliations []PubSubAffiliation `xml:"affiliation"`
+}
+
+type PubSubPublish struct {
+	Node  string           `xml:"node,attr"`
+	Items []PubSubItemElem `xml:"item"`
+}
+
+type PubSubItems struct {
+	Node     string           `xml:"node,attr"`
+	MaxItems int              `xml:"max_items,attr,omitempty"`
+	Items    []PubSubItemElem `xml:"item"`
+}
+
+type PubSubRetract struct {
+	Node   string           `xml:"node,attr"`
+	Notify string           `xml:"notify,attr,omitempty"`
+	Items  []PubSubItemElem `xml:"item"`
+}
+
+type PubSubItemElem struct {
+	ID        string `xml:"id,attr,omitempty"`
+	Publisher string `xml:"publisher,attr,omitempty"`
+	Payload   []byte `xml:",innerxml"`
+}
+
+// PubSubFormElement is an element which only contains a data form, e.g.,
+// publish-options.
+type PubSubFormElement struct {
+	Node string    `xml:"node,attr,omitempty"`
+	Form *DataForm `xml:"jabber:x:data x,omitempty"`
+}
+
+type PubSubEvent struct {
+	XMLName      xml.Name            `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items        *PubSubEventItems   `xml:"items,omitempty"`
+	Delete       *PubSubNodeElement  `xml:"delete,omitempty"`
+	Purge        *PubSubNodeElement  `xml:"purge,omitempty"`
+	Subscription *PubSubSubscription `xml:"subscription,omitempty"`
+}
+
+type PubSubEventItems struct {
+	Node     string               `xml:"node,attr"`
+	Items    []PubSubItemElem     `xml:"item"`
+	Retracts []PubSubEventRetract `xml:"retract"`
+}
+
+type PubSubEventRetract struct {
+	ID string `xml:"id,attr"`
+}
+
+const (
+	PubSubAffiliationOwner     = "owner"
+	PubSubAffiliationPublisher = "publisher"
+	PubSubAffiliationMember    = "member"
+	PubSubAffiliationNone      = "none"
+	PubSubAffiliationOutcast   = "outcast"
+
+	PubSubAccessModelOpen      = "open"
+	PubSubAccessModelPresence  = "presence"
+	PubSubAccessModelRoster    = "roster"
+	PubSubAccessModelAuthorize = "authorize"
+	PubSubAccessModelWhitelist = "whitelist"
+
+	PubSubPublishModelPublishers  = "publishers"
+	PubSubPublishModelSubscribers = "subscribers"
+	PubSubPublishModelOpen        = "open"
+
+	PubSubSubscriptionNone       = "none"
+	PubSubSubscriptionPending    = "pending"
+	PubSubSubscriptionSubscribed = "subscribed"
+
+	PubSubPublishOptionsFormType         = PubSubNS + "#publish-options"
+	PubSubNodeConfigFormType             = PubSubNS + "#node_config"
+	PubSubMetaDataFormType               = PubSubNS + "#meta-data"
+	PubSubSubscribeAuthorizationFormType = PubSubNS + "#subscribe_authorization"
+)
+
+// XEP-0045
+const (
+	MUCNS                    = "http://jabber.org/protocol/muc"
+	MUCUserNS                = MUCNS + "#user"
+	MUCAdminNS               = MUCNS + "#admin"
+	MUCOwnerNS               = MUCNS + "#owner"
+	MUCAdminQueryElementName = MUCAdminNS + " query"
+	MUCOwnerQueryElementName = MUCOwnerNS + " query"
+
+	MUCRoomConfigFormType = MUCNS + "#roomconfig"
+	MUCRoomInfoFormType   = MUCNS + "#roominfo"
+
+	MUCAffiliationOwner   = "owner"
+	MUCAffiliationAdmin   = "admin"
+	MUCAffiliationMember  = "member"
+	MUCAffiliationNone    = "none"
+	MUCAffiliationOutcast = "outcast"
+
+	MUCRoleModerator   = "moderator"
+	MUCRoleParticipant = "participant"
+	MUCRoleVisitor     = "visitor"
+	MUCRoleNone        = "none"
+
+	MUCWhoIsModerators = "moderators"
+	MUCWhoIsAnyone     = "anyone"
+)
+
+// MUCJoin is the element in the presence which joins a room.
+type MUCJoin struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"password,omitempty"`
+	History  *MUCHistory `xml:"history,omitempty"`
+}
+
+type MUCHistory struct {
+	MaxChars   *int   `xml:"maxchars,attr,omitempty"`
+	MaxStanzas *int   `xml:"maxstanzas,attr,omitempty"`
+	Seconds    *int   `xml:"seconds,attr,omitempty"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
+type MUCUser struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Invites  []MUCInvite `xml:"invite"`
+	Items    []MUCItem   `xml:"item"`
+	Statuses []MUCStatus `xml:"status"`
+	Destroy  *MUCDestroy `xml:"destroy,omitempty"`
+	Password string      `xml:"password,omitempty"`
+}
+
+type MUCInvite struct {
+	From   string `xml:"from,attr,omitempty"`
+	To     string `xml:"to,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+type MUCItem struct {
+	Affiliation string    `xml:"affiliation,attr,omitempty"`
+	Role        string    `xml:"role,attr,omitempty"`
+	JID         string    `xml:"jid,attr,omitempty"`
+	Nick        string    `xml:"nick,attr,omitempty"`
+	Actor       *MUCActor `xml:"actor,omitempty"`
+	Reason      string    `xml:"reason,omitempty"`
+}
+
+type MUCActor struct {
+	Nick string `xml:"nick,attr,omitempty"`
+	JID  string `xml:"jid,attr,omitempty"`
+}
+
+type MUCStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type MUCDestroy struct {
+	JID    string `xml:"jid,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+type MUCAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []MUCItem `xml:"item"`
+}
+
+type MUCOwnerQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *DataForm   `xml:"jabber:x:data x,omitempty"`
+	Destroy *MUCDestroy `xml:"destroy,omitempty"`
+}
+
+// XEP-0198
+const (
+	SMNS                 = "urn:xmpp:sm:3"
+	SMEnableElementName  = SMNS + " enable"
+	SMResumeElementName  = SMNS + " resume"
+	SMRequestElementName = SMNS + " r"
+	SMAnswerElementName  = SMNS + " a"
+)
+
+type SMFeature struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 sm"`
+}
+
+type SMEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
+	Resume  string   `xml:"resume,attr,omitempty"`
+	Max     int      `xml:"max,attr,omitempty"`
+}
+
+type SMEnabled struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Resume  string   `xml:"resume,attr,omitempty"`
+	Max     int      `xml:"max,attr,omitempty"`
+}
+
+type SMRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type SMAnswer struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
+
+type SMResume struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resume"`
+	PrevID  string   `xml:"previd,attr"`
+	H       uint32   `xml:"h,attr"`
+}
+
+type SMResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	PrevID  string   `xml:"previd,attr"`
+	H       uint32   `xml:"h,attr"`
+}
+
+// SMFailed carries the stanza error condition as-is.
+type SMFailed struct {
+	XMLName   xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	H         *uint32  `xml:"h,attr,omitempty"`
+	Condition []byte   `xml:",innerxml"`
+}
+
+// XEP-0388
+const (
+	SASL2NS                      = "urn:xmpp:sasl:2"
+	SASL2AuthenticateElementName = SASL2NS + " authenticate"
+)
+
+type SASL2Authentication struct {
+	XMLName    xml.Name     `xml:"urn:xmpp:sasl:2 authentication"`
+	Mechanisms []string     `xml:"mechanism"`
+	Inline     *SASL2Inline `xml:"inline,omitempty"`
+}
+
+type SASL2Inline struct {
+	Bind *Bind2Feature `xml:"urn:xmpp:bind:0 bind,omitempty"`
+	SM   *SMFeature    `xml:"urn:xmpp:sm:3 sm,omitempty"`
+	FAST *FASTFeature  `xml:"urn:xmpp:fast:0 fast,omitempty"`
+}
+
+type SASL2Authenticate struct {
+	XMLName         xml.Name          `xml:"urn:xmpp:sasl:2 authenticate"`
+	Mechanism       string            `xml:"mechanism,attr"`
+	InitialResponse string            `xml:"initial-response"`
+	UserAgent       *SASL2UserAgent   `xml:"user-agent"`
+	Bind            *Bind2Bind        `xml:"urn:xmpp:bind:0 bind"`
+	Resume          *SMResume         `xml:"urn:xmpp:sm:3 resume"`
+	RequestToken    *FASTRequestToken `xml:"urn:xmpp:fast:0 request-token"`
+	FAST            *FASTAuth         `xml:"urn:xmpp:fast:0 fast"`
+}
+
+type SASL2UserAgent struct {
+	ID       string `xml:"id,attr"`
+	Software string `xml:"software"`
+	Device   string `xml:"device"`
+}
+
+// SASL2Success carries the results of the inline features as-is.
+type SASL2Success struct {
+	XMLName                 xml.Name `xml:"urn:xmpp:sasl:2 success"`
+	AdditionalData          string   `xml:"additional-data,omitempty"`
+	AuthorizationIdentifier string   `xml:"authorization-identifier"`
+	Payload                 []byte   `xml:",innerxml"`
+}
+
+// SASL2Failure carries the SASL failure condition as-is.
+type SASL2Failure struct {
+	XMLName   xml.Name `xml:"urn:xmpp:sasl:2 failure"`
+	Condition []byte   `xml:",innerxml"`
+}
+
+// XEP-0386
+const Bind2NS = "urn:xmpp:bind:0"
+
+type Bind2Feature struct {
+	XMLName xml.Name          `xml:"urn:xmpp:bind:0 bind"`
+	Inline  []Bind2FeatureVar `xml:"inline>feature"`
+}
+
+type Bind2FeatureVar struct {
+	Var string `xml:"var,attr"`
+}
+
+type Bind2Bind struct {
+	XMLName       xml.Name       `xml:"urn:xmpp:bind:0 bind"`
+	Tag           string         `xml:"tag,omitempty"`
+	SMEnable      *SMEnable      `xml:"urn:xmpp:sm:3 enable"`
+	CarbonsEnable *CarbonsEnable `xml:"urn:xmpp:carbons:2 enable"`
+}
+
+// Bind2Bound carries the results of the inline features as-is.
+type Bind2Bound struct {
+	XMLName xml.Name `xml:"urn:xmpp:bind:0 bound"`
+	Payload []byte   `xml:",innerxml"`
+}
+
+// XEP-0484
+const FASTNS = "urn:xmpp:fast:0"
+
+type FASTFeature struct {
+	XMLName    xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Mechanisms []string `xml:"mechanism"`
+}
+
+type FASTRequestToken struct {
+	XMLName   xml.Name `xml:"urn:xmpp:fast:0 request-token"`
+	Mechanism string   `xml:"mechanism,attr"`
+}
+
+// FASTAuth accompanies the authentication with a token.
+type FASTAuth struct {
+	XMLName    xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Count      uint64   `xml:"count,attr,omitempty"`
+	Invalidate string   `xml:"invalidate,attr,omitempty"`
+}
+
+type FASTIssuedToken struct {
+	XMLName xml.Name `xml:"urn:xmpp:fast:0 token"`
+	Expiry  string   `xml:"expiry,attr"`
+	Token   string   `xml:"token,attr"`
+}
+
+// The server's own protocol for the users to manage the FAST tokens of
+// their devices.
+const (
+	FASTDevicesNS                = "https://github.com/exavolt/xmpp-server/protocol/fast-devices"
+	FASTDevicesQueryElementName  = FASTDevicesNS + " query"
+	FASTDevicesRevokeElementName = FASTDevicesNS + " revoke"
+)
+
+type FASTDevicesQuery struct {
+	XMLName xml.Name     `xml:"https://github.com/exavolt/xmpp-server/protocol/fast-devices query"`
+	Devices []FASTDevice `xml:"device"`
+}
+
+type FASTDevice struct {
+	ID       string `xml:"id,attr"`
+	Software string `xml:"software,attr,omitempty"`
+	Device   string `xml:"device,attr,omitempty"`
+	Expiry   string `xml:"expiry,attr,omitempty"`
+}
+
+// FASTDevicesRevoke revokes the tokens of the devices, or those of all
+// the devices if none is listed.
+type FASTDevicesRevoke struct {
+	XMLName xml.Name     `xml:"https://github.com/exavolt/xmpp-server/protocol/fast-devices revoke"`
+	Devices []FASTDevice `xml:"device"`
+}
+
+// XEP-0352
+const (
+	CSINS                  = "urn:xmpp:csi:0"
+	CSIActiveElementName   = CSINS + " active"
+	CSIInactiveElementName = CSINS + " inactive"
+)
+
+type CSIFeature struct {
+	XMLName xml.Name `xml:"urn:xmpp:csi:0 csi"`
+}
+
+// XEP-0085
+const ChatStatesNS = "http://jabber.org/protocol/chatstates"
+
+// RFC 7395
+const (
+	FramingNS               = "urn:ietf:params:xml:ns:xmpp-framing"
+	FramingOpenElementName  = FramingNS + " open"
+	FramingCloseElementName = FramingNS + " close"
+)
+
+// XEP-0124, XEP-0206
+const (
+	BOSHNS  = "http://jabber.org/protocol/httpbind"
+	XBOSHNS = "urn:xmpp:xbosh"
+)
+
+// BOSHBody is the wrapper of the BOSH requests and responses.
+type BOSHBody struct {
+	XMLName     xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+	RID         uint64   `xml:"rid,attr"`
+	SID         string   `xml:"sid,attr"`
+	To          string   `xml:"to,attr"`
+	Lang        string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Wait        int      `xml:"wait,attr"`
+	Hold        int      `xml:"hold,attr"`
+	Type        string   `xml:"type,attr"`
+	XMPPVersion string   `xml:"urn:xmpp:xbosh version,attr"`
+	Restart     string   `xml:"urn:xmpp:xbosh restart,attr"`
+	Payload     []byte   `xml:",innerxml"`
+}